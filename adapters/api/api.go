@@ -0,0 +1,194 @@
+// Package api serves the latest readings as JSON over HTTP
+package api
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/misterdelle/invt_logger_reader/ports"
+)
+
+// Prefix is the path all the API routes are served under
+const Prefix = "/api/v1/"
+
+//go:embed openapi.json
+var openAPI []byte
+
+// DeviceInfo describes the inverter and its logger
+type DeviceInfo struct {
+	Serial       string `json:"serial"`
+	Name         string `json:"name"`
+	Manufacturer string `json:"manufacturer"`
+	Model        string `json:"model"`
+}
+
+// ReaderStatus is the state of the reader, see the circuit breaker in main
+type ReaderStatus struct {
+	State               string     `json:"state"`
+	LoggerAvailable     bool       `json:"loggerAvailable"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	LastError           string     `json:"lastError,omitempty"`
+	NextProbe           *time.Time `json:"nextProbe,omitempty"`
+	LastPoll            *time.Time `json:"lastPoll,omitempty"`
+	ReadInterval        int        `json:"readInterval"`
+}
+
+// FieldValue is the result of a single field lookup
+type FieldValue struct {
+	Topic        string      `json:"topic"`
+	Field        string      `json:"field"`
+	Value        interface{} `json:"value"`
+	Unit         string      `json:"unit,omitempty"`
+	Quality      string      `json:"quality,omitempty"`
+	PollTime     time.Time   `json:"pollTime"`
+	InverterTime *time.Time  `json:"inverterTime,omitempty"`
+}
+
+type errorResponse struct {
+	Error  string   `json:"error"`
+	Topics []string `json:"topics,omitempty"`
+}
+
+// Series is the result of a history query
+type Series struct {
+	Topic  string               `json:"topic"`
+	Field  string               `json:"field"`
+	Unit   string               `json:"unit,omitempty"`
+	From   time.Time            `json:"from"`
+	To     time.Time            `json:"to"`
+	Step   string               `json:"step,omitempty"`
+	Points []ports.HistoryPoint `json:"points"`
+}
+
+type Server struct {
+	store   *Store
+	hub     *Hub
+	history ports.History
+	device  DeviceInfo
+	status  func() ReaderStatus
+}
+
+// NewServer serves the records of store and streams the cycles of hub, status is called at every /status request.
+// history is nil when no history is recorded
+func NewServer(store *Store, hub *Hub, history ports.History, device DeviceInfo, status func() ReaderStatus) *Server {
+	return &Server{store: store, hub: hub, history: history, device: device, status: status}
+}
+
+// ServeHTTP routes the requests below Prefix:
+//
+//	GET groups                 latest record of every topic
+//	GET groups/{topic}         latest record of a topic, e.g. groups/EnergyTodayTotals/Battery%20Charge
+//	GET fields/{field}         a single field, ?topic= picks one when the name is used in several topics
+//	GET device                 inverter information
+//	GET status                 reader status
+//	GET stream                 poll cycles as Server-Sent Events, ?groups= selects the groups
+//	GET ws                     poll cycles over WebSocket, ?groups= selects the groups
+//	GET history                recorded fields
+//	GET history/{field}        time series of a field, ?topic= &from= &to= &step=
+//	GET openapi.json           OpenAPI description of the API
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	route := strings.TrimPrefix(r.URL.Path, Prefix)
+
+	switch {
+	case route == "groups":
+		writeJSON(w, http.StatusOK, s.store.Records())
+	case strings.HasPrefix(route, "groups/"):
+		s.group(w, strings.TrimPrefix(route, "groups/"))
+	case strings.HasPrefix(route, "fields/"):
+		s.field(w, strings.TrimPrefix(route, "fields/"), r.URL.Query().Get("topic"))
+	case route == "device":
+		writeJSON(w, http.StatusOK, s.device)
+	case route == "status":
+		writeJSON(w, http.StatusOK, s.status())
+	case route == "stream":
+		s.hub.ServeSSE(w, r)
+	case route == "ws":
+		s.hub.ServeWebSocket(w, r)
+	case route == "history":
+		s.historyFields(w)
+	case strings.HasPrefix(route, "history/"):
+		s.series(w, strings.TrimPrefix(route, "history/"), r.URL.Query())
+	case route == "openapi.json":
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openAPI)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (s *Server) group(w http.ResponseWriter, topic string) {
+	topic = strings.TrimSuffix(topic, "/")
+
+	record, ok := s.store.Record(topic)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: fmt.Sprintf("unknown topic %q", topic), Topics: s.store.Topics()})
+		return
+	}
+	writeJSON(w, http.StatusOK, record)
+}
+
+func (s *Server) field(w http.ResponseWriter, field string, topic string) {
+	matches := make([]FieldValue, 0)
+	for _, r := range s.store.Records() {
+		if topic != "" && r.Topic != topic {
+			continue
+		}
+
+		v, ok := r.Values[field]
+		if !ok {
+			continue
+		}
+
+		matches = append(matches, FieldValue{
+			Topic:        r.Topic,
+			Field:        field,
+			Value:        v,
+			Unit:         r.Units[field],
+			Quality:      r.Quality[field],
+			PollTime:     r.PollTime,
+			InverterTime: r.InverterTime,
+		})
+	}
+
+	switch len(matches) {
+	case 0:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown field %q", field))
+	case 1:
+		writeJSON(w, http.StatusOK, matches[0])
+	default:
+		topics := make([]string, 0, len(matches))
+		for _, m := range matches {
+			topics = append(topics, m.Topic)
+		}
+		sort.Strings(topics)
+		writeJSON(w, http.StatusConflict, errorResponse{
+			Error:  fmt.Sprintf("field %q is published in several topics, pick one with ?topic=%s", field, url.QueryEscape(topics[0])),
+			Topics: topics,
+		})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, errorResponse{Error: msg})
+}
@@ -0,0 +1,204 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/misterdelle/invt_logger_reader/ports"
+)
+
+var at = time.Date(2024, 5, 1, 10, 15, 0, 0, time.UTC)
+
+// history is a ports.History answering with fixed fields and recording the series queries
+type history struct {
+	fields []ports.HistoryField
+	query  string
+}
+
+func (h *history) Fields() ([]ports.HistoryField, error) {
+	return h.fields, nil
+}
+
+func (h *history) Series(topic string, field string, from time.Time, to time.Time, step time.Duration) ([]ports.HistoryPoint, error) {
+	h.query = strings.Join([]string{topic, field, from.Format(time.RFC3339), to.Format(time.RFC3339), step.String()}, " ")
+	return []ports.HistoryPoint{{Time: from, Value: 1, Min: 1, Max: 1, Count: 1}}, nil
+}
+
+func newTestServer(h ports.History) *Server {
+	store := NewStore()
+	store.Export(ports.NewSnapshot("", "GridOutput/Grid A", map[string]interface{}{"Inv Voltage": "230.1", "Inv Power": "276"}, ports.RecordInfo{
+		PollTime:   at,
+		SourceTime: at.Add(-2 * time.Second),
+		Units:      map[string]string{"Inv Voltage": "V", "Inv Power": "W"},
+		Quality:    map[string]string{"Inv Voltage": ports.QualityGood, "Inv Power": ports.QualityGood},
+	}))
+	store.Export(ports.NewSnapshot("", "GridOutput/Grid B", map[string]interface{}{"Inv Voltage": "229.8"}, ports.RecordInfo{PollTime: at}))
+	store.Export(ports.NewSnapshot("", "station", map[string]interface{}{"Work Mode": "Self use", "pvDayEnergy": "NaN"}, ports.RecordInfo{PollTime: at}))
+
+	status := func() ReaderStatus { return ReaderStatus{State: "closed", LoggerAvailable: true, ReadInterval: 60} }
+	return NewServer(store, NewHub(store), h, DeviceInfo{Serial: "2333571751", Manufacturer: "INVT"}, status)
+}
+
+// get serves a request and decodes the JSON answer into v
+func get(t *testing.T, s *Server, method string, target string, v interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	if v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: %s in %q", method, target, err, w.Body.String())
+		}
+	}
+	return w
+}
+
+func TestGroups(t *testing.T) {
+	s := newTestServer(nil)
+
+	var records []Record
+	if w := get(t, s, http.MethodGet, Prefix+"groups", &records); w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("status %d, %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if len(records) != 3 || records[0].Topic != "GridOutput/Grid A" || records[2].Topic != "station" {
+		t.Fatalf("records %+v", records)
+	}
+
+	var r Record
+	get(t, s, http.MethodGet, Prefix+"groups/GridOutput/Grid%20A", &r)
+	if r.Values["Inv Voltage"] != 230.1 || r.Units["Inv Voltage"] != "V" || r.Quality["Inv Power"] != ports.QualityGood || !r.PollTime.Equal(at) || r.InverterTime == nil {
+		t.Errorf("record %+v", r)
+	}
+
+	// texts stay texts, NaN included
+	var station Record
+	get(t, s, http.MethodGet, Prefix+"groups/station/", &station)
+	if station.Values["Work Mode"] != "Self use" || station.Values["pvDayEnergy"] != "NaN" || station.InverterTime != nil {
+		t.Errorf("record %+v", station)
+	}
+
+	var e errorResponse
+	if w := get(t, s, http.MethodGet, Prefix+"groups/GridOutput", &e); w.Code != http.StatusNotFound || len(e.Topics) != 3 || e.Topics[0] != "GridOutput/Grid A" {
+		t.Errorf("unknown topic: %d %+v", w.Code, e)
+	}
+}
+
+func TestFields(t *testing.T) {
+	s := newTestServer(nil)
+
+	var v FieldValue
+	if w := get(t, s, http.MethodGet, Prefix+"fields/Inv%20Power", &v); w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	if v.Topic != "GridOutput/Grid A" || v.Value != 276.0 || v.Unit != "W" || v.Quality != ports.QualityGood || v.InverterTime == nil {
+		t.Errorf("field %+v", v)
+	}
+
+	var e errorResponse
+	if w := get(t, s, http.MethodGet, Prefix+"fields/Inv%20Voltage", &e); w.Code != http.StatusConflict || len(e.Topics) != 2 || !strings.Contains(e.Error, "?topic=GridOutput%2FGrid+A") {
+		t.Errorf("field in several topics: %d %+v", w.Code, e)
+	}
+
+	get(t, s, http.MethodGet, Prefix+"fields/Inv%20Voltage?topic=GridOutput/Grid%20B", &v)
+	if v.Topic != "GridOutput/Grid B" || v.Value != 229.8 {
+		t.Errorf("field %+v", v)
+	}
+
+	for _, target := range []string{"fields/Battery%20SOC", "fields/Inv%20Power?topic=station"} {
+		if w := get(t, s, http.MethodGet, Prefix+target, &e); w.Code != http.StatusNotFound {
+			t.Errorf("%s: status %d", target, w.Code)
+		}
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	s := newTestServer(nil)
+
+	var device DeviceInfo
+	get(t, s, http.MethodGet, Prefix+"device", &device)
+	if device.Serial != "2333571751" || device.Manufacturer != "INVT" {
+		t.Errorf("device %+v", device)
+	}
+
+	var status ReaderStatus
+	get(t, s, http.MethodGet, Prefix+"status", &status)
+	if status.State != "closed" || !status.LoggerAvailable || status.ReadInterval != 60 {
+		t.Errorf("status %+v", status)
+	}
+
+	var spec map[string]interface{}
+	if get(t, s, http.MethodGet, Prefix+"openapi.json", &spec); spec["openapi"] == nil {
+		t.Errorf("OpenAPI description %v", spec)
+	}
+
+	var e errorResponse
+	if w := get(t, s, http.MethodGet, Prefix+"inverter", &e); w.Code != http.StatusNotFound {
+		t.Errorf("unknown route: status %d", w.Code)
+	}
+	if w := get(t, s, http.MethodHead, Prefix+"device", nil); w.Code != http.StatusOK {
+		t.Errorf("HEAD: status %d", w.Code)
+	}
+	if w := get(t, s, http.MethodPost, Prefix+"groups", &e); w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, HEAD" {
+		t.Errorf("POST: status %d, Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+}
+
+func TestHistory(t *testing.T) {
+	var e errorResponse
+	if w := get(t, newTestServer(nil), http.MethodGet, Prefix+"history", &e); w.Code != http.StatusNotFound {
+		t.Errorf("history disabled: status %d", w.Code)
+	}
+	if w := get(t, newTestServer(nil), http.MethodGet, Prefix+"history/PV1%20Power", &e); w.Code != http.StatusNotFound {
+		t.Errorf("history disabled: status %d", w.Code)
+	}
+
+	h := &history{fields: []ports.HistoryField{
+		{Topic: "GridOutput/Grid A", Field: "Inv Voltage", Unit: "V"},
+		{Topic: "GridOutput/Grid B", Field: "Inv Voltage", Unit: "V"},
+		{Topic: "PV", Field: "PV1 Power", Unit: "W"},
+	}}
+	s := newTestServer(h)
+
+	var fields []ports.HistoryField
+	if get(t, s, http.MethodGet, Prefix+"history", &fields); len(fields) != 3 {
+		t.Errorf("fields %+v", fields)
+	}
+
+	var series Series
+	w := get(t, s, http.MethodGet, Prefix+"history/PV1%20Power?from=2024-05-01T00:00:00Z&to=2024-05-02T00:00:00Z&step=15m", &series)
+	if w.Code != http.StatusOK || series.Topic != "PV" || series.Unit != "W" || series.Step != "15m0s" || len(series.Points) != 1 {
+		t.Errorf("series %d %+v", w.Code, series)
+	}
+	if h.query != "PV PV1 Power 2024-05-01T00:00:00Z 2024-05-02T00:00:00Z 15m0s" {
+		t.Errorf("query %s", h.query)
+	}
+
+	// the last 24 hours by default
+	var day Series
+	get(t, s, http.MethodGet, Prefix+"history/Inv%20Voltage?topic=GridOutput/Grid%20B&to=2024-05-02T00:00:00Z", &day)
+	if day.Topic != "GridOutput/Grid B" || !day.From.Equal(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)) || day.Step != "" {
+		t.Errorf("series %+v", day)
+	}
+
+	tests := []struct {
+		query  string
+		status int
+	}{
+		{"history/PV1%20Power?from=yesterday", http.StatusBadRequest},
+		{"history/PV1%20Power?to=2024-05-02", http.StatusBadRequest},
+		{"history/PV1%20Power?step=often", http.StatusBadRequest},
+		{"history/PV1%20Power?step=-1h", http.StatusBadRequest},
+		{"history/PV1%20Power?from=2024-05-02T00:00:00Z&to=2024-05-01T00:00:00Z", http.StatusBadRequest},
+		{"history/PV2%20Power", http.StatusNotFound},
+		{"history/Inv%20Voltage", http.StatusConflict},
+	}
+	for _, tt := range tests {
+		if w := get(t, s, http.MethodGet, Prefix+tt.query, &e); w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d (%s)", tt.query, w.Code, tt.status, e.Error)
+		}
+	}
+}
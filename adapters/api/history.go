@@ -0,0 +1,111 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/misterdelle/invt_logger_reader/ports"
+)
+
+// defaultRange is the range of a history query without from
+const defaultRange = 24 * time.Hour
+
+func (s *Server) historyFields(w http.ResponseWriter) {
+	if s.history == nil {
+		writeError(w, http.StatusNotFound, "history is not enabled")
+		return
+	}
+
+	fields, err := s.history.Fields()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, fields)
+}
+
+// series answers history/{field}?topic=&from=&to=&step=, from and to are RFC 3339 times and default
+// to the last 24 hours, step is a duration such as 15m or 1h, every sample is returned without it
+func (s *Server) series(w http.ResponseWriter, field string, query url.Values) {
+	if s.history == nil {
+		writeError(w, http.StatusNotFound, "history is not enabled")
+		return
+	}
+
+	to := time.Now()
+	from := time.Time{}
+	var step time.Duration
+	var err error
+
+	if v := query.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid to %q, expected an RFC 3339 time", v))
+			return
+		}
+	}
+	if v := query.Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid from %q, expected an RFC 3339 time", v))
+			return
+		}
+	} else {
+		from = to.Add(-defaultRange)
+	}
+	if v := query.Get("step"); v != "" {
+		if step, err = time.ParseDuration(v); err != nil || step < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid step %q, expected a duration such as 15m", v))
+			return
+		}
+	}
+	if !from.Before(to) {
+		writeError(w, http.StatusBadRequest, "from must be before to")
+		return
+	}
+
+	fields, err := s.history.Fields()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	topic := query.Get("topic")
+	matches := make([]ports.HistoryField, 0)
+	for _, f := range fields {
+		if f.Field == field && (topic == "" || f.Topic == topic) {
+			matches = append(matches, f)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("field %q has not been recorded", field))
+		return
+	case 1:
+	default:
+		topics := make([]string, 0, len(matches))
+		for _, m := range matches {
+			topics = append(topics, m.Topic)
+		}
+		sort.Strings(topics)
+		writeJSON(w, http.StatusConflict, errorResponse{
+			Error:  fmt.Sprintf("field %q is recorded in several topics, pick one with ?topic=%s", field, url.QueryEscape(topics[0])),
+			Topics: topics,
+		})
+		return
+	}
+
+	points, err := s.history.Series(matches[0].Topic, field, from, to, step)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	result := Series{Topic: matches[0].Topic, Field: field, Unit: matches[0].Unit, From: from, To: to, Points: points}
+	if step > 0 {
+		result.Step = step.String()
+	}
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/misterdelle/invt_logger_reader/ports"
+)
+
+// Record is the latest reading of a topic, e.g. "EnergyTodayTotals/Battery Charge"
+type Record struct {
+	Topic        string                 `json:"topic"`
+	Device       string                 `json:"device,omitempty"`
+	PollTime     time.Time              `json:"pollTime"`
+	InverterTime *time.Time             `json:"inverterTime,omitempty"`
+	Values       map[string]interface{} `json:"values"`
+	Units        map[string]string      `json:"units,omitempty"`
+	Quality      map[string]string      `json:"quality,omitempty"`
+}
+
+// Store keeps the latest record of every topic, it implements ports.Exporter
+type Store struct {
+	mu      sync.RWMutex
+	records map[string]Record
+	order   []string
+}
+
+func NewStore() *Store {
+	return &Store{records: make(map[string]Record)}
+}
+
+// Export replaces the record of the group
+func (s *Store) Export(snapshot ports.Snapshot) error {
+	r := newRecord(snapshot)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.records[r.Topic]; !found {
+		s.order = append(s.order, r.Topic)
+	}
+	s.records[r.Topic] = r
+
+	return nil
+}
+
+func newRecord(snapshot ports.Snapshot) Record {
+	r := Record{
+		Topic:    snapshot.Group(),
+		Device:   snapshot.DeviceID(),
+		PollTime: snapshot.PollTime(),
+		Values:   make(map[string]interface{}, snapshot.Len()),
+		Units:    make(map[string]string),
+		Quality:  make(map[string]string),
+	}
+	if t := snapshot.SourceTime(); !t.IsZero() {
+		r.InverterTime = &t
+	}
+
+	for _, m := range snapshot.Measurements() {
+		r.Values[m.Field] = m.JSONValue()
+		if m.Unit != "" {
+			r.Units[m.Field] = m.Unit
+		}
+		if m.Quality != "" {
+			r.Quality[m.Field] = m.Quality
+		}
+	}
+
+	return r
+}
+
+func (s *Store) Close(timeout time.Duration) error {
+	return nil
+}
+
+// Records returns the latest record of every topic, in the order they have been first read
+func (s *Store) Records() []Record {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]Record, 0, len(s.order))
+	for _, topic := range s.order {
+		result = append(result, s.records[topic])
+	}
+	return result
+}
+
+// Record returns the latest record of a topic
+func (s *Store) Record(topic string) (Record, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	r, ok := s.records[topic]
+	return r, ok
+}
+
+// Topics returns the names of the topics read so far, sorted
+func (s *Store) Topics() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	topics := append([]string(nil), s.order...)
+	sort.Strings(topics)
+	return topics
+}
+
+// LastPoll returns the most recent poll time of all records
+func (s *Store) LastPoll() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var last time.Time
+	for _, r := range s.records {
+		if r.PollTime.After(last) {
+			last = r.PollTime
+		}
+	}
+	return last
+}
@@ -0,0 +1,275 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/misterdelle/invt_logger_reader/ports"
+)
+
+const (
+	// clientBuffer is the number of events queued for a slow client before they are dropped
+	clientBuffer   = 16
+	keepAlive      = 30 * time.Second
+	wsWriteTimeout = 10 * time.Second
+)
+
+// event types
+const (
+	// EventSnapshot is sent on connect with the latest record of every topic
+	EventSnapshot = "snapshot"
+	// EventCycle is sent at the end of every poll cycle with the records read in the cycle
+	EventCycle = "cycle"
+)
+
+// Event is a message streamed to the clients
+type Event struct {
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	PollTime time.Time `json:"pollTime,omitempty"`
+	// Complete is false when the cycle stopped at a failing query
+	Complete bool     `json:"complete"`
+	Records  []Record `json:"records"`
+}
+
+type client struct {
+	groups []string
+	events chan Event
+}
+
+// Hub collects the records of a poll cycle and streams them to the SSE and WebSocket clients
+// once the cycle is completed, it implements ports.Exporter and ports.CycleListener
+type Hub struct {
+	store *Store
+
+	mu      sync.Mutex
+	cycle   []Record
+	clients map[*client]struct{}
+	closed  bool
+}
+
+var upgrader = websocket.Upgrader{
+	// the API is meant for the LAN, dashboards may be served from anywhere
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// NewHub returns a hub sending the records of store to the clients when they connect
+func NewHub(store *Store) *Hub {
+	return &Hub{store: store, clients: make(map[*client]struct{})}
+}
+
+// Export adds a record to the running cycle
+func (h *Hub) Export(snapshot ports.Snapshot) error {
+	r := newRecord(snapshot)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.cycle = append(h.cycle, r)
+	return nil
+}
+
+// CycleComplete streams the records of the cycle, complete is false when the cycle failed
+func (h *Hub) CycleComplete(complete bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	records := h.cycle
+	h.cycle = nil
+
+	if len(records) == 0 {
+		return
+	}
+
+	e := Event{Type: EventCycle, Time: time.Now(), PollTime: records[0].PollTime, Complete: complete}
+	for c := range h.clients {
+		h.send(c, e, records)
+	}
+}
+
+// Close disconnects all the clients
+func (h *Hub) Close(timeout time.Duration) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for c := range h.clients {
+		close(c.events)
+		delete(h.clients, c)
+	}
+	return nil
+}
+
+// send queues the event with the records the client subscribed to, must be called with mu held
+func (h *Hub) send(c *client, e Event, records []Record) {
+	e.Records = filterRecords(records, c.groups)
+	if len(e.Records) == 0 {
+		return
+	}
+
+	select {
+	case c.events <- e:
+	default:
+		log.Printf("stream client too slow, %s event dropped", e.Type)
+	}
+}
+
+// subscribe registers a client for the groups, all groups when empty, and queues the current snapshot
+func (h *Hub) subscribe(groups []string) *client {
+	c := &client{groups: groups, events: make(chan Event, clientBuffer)}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		close(c.events)
+		return c
+	}
+
+	h.clients[c] = struct{}{}
+	h.send(c, Event{Type: EventSnapshot, Time: time.Now(), Complete: true}, h.store.Records())
+
+	return c
+}
+
+func (h *Hub) unsubscribe(c *client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.clients[c]; ok {
+		delete(h.clients, c)
+		close(c.events)
+	}
+}
+
+// ServeSSE streams the events as Server-Sent Events, ?groups=GridOutput,EnergyTodayTotals selects the groups
+func (h *Hub) ServeSSE(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	c := h.subscribe(parseGroups(r))
+	defer h.unsubscribe(c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e, ok := <-c.events:
+			if !ok {
+				return
+			}
+
+			data, err := json.Marshal(e)
+			if err != nil {
+				log.Printf("error encoding %s event: %s", e.Type, err)
+				continue
+			}
+
+			if _, err := w.Write([]byte("event: " + e.Type + "\ndata: " + string(data) + "\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-ticker.C:
+			// comment line, keeps proxies from closing an idle connection
+			if _, err := w.Write([]byte(": keep-alive\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// ServeWebSocket streams the events as JSON text messages, ?groups= selects the groups
+func (h *Hub) ServeWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader already replied with an error
+		return
+	}
+	defer conn.Close()
+
+	c := h.subscribe(parseGroups(r))
+	defer h.unsubscribe(c)
+
+	// the client is not expected to send anything, reading detects when it goes away
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e, ok := <-c.events:
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutting down"), time.Now().Add(wsWriteTimeout))
+				return
+			}
+
+			conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := conn.WriteJSON(e); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
+
+// parseGroups reads ?groups=GridOutput,EnergyTodayTotals/PV
+func parseGroups(r *http.Request) []string {
+	groups := make([]string, 0)
+	for _, g := range strings.Split(r.URL.Query().Get("groups"), ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+// filterRecords keeps the records whose topic, or first topic segment, is in groups
+func filterRecords(records []Record, groups []string) []Record {
+	if len(groups) == 0 {
+		return records
+	}
+
+	result := make([]Record, 0, len(records))
+	for _, r := range records {
+		group, _, _ := strings.Cut(r.Topic, "/")
+		for _, g := range groups {
+			if g == r.Topic || g == group {
+				result = append(result, r)
+				break
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,196 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/misterdelle/invt_logger_reader/ports"
+)
+
+// sseReader reads the events of a Server-Sent Events stream
+type sseReader struct {
+	t       *testing.T
+	scanner *bufio.Scanner
+}
+
+func (r *sseReader) next() Event {
+	r.t.Helper()
+
+	var typ string
+	for r.scanner.Scan() {
+		line := r.scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			typ = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			var e Event
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+				r.t.Fatalf("%s in %q", err, line)
+			}
+			if e.Type != typ {
+				r.t.Fatalf("event %s with %s data", typ, e.Type)
+			}
+			return e
+		}
+	}
+	r.t.Fatalf("stream ended: %v", r.scanner.Err())
+	return Event{}
+}
+
+func topics(e Event) string {
+	result := make([]string, 0, len(e.Records))
+	for _, r := range e.Records {
+		result = append(result, r.Topic)
+	}
+	return strings.Join(result, ",")
+}
+
+// connected waits until the hub has n clients
+func connected(t *testing.T, h *Hub, n int) {
+	t.Helper()
+
+	var clients int
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		h.mu.Lock()
+		clients = len(h.clients)
+		h.mu.Unlock()
+		if clients == n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("%d clients connected, want %d", clients, n)
+}
+
+func TestSSE(t *testing.T) {
+	s := newTestServer(nil)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + Prefix + "stream?groups=GridOutput")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status %d, %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	events := &sseReader{t: t, scanner: bufio.NewScanner(resp.Body)}
+
+	if e := events.next(); e.Type != EventSnapshot || !e.Complete || topics(e) != "GridOutput/Grid A,GridOutput/Grid B" {
+		t.Errorf("snapshot %+v", e)
+	}
+
+	// the records are held until the cycle is completed, the groups filter applies to them too
+	s.hub.Export(ports.NewSnapshot("", "station", map[string]interface{}{"Work Mode": "Self use"}, ports.RecordInfo{PollTime: at}))
+	s.hub.Export(ports.NewSnapshot("", "GridOutput/Grid A", map[string]interface{}{"Inv Voltage": "231"}, ports.RecordInfo{PollTime: at}))
+	s.hub.CycleComplete(false)
+
+	e := events.next()
+	if e.Type != EventCycle || e.Complete || !e.PollTime.Equal(at) || topics(e) != "GridOutput/Grid A" || e.Records[0].Values["Inv Voltage"] != 231.0 {
+		t.Errorf("cycle %+v", e)
+	}
+
+	// closing the hub ends the stream
+	s.hub.Close(time.Second)
+	for events.scanner.Scan() {
+		if line := events.scanner.Text(); line != "" {
+			t.Errorf("read %q after Close", line)
+		}
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	s := newTestServer(nil)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + Prefix + "ws"
+	all, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer all.Close()
+	station, _, err := websocket.DefaultDialer.Dial(url+"?groups=station", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer station.Close()
+
+	read := func(conn *websocket.Conn) Event {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var e Event
+		if err := conn.ReadJSON(&e); err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+
+	if e := read(all); e.Type != EventSnapshot || len(e.Records) != 3 {
+		t.Errorf("snapshot %+v", e)
+	}
+	if e := read(station); e.Type != EventSnapshot || topics(e) != "station" {
+		t.Errorf("snapshot %+v", e)
+	}
+
+	s.hub.Export(ports.NewSnapshot("", "GridOutput/Grid A", map[string]interface{}{"Inv Voltage": "231"}, ports.RecordInfo{PollTime: at}))
+	s.hub.Export(ports.NewSnapshot("", "station", map[string]interface{}{"Work Mode": "Backup"}, ports.RecordInfo{PollTime: at}))
+	s.hub.CycleComplete(true)
+
+	if e := read(all); e.Type != EventCycle || !e.Complete || topics(e) != "GridOutput/Grid A,station" {
+		t.Errorf("cycle %+v", e)
+	}
+	if e := read(station); e.Type != EventCycle || topics(e) != "station" || e.Records[0].Values["Work Mode"] != "Backup" {
+		t.Errorf("cycle %+v", e)
+	}
+
+	// a client going away is unsubscribed
+	station.Close()
+	connected(t, s.hub, 1)
+
+	// closing the hub sends a close frame
+	s.hub.Close(time.Second)
+	all.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := all.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("read after Close: %v", err)
+	}
+
+	// clients connecting after Close get nothing
+	late, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer late.Close()
+	late.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := late.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("read after Close: %v", err)
+	}
+}
+
+func TestFilterRecords(t *testing.T) {
+	records := []Record{{Topic: "GridOutput/Grid A"}, {Topic: "EnergyTodayTotals/PV"}, {Topic: "EnergyTodayTotals/Battery"}, {Topic: "station"}}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", "GridOutput/Grid A,EnergyTodayTotals/PV,EnergyTodayTotals/Battery,station"},
+		{"?groups=GridOutput", "GridOutput/Grid A"},
+		{"?groups=EnergyTodayTotals/PV,%20station%20,", "EnergyTodayTotals/PV,station"},
+		{"?groups=PV", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, Prefix+"stream"+tt.query, nil)
+		if got := topics(Event{Records: filterRecords(records, parseGroups(r))}); got != tt.want {
+			t.Errorf("%s: %s, want %s", tt.query, got, tt.want)
+		}
+	}
+}
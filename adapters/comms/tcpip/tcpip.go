@@ -2,8 +2,11 @@ package tcpip
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/misterdelle/invt_logger_reader/ports"
@@ -11,32 +14,68 @@ import (
 
 const timeout = 20 * time.Second
 
+// errShutdown is returned by Open once the port has been shut down
+var errShutdown = errors.New("connection shut down")
+
 type tcpIpPort struct {
 	name string
-	conn net.Conn
+
+	// ctx is cancelled by Shutdown, aborting a pending dial
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// mu guards conn and shutdown, Close may be called by another goroutine to abort a pending request
+	mu       sync.Mutex
+	conn     net.Conn
+	shutdown bool
 }
 
 func New(portName string) ports.CommunicationPort {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &tcpIpPort{
-		name: portName,
+		name:   portName,
+		ctx:    ctx,
+		cancel: cancel,
 	}
 }
 
 func (s *tcpIpPort) Open() error {
 
-	var err error
-
 	d := net.Dialer{Timeout: 3 * time.Second}
-	s.conn, err = d.Dial("tcp", s.name)
+	conn, err := d.DialContext(s.ctx, "tcp", s.name)
 
 	if err != nil {
+		if s.ctx.Err() != nil {
+			return errShutdown
+		}
 		return err
 	}
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// shut down while dialing
+	if s.shutdown {
+		conn.Close()
+		return errShutdown
+	}
+	s.conn = conn
+
 	return nil
 }
 
+func (s *tcpIpPort) Shutdown() error {
+	s.mu.Lock()
+	s.shutdown = true
+	s.mu.Unlock()
+
+	s.cancel()
+	return s.Close()
+}
+
 func (s *tcpIpPort) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
 	if s.conn != nil {
 		err := s.conn.Close()
@@ -47,13 +86,14 @@ func (s *tcpIpPort) Close() error {
 }
 
 func (s *tcpIpPort) Read(buf []byte) (int, error) {
-	if s.conn == nil {
+	conn := s.current()
+	if conn == nil {
 		return 0, fmt.Errorf("connection is not open")
 	}
 
-	reader := bufio.NewReader(s.conn)
+	reader := bufio.NewReader(conn)
 
-	if err := s.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
 		return 0, err
 	}
 
@@ -61,12 +101,20 @@ func (s *tcpIpPort) Read(buf []byte) (int, error) {
 }
 
 func (s *tcpIpPort) Write(payload []byte) (int, error) {
-	if s.conn == nil {
+	conn := s.current()
+	if conn == nil {
 		return 0, fmt.Errorf("connection is not open")
 	}
-	if err := s.conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+	if err := conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
 		return 0, err
 	}
 
-	return s.conn.Write(payload)
+	return conn.Write(payload)
+}
+
+func (s *tcpIpPort) current() net.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.conn
 }
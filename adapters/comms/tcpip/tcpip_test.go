@@ -0,0 +1,35 @@
+package tcpip
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	p := New(l.Addr().String())
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	// a request in flight fails once the port is shut down
+	if err := p.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Write([]byte{0xa5}); err == nil {
+		t.Error("write after Shutdown accepted")
+	}
+
+	// the next register ranges do not connect again
+	if err := p.Open(); !errors.Is(err, errShutdown) {
+		t.Errorf("Open after Shutdown = %v", err)
+	}
+	if err := p.Close(); err != nil {
+		t.Errorf("Close after Shutdown = %v", err)
+	}
+}
@@ -0,0 +1,22 @@
+// Package dashboard serves a single page dashboard fed by the API event stream
+package dashboard
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed static
+var static embed.FS
+
+// Handler serves the dashboard files, it is meant to be mounted on "/"
+func Handler() http.Handler {
+	files, err := fs.Sub(static, "static")
+	if err != nil {
+		// the embedded directory is always there
+		panic(err)
+	}
+
+	return http.FileServer(http.FS(files))
+}
@@ -0,0 +1,221 @@
+"use strict";
+
+// Sign conventions of the inverter registers: grid power is positive when exporting and battery
+// power is positive when discharging. Add ?gridSign=-1 or ?batterySign=-1 to the URL to flip them.
+const params = new URLSearchParams(location.search);
+const gridSign = Number(params.get("gridSign") || 1);
+const batterySign = Number(params.get("batterySign") || 1);
+
+// below this power (W) a flow line is shown as idle
+const idlePower = 10;
+
+// latest record of every topic, as sent by the API
+const records = {};
+
+function value(topic, field) {
+  const r = records[topic];
+  if (!r || !(field in r.values)) {
+    return undefined;
+  }
+  return r.values[field];
+}
+
+function unit(topic, field) {
+  const r = records[topic];
+  return (r && r.units && r.units[field]) || "";
+}
+
+// watts converts a power field to W using its unit
+function watts(topic, field) {
+  const v = value(topic, field);
+  if (typeof v !== "number") {
+    return undefined;
+  }
+  return unit(topic, field) === "kW" ? v * 1000 : v;
+}
+
+function sum(values) {
+  const known = values.filter((v) => typeof v === "number");
+  return known.length ? known.reduce((a, b) => a + b, 0) : undefined;
+}
+
+function formatPower(w) {
+  if (typeof w !== "number") {
+    return "–";
+  }
+  return Math.abs(w) >= 1000 ? (w / 1000).toFixed(2) + " kW" : Math.round(w) + " W";
+}
+
+function format(topic, field) {
+  const v = value(topic, field);
+  if (v === undefined || v === null) {
+    return "–";
+  }
+  const u = unit(topic, field);
+  return typeof v === "number" ? `${+v.toFixed(2)} ${u}`.trim() : String(v);
+}
+
+function el(tag, text, cls) {
+  const e = document.createElement(tag);
+  if (text !== undefined) {
+    e.textContent = text;
+  }
+  if (cls) {
+    e.className = cls;
+  }
+  return e;
+}
+
+// table renders rows of [label, [topic, field], ...], one cell per field, below an optional header
+function table(id, header, rows) {
+  const t = document.getElementById(id);
+  t.replaceChildren();
+
+  if (header) {
+    const tr = el("tr");
+    header.forEach((h) => tr.appendChild(el("th", h)));
+    t.appendChild(tr);
+  }
+
+  rows.forEach((row) => {
+    const tr = el("tr");
+    tr.appendChild(el("th", row[0]));
+    row.slice(1).forEach(([topic, field]) => tr.appendChild(el("td", format(topic, field), "num")));
+    t.appendChild(tr);
+  });
+}
+
+function phases(topic, fields) {
+  return ["A", "B", "C"].map((p) => [p, ...fields.map((f) => [`${topic} ${p}`, f.replace("{p}", p)])]);
+}
+
+function flow(name, power, forward) {
+  const line = document.getElementById(`line-${name}`);
+  const active = typeof power === "number" && Math.abs(power) >= idlePower;
+
+  line.classList.toggle("active", active);
+  line.classList.toggle("reverse", active && !forward);
+  if (active) {
+    // faster dashes for more power, between 0.4s and 3s per cycle
+    const speed = Math.max(0.4, Math.min(3, 3 - Math.log10(Math.abs(power)) * 0.7));
+    line.style.setProperty("--speed", `${speed}s`);
+  }
+
+  document.getElementById(`flow-${name}`).textContent = formatPower(typeof power === "number" ? Math.abs(power) : power);
+}
+
+function render() {
+  // energy flow
+  const pv = sum([watts("PVOutput/PV1", "Power PV 1"), watts("PVOutput/PV2", "Power PV 2")]);
+  const grid = sum(["A", "B", "C"].map((p) => watts(`GridOutput/Grid ${p}`, `Inv ${p} Power`)));
+  const battery = watts("BatteryOutput/BAT", "BAT Power");
+  const load = sum(["A", "B", "C"].map((p) => watts(`LoadInfo/Load ${p}`, `Load ${p} Power`)));
+
+  flow("pv", pv, true);
+  flow("grid", grid === undefined ? grid : grid * gridSign, grid * gridSign < 0);
+  flow("battery", battery === undefined ? battery : battery * batterySign, battery * batterySign > 0);
+  flow("load", load, true);
+
+  const soc = value("BatteryOutput/BAT", "BAT SOC") ?? value("station", "batterySOC");
+  document.getElementById("flow-soc").textContent = typeof soc === "number" ? `${Math.round(soc)} %` : "–";
+  document.getElementById("soc-bar").style.width = typeof soc === "number" ? `${Math.max(0, Math.min(100, soc))}%` : "0";
+  document.getElementById("soc-value").textContent = typeof soc === "number" ? `SOC ${Math.round(soc)} %` : "SOC –";
+
+  table("pv", ["", "Voltage", "Current", "Power"], [1, 2].map((n) => [
+    `PV${n}`,
+    [`PVOutput/PV${n}`, `Voltage PV ${n}`],
+    [`PVOutput/PV${n}`, `Current PV ${n}`],
+    [`PVOutput/PV${n}`, `Power PV ${n}`],
+  ]));
+
+  table("battery", null, [
+    ["Power", ["BatteryOutput/BAT", "BAT Power"]],
+    ["Voltage", ["BatteryOutput/BAT", "BAT Voltage"]],
+    ["Current", ["BatteryOutput/BAT", "BAT Current"]],
+    ["Cell voltage max", ["BatteryOutput/BMS BAT", "BMS BAT Cell Max Voltage"]],
+    ["Cell voltage min", ["BatteryOutput/BMS BAT", "BMS BAT Cell Min Voltage"]],
+  ]);
+
+  table("grid", ["", "Voltage", "Current", "Power"], [
+    ...phases("GridOutput/Grid", ["Inv {p} Voltage", "Inv {p} Current", "Inv {p} Power"]),
+    ["Frequency", ["GridOutput", "Grid Freq"]],
+  ]);
+
+  table("load", ["", "Voltage", "Current", "Power", "Rate"],
+    phases("LoadInfo/Load", ["Load {p} Voltage", "Load {p} Current", "Load {p} Power", "Load {p} Rate"]));
+
+  table("temperatures", null, [
+    ["Inverter 1", ["GridOutput", "Inv 1 Temperature"]],
+    ["Inverter 2", ["GridOutput", "Inv 2 Temperature"]],
+    ["DC/DC", ["EnergyTodayTotals", "DC DC Temperature"]],
+    ["Battery", ["BatteryOutput/BAT", "BAT Temperature"]],
+    ["Cell max", ["BatteryOutput/BMS BAT", "BMS BAT Cell Max Temperature"]],
+    ["Cell min", ["BatteryOutput/BMS BAT", "BMS BAT Cell Min Temperature"]],
+  ]);
+
+  table("today", null, [
+    ["PV", ["station", "pvDayEnergy"]],
+    ["Load", ["station", "loadDayEnergy"]],
+    ["Grid export", ["station", "gridDayEnergy"]],
+    ["Grid purchase", ["station", "purchasingDayEnergy"]],
+    ["Battery charge", ["station", "batteryChargeDayEnergy"]],
+    ["Battery discharge", ["station", "batteryDischargeDayEnergy"]],
+  ]);
+}
+
+function setStatus(text, cls) {
+  const s = document.getElementById("status");
+  s.textContent = text;
+  s.className = `status ${cls || ""}`;
+}
+
+function onEvent(e) {
+  const event = JSON.parse(e.data);
+  event.records.forEach((r) => { records[r.topic] = r; });
+  render();
+
+  const when = event.pollTime ? new Date(event.pollTime) : new Date(event.time);
+  const inverter = records.station && records.station.inverterTime ? ` · inverter clock ${new Date(records.station.inverterTime).toLocaleTimeString()}` : "";
+  document.getElementById("updated").textContent = `last poll ${when.toLocaleString()}${inverter}`;
+  if (event.type === "cycle" && !event.complete) {
+    setStatus("last poll incomplete", "error");
+  }
+}
+
+async function refreshStatus() {
+  try {
+    const status = await (await fetch("api/v1/status")).json();
+    if (status.loggerAvailable) {
+      setStatus(`polling every ${status.readInterval}s`, "ok");
+    } else {
+      setStatus(`logger unreachable${status.lastError ? ": " + status.lastError : ""}`, "error");
+    }
+  } catch (err) {
+    setStatus("reader unreachable", "error");
+  }
+}
+
+async function loadDevice() {
+  try {
+    const device = await (await fetch("api/v1/device")).json();
+    document.getElementById("device").textContent = device.name;
+    document.title = device.name;
+  } catch (err) {
+    // keep the default title
+  }
+}
+
+function connect() {
+  // EventSource reconnects by itself, a new snapshot is sent on every connect
+  const source = new EventSource("api/v1/stream");
+  source.addEventListener("snapshot", onEvent);
+  source.addEventListener("cycle", onEvent);
+  source.onerror = () => setStatus("reconnecting…", "error");
+  source.onopen = refreshStatus;
+}
+
+loadDevice();
+connect();
+refreshStatus();
+setInterval(refreshStatus, 30000);
+render();
@@ -1,10 +1,19 @@
 package invt
 
-import "github.com/misterdelle/invt_logger_reader/ports"
+import (
+	"sync"
+
+	"github.com/misterdelle/invt_logger_reader/ports"
+)
 
 type Logger struct {
 	serialNumber uint
 	connPort     ports.CommunicationPort
+
+	// mu serialises the requests, commands may write settings while a measurement cycle is running
+	mu sync.Mutex
+
+	registers *RegisterCache
 }
 
 type Station struct {
@@ -131,11 +140,20 @@ func NewInvtLogger(serialNumber uint, connPort ports.CommunicationPort) *Logger
 	return &Logger{
 		serialNumber: serialNumber,
 		connPort:     connPort,
+		registers:    NewRegisterCache(),
 	}
 }
 
+// Registers returns the raw value of the registers read so far
+func (s *Logger) Registers() *RegisterCache {
+	return s.registers
+}
+
 func (s *Logger) Query() (map[string]interface{}, error) {
-	return readData(s.connPort, s.serialNumber)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return readData(s.connPort, s.serialNumber, s.registers)
 }
 
 func (s *Logger) Name() string {
@@ -143,31 +161,60 @@ func (s *Logger) Name() string {
 }
 
 func (s *Logger) QueryStation() (map[string]interface{}, error) {
-	return readStationData(s.connPort, s.serialNumber)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return readStationData(s.connPort, s.serialNumber, s.registers)
 }
 
 func (s *Logger) QueryEnergyTodayTotals() (map[string]interface{}, error) {
-	return readEnergyTodayTotalsData(s.connPort, s.serialNumber)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return readEnergyTodayTotalsData(s.connPort, s.serialNumber, s.registers)
 }
 
 func (s *Logger) QueryGridOutput() (map[string]interface{}, error) {
-	return readGridOutput(s.connPort, s.serialNumber)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return readGridOutput(s.connPort, s.serialNumber, s.registers)
 }
 
 func (s *Logger) QueryInverterInfo() (map[string]interface{}, error) {
-	return readInverterInfo(s.connPort, s.serialNumber)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return readInverterInfo(s.connPort, s.serialNumber, s.registers)
 }
 
 func (s *Logger) QueryLoadInfo() (map[string]interface{}, error) {
-	return readLoadInfo(s.connPort, s.serialNumber)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return readLoadInfo(s.connPort, s.serialNumber, s.registers)
 }
 
 func (s *Logger) QueryBatteryOutput() (map[string]interface{}, error) {
-	return readBatteryOutput(s.connPort, s.serialNumber)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return readBatteryOutput(s.connPort, s.serialNumber, s.registers)
 }
 
 func (s *Logger) QueryPVOutput() (map[string]interface{}, error) {
-	return readPVOutput(s.connPort, s.serialNumber)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return readPVOutput(s.connPort, s.serialNumber, s.registers)
+}
+
+// WriteSetting writes one of the writable inverter settings, e.g. "Charge Time1 Start" = "02:30"
+func (s *Logger) WriteSetting(name string, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return writeSetting(s.connPort, s.serialNumber, name, value)
 }
 
 func NewStation(lastUpdateTime string, lastUpdateTimeUnix, generationTotal, generationPower, chargePower, dischargePower, batteryPower, batterySOC, usePower int) *Station {
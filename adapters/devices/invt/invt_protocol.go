@@ -8,6 +8,12 @@ type field struct {
 	unit      string
 }
 
+// fieldAlias maps a register field to the measurement name returned by the Query functions
+type fieldAlias struct {
+	field string
+	name  string
+}
+
 type registerRange struct {
 	start       int
 	end         int
@@ -72,6 +78,37 @@ func GetAllRegisterNames() []string {
 	return result
 }
 
+// fieldUnits maps the measurements returned by the Query functions to their unit of measure
+var fieldUnits = buildFieldUnits()
+
+// Unit returns the unit of measure of a measurement returned by the Query functions, "" when unknown
+func Unit(name string) string {
+	return fieldUnits[name]
+}
+
+func buildFieldUnits() map[string]string {
+	registerUnits := make(map[string]string)
+	for _, ranges := range [][]registerRange{stationRegisterRanges, allRegisterRanges} {
+		for _, rr := range ranges {
+			for _, f := range rr.replyFields {
+				registerUnits[f.name] = f.unit
+			}
+		}
+	}
+
+	units := make(map[string]string)
+	for _, aliases := range [][]fieldAlias{stationFields, energyTodayTotalsFields, gridOutputFields, inverterInfoFields, loadInfoFields, batteryOutputFields, pvOutputFields} {
+		for _, a := range aliases {
+			units[a.name] = registerUnits[a.field]
+		}
+	}
+
+	// computed by readStationData
+	units["totalPowerFromPV"] = units["powerFromPV1"]
+
+	return units
+}
+
 var rrPVOutput = registerRange{
 	start: 0x3130,
 	end:   0x3135,
@@ -173,7 +210,7 @@ var rrBatOutput = registerRange{
 		{0x3143, "BO: BAT 2 Current", "S16", 0.1, "A"}, //eccolo
 		{0x3144, "BO: BAT 3 Current", "S16", 0.1, "A"},
 		{0x3145, "BO: BAT SOC", "U16", 0.1, "%"},
-		{0x3146, "BO: BAT Temperature", "U16", 0.1, "℃"},
+		{0x3146, "BO: BAT Temperature", "U16", 0.1, "°C"},
 		{0x3147, "BO: BAT Charge Voltage", "U16", 0.1, "V"},
 		{0x3148, "BO: BAT Charge Current Limit", "U16", 0.1, "A"},
 		{0x3149, "BO: BAT Discharge Current Limit", "U16", 0.1, "A"},
@@ -320,3 +357,131 @@ func GetStationRegisterNames() []string {
 	}
 	return result
 }
+
+var energyTodayTotalsFields = []fieldAlias{
+	{"ETT: S BUS Voltage", "S BUS Voltage"},
+	{"ETT: N BUS Voltage", "N BUS Voltage"},
+	{"ETT: DCDC Temperature", "DC DC Temperature"},
+	{"ETT: PV Day Energy", "PV Day Energy"},
+	{"ETT: Grid Day Energy", "Grid Day Energy"},
+	{"ETT: Load Day Energy", "Load Day Energy"},
+	{"ETT: PV Month Energy", "PV Month Energy"},
+	{"ETT: Grid Month Energy", "Grid Month Energy"},
+	{"ETT: Load Month Energy", "Load Month Energy"},
+	{"ETT: PV Year Energy", "PV Year Energy"},
+	{"ETT: Grid Year Energy", "Grid Year Energy"},
+	{"ETT: Load Year Energy", "Load Year Energy"},
+	{"ETT: PV Total Energy", "PV Total Energy"},
+	{"ETT: Grid Total Energy", "Grid Total Energy"},
+	{"ETT: Load Total Energy", "Load Total Energy"},
+	{"ETT: Purchasing Day Energy", "Purchasing Day Energy"},
+	{"ETT: Bat Charge Day Energy", "BAT Charge Day Energy"},
+	{"ETT: Bat Discharge Day Energy", "BAT Discharge Day Energy"},
+	{"ETT: Purchasing Month Energy", "Purchasing Month Energy"},
+	{"ETT: Bat Charge Month Energy", "BAT Charge Month Energy"},
+	{"ETT: Bat Discharge Month Energy", "BAT Discharge Month Energy"},
+	{"ETT: Purchasing Year Energy", "Purchasing Year Energy"},
+	{"ETT: Bat Charge Year Energy", "BAT Charge Year Energy"},
+	{"ETT: Bat Discharge Year Energy", "BAT Discharge Year Energy"},
+	{"ETT: Purchasing Total Energy", "Purchasing Total Energy"},
+	{"ETT: Bat Charge Total Energy", "BAT Charge Total Energy"},
+	{"ETT: Bat Discharge Total Energy", "BAT Discharge Total Energy"},
+}
+
+var gridOutputFields = []fieldAlias{
+	{"GO: Grid A Voltage", "Grid A Voltage"},
+	{"GO: Grid A Current", "Grid A Current"},
+	{"GO: Grid A Power", "Grid A Power"},
+	{"GO: Grid B Voltage", "Grid B Voltage"},
+	{"GO: Grid B Current", "Grid B Current"},
+	{"GO: Grid B Power", "Grid B Power"},
+	{"GO: Grid C Voltage", "Grid C Voltage"},
+	{"GO: Grid C Current", "Grid C Current"},
+	{"GO: Grid C Power", "Grid C Power"},
+	{"GO: Grid Freq", "Grid Freq"},
+	{"GO: INV1 Temperature", "Inv 1 Temperature"},
+	{"GO: INV2 Temperature", "Inv 2 Temperature"},
+}
+
+var inverterInfoFields = []fieldAlias{
+	{"II: INV A Voltage", "Inv A Voltage"},
+	{"II: INV A Current", "Inv A Current"},
+	{"II: INV A Power", "Inv A Power"},
+	{"II: INV B Voltage", "Inv B Voltage"},
+	{"II: INV B Current", "Inv B Current"},
+	{"II: INV B Power", "Inv B Power"},
+	{"II: INV C Voltage", "Inv C Voltage"},
+	{"II: INV C Current", "Inv C Current"},
+	{"II: INV C Power", "Inv C Power"},
+	{"II: INV A Freq", "Inv A Freq"},
+	{"II: INV B Freq", "Inv B Freq"},
+	{"II: INV C Freq", "Inv C Freq"},
+	{"II: Leak Current", "Leak Current"},
+}
+
+var loadInfoFields = []fieldAlias{
+	{"LI: Load A Voltage", "Load A Voltage"},
+	{"LI: Load A Current", "Load A Current"},
+	{"LI: Load A Power", "Load A Power"},
+	{"LI: Load A Rate", "Load A Rate"},
+	{"LI: Load B Voltage", "Load B Voltage"},
+	{"LI: Load B Current", "Load B Current"},
+	{"LI: Load B Power", "Load B Power"},
+	{"LI: Load B Rate", "Load B Rate"},
+	{"LI: Load C Voltage", "Load C Voltage"},
+	{"LI: Load C Current", "Load C Current"},
+	{"LI: Load C Power", "Load C Power"},
+	{"LI: Load C Rate", "Load C Rate"},
+	{"LI: Generator Port Voltage A", "Generator Port Voltage A"},
+	{"LI: Generator Port Voltage B", "Generator Port Voltage B"},
+	{"LI: Generator Port Voltage C", "Generator Port Voltage C"},
+}
+
+var batteryOutputFields = []fieldAlias{
+	{"BO: BAT Voltage", "BAT Voltage"},
+	{"BO: BAT Current", "BAT Current"},
+	{"BO: BAT 1 Current", "BAT 1 Current"},
+	{"BO: BAT 2 Current", "BAT 2 Current"},
+	{"BO: BAT 3 Current", "BAT 3 Current"},
+	{"BO: BAT SOC", "BAT SOC"},
+	{"BO: BAT Temperature", "BAT Temperature"},
+	{"BO: BAT Charge Voltage", "BAT Charge Voltage"},
+	{"BO: BAT Charge Current Limit", "BAT Charge Current Limit"},
+	{"BO: BAT Discharge Current Limit", "BAT Discharge Current Limit"},
+	{"BO: BAT Power", "BAT Power"},
+	{"BO: BMS BAT Voltage", "BMS BAT Voltage"},
+	{"BO: BMS BAT Current", "BMS BAT Current"},
+	{"BO: BMS BAT Cell Max Voltage", "BMS BAT Cell Max Voltage"},
+	{"BO: BMS BAT Cell Min Voltage", "BMS BAT Cell Min Voltage"},
+	{"BO: BMS BAT Cell Max Temperature", "BMS BAT Cell Max Temperature"},
+	{"BO: BMS BAT Cell Min Temperature", "BMS BAT Cell Min Temperature"},
+}
+
+var pvOutputFields = []fieldAlias{
+	{"PV: Voltage_PV1", "Voltage PV 1"},
+	{"PV: Current_PV1", "Current PV 1"},
+	{"PV: Power_PV1", "Power PV 1"},
+	{"PV: Voltage_PV2", "Voltage PV 2"},
+	{"PV: Current_PV2", "Current PV 2"},
+	{"PV: Power_PV2", "Power PV 2"},
+}
+
+var stationFields = []fieldAlias{
+	{"batterySOC", "batterySOC"},
+	{"batteryPower", "batteryPower"},
+	{"currentConsumptionPower", "currentConsumptionPower"},
+	{"Bat Charge Day Energy", "batteryChargeDayEnergy"},
+	{"Bat Discharge Day Energy", "batteryDischargeDayEnergy"},
+	{"Bat Charge Total Energy", "batteryChargeTotalEnergy"},
+	{"Bat Discharge Total Energy", "batteryDischargeTotalEnergy"},
+	{"PV Day Energy", "pvDayEnergy"},
+	{"Grid Day Energy", "gridDayEnergy"},
+	{"Load Day Energy", "loadDayEnergy"},
+	{"PV Total Energy", "pvTotalEnergy"},
+	{"Grid Total Energy", "gridTotalEnergy"},
+	{"Load Total Energy", "loadTotalEnergy"},
+	{"Purchasing Day Energy", "purchasingDayEnergy"},
+	{"Purchasing Total Energy", "purchasingTotalEnergy"},
+	{"Power PV1", "powerFromPV1"},
+	{"Power PV2", "powerFromPV2"},
+}
@@ -28,46 +28,85 @@ func NewLSWRequest(serialNumber uint, startRegister int, endRegister int) LSWReq
 }
 
 func (l LSWRequest) ToBytes() []byte {
-	buf := make([]byte, 36)
+	modbusFrame := make([]byte, 6)
+	binary.BigEndian.PutUint16(modbusFrame[0:], 0x0103)
+	binary.BigEndian.PutUint16(modbusFrame[2:], uint16(l.startRegister))
+	binary.BigEndian.PutUint16(modbusFrame[4:], uint16(l.endRegister-l.startRegister+1))
+
+	return lswFrame(l.serialNumber, modbusFrame)
+}
+
+func (l LSWRequest) String() string {
+	return fmt.Sprintf("% 0X", l.ToBytes())
+}
+
+// LSWWriteRequest writes consecutive holding registers (modbus function 0x10)
+type LSWWriteRequest struct {
+	serialNumber  uint
+	startRegister int
+	values        []uint16
+}
+
+func NewLSWWriteRequest(serialNumber uint, startRegister int, values ...uint16) LSWWriteRequest {
+	return LSWWriteRequest{
+		serialNumber:  serialNumber,
+		startRegister: startRegister,
+		values:        values,
+	}
+}
+
+func (l LSWWriteRequest) ToBytes() []byte {
+	modbusFrame := make([]byte, 7+2*len(l.values))
+	binary.BigEndian.PutUint16(modbusFrame[0:], 0x0110)
+	binary.BigEndian.PutUint16(modbusFrame[2:], uint16(l.startRegister))
+	binary.BigEndian.PutUint16(modbusFrame[4:], uint16(len(l.values)))
+	modbusFrame[6] = byte(2 * len(l.values))
+	for i, v := range l.values {
+		binary.BigEndian.PutUint16(modbusFrame[7+2*i:], v)
+	}
+
+	return lswFrame(l.serialNumber, modbusFrame)
+}
+
+func (l LSWWriteRequest) String() string {
+	return fmt.Sprintf("% 0X", l.ToBytes())
+}
+
+// lswFrame wraps a modbus RTU frame (without crc) into a logger request
+func lswFrame(serialNumber uint, modbusFrame []byte) []byte {
+	modbusEnd := 26 + len(modbusFrame)
+	buf := make([]byte, modbusEnd+4)
 
 	// preamble
 	buf[0] = 0xa5
-	binary.BigEndian.PutUint16(buf[1:], 0x1700)
+	binary.LittleEndian.PutUint16(buf[1:], uint16(15+len(modbusFrame)+2))
 	binary.BigEndian.PutUint16(buf[3:], 0x1045)
 	buf[5] = 0x00
 	buf[6] = 0x00
 
-	binary.LittleEndian.PutUint32(buf[7:], uint32(l.serialNumber))
+	binary.LittleEndian.PutUint32(buf[7:], uint32(serialNumber))
 
 	buf[11] = 0x02
 
-	binary.BigEndian.PutUint16(buf[26:], 0x0103)
-
-	binary.BigEndian.PutUint16(buf[28:], uint16(l.startRegister))
-	binary.BigEndian.PutUint16(buf[30:], uint16(l.endRegister-l.startRegister+1))
+	copy(buf[26:], modbusFrame)
 
 	// compute crc
 	table := crc16.MakeTable(crc16.CRC16_MODBUS)
-	modbusCRC := crc16.Checksum(buf[26:32], table)
+	modbusCRC := crc16.Checksum(buf[26:modbusEnd], table)
 
 	// append crc
-	binary.LittleEndian.PutUint16(buf[32:], modbusCRC)
+	binary.LittleEndian.PutUint16(buf[modbusEnd:], modbusCRC)
 
 	// compute & append frame crc
-	buf[34] = l.checksum(buf)
+	buf[modbusEnd+2] = checksum(buf)
 
 	// end of frame
-	buf[35] = 0x15
+	buf[modbusEnd+3] = 0x15
 
 	return buf
-
-}
-
-func (l LSWRequest) String() string {
-	return fmt.Sprintf("% 0X", l.ToBytes())
 }
 
-func (l LSWRequest) checksum(buf []byte) uint8 {
+func checksum(buf []byte) uint8 {
 	var checksum uint8
 	for _, b := range buf[1 : len(buf)-2] {
 		checksum += b
@@ -75,11 +114,11 @@ func (l LSWRequest) checksum(buf []byte) uint8 {
 	return checksum
 }
 
-func readData(connPort ports.CommunicationPort, serialNumber uint) (map[string]interface{}, error) {
+func readData(connPort ports.CommunicationPort, serialNumber uint, cache *RegisterCache) (map[string]interface{}, error) {
 	result := make(map[string]interface{})
 
 	for _, rr := range allRegisterRanges {
-		reply, err := readRegisterRange(rr, connPort, serialNumber)
+		reply, err := readRegisterRange(rr, connPort, serialNumber, cache)
 		if err != nil {
 			return nil, err
 		}
@@ -91,7 +130,7 @@ func readData(connPort ports.CommunicationPort, serialNumber uint) (map[string]i
 	return result, nil
 }
 
-func readRegisterRange(rr registerRange, connPort ports.CommunicationPort, serialNumber uint) (map[string]interface{}, error) {
+func readRegisterRange(rr registerRange, connPort ports.CommunicationPort, serialNumber uint, cache *RegisterCache) (map[string]interface{}, error) {
 	lswRequest := NewLSWRequest(serialNumber, rr.start, rr.end)
 
 	commandBytes := lswRequest.ToBytes()
@@ -122,14 +161,27 @@ func readRegisterRange(rr registerRange, connPort ports.CommunicationPort, seria
 
 	// truncate the buffer
 	buf = buf[:n]
-	if len(buf) < 27 {
+	if len(buf) < 28 {
 		// short reply
 		return nil, fmt.Errorf("short reply: %d bytes", n)
 	}
 
-	replyBytesCount := buf[27]
+	// modbus exception replies have the function code high bit set
+	if buf[26]&0x80 != 0 {
+		return nil, fmt.Errorf("registers 0x%04X-0x%04X read refused, modbus exception %d", rr.start, rr.end, buf[27])
+	}
+	if buf[26] != 0x03 {
+		return nil, fmt.Errorf("unexpected reply to registers 0x%04X-0x%04X read: function 0x%02X", rr.start, rr.end, buf[26])
+	}
+
+	// a reply to another request, or truncated, must not reach the register cache
+	replyBytesCount := int(buf[27])
+	if replyBytesCount != 2*(rr.end-rr.start+1) || len(buf) < 28+replyBytesCount {
+		return nil, fmt.Errorf("invalid reply to registers 0x%04X-0x%04X read: %d data bytes in a %d bytes reply", rr.start, rr.end, replyBytesCount, n)
+	}
 
 	modbusReply := buf[28 : 28+replyBytesCount]
+	cache.store(rr.start, modbusReply, time.Now())
 
 	// shove the data into the reply
 	reply := make(map[string]interface{})
@@ -173,7 +225,7 @@ func readRegisterRange(rr registerRange, connPort ports.CommunicationPort, seria
 	return reply, nil
 }
 
-func readStationData(connPort ports.CommunicationPort, serialNumber uint) (map[string]interface{}, error) {
+func readStationData(connPort ports.CommunicationPort, serialNumber uint, cache *RegisterCache) (map[string]interface{}, error) {
 	result := make(map[string]interface{})
 
 	for _, rr := range stationRegisterRanges {
@@ -181,7 +233,7 @@ func readStationData(connPort ports.CommunicationPort, serialNumber uint) (map[s
 			fmt.Println(rr.start)
 		}
 
-		reply, err := readRegisterRange(rr, connPort, serialNumber)
+		reply, err := readRegisterRange(rr, connPort, serialNumber, cache)
 		if err != nil {
 			return nil, err
 		}
@@ -212,28 +264,14 @@ func readStationData(connPort ports.CommunicationPort, serialNumber uint) (map[s
 	dayOfWeek := secondDayOfWeek[sep+1:]
 	_ = dayOfWeek
 
-	batterySOC := result["batterySOC"].(string)
-	batteryPower := result["batteryPower"].(string)
-	currentConsumptionPower := result["currentConsumptionPower"].(string)
-	batteryChargeDayEnergy := result["Bat Charge Day Energy"].(string)
-	batteryDischargeDayEnergy := result["Bat Discharge Day Energy"].(string)
-	batteryChargeTotalEnergy := result["Bat Charge Total Energy"].(string)
-	batteryDischargeTotalEnergy := result["Bat Discharge Total Energy"].(string)
-	pvDayEnergy := result["PV Day Energy"].(string)
-	gridDayEnergy := result["Grid Day Energy"].(string)
-	loadDayEnergy := result["Load Day Energy"].(string)
-	pvTotalEnergy := result["PV Total Energy"].(string)
-	gridTotalEnergy := result["Grid Total Energy"].(string)
-	loadTotalEnergy := result["Load Total Energy"].(string)
-	purchasingDayEnergy := result["Purchasing Day Energy"].(string)
-	purchasingTotalEnergy := result["Purchasing Total Energy"].(string)
-	powerPV1 := result["Power PV1"].(string)
-	powerPV2 := result["Power PV2"].(string)
-	powPV1, _ := strconv.ParseFloat(powerPV1, 64)
-	powPV2, _ := strconv.ParseFloat(powerPV2, 64)
+	powPV1, _ := strconv.ParseFloat(result["Power PV1"].(string), 64)
+	powPV2, _ := strconv.ParseFloat(result["Power PV2"].(string), 64)
 	totalPowerFromPV := fmt.Sprintf("%v", powPV1+powPV2)
 
-	result = make(map[string]interface{})
+	result, err := aliasFields(result, stationFields)
+	if err != nil {
+		return nil, err
+	}
 
 	lastUpdateTime := fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d", year, month, day, hour, minute, second)
 	t, err := time.Parse("2006-01-02 15:04:05", lastUpdateTime)
@@ -244,153 +282,41 @@ func readStationData(connPort ports.CommunicationPort, serialNumber uint) (map[s
 
 	result["lastUpdateTime"] = lastUpdateTime
 	result["lastUpdateTimeUnix"] = lastUpdateTimeUnix
-	result["batterySOC"] = batterySOC
-	result["batteryPower"] = batteryPower
-	result["currentConsumptionPower"] = currentConsumptionPower
-	result["batteryChargeDayEnergy"] = batteryChargeDayEnergy
-	result["batteryDischargeDayEnergy"] = batteryDischargeDayEnergy
-	result["batteryChargeTotalEnergy"] = batteryChargeTotalEnergy
-	result["batteryDischargeTotalEnergy"] = batteryDischargeTotalEnergy
-	result["pvDayEnergy"] = pvDayEnergy
-	result["gridDayEnergy"] = gridDayEnergy
-	result["loadDayEnergy"] = loadDayEnergy
-	result["pvTotalEnergy"] = pvTotalEnergy
-	result["gridTotalEnergy"] = gridTotalEnergy
-	result["loadTotalEnergy"] = loadTotalEnergy
-	result["purchasingDayEnergy"] = purchasingDayEnergy
-	result["purchasingTotalEnergy"] = purchasingTotalEnergy
-	result["powerFromPV1"] = powerPV1
-	result["powerFromPV2"] = powerPV2
 	result["totalPowerFromPV"] = totalPowerFromPV
 
 	return result, nil
 }
 
-func readEnergyTodayTotalsData(connPort ports.CommunicationPort, serialNumber uint) (map[string]interface{}, error) {
-	result := make(map[string]interface{})
-
-	for _, rr := range energyTodayTotalsRegisterRanges {
-		reply, err := readRegisterRange(rr, connPort, serialNumber)
-		if err != nil {
-			return nil, err
-		}
-
-		for k, v := range reply {
-			result[k] = v
-		}
-	}
-
-	sBUSVoltage := result["ETT: S BUS Voltage"].(string)
-	nBUSVoltage := result["ETT: N BUS Voltage"].(string)
-	dcdcTemperature := result["ETT: DCDC Temperature"].(string)
-	pvDayEnergy := result["ETT: PV Day Energy"].(string)
-	gridDayEnergy := result["ETT: Grid Day Energy"].(string)
-	loadDayEnergy := result["ETT: Load Day Energy"].(string)
-	pvMonthEnergy := result["ETT: PV Month Energy"].(string)
-	gridMonthEnergy := result["ETT: Grid Month Energy"].(string)
-	loadMonthEnergy := result["ETT: Load Month Energy"].(string)
-	pvYearEnergy := result["ETT: PV Year Energy"].(string)
-	gridYearEnergy := result["ETT: Grid Year Energy"].(string)
-	loadYearEnergy := result["ETT: Load Year Energy"].(string)
-	pvTotalEnergy := result["ETT: PV Total Energy"].(string)
-	gridTotalEnergy := result["ETT: Grid Total Energy"].(string)
-	loadTotalEnergy := result["ETT: Load Total Energy"].(string)
-	purchasingDayEnergy := result["ETT: Purchasing Day Energy"].(string)
-	batChargeDayEnergy := result["ETT: Bat Charge Day Energy"].(string)
-	batDischargeDayEnergy := result["ETT: Bat Discharge Day Energy"].(string)
-	purchasingMonthEnergy := result["ETT: Purchasing Month Energy"].(string)
-	batChargeMonthEnergy := result["ETT: Bat Charge Month Energy"].(string)
-	batDischargeMonthEnergy := result["ETT: Bat Discharge Month Energy"].(string)
-	purchasingYearEnergy := result["ETT: Purchasing Year Energy"].(string)
-	batChargeYearEnergy := result["ETT: Bat Charge Year Energy"].(string)
-	batDischargeYearEnergy := result["ETT: Bat Discharge Year Energy"].(string)
-	purchasingTotalEnergy := result["ETT: Purchasing Total Energy"].(string)
-	batChargeTotalEnergy := result["ETT: Bat Charge Total Energy"].(string)
-	batDischargeTotalEnergy := result["ETT: Bat Discharge Total Energy"].(string)
-
-	result = make(map[string]interface{})
-
-	result["S BUS Voltage"] = sBUSVoltage
-	result["N BUS Voltage"] = nBUSVoltage
-	result["DC DC Temperature"] = dcdcTemperature
-	result["PV Day Energy"] = pvDayEnergy
-	result["Grid Day Energy"] = gridDayEnergy
-	result["Load Day Energy"] = loadDayEnergy
-	result["PV Month Energy"] = pvMonthEnergy
-	result["Grid Month Energy"] = gridMonthEnergy
-	result["Load Month Energy"] = loadMonthEnergy
-	result["PV Year Energy"] = pvYearEnergy
-	result["Grid Year Energy"] = gridYearEnergy
-	result["Load Year Energy"] = loadYearEnergy
-	result["PV Total Energy"] = pvTotalEnergy
-	result["Grid Total Energy"] = gridTotalEnergy
-	result["Load Total Energy"] = loadTotalEnergy
-	result["Purchasing Day Energy"] = purchasingDayEnergy
-	result["BAT Charge Day Energy"] = batChargeDayEnergy
-	result["BAT Discharge Day Energy"] = batDischargeDayEnergy
-	result["Purchasing Month Energy"] = purchasingMonthEnergy
-	result["BAT Charge Month Energy"] = batChargeMonthEnergy
-	result["BAT Discharge Month Energy"] = batDischargeMonthEnergy
-	result["Purchasing Year Energy"] = purchasingYearEnergy
-	result["BAT Charge Year Energy"] = batChargeYearEnergy
-	result["BAT Discharge Year Energy"] = batDischargeYearEnergy
-	result["Purchasing Total Energy"] = purchasingTotalEnergy
-	result["BAT Charge Total Energy"] = batChargeTotalEnergy
-	result["BAT Discharge Total Energy"] = batDischargeTotalEnergy
-
-	return result, nil
+func readEnergyTodayTotalsData(connPort ports.CommunicationPort, serialNumber uint, cache *RegisterCache) (map[string]interface{}, error) {
+	return readAliasedFields(energyTodayTotalsRegisterRanges, energyTodayTotalsFields, connPort, serialNumber, cache)
 }
 
-func readGridOutput(connPort ports.CommunicationPort, serialNumber uint) (map[string]interface{}, error) {
-	result := make(map[string]interface{})
+func readGridOutput(connPort ports.CommunicationPort, serialNumber uint, cache *RegisterCache) (map[string]interface{}, error) {
+	return readAliasedFields(gridOutputRegisterRanges, gridOutputFields, connPort, serialNumber, cache)
+}
 
-	for _, rr := range gridOutputRegisterRanges {
-		reply, err := readRegisterRange(rr, connPort, serialNumber)
-		if err != nil {
-			return nil, err
-		}
+func readInverterInfo(connPort ports.CommunicationPort, serialNumber uint, cache *RegisterCache) (map[string]interface{}, error) {
+	return readAliasedFields(inverterInfoRegisterRanges, inverterInfoFields, connPort, serialNumber, cache)
+}
 
-		for k, v := range reply {
-			result[k] = v
-		}
-	}
+func readLoadInfo(connPort ports.CommunicationPort, serialNumber uint, cache *RegisterCache) (map[string]interface{}, error) {
+	return readAliasedFields(loadInfoRegisterRanges, loadInfoFields, connPort, serialNumber, cache)
+}
 
-	gridAVoltage := result["GO: Grid A Voltage"].(string)
-	gridACurrent := result["GO: Grid A Current"].(string)
-	gridAPower := result["GO: Grid A Power"].(string)
-	gridBVoltage := result["GO: Grid B Voltage"].(string)
-	gridBCurrent := result["GO: Grid B Current"].(string)
-	gridBPower := result["GO: Grid B Power"].(string)
-	gridCVoltage := result["GO: Grid C Voltage"].(string)
-	gridCCurrent := result["GO: Grid C Current"].(string)
-	gridCPower := result["GO: Grid C Power"].(string)
-	gridFreq := result["GO: Grid Freq"].(string)
-	inv1Temperature := result["GO: INV1 Temperature"].(string)
-	inv2Temperature := result["GO: INV2 Temperature"].(string)
-
-	result = make(map[string]interface{})
-
-	result["Grid A Voltage"] = gridAVoltage
-	result["Grid A Current"] = gridACurrent
-	result["Grid A Power"] = gridAPower
-	result["Grid B Voltage"] = gridBVoltage
-	result["Grid B Current"] = gridBCurrent
-	result["Grid B Power"] = gridBPower
-	result["Grid C Voltage"] = gridCVoltage
-	result["Grid C Current"] = gridCCurrent
-	result["Grid C Power"] = gridCPower
-	result["Grid Freq"] = gridFreq
-	result["Inv 1 Temperature"] = inv1Temperature
-	result["Inv 2 Temperature"] = inv2Temperature
+func readBatteryOutput(connPort ports.CommunicationPort, serialNumber uint, cache *RegisterCache) (map[string]interface{}, error) {
+	return readAliasedFields(batteryOutputRanges, batteryOutputFields, connPort, serialNumber, cache)
+}
 
-	return result, nil
+func readPVOutput(connPort ports.CommunicationPort, serialNumber uint, cache *RegisterCache) (map[string]interface{}, error) {
+	return readAliasedFields(pvOutputRanges, pvOutputFields, connPort, serialNumber, cache)
 }
 
-func readInverterInfo(connPort ports.CommunicationPort, serialNumber uint) (map[string]interface{}, error) {
+// readAliasedFields reads the given register ranges and returns their fields renamed as described by aliases
+func readAliasedFields(ranges []registerRange, aliases []fieldAlias, connPort ports.CommunicationPort, serialNumber uint, cache *RegisterCache) (map[string]interface{}, error) {
 	result := make(map[string]interface{})
 
-	for _, rr := range inverterInfoRegisterRanges {
-		reply, err := readRegisterRange(rr, connPort, serialNumber)
+	for _, rr := range ranges {
+		reply, err := readRegisterRange(rr, connPort, serialNumber, cache)
 		if err != nil {
 			return nil, err
 		}
@@ -400,176 +326,63 @@ func readInverterInfo(connPort ports.CommunicationPort, serialNumber uint) (map[
 		}
 	}
 
-	invAVoltage := result["II: INV A Voltage"].(string)
-	invACurrent := result["II: INV A Current"].(string)
-	invAPower := result["II: INV A Power"].(string)
-	invBVoltage := result["II: INV B Voltage"].(string)
-	invBCurrent := result["II: INV B Current"].(string)
-	invBPower := result["II: INV B Power"].(string)
-	invCVoltage := result["II: INV C Voltage"].(string)
-	invCCurrent := result["II: INV C Current"].(string)
-	invCPower := result["II: INV C Power"].(string)
-	invAFreq := result["II: INV A Freq"].(string)
-	invBFreq := result["II: INV B Freq"].(string)
-	invCFreq := result["II: INV C Freq"].(string)
-	leakCurrent := result["II: Leak Current"].(string)
-
-	result = make(map[string]interface{})
-
-	result["Inv A Voltage"] = invAVoltage
-	result["Inv A Current"] = invACurrent
-	result["Inv A Power"] = invAPower
-	result["Inv B Voltage"] = invBVoltage
-	result["Inv B Current"] = invBCurrent
-	result["Inv B Power"] = invBPower
-	result["Inv C Voltage"] = invCVoltage
-	result["Inv C Current"] = invCCurrent
-	result["Inv C Power"] = invCPower
-	result["Inv A Freq"] = invAFreq
-	result["Inv B Freq"] = invBFreq
-	result["Inv C Freq"] = invCFreq
-	result["Leak Current"] = leakCurrent
-
-	return result, nil
+	return aliasFields(result, aliases)
 }
 
-func readLoadInfo(connPort ports.CommunicationPort, serialNumber uint) (map[string]interface{}, error) {
-	result := make(map[string]interface{})
+func aliasFields(fields map[string]interface{}, aliases []fieldAlias) (map[string]interface{}, error) {
+	result := make(map[string]interface{}, len(aliases))
 
-	for _, rr := range loadInfoRegisterRanges {
-		reply, err := readRegisterRange(rr, connPort, serialNumber)
-		if err != nil {
-			return nil, err
-		}
-
-		for k, v := range reply {
-			result[k] = v
+	for _, a := range aliases {
+		v, ok := fields[a.field]
+		if !ok {
+			return nil, fmt.Errorf("field %s missing in reply", a.field)
 		}
+		result[a.name] = v
 	}
 
-	loadAVoltage := result["LI: Load A Voltage"].(string)
-	loadACurrent := result["LI: Load A Current"].(string)
-	loadAPower := result["LI: Load A Power"].(string)
-	loadARate := result["LI: Load A Rate"].(string)
-	loadBVoltage := result["LI: Load B Voltage"].(string)
-	loadBCurrent := result["LI: Load B Current"].(string)
-	loadBPower := result["LI: Load B Power"].(string)
-	loadBRate := result["LI: Load B Rate"].(string)
-	loadCVoltage := result["LI: Load C Voltage"].(string)
-	loadCCurrent := result["LI: Load C Current"].(string)
-	loadCPower := result["LI: Load C Power"].(string)
-	loadCRate := result["LI: Load C Rate"].(string)
-	generatorPortVoltageA := result["LI: Generator Port Voltage A"].(string)
-	generatorPortVoltageB := result["LI: Generator Port Voltage B"].(string)
-	generatorPortVoltageC := result["LI: Generator Port Voltage C"].(string)
-
-	result = make(map[string]interface{})
-
-	result["Load A Voltage"] = loadAVoltage
-	result["Load A Current"] = loadACurrent
-	result["Load A Power"] = loadAPower
-	result["Load A Rate"] = loadARate
-	result["Load B Voltage"] = loadBVoltage
-	result["Load B Current"] = loadBCurrent
-	result["Load B Power"] = loadBPower
-	result["Load B Rate"] = loadBRate
-	result["Load C Voltage"] = loadCVoltage
-	result["Load C Current"] = loadCCurrent
-	result["Load C Power"] = loadCPower
-	result["Load C Rate"] = loadCRate
-	result["Generator Port Voltage A"] = generatorPortVoltageA
-	result["Generator Port Voltage B"] = generatorPortVoltageB
-	result["Generator Port Voltage C"] = generatorPortVoltageC
-
 	return result, nil
 }
 
-func readBatteryOutput(connPort ports.CommunicationPort, serialNumber uint) (map[string]interface{}, error) {
-	result := make(map[string]interface{})
+// writeRegisters writes consecutive holding registers and checks the modbus reply
+func writeRegisters(connPort ports.CommunicationPort, serialNumber uint, startRegister int, values ...uint16) error {
+	lswRequest := NewLSWWriteRequest(serialNumber, startRegister, values...)
 
-	for _, rr := range batteryOutputRanges {
-		reply, err := readRegisterRange(rr, connPort, serialNumber)
-		if err != nil {
-			return nil, err
-		}
-
-		for k, v := range reply {
-			result[k] = v
-		}
+	err := connPort.Open()
+	if err != nil {
+		return err
 	}
 
-	batVoltage := result["BO: BAT Voltage"].(string)
-	batCurrent := result["BO: BAT Current"].(string)
-	bat1Current := result["BO: BAT 1 Current"].(string)
-	bat2Current := result["BO: BAT 2 Current"].(string)
-	bat3Current := result["BO: BAT 3 Current"].(string)
-	batSOC := result["BO: BAT SOC"].(string)
-	batTemperature := result["BO: BAT Temperature"].(string)
-	batChargeVoltage := result["BO: BAT Charge Voltage"].(string)
-	batChargeCurrentLimit := result["BO: BAT Charge Current Limit"].(string)
-	batDischargeCurrentLimit := result["BO: BAT Discharge Current Limit"].(string)
-	batPower := result["BO: BAT Power"].(string)
-	bmsBatVoltage := result["BO: BMS BAT Voltage"].(string)
-	bmsBatCurrent := result["BO: BMS BAT Current"].(string)
-	bmsBatCellMaxVoltage := result["BO: BMS BAT Cell Max Voltage"].(string)
-	bmsBatCellMinVoltage := result["BO: BMS BAT Cell Min Voltage"].(string)
-	bmsBatCellMaxTemperature := result["BO: BMS BAT Cell Max Temperature"].(string)
-	bmsBatCellMinTemperature := result["BO: BMS BAT Cell Min Temperature"].(string)
-
-	result = make(map[string]interface{})
-
-	result["BAT Voltage"] = batVoltage
-	result["BAT Current"] = batCurrent
-	result["BAT 1 Current"] = bat1Current
-	result["BAT 2 Current"] = bat2Current
-	result["BAT 3 Current"] = bat3Current
-	result["BAT SOC"] = batSOC
-	result["BAT Temperature"] = batTemperature
-	result["BAT Charge Voltage"] = batChargeVoltage
-	result["BAT Charge Current Limit"] = batChargeCurrentLimit
-	result["BAT Discharge Current Limit"] = batDischargeCurrentLimit
-	result["BAT Power"] = batPower
-	result["BMS BAT Voltage"] = bmsBatVoltage
-	result["BMS BAT Current"] = bmsBatCurrent
-	result["BMS BAT Cell Max Voltage"] = bmsBatCellMaxVoltage
-	result["BMS BAT Cell Min Voltage"] = bmsBatCellMinVoltage
-	result["BMS BAT Cell Max Temperature"] = bmsBatCellMaxTemperature
-	result["BMS BAT Cell Min Temperature"] = bmsBatCellMinTemperature
-
-	return result, nil
-}
-
-func readPVOutput(connPort ports.CommunicationPort, serialNumber uint) (map[string]interface{}, error) {
-	result := make(map[string]interface{})
-
-	for _, rr := range pvOutputRanges {
-		reply, err := readRegisterRange(rr, connPort, serialNumber)
-		if err != nil {
-			return nil, err
+	defer func(connPort ports.CommunicationPort) {
+		if err := connPort.Close(); err != nil {
+			log.Printf("error during connection close: %s", err)
 		}
+	}(connPort)
 
-		for k, v := range reply {
-			result[k] = v
-		}
+	_, err = connPort.Write(lswRequest.ToBytes())
+	if err != nil {
+		return err
 	}
 
-	voltagePV1 := result["PV: Voltage_PV1"].(string)
-	currentPV1 := result["PV: Current_PV1"].(string)
-	powerPV1 := result["PV: Power_PV1"].(string)
-	voltagePV2 := result["PV: Voltage_PV2"].(string)
-	currentPV2 := result["PV: Current_PV2"].(string)
-	powerPV2 := result["PV: Power_PV2"].(string)
+	buf := make([]byte, 2048)
+	n, err := connPort.Read(buf)
+	if err != nil {
+		return err
+	}
 
-	result = make(map[string]interface{})
+	buf = buf[:n]
+	if len(buf) < 28 {
+		return fmt.Errorf("short reply: %d bytes", n)
+	}
 
-	result["Voltage PV 1"] = voltagePV1
-	result["Current PV 1"] = currentPV1
-	result["Power PV 1"] = powerPV1
-	result["Voltage PV 2"] = voltagePV2
-	result["Current PV 2"] = currentPV2
-	result["Power PV 2"] = powerPV2
+	// modbus exception replies have the function code high bit set
+	if buf[26]&0x80 != 0 {
+		return fmt.Errorf("register 0x%04X write refused, modbus exception %d", startRegister, buf[27])
+	}
+	if buf[26] != 0x10 {
+		return fmt.Errorf("unexpected reply to register 0x%04X write: function 0x%02X", startRegister, buf[26])
+	}
 
-	return result, nil
+	return nil
 }
 
 func TwoComplement(b []byte) int16 {
@@ -0,0 +1,66 @@
+package invt
+
+import (
+	"testing"
+)
+
+// port answers every request with reply
+type port struct {
+	reply []byte
+}
+
+func (p *port) Open() error                       { return nil }
+func (p *port) Close() error                      { return nil }
+func (p *port) Shutdown() error                   { return nil }
+func (p *port) Write(payload []byte) (int, error) { return len(payload), nil }
+func (p *port) Read(buffer []byte) (int, error)   { return copy(buffer, p.reply), nil }
+
+// readReply builds a logger reply carrying a modbus reply with function and data
+func readReply(function byte, count byte, data []byte) []byte {
+	buf := make([]byte, 28, 28+len(data)+4)
+	buf[0] = 0xa5
+	buf[25] = 0x01
+	buf[26] = function
+	buf[27] = count
+	buf = append(buf, data...)
+	// crc, checksum and end of frame are not checked
+	return append(buf, 0, 0, 0, 0x15)
+}
+
+func TestReadRegisterRange(t *testing.T) {
+	rr := registerRange{start: 0x1000, end: 0x1001, replyFields: []field{{register: 0x1001, name: "Value", valueType: "U16", factor: 1}}}
+
+	cache := NewRegisterCache()
+	reply, err := readRegisterRange(rr, &port{reply: readReply(0x03, 4, []byte{0x00, 0x01, 0x00, 0x2a})}, 1, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply["Value"] == nil {
+		t.Errorf("reply %v", reply)
+	}
+	if values, _, ok := cache.Read(0x1000, 2); !ok || values[0] != 1 || values[1] != 42 {
+		t.Errorf("cached %v, %t", values, ok)
+	}
+
+	tests := []struct {
+		name  string
+		reply []byte
+	}{
+		{"short", readReply(0x03, 4, nil)[:27]},
+		{"exception", readReply(0x83, 2, nil)},
+		{"other function", readReply(0x04, 4, []byte{0, 1, 0, 2})},
+		{"other range", readReply(0x03, 2, []byte{0, 1})},
+		{"truncated", readReply(0x03, 4, []byte{0, 1})[:30]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := NewRegisterCache()
+			if _, err := readRegisterRange(rr, &port{reply: tt.reply}, 1, cache); err == nil {
+				t.Error("invalid reply accepted")
+			}
+			if _, _, ok := cache.Read(0x1000, 1); ok {
+				t.Error("invalid reply cached")
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package invt
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// RegisterCache keeps the raw value of the registers, at their INVT address, as last read from the inverter
+type RegisterCache struct {
+	mu      sync.RWMutex
+	values  map[uint16]uint16
+	updated map[uint16]time.Time
+}
+
+func NewRegisterCache() *RegisterCache {
+	return &RegisterCache{
+		values:  make(map[uint16]uint16),
+		updated: make(map[uint16]time.Time),
+	}
+}
+
+// store keeps the big endian register values of a modbus read reply starting at register start
+func (c *RegisterCache) store(start int, data []byte, t time.Time) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := 0; i+1 < len(data); i += 2 {
+		address := uint16(start + i/2)
+		c.values[address] = binary.BigEndian.Uint16(data[i : i+2])
+		c.updated[address] = t
+	}
+}
+
+// Read returns count registers from address and the time the oldest of them has been read,
+// ok is false when any of them has never been read
+func (c *RegisterCache) Read(address uint16, count uint16) (values []uint16, oldest time.Time, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	values = make([]uint16, count)
+	for i := uint16(0); i < count; i++ {
+		v, found := c.values[address+i]
+		if !found {
+			return nil, time.Time{}, false
+		}
+		values[i] = v
+
+		if t := c.updated[address+i]; oldest.IsZero() || t.Before(oldest) {
+			oldest = t
+		}
+	}
+	return values, oldest, true
+}
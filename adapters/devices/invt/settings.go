@@ -0,0 +1,72 @@
+package invt
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/misterdelle/invt_logger_reader/ports"
+)
+
+// setting is an inverter register that may be written through WriteSetting
+type setting struct {
+	register int
+	encode   func(value string) (uint16, error)
+}
+
+// writableSettings are the only registers the reader is allowed to write: the battery
+// charge and discharge time windows, written as "HH:MM"
+var writableSettings = map[string]setting{
+	"Charge Time1 Start":    {0x3504, encodeTimeOfDay},
+	"Charge Time1 End":      {0x3505, encodeTimeOfDay},
+	"Discharge Time1 Start": {0x3506, encodeTimeOfDay},
+	"Discharge Time1 End":   {0x3507, encodeTimeOfDay},
+	"Charge Time2 Start":    {0x3508, encodeTimeOfDay},
+	"Charge Time2 End":      {0x3509, encodeTimeOfDay},
+	"Discharge Time2 Start": {0x350A, encodeTimeOfDay},
+	"Discharge Time2 End":   {0x350B, encodeTimeOfDay},
+}
+
+// Settings returns the names of the settings accepted by WriteSetting
+func Settings() []string {
+	names := make([]string, 0, len(writableSettings))
+	for name := range writableSettings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// encodeTimeOfDay stores "HH:MM" as an U8 pair, hour in the high byte
+func encodeTimeOfDay(value string) (uint16, error) {
+	h, m, ok := strings.Cut(value, ":")
+	if !ok {
+		return 0, fmt.Errorf("invalid time %q, use HH:MM", value)
+	}
+
+	hour, err := strconv.Atoi(h)
+	if err != nil || hour < 0 || hour > 23 {
+		return 0, fmt.Errorf("invalid hour in %q", value)
+	}
+	minute, err := strconv.Atoi(m)
+	if err != nil || minute < 0 || minute > 59 {
+		return 0, fmt.Errorf("invalid minute in %q", value)
+	}
+
+	return uint16(hour)<<8 | uint16(minute), nil
+}
+
+func writeSetting(connPort ports.CommunicationPort, serialNumber uint, name string, value string) error {
+	s, ok := writableSettings[name]
+	if !ok {
+		return fmt.Errorf("setting %q is not writable, use one of: %s", name, strings.Join(Settings(), ", "))
+	}
+
+	v, err := s.encode(value)
+	if err != nil {
+		return err
+	}
+
+	return writeRegisters(connPort, serialNumber, s.register, v)
+}
@@ -0,0 +1,364 @@
+// Package history records the numeric measurements in a local SQLite database
+package history
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/misterdelle/invt_logger_reader/ports"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	defaultRetention = 7 * 24 * time.Hour
+	// maintenanceInterval is how often the hourly rollup and the retention run
+	maintenanceInterval = 10 * time.Minute
+	hour                = int64(time.Hour / time.Millisecond)
+)
+
+// samples holds every poll, hourly the per hour average, minimum and maximum of the samples,
+// timestamps are Unix milliseconds. rollup in meta is the hour the hourly table is complete up to
+const schema = `
+CREATE TABLE IF NOT EXISTS fields (
+	id    INTEGER PRIMARY KEY,
+	topic TEXT NOT NULL,
+	field TEXT NOT NULL,
+	unit  TEXT NOT NULL DEFAULT '',
+	UNIQUE (topic, field)
+);
+CREATE TABLE IF NOT EXISTS samples (
+	field_id INTEGER NOT NULL,
+	ts       INTEGER NOT NULL,
+	value    REAL NOT NULL,
+	PRIMARY KEY (field_id, ts)
+) WITHOUT ROWID;
+CREATE TABLE IF NOT EXISTS hourly (
+	field_id INTEGER NOT NULL,
+	ts       INTEGER NOT NULL,
+	avg      REAL NOT NULL,
+	min      REAL NOT NULL,
+	max      REAL NOT NULL,
+	count    INTEGER NOT NULL,
+	PRIMARY KEY (field_id, ts)
+) WITHOUT ROWID;
+CREATE TABLE IF NOT EXISTS meta (
+	key   TEXT PRIMARY KEY,
+	value INTEGER NOT NULL
+);
+`
+
+// series merges the hourly aggregates before ?5 with the samples from ?5 on and groups them by ?1 milliseconds
+const series = `
+SELECT ts / ?1 * ?1 AS bucket, sum(avg * cnt) / sum(cnt), min(mn), max(mx), sum(cnt) FROM (
+	SELECT ts, avg, min AS mn, max AS mx, count AS cnt FROM hourly
+	WHERE field_id = ?2 AND ts >= ?3 AND ts < ?4 AND ts < ?5
+	UNION ALL
+	SELECT ts, value, value, value, 1 FROM samples
+	WHERE field_id = ?2 AND ts >= ?3 AND ts < ?4 AND ts >= ?5
+)
+GROUP BY bucket ORDER BY bucket
+`
+
+type HistoryConfig struct {
+	Path string `yaml:"path"`
+	// Retention is how long every sample is kept, older samples only survive as hourly aggregates
+	Retention time.Duration `yaml:"retention"`
+	// HourlyRetention is how long the hourly aggregates are kept, forever when 0
+	HourlyRetention time.Duration `yaml:"hourlyRetention"`
+}
+
+// Store records the measurements, it implements ports.Exporter and ports.History
+type Store struct {
+	config HistoryConfig
+	db     *sql.DB
+
+	mu     sync.Mutex
+	fields map[ports.HistoryField]int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New opens, or creates, the database at config.Path
+func New(config *HistoryConfig) (*Store, error) {
+	cfg := *config
+	if cfg.Retention <= 0 {
+		cfg.Retention = defaultRetention
+	}
+
+	if dir := filepath.Dir(cfg.Path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("cannot create history directory: %w", err)
+		}
+	}
+
+	db, err := sql.Open("sqlite", cfg.Path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)")
+	if err != nil {
+		return nil, fmt.Errorf("cannot open history database %s: %w", cfg.Path, err)
+	}
+	// a single connection serializes the writes, SQLite would refuse concurrent ones anyway
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot create history schema in %s: %w", cfg.Path, err)
+	}
+
+	s := &Store{
+		config: cfg,
+		db:     db,
+		fields: make(map[ports.HistoryField]int64),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	go s.run()
+
+	return s, nil
+}
+
+// OpenReadOnly opens the existing database at path to read it, e.g. to export it: the schema is not created
+// and no maintenance runs
+func OpenReadOnly(path string) (*Store, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("cannot open history database: %w", err)
+	}
+
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, fmt.Errorf("cannot open history database %s: %w", path, err)
+	}
+	db.SetMaxOpenConns(1)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot open history database %s: %w", path, err)
+	}
+
+	s := &Store{
+		config: HistoryConfig{Path: path},
+		db:     db,
+		fields: make(map[ports.HistoryField]int64),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	close(s.done)
+
+	return s, nil
+}
+
+// Export records the numeric fields at the poll time, the others are ignored
+func (s *Store) Export(snapshot ports.Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ts := snapshot.PollTime().UnixMilli()
+	for _, m := range snapshot.Measurements() {
+		value, ok := m.Number()
+		if !ok || m.Quality == ports.QualityInvalid {
+			continue
+		}
+
+		id, err := s.fieldID(tx, ports.HistoryField{Topic: m.Group, Field: m.Field, Unit: m.Unit})
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO samples (field_id, ts, value) VALUES (?, ?, ?)`, id, ts, value); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// fieldID returns the id of a field, adding it or updating its unit when needed, must be called with mu held
+func (s *Store) fieldID(tx *sql.Tx, f ports.HistoryField) (int64, error) {
+	if id, ok := s.fields[f]; ok {
+		return id, nil
+	}
+
+	_, err := tx.Exec(`INSERT INTO fields (topic, field, unit) VALUES (?, ?, ?)
+		ON CONFLICT (topic, field) DO UPDATE SET unit = excluded.unit`, f.Topic, f.Field, f.Unit)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int64
+	if err := tx.QueryRow(`SELECT id FROM fields WHERE topic = ? AND field = ?`, f.Topic, f.Field).Scan(&id); err != nil {
+		return 0, err
+	}
+
+	s.fields[f] = id
+	return id, nil
+}
+
+// Fields returns the recorded fields
+func (s *Store) Fields() ([]ports.HistoryField, error) {
+	rows, err := s.db.Query(`SELECT topic, field, unit FROM fields ORDER BY topic, field`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]ports.HistoryField, 0)
+	for rows.Next() {
+		var f ports.HistoryField
+		if err := rows.Scan(&f.Topic, &f.Field, &f.Unit); err != nil {
+			return nil, err
+		}
+		result = append(result, f)
+	}
+	return result, rows.Err()
+}
+
+// Series returns the points of a field. Every sample is used while the range is within the retention
+// and the step is below an hour, otherwise the hourly aggregates are, with the samples not yet aggregated
+func (s *Store) Series(topic string, field string, from time.Time, to time.Time, step time.Duration) ([]ports.HistoryPoint, error) {
+	var id int64
+	err := s.db.QueryRow(`SELECT id FROM fields WHERE topic = ? AND field = ?`, topic, field).Scan(&id)
+	if err == sql.ErrNoRows {
+		return []ports.HistoryPoint{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	bucket := step.Milliseconds()
+	if bucket <= 0 {
+		bucket = 1
+	}
+
+	// samples are used from boundary on
+	var boundary int64
+	if bucket >= hour || from.Before(time.Now().Add(-s.config.Retention)) {
+		if boundary, err = s.rollupMark(); err != nil {
+			return nil, err
+		}
+		// an hourly aggregate cannot be split
+		if bucket < hour {
+			bucket = hour
+		}
+	}
+
+	rows, err := s.db.Query(series, bucket, id, from.UnixMilli(), to.UnixMilli(), boundary)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]ports.HistoryPoint, 0)
+	for rows.Next() {
+		var ts int64
+		var p ports.HistoryPoint
+		if err := rows.Scan(&ts, &p.Value, &p.Min, &p.Max, &p.Count); err != nil {
+			return nil, err
+		}
+		p.Time = time.UnixMilli(ts)
+		result = append(result, p)
+	}
+	return result, rows.Err()
+}
+
+// Close stops the maintenance and closes the database
+func (s *Store) Close(timeout time.Duration) error {
+	close(s.stop)
+
+	select {
+	case <-s.done:
+	case <-time.After(timeout):
+		log.Printf("history maintenance still running after %s", timeout)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.db.Close()
+}
+
+func (s *Store) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(maintenanceInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.maintain(time.Now()); err != nil {
+			log.Printf("history maintenance failed: %s", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// maintain aggregates the completed hours and removes what is past retention
+func (s *Store) maintain(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	from, err := s.rollupMark()
+	if err != nil {
+		return err
+	}
+	to := now.Truncate(time.Hour).UnixMilli()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if from < to {
+		_, err = tx.Exec(`INSERT OR REPLACE INTO hourly (field_id, ts, avg, min, max, count)
+			SELECT field_id, ts / ?1 * ?1, avg(value), min(value), max(value), count(*) FROM samples
+			WHERE ts >= ?2 AND ts < ?3 GROUP BY field_id, ts / ?1`, hour, from, to)
+		if err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(`INSERT OR REPLACE INTO meta (key, value) VALUES ('rollup', ?)`, to); err != nil {
+			return err
+		}
+	}
+
+	// samples are kept until aggregated, whatever the retention
+	cutoff := now.Add(-s.config.Retention).UnixMilli()
+	if cutoff > to {
+		cutoff = to
+	}
+	if _, err = tx.Exec(`DELETE FROM samples WHERE ts < ?`, cutoff); err != nil {
+		return err
+	}
+
+	if s.config.HourlyRetention > 0 {
+		if _, err = tx.Exec(`DELETE FROM hourly WHERE ts < ?`, now.Add(-s.config.HourlyRetention).UnixMilli()); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// rollupMark returns the time the hourly aggregates are complete up to
+func (s *Store) rollupMark() (int64, error) {
+	var mark int64
+	err := s.db.QueryRow(`SELECT value FROM meta WHERE key = 'rollup'`).Scan(&mark)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return mark, err
+}
@@ -0,0 +1,164 @@
+package history
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/misterdelle/invt_logger_reader/ports"
+)
+
+func TestOpenReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+
+	if _, err := OpenReadOnly(path); err == nil {
+		t.Fatal("missing database opened")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("missing database created: %v", err)
+	}
+
+	s, err := New(&HistoryConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Now().Truncate(time.Second)
+	if err := s.Export(ports.NewSnapshot("", "PV", map[string]interface{}{"PV1 Power": "1200"}, ports.RecordInfo{PollTime: at, Units: map[string]string{"PV1 Power": "W"}})); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	ro, err := OpenReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close(time.Second)
+
+	fields, err := ro.Fields()
+	if err != nil || len(fields) != 1 || fields[0] != (ports.HistoryField{Topic: "PV", Field: "PV1 Power", Unit: "W"}) {
+		t.Errorf("Fields = %v, %v", fields, err)
+	}
+	points, err := ro.Series("PV", "PV1 Power", at.Add(-time.Minute), at.Add(time.Minute), 0)
+	if err != nil || len(points) != 1 || points[0].Value != 1200 {
+		t.Errorf("Series = %v, %v", points, err)
+	}
+
+	if err := ro.Export(ports.NewSnapshot("", "PV", map[string]interface{}{"PV2 Power": "800"}, ports.RecordInfo{PollTime: at})); err == nil {
+		t.Error("read-only database written")
+	}
+}
+
+func newStore(t *testing.T, cfg HistoryConfig) *Store {
+	t.Helper()
+	cfg.Path = filepath.Join(t.TempDir(), "history.db")
+	s, err := New(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close(time.Second) })
+	return s
+}
+
+func insert(t *testing.T, s *Store, at time.Time, data map[string]interface{}, quality map[string]string) {
+	t.Helper()
+	if err := s.Export(ports.NewSnapshot("", "GridOutput/Grid A", data, ports.RecordInfo{PollTime: at, Quality: quality})); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSeries(t *testing.T) {
+	s := newStore(t, HistoryConfig{})
+	base := time.Now().Truncate(time.Hour).Add(-2 * time.Hour)
+
+	insert(t, s, base, map[string]interface{}{"Inv A Power": "100", "Work Mode": "Self use"}, nil)
+	insert(t, s, base.Add(time.Minute), map[string]interface{}{"Inv A Power": 300}, nil)
+	insert(t, s, base.Add(2*time.Minute), map[string]interface{}{"Inv A Power": "NaN"}, nil)
+	insert(t, s, base.Add(3*time.Minute), map[string]interface{}{"Inv A Power": "9999"}, map[string]string{"Inv A Power": ports.QualityInvalid})
+	insert(t, s, base.Add(10*time.Minute), map[string]interface{}{"Inv A Power": "500"}, nil)
+
+	fields, err := s.Fields()
+	if err != nil || len(fields) != 1 || fields[0].Field != "Inv A Power" {
+		t.Fatalf("Fields = %v, %v", fields, err)
+	}
+
+	tests := []struct {
+		step time.Duration
+		want []ports.HistoryPoint
+	}{
+		{0, []ports.HistoryPoint{
+			{Time: base, Value: 100, Min: 100, Max: 100, Count: 1},
+			{Time: base.Add(time.Minute), Value: 300, Min: 300, Max: 300, Count: 1},
+			{Time: base.Add(10 * time.Minute), Value: 500, Min: 500, Max: 500, Count: 1},
+		}},
+		{5 * time.Minute, []ports.HistoryPoint{
+			{Time: base, Value: 200, Min: 100, Max: 300, Count: 2},
+			{Time: base.Add(10 * time.Minute), Value: 500, Min: 500, Max: 500, Count: 1},
+		}},
+	}
+	for _, tt := range tests {
+		points, err := s.Series("GridOutput/Grid A", "Inv A Power", base, base.Add(time.Hour), tt.step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(points) != len(tt.want) {
+			t.Fatalf("step %s: %v, want %v", tt.step, points, tt.want)
+		}
+		for i, p := range points {
+			if !p.Time.Equal(tt.want[i].Time) || p.Value != tt.want[i].Value || p.Min != tt.want[i].Min || p.Max != tt.want[i].Max || p.Count != tt.want[i].Count {
+				t.Errorf("step %s point %d = %+v, want %+v", tt.step, i, p, tt.want[i])
+			}
+		}
+	}
+
+	if points, err := s.Series("GridOutput/Grid A", "Work Mode", base, base.Add(time.Hour), 0); err != nil || len(points) != 0 {
+		t.Errorf("text field recorded: %v, %v", points, err)
+	}
+}
+
+func TestMaintain(t *testing.T) {
+	s := newStore(t, HistoryConfig{Retention: time.Hour, HourlyRetention: 48 * time.Hour})
+	// after the hour the startup maintenance aggregated up to
+	base := time.Now().Truncate(time.Hour).Add(24 * time.Hour)
+
+	insert(t, s, base, map[string]interface{}{"Inv A Power": "100"}, nil)
+	insert(t, s, base.Add(10*time.Minute), map[string]interface{}{"Inv A Power": "200"}, nil)
+	insert(t, s, base.Add(20*time.Minute), map[string]interface{}{"Inv A Power": "600"}, nil)
+	insert(t, s, base.Add(65*time.Minute), map[string]interface{}{"Inv A Power": "400"}, nil)
+
+	if err := s.maintain(base.Add(2 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the samples of the first hour are past retention, only its aggregate is left
+	points, err := s.Series("GridOutput/Grid A", "Inv A Power", base, base.Add(2*time.Hour), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ports.HistoryPoint{
+		{Time: base, Value: 300, Min: 100, Max: 600, Count: 3},
+		{Time: base.Add(time.Hour), Value: 400, Min: 400, Max: 400, Count: 1},
+	}
+	if len(points) != len(want) {
+		t.Fatalf("hourly %v, want %v", points, want)
+	}
+	for i, p := range points {
+		if !p.Time.Equal(want[i].Time) || p.Value != want[i].Value || p.Min != want[i].Min || p.Max != want[i].Max || p.Count != want[i].Count {
+			t.Errorf("hourly point %d = %+v, want %+v", i, p, want[i])
+		}
+	}
+
+	if points, err := s.Series("GridOutput/Grid A", "Inv A Power", base, base.Add(2*time.Hour), 0); err != nil || len(points) != 1 {
+		t.Errorf("samples %v, %v, want the one of the second hour", points, err)
+	}
+
+	// past the hourly retention too
+	if err := s.maintain(base.Add(72 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if points, err := s.Series("GridOutput/Grid A", "Inv A Power", base, base.Add(2*time.Hour), time.Hour); err != nil || len(points) != 0 {
+		t.Errorf("hourly aggregates kept past retention: %v, %v", points, err)
+	}
+}
@@ -0,0 +1,332 @@
+package influxdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/misterdelle/invt_logger_reader/ports"
+)
+
+// API versions
+const (
+	// V2 writes to /api/v2/write with a token, org and bucket
+	V2 = "v2"
+	// V1 writes to /write with a database and optional user and password, also accepted by InfluxDB 2 compatibility API
+	V1 = "v1"
+)
+
+const (
+	defaultBatchSize     = 500
+	defaultFlushInterval = 10 * time.Second
+	defaultMaxRetries    = 3
+	requestTimeout       = 10 * time.Second
+)
+
+// retryDelay is the wait before the first retry, it grows with every attempt
+var retryDelay = 2 * time.Second
+
+type InfluxConfig struct {
+	Url     string `yaml:"url"`
+	Version string `yaml:"version"`
+
+	// v2
+	Token  string `yaml:"token"`
+	Org    string `yaml:"org"`
+	Bucket string `yaml:"bucket"`
+
+	// v1
+	Database        string `yaml:"database"`
+	User            string `yaml:"user"`
+	Password        string `yaml:"password"`
+	RetentionPolicy string `yaml:"retentionPolicy"`
+
+	// BatchSize lines are written at once, or less every FlushInterval
+	BatchSize     int           `yaml:"batchSize"`
+	FlushInterval time.Duration `yaml:"flushInterval"`
+	// MaxRetries is the number of further attempts for a batch refused with a temporary error, 0 disables
+	// the retries and a negative value takes the default
+	MaxRetries int `yaml:"maxRetries"`
+
+	// Tags added to every point, e.g. the inverter serial number
+	Tags map[string]string `yaml:"tags"`
+}
+
+// Connection buffers the records as line protocol and writes them in batches
+type Connection struct {
+	config   InfluxConfig
+	writeURL string
+	client   *http.Client
+
+	mu     sync.Mutex
+	lines  []string
+	closed bool
+
+	flush chan struct{}
+	done  chan struct{}
+	stop  chan struct{}
+}
+
+var errClosed = errors.New("InfluxDB connection is closed")
+
+func New(config *InfluxConfig) (*Connection, error) {
+	cfg := *config
+	if cfg.Version == "" {
+		cfg.Version = V2
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultBatchSize
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = defaultFlushInterval
+	}
+	if cfg.MaxRetries < 0 {
+		cfg.MaxRetries = defaultMaxRetries
+	}
+
+	writeURL, err := buildWriteURL(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &Connection{
+		config:   cfg,
+		writeURL: writeURL,
+		client:   &http.Client{Timeout: requestTimeout},
+		flush:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		stop:     make(chan struct{}),
+	}
+
+	go conn.run()
+
+	return conn, nil
+}
+
+func buildWriteURL(cfg InfluxConfig) (string, error) {
+	base, err := url.Parse(strings.TrimSuffix(cfg.Url, "/"))
+	if err != nil || base.Scheme == "" || base.Host == "" {
+		return "", fmt.Errorf("invalid InfluxDB URL %q", cfg.Url)
+	}
+
+	query := url.Values{}
+	query.Set("precision", "ns")
+
+	switch cfg.Version {
+	case V2:
+		if cfg.Org == "" || cfg.Bucket == "" {
+			return "", errors.New("InfluxDB v2 requires org and bucket")
+		}
+		base.Path += "/api/v2/write"
+		query.Set("org", cfg.Org)
+		query.Set("bucket", cfg.Bucket)
+	case V1:
+		if cfg.Database == "" {
+			return "", errors.New("InfluxDB v1 requires a database")
+		}
+		base.Path += "/write"
+		query.Set("db", cfg.Database)
+		if cfg.RetentionPolicy != "" {
+			query.Set("rp", cfg.RetentionPolicy)
+		}
+	default:
+		return "", fmt.Errorf("unknown InfluxDB version %q, use %s or %s", cfg.Version, V2, V1)
+	}
+
+	base.RawQuery = query.Encode()
+	return base.String(), nil
+}
+
+// Export queues a snapshot as a single point: the first segment of the group is the measurement,
+// the subgroup becomes the phase tag (e.g. "Grid A") or the subgroup tag (e.g. "Battery Charge")
+func (conn *Connection) Export(snapshot ports.Snapshot) error {
+	group, subgroup, _ := strings.Cut(snapshot.Group(), "/")
+
+	tags := make(map[string]string, len(conn.config.Tags)+1)
+	for k, v := range conn.config.Tags {
+		tags[k] = v
+	}
+	if phase, ok := phaseOf(subgroup); ok {
+		tags["phase"] = phase
+	} else if subgroup != "" {
+		tags["subgroup"] = subgroup
+	}
+
+	fields := make(map[string]ports.Value, snapshot.Len())
+	units := make(map[string]string, snapshot.Len())
+	for _, m := range snapshot.Measurements() {
+		fields[m.Field] = m.Value
+		units[m.Field] = m.Unit
+	}
+
+	t := snapshot.PollTime()
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	line := point{measurement: group, tags: tags, fields: fields, units: units, time: t}.line()
+	if line == "" {
+		return nil
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	if conn.closed {
+		return errClosed
+	}
+
+	conn.lines = append(conn.lines, line)
+	if len(conn.lines) >= conn.config.BatchSize {
+		select {
+		case conn.flush <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// phaseOf returns the phase of subgroups like "Grid A", "INV B" or "Load C"
+func phaseOf(subgroup string) (string, bool) {
+	i := strings.LastIndex(subgroup, " ")
+	if i < 0 {
+		return "", false
+	}
+
+	switch phase := subgroup[i+1:]; phase {
+	case "A", "B", "C":
+		return phase, true
+	default:
+		return "", false
+	}
+}
+
+// Close writes the buffered lines, waiting at most timeout
+func (conn *Connection) Close(timeout time.Duration) error {
+	conn.mu.Lock()
+	if conn.closed {
+		conn.mu.Unlock()
+		return nil
+	}
+	conn.closed = true
+	conn.mu.Unlock()
+
+	close(conn.stop)
+
+	select {
+	case <-conn.done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("pending InfluxDB writes not completed within %s", timeout)
+	}
+}
+
+func (conn *Connection) run() {
+	defer close(conn.done)
+
+	ticker := time.NewTicker(conn.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-conn.flush:
+		case <-conn.stop:
+			conn.writeBuffered(false)
+			return
+		}
+
+		conn.writeBuffered(true)
+	}
+}
+
+// writeBuffered writes all the buffered lines in batches, a batch that still fails after
+// the retries is dropped
+func (conn *Connection) writeBuffered(retry bool) {
+	for {
+		conn.mu.Lock()
+		n := len(conn.lines)
+		if n > conn.config.BatchSize {
+			n = conn.config.BatchSize
+		}
+		batch := conn.lines[:n]
+		conn.lines = conn.lines[n:]
+		conn.mu.Unlock()
+
+		if len(batch) == 0 {
+			return
+		}
+
+		body := []byte(strings.Join(batch, "\n") + "\n")
+
+		attempts := 1
+		if retry {
+			attempts += conn.config.MaxRetries
+		}
+
+		var err error
+		for attempt := 1; attempt <= attempts; attempt++ {
+			var temporary bool
+			temporary, err = conn.write(body)
+			if err == nil || !temporary {
+				break
+			}
+
+			if attempt < attempts {
+				log.Printf("InfluxDB write failed (attempt %d of %d): %s", attempt, attempts, err)
+				select {
+				case <-time.After(retryDelay * time.Duration(attempt)):
+				case <-conn.stop:
+					// shutting down, one last attempt
+					attempts = attempt + 1
+				}
+			}
+		}
+
+		if err != nil {
+			log.Printf("error writing %d lines to InfluxDB, dropped: %s", len(batch), err)
+		}
+	}
+}
+
+// write posts a batch, temporary reports whether the request may succeed if retried
+func (conn *Connection) write(body []byte) (temporary bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, conn.writeURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	switch conn.config.Version {
+	case V2:
+		req.Header.Set("Authorization", "Token "+conn.config.Token)
+	case V1:
+		if conn.config.User != "" {
+			req.SetBasicAuth(conn.config.User, conn.config.Password)
+		}
+	}
+
+	resp, err := conn.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return false, nil
+	}
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
@@ -0,0 +1,295 @@
+package influxdb
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/misterdelle/invt_logger_reader/ports"
+)
+
+func init() {
+	retryDelay = 10 * time.Millisecond
+}
+
+func TestLine(t *testing.T) {
+	at := time.Unix(1714551300, 0)
+
+	tests := []struct {
+		name  string
+		point point
+		want  string
+	}{
+		{
+			name: "numbers from text",
+			point: point{
+				measurement: "GridOutput",
+				tags:        map[string]string{"inverter": "2333571751", "phase": "A"},
+				fields:      values(map[string]interface{}{"Inv A Voltage": "230.1", "Inv A Power": 276}),
+				time:        at,
+			},
+			want: `GridOutput,inverter=2333571751,phase=A Inv\ A\ Power=276,Inv\ A\ Voltage=230.1 1714551300000000000`,
+		},
+		{
+			name: "escaping",
+			point: point{
+				measurement: "Energy Today,Totals",
+				tags:        map[string]string{"sub group": "Battery=Charge, A"},
+				fields:      values(map[string]interface{}{"Work=Mode": `On "grid" \ backup`}),
+				time:        at,
+			},
+			want: `Energy\ Today\,Totals,sub\ group=Battery\=Charge\,\ A Work\=Mode="On \"grid\" \\ backup" 1714551300000000000`,
+		},
+		{
+			name: "unwritable values left out",
+			point: point{
+				measurement: "station",
+				tags:        map[string]string{"empty": ""},
+				fields:      values(map[string]interface{}{"a": nil, "b": math.NaN(), "c": "NaN", "d": math.Inf(1), "e": true}),
+				time:        at,
+			},
+			want: `station e="true" 1714551300000000000`,
+		},
+		{
+			name: "texts of fields with a unit left out",
+			point: point{
+				measurement: "GridOutput",
+				fields:      values(map[string]interface{}{"Inv A Voltage": "---", "Inv A Power": "276", "Work Mode": "Self use", "Online": true}),
+				units:       map[string]string{"Inv A Voltage": "V", "Inv A Power": "W", "Online": "%"},
+				time:        at,
+			},
+			want: `GridOutput Inv\ A\ Power=276,Work\ Mode="Self use" 1714551300000000000`,
+		},
+		{
+			name: "no fields",
+			point: point{
+				measurement: "station",
+				fields:      values(map[string]interface{}{"a": nil}),
+				time:        at,
+			},
+			want: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.point.line(); got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// values types the values of a record
+func values(data map[string]interface{}) map[string]ports.Value {
+	result := make(map[string]ports.Value, len(data))
+	for k, v := range data {
+		result[k] = ports.NewValue(v)
+	}
+	return result
+}
+
+func TestPhaseOf(t *testing.T) {
+	for subgroup, want := range map[string]string{"Grid A": "A", "INV B": "B", "Load C": "C", "Battery Charge": "", "": ""} {
+		got, ok := phaseOf(subgroup)
+		if got != want || ok != (want != "") {
+			t.Errorf("phaseOf(%q) = %q, %t", subgroup, got, ok)
+		}
+	}
+}
+
+func TestWriteURL(t *testing.T) {
+	tests := []struct {
+		config InfluxConfig
+		want   string
+	}{
+		{InfluxConfig{Url: "http://influx:8086/", Version: V2, Org: "home", Bucket: "solar"}, "http://influx:8086/api/v2/write?bucket=solar&org=home&precision=ns"},
+		{InfluxConfig{Url: "http://influx:8086", Version: V1, Database: "solar", RetentionPolicy: "week"}, "http://influx:8086/write?db=solar&precision=ns&rp=week"},
+	}
+	for _, tt := range tests {
+		got, err := buildWriteURL(tt.config)
+		if err != nil || got != tt.want {
+			t.Errorf("buildWriteURL = %q, %v, want %q", got, err, tt.want)
+		}
+	}
+
+	for _, cfg := range []InfluxConfig{
+		{Url: "influx:8086", Version: V2, Org: "home", Bucket: "solar"},
+		{Url: "http://influx:8086", Version: V2, Org: "home"},
+		{Url: "http://influx:8086", Version: V1},
+		{Url: "http://influx:8086", Version: "v3"},
+	} {
+		if _, err := buildWriteURL(cfg); err == nil {
+			t.Errorf("no error for %+v", cfg)
+		}
+	}
+}
+
+// stand-in is a local InfluxDB write endpoint answering with the queued status codes, then 204
+type standIn struct {
+	mu       sync.Mutex
+	statuses []int
+	bodies   []string
+	headers  []http.Header
+	server   *httptest.Server
+}
+
+func newStandIn(t *testing.T, statuses ...int) *standIn {
+	s := &standIn{statuses: statuses}
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		s.mu.Lock()
+		s.bodies = append(s.bodies, string(body))
+		s.headers = append(s.headers, r.Header.Clone())
+		status := http.StatusNoContent
+		if len(s.statuses) > 0 {
+			status, s.statuses = s.statuses[0], s.statuses[1:]
+		}
+		s.mu.Unlock()
+
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+func (s *standIn) requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.bodies...)
+}
+
+func record(conn *Connection, t *testing.T, i int) {
+	t.Helper()
+	err := conn.Export(ports.NewSnapshot("", "GridOutput/Grid A", map[string]interface{}{"Inv A Power": i}, ports.RecordInfo{PollTime: time.Unix(int64(i), 0)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBatching(t *testing.T) {
+	s := newStandIn(t)
+	conn, err := New(&InfluxConfig{Url: s.server.URL, Org: "home", Bucket: "solar", Token: "secret", BatchSize: 2, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 5; i++ {
+		record(conn, t, i)
+	}
+	if err := conn.Close(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := s.requests()
+	lines := 0
+	for _, body := range requests {
+		n := strings.Count(body, "\n")
+		if n > 2 {
+			t.Errorf("batch of %d lines, want at most 2", n)
+		}
+		lines += n
+	}
+	if lines != 5 {
+		t.Errorf("%d lines written, want 5", lines)
+	}
+	if !strings.HasPrefix(requests[0], "GridOutput,phase=A Inv\\ A\\ Power=1 1000000000\n") {
+		t.Errorf("first batch %q", requests[0])
+	}
+	if got := s.headers[0].Get("Authorization"); got != "Token secret" {
+		t.Errorf("Authorization = %q", got)
+	}
+
+	if err := conn.Export(ports.NewSnapshot("", "station", map[string]interface{}{"a": 1}, ports.RecordInfo{})); err == nil {
+		t.Error("export after Close accepted")
+	}
+}
+
+func TestFlushInterval(t *testing.T) {
+	s := newStandIn(t)
+	conn, err := New(&InfluxConfig{Url: s.server.URL, Version: V1, Database: "solar", User: "reader", Password: "pw", FlushInterval: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(time.Second)
+
+	record(conn, t, 1)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(s.requests()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if len(s.requests()) != 1 {
+		t.Fatal("buffered line not written after the flush interval")
+	}
+
+	s.mu.Lock()
+	user, pw, ok := (&http.Request{Header: s.headers[0]}).BasicAuth()
+	s.mu.Unlock()
+	if !ok || user != "reader" || pw != "pw" {
+		t.Errorf("basic auth %q %q %t", user, pw, ok)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name       string
+		statuses   []int
+		maxRetries int
+		requests   int
+	}{
+		{"server error retried", []int{http.StatusServiceUnavailable, http.StatusInternalServerError}, 3, 3},
+		{"rate limit retried", []int{http.StatusTooManyRequests}, 3, 2},
+		{"bad request dropped", []int{http.StatusBadRequest}, 3, 1},
+		{"retries exhausted", []int{500, 500, 500, 500, 500}, 2, 3},
+		{"retries disabled", []int{http.StatusServiceUnavailable}, 0, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStandIn(t, tt.statuses...)
+			conn, err := New(&InfluxConfig{Url: s.server.URL, Org: "home", Bucket: "solar", BatchSize: 1, FlushInterval: time.Hour, MaxRetries: tt.maxRetries})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			record(conn, t, 1)
+
+			deadline := time.Now().Add(2 * time.Second)
+			for len(s.requests()) < tt.requests && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+			// let a wrong extra attempt show up
+			time.Sleep(50 * time.Millisecond)
+			conn.Close(time.Second)
+
+			requests := s.requests()
+			if len(requests) != tt.requests {
+				t.Errorf("%d requests, want %d", len(requests), tt.requests)
+			}
+			for _, body := range requests {
+				if body != requests[0] {
+					t.Errorf("retry sent %q, want %q", body, requests[0])
+				}
+			}
+		})
+	}
+}
+
+func TestNegativeMaxRetries(t *testing.T) {
+	conn, err := New(&InfluxConfig{Url: "http://influx:8086", Org: "home", Bucket: "solar", MaxRetries: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(time.Second)
+
+	if conn.config.MaxRetries != defaultMaxRetries {
+		t.Errorf("MaxRetries = %d, want the default %d", conn.config.MaxRetries, defaultMaxRetries)
+	}
+}
@@ -0,0 +1,94 @@
+package influxdb
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/misterdelle/invt_logger_reader/ports"
+)
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	keyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	stringEscaper      = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// point is a line of the line protocol: measurement,tag=value field=value timestamp
+type point struct {
+	measurement string
+	tags        map[string]string
+	fields      map[string]ports.Value
+	// units of the fields, the fields with a unit are only written as numbers
+	units map[string]string
+	time  time.Time
+}
+
+// line encodes the point, numbers are written as floats and anything else as strings.
+// It returns "" when the point has no fields
+func (p point) line() string {
+	values := make(map[string]string, len(p.fields))
+	fieldKeys := make([]string, 0, len(p.fields))
+	for k, v := range p.fields {
+		if fv, ok := fieldValue(v, p.units[k]); ok {
+			values[k] = fv
+			fieldKeys = append(fieldKeys, k)
+		}
+	}
+	if len(fieldKeys) == 0 {
+		return ""
+	}
+	sort.Strings(fieldKeys)
+
+	var b strings.Builder
+	b.WriteString(measurementEscaper.Replace(p.measurement))
+
+	// tags sorted by key, as recommended for write performance
+	tagKeys := make([]string, 0, len(p.tags))
+	for k, v := range p.tags {
+		if v != "" {
+			tagKeys = append(tagKeys, k)
+		}
+	}
+	sort.Strings(tagKeys)
+	for _, k := range tagKeys {
+		b.WriteByte(',')
+		b.WriteString(keyEscaper.Replace(k))
+		b.WriteByte('=')
+		b.WriteString(keyEscaper.Replace(p.tags[k]))
+	}
+
+	for i, k := range fieldKeys {
+		if i == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(keyEscaper.Replace(k))
+		b.WriteByte('=')
+		b.WriteString(values[k])
+	}
+
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatInt(p.time.UnixNano(), 10))
+
+	return b.String()
+}
+
+// fieldValue encodes a field value, it returns false for values that cannot be written: missing values,
+// NaN and infinities and the texts of fields with a unit. Every number is written as a float and a field
+// with a unit is always a number: InfluxDB rejects the whole batch when the type of a field changes
+func fieldValue(v ports.Value, unit string) (string, bool) {
+	if f, ok := v.Number(); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64), true
+	}
+	if v.Kind() == ports.NoValue || unit != "" {
+		return "", false
+	}
+	// NaN and infinities
+	if _, err := strconv.ParseFloat(v.Text(), 64); err == nil {
+		return "", false
+	}
+	return `"` + stringEscaper.Replace(v.Text()) + `"`, true
+}
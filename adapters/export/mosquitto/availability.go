@@ -0,0 +1,69 @@
+package mosquitto
+
+import (
+	"fmt"
+	"log"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	payloadOnline  = "online"
+	payloadOffline = "offline"
+)
+
+// availabilityTopic tells whether the reader process is connected to the broker,
+// it is set "online" on connect and "offline" by the Last Will
+func (conn *Connection) availabilityTopic() string {
+	return fmt.Sprintf("%s/status", conn.prefix)
+}
+
+// loggerAvailabilityTopic tells whether the logger is answering to the reader
+func (conn *Connection) loggerAvailabilityTopic() string {
+	return fmt.Sprintf("%s/logger/status", conn.prefix)
+}
+
+func (conn *Connection) onConnect(client mqtt.Client) {
+	log.Printf("MQTT Connected")
+
+	conn.publishStatus(conn.availabilityTopic(), payloadOnline)
+
+	// restore the logger status, the broker may have lost it while we were away
+	conn.mu.Lock()
+	loggerStatus := conn.loggerStatus
+	conn.mu.Unlock()
+
+	if loggerStatus != "" {
+		conn.publishStatus(conn.loggerAvailabilityTopic(), loggerStatus)
+	}
+
+	conn.publishDiscovery()
+	conn.resubscribe()
+	conn.startReplay()
+}
+
+// SetLoggerAvailable publishes the logger reachability, the retained message is only updated when it changes
+func (conn *Connection) SetLoggerAvailable(available bool) {
+	status := payloadOffline
+	if available {
+		status = payloadOnline
+	}
+
+	conn.mu.Lock()
+	changed := conn.loggerStatus != status
+	conn.loggerStatus = status
+	conn.mu.Unlock()
+
+	if changed {
+		log.Printf("logger is %s", status)
+		conn.publishStatus(conn.loggerAvailabilityTopic(), status)
+	}
+}
+
+func (conn *Connection) publishStatus(topic string, status string) {
+	token := conn.client.Publish(topic, 1, true, status)
+	res := token.WaitTimeout(publishTimeout)
+	if !res || token.Error() != nil {
+		log.Printf("error publishing %s to %s: %s", status, topic, token.Error())
+	}
+}
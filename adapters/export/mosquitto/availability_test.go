@@ -0,0 +1,164 @@
+package mosquitto
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// message is a message published through fakeClient
+type message struct {
+	topic    string
+	qos      byte
+	retained bool
+	payload  string
+}
+
+// fakeClient records the published messages, every publish succeeds while connected
+type fakeClient struct {
+	mqtt.Client
+
+	mu         sync.Mutex
+	published  []message
+	subscribed []string
+	offline    bool
+}
+
+func (c *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.offline {
+		return doneToken{err: fmt.Errorf("not connected")}
+	}
+	c.published = append(c.published, message{topic: topic, qos: qos, retained: retained, payload: fmt.Sprintf("%s", payload)})
+	return doneToken{}
+}
+
+func (c *fakeClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.subscribed = append(c.subscribed, topic)
+	return doneToken{}
+}
+
+func (c *fakeClient) IsConnectionOpen() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.offline
+}
+
+func (c *fakeClient) setOffline(offline bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.offline = offline
+}
+
+// messages returns the published messages and forgets them
+func (c *fakeClient) messages() []message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	result := c.published
+	c.published = nil
+	return result
+}
+
+// doneToken is a completed token
+type doneToken struct {
+	err error
+}
+
+func (t doneToken) Wait() bool                     { return true }
+func (t doneToken) WaitTimeout(time.Duration) bool { return true }
+func (t doneToken) Error() error                   { return t.err }
+
+func (t doneToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+// newTestConnection returns a connection publishing through a fakeClient
+func newTestConnection(t *testing.T, config MqttConfig) (*Connection, *fakeClient) {
+	t.Helper()
+
+	namer, err := newTopicNamer(config.TopicNaming, config.TopicTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &fakeClient{}
+	conn := &Connection{
+		client:          client,
+		prefix:          config.Prefix,
+		discoveryPrefix: config.DiscoveryPrefix,
+		topicNamer:      namer,
+		defaults:        PublishOptions{QoS: config.QoS, Retain: config.Retain, Payload: config.Payload},
+		groups:          config.Groups,
+		resumeSubs:      config.ResumeSubs,
+		subscriptions:   make(map[string]subscription),
+	}
+	return conn, client
+}
+
+func TestAvailabilityTopics(t *testing.T) {
+	conn, _ := newTestConnection(t, MqttConfig{Prefix: "invt"})
+
+	if got := conn.availabilityTopic(); got != "invt/status" {
+		t.Errorf("availability topic %s", got)
+	}
+	if got := conn.loggerAvailabilityTopic(); got != "invt/logger/status" {
+		t.Errorf("logger availability topic %s", got)
+	}
+}
+
+func TestSetLoggerAvailable(t *testing.T) {
+	conn, client := newTestConnection(t, MqttConfig{Prefix: "invt"})
+
+	tests := []struct {
+		available bool
+		want      []message
+	}{
+		{true, []message{{"invt/logger/status", 1, true, payloadOnline}}},
+		// unchanged, the retained message is left alone
+		{true, nil},
+		{false, []message{{"invt/logger/status", 1, true, payloadOffline}}},
+		{false, nil},
+		{true, []message{{"invt/logger/status", 1, true, payloadOnline}}},
+	}
+	for i, tt := range tests {
+		conn.SetLoggerAvailable(tt.available)
+		if got := client.messages(); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("step %d: published %v, want %v", i, got, tt.want)
+		}
+	}
+}
+
+func TestOnConnect(t *testing.T) {
+	conn, client := newTestConnection(t, MqttConfig{Prefix: "invt", ResumeSubs: true})
+
+	// before the logger status is known only the reader one is published
+	conn.onConnect(client)
+	if got := client.messages(); fmt.Sprint(got) != fmt.Sprint([]message{{"invt/status", 1, true, payloadOnline}}) {
+		t.Errorf("first connect published %v", got)
+	}
+
+	conn.SetLoggerAvailable(false)
+	client.messages()
+	conn.Subscribe("invt/set/+", nil)
+
+	// a reconnect restores the logger status and the subscriptions
+	conn.onConnect(client)
+	want := []message{{"invt/status", 1, true, payloadOnline}, {"invt/logger/status", 1, true, payloadOffline}}
+	if got := client.messages(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("reconnect published %v, want %v", got, want)
+	}
+	if got := client.subscribed; len(got) != 2 || got[1] != "invt/set/+" {
+		t.Errorf("subscriptions %v", got)
+	}
+}
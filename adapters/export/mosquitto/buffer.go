@@ -0,0 +1,101 @@
+package mosquitto
+
+import (
+	"log"
+	"time"
+
+	"github.com/misterdelle/invt_logger_reader/adapters/export/spool"
+)
+
+// send publishes a record message; when a spool is configured, messages that cannot be
+// delivered are queued on disk and replayed in order after a reconnect. A replayed message is
+// followed by its time t on timeTopic, if any, the plain values do not tell when they were read
+func (conn *Connection) send(topic string, opts PublishOptions, payload []byte, t time.Time, timeTopic string) {
+	if conn.spool == nil {
+		conn.publishNow(topic, opts.QoS, opts.Retain, payload)
+		return
+	}
+
+	// while older messages are queued new ones go after them, otherwise a late replay
+	// would overwrite retained values with stale ones
+	if conn.client.IsConnectionOpen() && conn.spool.Len() == 0 {
+		if conn.publishNow(topic, opts.QoS, opts.Retain, payload) {
+			return
+		}
+	}
+
+	err := conn.spool.Push(spool.Message{Time: t, Topic: topic, QoS: opts.QoS, Retain: opts.Retain, Payload: payload, TimeTopic: timeTopic})
+	if err != nil {
+		log.Printf("error queueing MQTT message for %s: %s", topic, err)
+	}
+
+	if conn.client.IsConnectionOpen() {
+		conn.startReplay()
+	}
+}
+
+func (conn *Connection) publishNow(topic string, qos byte, retain bool, payload []byte) bool {
+	token := conn.client.Publish(topic, qos, retain, payload)
+	res := token.WaitTimeout(publishTimeout)
+	if !res || token.Error() != nil {
+		log.Printf("error inserting to MQTT: %s", token.Error())
+		return false
+	}
+	return true
+}
+
+// startReplay sends the queued messages, unless a replay is already running
+func (conn *Connection) startReplay() {
+	if conn.spool == nil {
+		return
+	}
+
+	conn.mu.Lock()
+	if conn.replaying {
+		conn.mu.Unlock()
+		return
+	}
+	conn.replaying = true
+	conn.mu.Unlock()
+
+	go conn.replay()
+}
+
+func (conn *Connection) replay() {
+	sent := 0
+	for {
+		m, ok := conn.spool.Peek()
+		if !ok {
+			// send does not start a replay while this one runs, a message queued since Peek must be sent too
+			conn.mu.Lock()
+			if conn.spool.Len() > 0 {
+				conn.mu.Unlock()
+				continue
+			}
+			conn.replaying = false
+			conn.mu.Unlock()
+			break
+		}
+
+		if !conn.client.IsConnectionOpen() || !conn.publishNow(m.Topic, m.QoS, m.Retain, m.Payload) {
+			conn.mu.Lock()
+			conn.replaying = false
+			conn.mu.Unlock()
+
+			log.Printf("replay of queued MQTT messages interrupted, %d sent, %d left", sent, conn.spool.Len())
+			return
+		}
+		if m.TimeTopic != "" {
+			conn.publishNow(m.TimeTopic, m.QoS, false, []byte(m.Time.Format(time.RFC3339)))
+		}
+
+		if err := conn.spool.Pop(); err != nil {
+			log.Printf("error updating MQTT spool: %s", err)
+		}
+		sent++
+	}
+
+	if sent > 0 {
+		log.Printf("replayed %d queued MQTT messages", sent)
+	}
+}
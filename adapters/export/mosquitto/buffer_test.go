@@ -0,0 +1,100 @@
+package mosquitto
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/misterdelle/invt_logger_reader/adapters/export/spool"
+)
+
+// waitReplay waits for the running replay to end
+func waitReplay(t *testing.T, conn *Connection) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		conn.mu.Lock()
+		replaying := conn.replaying
+		conn.mu.Unlock()
+		if !replaying {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("replay still running")
+}
+
+func TestReplay(t *testing.T) {
+	conn, client := newTestConnection(t, MqttConfig{Prefix: "invt", Retain: true})
+	q, err := spool.New(spool.Config{Path: filepath.Join(t.TempDir(), "spool.jsonl")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	conn.spool = q
+
+	first := time.Date(2024, 5, 1, 10, 15, 0, 0, time.UTC)
+	second := first.Add(time.Minute)
+	opts := conn.publishOptions("station")
+
+	client.setOffline(true)
+	conn.send("invt/station/pvDayEnergy", opts, []byte("12.5"), first, "invt/station/pvDayEnergy/time")
+	conn.send("invt/station", opts, []byte(`{"values":{}}`), first, "")
+	conn.send("invt/station/pvDayEnergy", opts, []byte("12.7"), second, "invt/station/pvDayEnergy/time")
+	if q.Len() != 3 || len(client.messages()) != 0 {
+		t.Fatalf("%d messages queued while offline", q.Len())
+	}
+
+	client.setOffline(false)
+	conn.startReplay()
+	waitReplay(t, conn)
+
+	want := []message{
+		{"invt/station/pvDayEnergy", 0, true, "12.5"},
+		{"invt/station/pvDayEnergy/time", 0, false, "2024-05-01T10:15:00Z"},
+		{"invt/station", 0, true, `{"values":{}}`},
+		{"invt/station/pvDayEnergy", 0, true, "12.7"},
+		{"invt/station/pvDayEnergy/time", 0, false, "2024-05-01T10:16:00Z"},
+	}
+	if got := client.messages(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("replayed\n%v\nwant\n%v", got, want)
+	}
+	if q.Len() != 0 {
+		t.Errorf("%d messages left", q.Len())
+	}
+
+	// the replay is over, the next message is published at once
+	conn.send("invt/station/pvDayEnergy", opts, []byte("13"), second, "invt/station/pvDayEnergy/time")
+	if got := client.messages(); len(got) != 1 || got[0].payload != "13" {
+		t.Errorf("published %v", got)
+	}
+}
+
+func TestReplayInterrupted(t *testing.T) {
+	conn, client := newTestConnection(t, MqttConfig{Prefix: "invt"})
+	q, err := spool.New(spool.Config{Path: filepath.Join(t.TempDir(), "spool.jsonl")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	conn.spool = q
+
+	client.setOffline(true)
+	conn.send("invt/station/pvDayEnergy", PublishOptions{}, []byte("12.5"), time.Now(), "")
+
+	// the broker is gone again, the message stays queued and a later replay sends it
+	conn.startReplay()
+	waitReplay(t, conn)
+	if q.Len() != 1 {
+		t.Fatalf("%d messages queued, want 1", q.Len())
+	}
+
+	client.setOffline(false)
+	conn.startReplay()
+	waitReplay(t, conn)
+	if got := client.messages(); len(got) != 1 || q.Len() != 0 {
+		t.Errorf("replayed %v, %d left", got, q.Len())
+	}
+}
@@ -0,0 +1,207 @@
+package mosquitto
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"unicode"
+)
+
+// DiscoveryDevice identifies the inverter all the discovered sensors belong to
+type DiscoveryDevice struct {
+	Serial       string
+	Name         string
+	Manufacturer string
+	Model        string
+}
+
+// DiscoverySensor is a measurement announced to Home Assistant, Topic and Field are
+// the same values given to InsertGenericRecord
+type DiscoverySensor struct {
+	Topic string
+	Field string
+	Unit  string
+}
+
+type discovery struct {
+	device  DiscoveryDevice
+	sensors []DiscoverySensor
+}
+
+type discoveryAvailability struct {
+	Topic string `json:"topic"`
+}
+
+type discoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model,omitempty"`
+	SerialNumber string   `json:"serial_number,omitempty"`
+}
+
+type discoveryConfig struct {
+	Name              string                  `json:"name"`
+	UniqueID          string                  `json:"unique_id"`
+	ObjectID          string                  `json:"object_id"`
+	StateTopic        string                  `json:"state_topic"`
+	ValueTemplate     string                  `json:"value_template,omitempty"`
+	UnitOfMeasurement string                  `json:"unit_of_measurement,omitempty"`
+	DeviceClass       string                  `json:"device_class,omitempty"`
+	StateClass        string                  `json:"state_class,omitempty"`
+	Availability      []discoveryAvailability `json:"availability"`
+	AvailabilityMode  string                  `json:"availability_mode"`
+	Device            discoveryDevice         `json:"device"`
+}
+
+// PublishDiscovery publishes a retained Home Assistant discovery config for every sensor,
+// the configs are published again on every reconnect. It does nothing when no discovery prefix is configured
+func (conn *Connection) PublishDiscovery(device DiscoveryDevice, sensors []DiscoverySensor) {
+	if conn.discoveryPrefix == "" {
+		return
+	}
+
+	conn.mu.Lock()
+	conn.discovery = &discovery{device: device, sensors: sensors}
+	conn.mu.Unlock()
+
+	conn.publishDiscovery()
+}
+
+func (conn *Connection) publishDiscovery() {
+	conn.mu.Lock()
+	d := conn.discovery
+	conn.mu.Unlock()
+
+	if d == nil {
+		return
+	}
+
+	// the same field name may be published in several topics, e.g. "Inv A Voltage"
+	occurrences := make(map[string]int)
+	for _, s := range d.sensors {
+		occurrences[s.Field]++
+	}
+
+	nodeID := slug("invt_" + d.device.Serial)
+
+	for _, s := range d.sensors {
+		objectID := slug(nodeID + "_" + s.Topic + "_" + s.Field)
+
+		stateTopic, valueTemplate, err := conn.stateTopic(s)
+		if err != nil {
+			log.Printf("error building state topic for %s: %s", objectID, err)
+			continue
+		}
+
+		name := s.Field
+		if occurrences[s.Field] > 1 {
+			name = strings.ReplaceAll(s.Topic, "/", " ") + " " + s.Field
+		}
+
+		cfg := discoveryConfig{
+			Name:              name,
+			UniqueID:          objectID,
+			ObjectID:          objectID,
+			StateTopic:        stateTopic,
+			ValueTemplate:     valueTemplate,
+			UnitOfMeasurement: s.Unit,
+			DeviceClass:       deviceClass(s.Unit, s.Field),
+			StateClass:        stateClass(s.Unit),
+			Availability: []discoveryAvailability{
+				{Topic: conn.availabilityTopic()},
+				{Topic: conn.loggerAvailabilityTopic()},
+			},
+			AvailabilityMode: "all",
+			Device: discoveryDevice{
+				Identifiers:  []string{nodeID},
+				Name:         d.device.Name,
+				Manufacturer: d.device.Manufacturer,
+				Model:        d.device.Model,
+				SerialNumber: d.device.Serial,
+			},
+		}
+
+		payload, err := json.Marshal(cfg)
+		if err != nil {
+			log.Printf("error encoding discovery config for %s: %s", objectID, err)
+			continue
+		}
+
+		topic := fmt.Sprintf("%s/sensor/%s/%s/config", conn.discoveryPrefix, nodeID, objectID)
+		token := conn.client.Publish(topic, 1, true, payload)
+		res := token.WaitTimeout(publishTimeout)
+		if !res || token.Error() != nil {
+			log.Printf("error publishing discovery config to %s: %s", topic, token.Error())
+		}
+	}
+
+	log.Printf("published %d Home Assistant discovery configs", len(d.sensors))
+}
+
+// stateTopic returns where the sensor value is published and, in json payload mode,
+// the template extracting it from the record
+func (conn *Connection) stateTopic(s DiscoverySensor) (string, string, error) {
+	if conn.publishOptions(s.Topic).Payload == PayloadJSON {
+		topic, err := conn.groupTopic(s.Topic)
+		return topic, fmt.Sprintf("{{ value_json['values'][%q] }}", s.Field), err
+	}
+
+	topic, err := conn.fieldTopic(s.Topic, s.Field)
+	return topic, "", err
+}
+
+// deviceClass maps a unit of measure to the Home Assistant sensor device class
+func deviceClass(unit string, field string) string {
+	switch unit {
+	case "V", "mV":
+		return "voltage"
+	case "A", "mA":
+		return "current"
+	case "W", "kW":
+		return "power"
+	case "Wh", "kWh":
+		return "energy"
+	case "Hz":
+		return "frequency"
+	case "°C":
+		return "temperature"
+	case "%":
+		if strings.Contains(strings.ToUpper(field), "SOC") {
+			return "battery"
+		}
+	}
+	return ""
+}
+
+// stateClass tells Home Assistant how to build long term statistics, energy counters
+// only grow (daily, monthly and yearly counters reset, which total_increasing handles)
+func stateClass(unit string) string {
+	switch unit {
+	case "":
+		return ""
+	case "Wh", "kWh":
+		return "total_increasing"
+	default:
+		return "measurement"
+	}
+}
+
+// slug lowercases s and replaces every run of characters other than letters and digits with "_"
+func slug(s string) string {
+	var b strings.Builder
+	sep := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if sep && b.Len() > 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+			sep = false
+		} else {
+			sep = true
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,125 @@
+package mosquitto
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSlug(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"invt_2333571751", "invt_2333571751"},
+		{"EnergyTodayTotals/Battery Charge", "energytodaytotals_battery_charge"},
+		{"Inv A Voltage", "inv_a_voltage"},
+		{"  BAT -- SOC (%) ", "bat_soc"},
+		{"Temperature °C", "temperature_c"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := slug(tt.in); got != tt.want {
+			t.Errorf("slug(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDeviceClass(t *testing.T) {
+	tests := []struct {
+		unit        string
+		field       string
+		deviceClass string
+		stateClass  string
+	}{
+		{"V", "Inv A Voltage", "voltage", "measurement"},
+		{"mV", "Cell Voltage", "voltage", "measurement"},
+		{"A", "Inv A Current", "current", "measurement"},
+		{"kW", "PV Power", "power", "measurement"},
+		{"kWh", "PV Day Energy", "energy", "total_increasing"},
+		{"Wh", "Load Total Energy", "energy", "total_increasing"},
+		{"Hz", "Grid Frequency", "frequency", "measurement"},
+		{"°C", "Inverter Temperature", "temperature", "measurement"},
+		{"%", "Battery SOC", "battery", "measurement"},
+		{"%", "batterySoc", "battery", "measurement"},
+		{"%", "Battery SOH", "", "measurement"},
+		{"", "Work Mode", "", ""},
+	}
+	for _, tt := range tests {
+		if got := deviceClass(tt.unit, tt.field); got != tt.deviceClass {
+			t.Errorf("deviceClass(%q, %q) = %q, want %q", tt.unit, tt.field, got, tt.deviceClass)
+		}
+		if got := stateClass(tt.unit); got != tt.stateClass {
+			t.Errorf("stateClass(%q) = %q, want %q", tt.unit, got, tt.stateClass)
+		}
+	}
+}
+
+func TestPublishDiscovery(t *testing.T) {
+	conn, client := newTestConnection(t, MqttConfig{
+		Prefix:          "invt",
+		DiscoveryPrefix: "homeassistant",
+		TopicNaming:     NamingSnakeCase,
+		Groups:          map[string]PublishOptions{"station": {Payload: PayloadJSON}},
+	})
+
+	conn.PublishDiscovery(DiscoveryDevice{Serial: "2333571751", Name: "Inverter", Manufacturer: "INVT"}, []DiscoverySensor{
+		{Topic: "GridOutput/Grid A", Field: "Inv Voltage", Unit: "V"},
+		{Topic: "GridOutput/Grid B", Field: "Inv Voltage", Unit: "V"},
+		{Topic: "station", Field: "pvDayEnergy", Unit: "kWh"},
+	})
+
+	got := client.messages()
+	if len(got) != 3 {
+		t.Fatalf("%d configs published, want 3", len(got))
+	}
+
+	tests := []struct {
+		topic         string
+		name          string
+		stateTopic    string
+		valueTemplate string
+		deviceClass   string
+	}{
+		// the field is published in several topics, the name tells them apart
+		{"homeassistant/sensor/invt_2333571751/invt_2333571751_gridoutput_grid_a_inv_voltage/config", "GridOutput Grid A Inv Voltage", "invt/grid_output/grid_a/inv_voltage", "", "voltage"},
+		{"homeassistant/sensor/invt_2333571751/invt_2333571751_gridoutput_grid_b_inv_voltage/config", "GridOutput Grid B Inv Voltage", "invt/grid_output/grid_b/inv_voltage", "", "voltage"},
+		// json payload, the value is extracted from the record
+		{"homeassistant/sensor/invt_2333571751/invt_2333571751_station_pvdayenergy/config", "pvDayEnergy", "invt/station", `{{ value_json['values']["pvDayEnergy"] }}`, "energy"},
+	}
+	for i, tt := range tests {
+		m := got[i]
+		if m.topic != tt.topic || !m.retained || m.qos != 1 {
+			t.Errorf("config published to %s (qos %d, retained %t), want %s", m.topic, m.qos, m.retained, tt.topic)
+		}
+
+		var cfg discoveryConfig
+		if err := json.Unmarshal([]byte(m.payload), &cfg); err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Name != tt.name || cfg.StateTopic != tt.stateTopic || cfg.ValueTemplate != tt.valueTemplate || cfg.DeviceClass != tt.deviceClass {
+			t.Errorf("config %+v", cfg)
+		}
+		if len(cfg.Availability) != 2 || cfg.Availability[0].Topic != "invt/status" || cfg.Availability[1].Topic != "invt/logger/status" || cfg.AvailabilityMode != "all" {
+			t.Errorf("availability %+v %s", cfg.Availability, cfg.AvailabilityMode)
+		}
+		if cfg.Device.Identifiers[0] != "invt_2333571751" || cfg.Device.SerialNumber != "2333571751" || cfg.Device.Manufacturer != "INVT" {
+			t.Errorf("device %+v", cfg.Device)
+		}
+	}
+
+	// published again on reconnect
+	conn.publishDiscovery()
+	if got := client.messages(); len(got) != 3 {
+		t.Errorf("%d configs published again, want 3", len(got))
+	}
+}
+
+func TestPublishDiscoveryDisabled(t *testing.T) {
+	conn, client := newTestConnection(t, MqttConfig{Prefix: "invt"})
+
+	conn.PublishDiscovery(DiscoveryDevice{Serial: "2333571751"}, []DiscoverySensor{{Topic: "station", Field: "pvDayEnergy", Unit: "kWh"}})
+	conn.publishDiscovery()
+	if got := client.messages(); len(got) != 0 {
+		t.Errorf("published %v without a discovery prefix", got)
+	}
+}
@@ -2,11 +2,15 @@ package mosquitto
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/misterdelle/invt_logger_reader/adapters/export/spool"
+	"github.com/misterdelle/invt_logger_reader/ports"
 )
 
 type MqttConfig struct {
@@ -14,28 +18,110 @@ type MqttConfig struct {
 	User     string `yaml:"user"`
 	Password string `yaml:"password"`
 	Prefix   string `yaml:"prefix"`
+	ClientID string `yaml:"clientId"`
+	// TopicNaming is legacy (default), snake_case, camelCase or template
+	TopicNaming   string `yaml:"topicNaming"`
+	TopicTemplate string `yaml:"topicTemplate"`
+	// KeepAlive in seconds, 30 when not defined
+	KeepAlive     int  `yaml:"keepAlive"`
+	AutoReconnect bool `yaml:"autoReconnect"`
+	// ResumeSubs subscribes again to all the topics after a reconnect
+	ResumeSubs   bool `yaml:"resumeSubs"`
+	CleanSession bool `yaml:"cleanSession"`
+	// QoS and Retain are used for every record topic, unless overridden by Groups
+	QoS    byte `yaml:"qos"`
+	Retain bool `yaml:"retain"`
+	// Payload is values (default) or json
+	Payload string                    `yaml:"payload"`
+	Groups  map[string]PublishOptions `yaml:"groups"`
+	// DiscoveryPrefix enables Home Assistant MQTT discovery, usually "homeassistant"
+	DiscoveryPrefix string `yaml:"discoveryPrefix"`
+
+	// TLS settings, used with mqtts:// and ssl:// URLs
+	CACert             string `yaml:"caCert"`
+	ClientCert         string `yaml:"clientCert"`
+	ClientKey          string `yaml:"clientKey"`
+	ServerName         string `yaml:"serverName"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+
+	// Spool queues the records on disk while the broker is unreachable
+	Spool spool.Config `yaml:"spool"`
 }
 
 type Connection struct {
-	client mqtt.Client
-	prefix string
-}
+	client          mqtt.Client
+	prefix          string
+	discoveryPrefix string
+	topicNamer      topicNamer
+	defaults        PublishOptions
+	groups          map[string]PublishOptions
+	resumeSubs      bool
 
-var connectHandler mqtt.OnConnectHandler = func(client mqtt.Client) {
-	log.Printf("MQTT Connected")
+	mu            sync.Mutex
+	closed        bool
+	pending       sync.WaitGroup
+	loggerStatus  string
+	discovery     *discovery
+	subscriptions map[string]subscription
+	spool         *spool.Queue
+	replaying     bool
 }
 
+var errClosed = errors.New("MQTT connection is closed")
+
 var connectLostHandler mqtt.ConnectionLostHandler = func(client mqtt.Client, err error) {
 	log.Printf("Connect lost: %v", err)
 }
 
 func New(config *MqttConfig) (*Connection, error) {
+	namer, err := newTopicNamer(config.TopicNaming, config.TopicTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validPayload(config.Payload); err != nil {
+		return nil, err
+	}
+	for _, opts := range config.Groups {
+		if err := validPayload(opts.Payload); err != nil {
+			return nil, err
+		}
+	}
+
+	// fail fast on templates producing invalid topics
+	if _, err := namer(config.Prefix, "EnergyTodayTotals/PV", "PV Day Energy"); err != nil {
+		return nil, err
+	}
+
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(config.Url)
-	opts.SetClientID("invt")
-	opts.OnConnect = connectHandler
+	opts.SetClientID(config.ClientID)
 	opts.OnConnectionLost = connectLostHandler
 
+	keepAlive := defaultKeepAlive
+	if config.KeepAlive > 0 {
+		keepAlive = time.Duration(config.KeepAlive) * time.Second
+	}
+	opts.SetKeepAlive(keepAlive)
+
+	// paho only resumes subscriptions of persistent sessions, Connection subscribes again by itself on every connect
+	opts.SetAutoReconnect(config.AutoReconnect)
+	opts.SetCleanSession(config.CleanSession)
+	opts.SetResumeSubs(config.ResumeSubs && !config.CleanSession)
+
+	conn := &Connection{}
+	conn.prefix = config.Prefix
+	conn.discoveryPrefix = config.DiscoveryPrefix
+	conn.topicNamer = namer
+	conn.defaults = PublishOptions{QoS: config.QoS, Retain: config.Retain, Payload: config.Payload}
+	conn.groups = config.Groups
+	conn.resumeSubs = config.ResumeSubs
+	conn.subscriptions = make(map[string]subscription)
+
+	// the broker flags the reader offline when the connection drops without a proper disconnect
+	opts.SetWill(conn.availabilityTopic(), payloadOffline, 1, true)
+	opts.OnConnect = conn.onConnect
+
 	if config.User != "" {
 		opts.SetUsername(config.User)
 	}
@@ -44,10 +130,38 @@ func New(config *MqttConfig) (*Connection, error) {
 		opts.SetPassword(config.Password)
 	}
 
-	conn := &Connection{}
+	if isTLSUrl(config.Url) {
+		tlsConfig, err := newTLSConfig(config)
+		if err != nil {
+			return nil, err
+		}
+
+		if tlsConfig.InsecureSkipVerify {
+			log.Printf("MQTT broker certificate verification disabled")
+		}
+
+		opts.SetTLSConfig(tlsConfig)
+	} else if hasTLSSettings(config) {
+		return nil, fmt.Errorf("TLS settings require a mqtts:// or ssl:// broker URL, got %s", config.Url)
+	}
+
+	if config.Spool.Path != "" {
+		conn.spool, err = spool.New(config.Spool)
+		if err != nil {
+			return nil, fmt.Errorf("MQTT spool: %w", err)
+		}
+
+		// with a spool the reader starts even when the broker is down, records are queued until it connects
+		opts.SetConnectRetry(true)
+	}
+
 	conn.client = mqtt.NewClient(opts)
-	conn.prefix = config.Prefix
-	if token := conn.client.Connect(); token.Wait() && token.Error() != nil {
+	token := conn.client.Connect()
+	if conn.spool != nil {
+		if !token.WaitTimeout(connectTimeout) {
+			log.Printf("MQTT broker not reachable, queueing records in %s", config.Spool.Path)
+		}
+	} else if token.Wait() && token.Error() != nil {
 		return nil, token.Error()
 	}
 
@@ -92,15 +206,28 @@ func (conn *Connection) InsertRecord(measurement map[string]interface{}) error {
 	m, _ := json.Marshal(measurementCopy)
 	measurementCopy2["inverter"] = string(m)
 
+	if !conn.begin() {
+		return errClosed
+	}
+
 	go func(measurement map[string]interface{}) {
+		defer conn.pending.Done()
+
 		// timestamp it
 		// measurement["LastTimestamp"] = time.Now().UnixNano() / int64(time.Millisecond)
 		// m, _ := json.Marshal(measurement)
 		// measurement["All"] = string(m)
 
 		for k, v := range measurement {
-			token := conn.client.Publish(fmt.Sprintf("%s/%s", conn.prefix, k), 0, true, fmt.Sprintf("%v", v))
-			res := token.WaitTimeout(1 * time.Second)
+			topic, err := conn.fieldTopic("", k)
+			if err != nil {
+				log.Printf("error inserting to MQTT: %s", err)
+				continue
+			}
+
+			opts := conn.publishOptions(k)
+			token := conn.client.Publish(topic, opts.QoS, opts.Retain, fmt.Sprintf("%v", v))
+			res := token.WaitTimeout(publishTimeout)
 			if !res || token.Error() != nil {
 				log.Printf("error inserting to MQTT: %s", token.Error())
 			}
@@ -112,21 +239,167 @@ func (conn *Connection) InsertRecord(measurement map[string]interface{}) error {
 }
 
 func (conn *Connection) Subscribe(topic string, callback mqtt.MessageHandler) {
-	conn.client.Subscribe(topic, 0, callback)
+	opts := conn.defaults
+
+	conn.mu.Lock()
+	conn.subscriptions[topic] = subscription{qos: opts.QoS, callback: callback}
+	conn.mu.Unlock()
+
+	conn.client.Subscribe(topic, opts.QoS, callback)
+}
+
+// Publish sends a raw message, e.g. a command result, with the default QoS
+func (conn *Connection) Publish(topic string, payload []byte, retained bool) error {
+	if !conn.begin() {
+		return errClosed
+	}
+	defer conn.pending.Done()
+
+	token := conn.client.Publish(topic, conn.defaults.QoS, retained, payload)
+	if !token.WaitTimeout(publishTimeout) {
+		return fmt.Errorf("timeout publishing to %s", topic)
+	}
+	return token.Error()
+}
+
+// resubscribe restores the subscriptions after a reconnect
+func (conn *Connection) resubscribe() {
+	if !conn.resumeSubs {
+		return
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	for topic, s := range conn.subscriptions {
+		conn.client.Subscribe(topic, s.qos, s.callback)
+	}
 }
 
 func (conn *Connection) InsertGenericRecord(topicName string, measurement map[string]interface{}) error {
-	go func(allData map[string]interface{}) {
-		for k, v := range allData {
-			token := conn.client.Publish(fmt.Sprintf("%s/%s/%s", conn.prefix, topicName, k), 0, true, fmt.Sprintf("%v", v))
-			res := token.WaitTimeout(1 * time.Second)
-			if !res || token.Error() != nil {
-				log.Printf("error inserting to MQTT: %s", token.Error())
-			}
-		}
+	return conn.InsertRecordWithInfo(topicName, measurement, ports.RecordInfo{PollTime: time.Now()})
+}
+
+// InsertRecordWithInfo publishes a record, either a topic per field or, in json payload mode,
+// a single message carrying units, timestamps and quality flags. The record is copied before
+// returning, the caller may reuse measurement
+func (conn *Connection) InsertRecordWithInfo(topicName string, measurement map[string]interface{}, info ports.RecordInfo) error {
+	return conn.Export(ports.NewSnapshot("", topicName, measurement, info))
+}
+
+// WholeRecord tells the export pipeline that the groups published in json payload mode need every field
+// in each message, the Home Assistant sensors read their value from it
+func (conn *Connection) WholeRecord(group string) bool {
+	return conn.publishOptions(group).Payload == PayloadJSON
+}
+
+// Export publishes a snapshot in the background, as InsertRecordWithInfo does
+func (conn *Connection) Export(snapshot ports.Snapshot) error {
+	if !conn.begin() {
+		return errClosed
+	}
+
+	opts := conn.publishOptions(snapshot.Group())
+
+	go func() {
+		defer conn.pending.Done()
 
-		clear(measurement)
-	}(measurement)
+		allData, info := snapshot.Record()
+		if opts.Payload == PayloadJSON {
+			conn.publishJSON(snapshot.Group(), allData, info, opts)
+		} else {
+			conn.publishValues(snapshot.Group(), allData, info, opts)
+		}
+	}()
 
 	return nil
 }
+
+func (conn *Connection) publishValues(topicName string, allData map[string]interface{}, info ports.RecordInfo, opts PublishOptions) {
+	for k, v := range allData {
+		topic, err := conn.fieldTopic(topicName, k)
+		if err != nil {
+			log.Printf("error inserting to MQTT: %s", err)
+			continue
+		}
+
+		conn.send(topic, opts, []byte(fmt.Sprintf("%v", v)), info.PollTime, topic+"/time")
+	}
+}
+
+func (conn *Connection) publishJSON(topicName string, allData map[string]interface{}, info ports.RecordInfo, opts PublishOptions) {
+	topic, err := conn.groupTopic(topicName)
+	if err != nil {
+		log.Printf("error inserting to MQTT: %s", err)
+		return
+	}
+
+	payload, err := newJSONRecord(topicName, allData, info)
+	if err != nil {
+		log.Printf("error encoding %s record: %s", topicName, err)
+		return
+	}
+
+	// the record carries its poll time
+	conn.send(topic, opts, payload, info.PollTime, "")
+}
+
+// fieldTopic is the topic a single field of a record is published to, named by the configured strategy
+func (conn *Connection) fieldTopic(topicName string, field string) (string, error) {
+	return conn.topicNamer(conn.prefix, topicName, field)
+}
+
+// begin registers a pending publish, it returns false once the connection has been closed
+func (conn *Connection) begin() bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	if conn.closed {
+		return false
+	}
+
+	conn.pending.Add(1)
+	return true
+}
+
+// Close refuses new records, waits up to timeout for the pending publishes and disconnects from the broker
+func (conn *Connection) Close(timeout time.Duration) error {
+	conn.mu.Lock()
+	if conn.closed {
+		conn.mu.Unlock()
+		return nil
+	}
+	conn.closed = true
+	conn.mu.Unlock()
+
+	flushed := make(chan struct{})
+	go func() {
+		conn.pending.Wait()
+		close(flushed)
+	}()
+
+	var err error
+	select {
+	case <-flushed:
+	case <-time.After(timeout):
+		err = fmt.Errorf("pending publishes not completed within %s", timeout)
+	}
+
+	// a clean disconnect does not trigger the Last Will, flag the reader offline by ourselves
+	conn.publishStatus(conn.availabilityTopic(), payloadOffline)
+	conn.publishStatus(conn.loggerAvailabilityTopic(), payloadOffline)
+
+	conn.client.Disconnect(250)
+	log.Printf("MQTT Disconnected")
+
+	if conn.spool != nil {
+		if n := conn.spool.Len(); n > 0 {
+			log.Printf("%d MQTT messages left in the spool, they will be sent on the next start", n)
+		}
+		if cerr := conn.spool.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
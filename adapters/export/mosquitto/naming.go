@@ -0,0 +1,136 @@
+package mosquitto
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"github.com/misterdelle/invt_logger_reader/adapters/export/naming"
+)
+
+// topic naming strategies, selected by MqttConfig.TopicNaming
+const (
+	NamingLegacy    = "legacy"
+	NamingSnakeCase = "snake_case"
+	NamingCamelCase = "camelCase"
+	NamingTemplate  = "template"
+)
+
+// topicNamer builds the topic of a single field from the record topic name (e.g. "EnergyTodayTotals/Battery Charge")
+// and the field name (e.g. "BAT Charge Day Energy")
+type topicNamer func(prefix string, topicName string, field string) (string, error)
+
+// TopicNameData is the data given to the custom topic template, e.g.
+// {{.Prefix}}/{{snake .Group}}/{{snake .Field}}
+type TopicNameData struct {
+	Prefix   string
+	Topic    string
+	Group    string
+	Subgroup string
+	Field    string
+}
+
+var topicTemplateFuncs = template.FuncMap{
+	"snake": snakeCase,
+	"camel": camelCase,
+	"lower": strings.ToLower,
+	"slug":  slug,
+}
+
+func newTopicNamer(naming string, topicTemplate string) (topicNamer, error) {
+	switch naming {
+	case "", NamingLegacy:
+		return legacyTopic, nil
+	case NamingSnakeCase:
+		return segmentsTopic(snakeCase), nil
+	case NamingCamelCase:
+		return segmentsTopic(camelCase), nil
+	case NamingTemplate:
+		if topicTemplate == "" {
+			return nil, fmt.Errorf("topic naming %s requires a topic template", NamingTemplate)
+		}
+
+		tmpl, err := template.New("topic").Funcs(topicTemplateFuncs).Parse(topicTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid topic template: %w", err)
+		}
+
+		return templateTopic(tmpl), nil
+	default:
+		return nil, fmt.Errorf("unknown topic naming %q, use %s, %s, %s or %s", naming, NamingLegacy, NamingSnakeCase, NamingCamelCase, NamingTemplate)
+	}
+}
+
+// legacyTopic keeps topic and field names as they are, spaces included
+func legacyTopic(prefix string, topicName string, field string) (string, error) {
+	return joinTopic(prefix, topicName, field), nil
+}
+
+// segmentsTopic converts every segment of the topic name and the field name with convert
+func segmentsTopic(convert func(string) string) topicNamer {
+	return func(prefix string, topicName string, field string) (string, error) {
+		segments := make([]string, 0)
+		if topicName != "" {
+			for _, s := range strings.Split(topicName, "/") {
+				segments = append(segments, convert(s))
+			}
+		}
+		segments = append(segments, convert(field))
+
+		return joinTopic(prefix, segments...), nil
+	}
+}
+
+func templateTopic(tmpl *template.Template) topicNamer {
+	return func(prefix string, topicName string, field string) (string, error) {
+		group, subgroup, _ := strings.Cut(topicName, "/")
+
+		var buf bytes.Buffer
+		err := tmpl.Execute(&buf, TopicNameData{
+			Prefix:   prefix,
+			Topic:    topicName,
+			Group:    group,
+			Subgroup: subgroup,
+			Field:    field,
+		})
+		if err != nil {
+			return "", err
+		}
+
+		topic := buf.String()
+		if strings.ContainsAny(topic, "+#") || strings.Contains(topic, "//") || topic == "" {
+			return "", fmt.Errorf("invalid topic %q generated for %s/%s", topic, topicName, field)
+		}
+
+		return topic, nil
+	}
+}
+
+func joinTopic(prefix string, segments ...string) string {
+	parts := make([]string, 0, len(segments)+1)
+	for _, s := range append([]string{prefix}, segments...) {
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+func snakeCase(name string) string {
+	return strings.Join(naming.Words(name), "_")
+}
+
+func camelCase(name string) string {
+	var b strings.Builder
+	for i, w := range naming.Words(name) {
+		if i > 0 {
+			r := []rune(w)
+			r[0] = unicode.ToUpper(r[0])
+			w = string(r)
+		}
+		b.WriteString(w)
+	}
+	return b.String()
+}
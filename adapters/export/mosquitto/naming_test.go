@@ -0,0 +1,88 @@
+package mosquitto
+
+import (
+	"testing"
+)
+
+func TestCase(t *testing.T) {
+	tests := []struct {
+		name  string
+		snake string
+		camel string
+	}{
+		{"BAT Charge Day Energy", "bat_charge_day_energy", "batChargeDayEnergy"},
+		{"batterySOC", "battery_soc", "batterySoc"},
+		{"SOCValue", "soc_value", "socValue"},
+		{"PV1 Power", "pv1_power", "pv1Power"},
+		{"Inv A Voltage", "inv_a_voltage", "invAVoltage"},
+		{"EnergyTodayTotals", "energy_today_totals", "energyTodayTotals"},
+		{"Grid-Export (total)", "grid_export_total", "gridExportTotal"},
+		{"pvDayEnergy", "pv_day_energy", "pvDayEnergy"},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		if got := snakeCase(tt.name); got != tt.snake {
+			t.Errorf("snakeCase(%q) = %q, want %q", tt.name, got, tt.snake)
+		}
+		if got := camelCase(tt.name); got != tt.camel {
+			t.Errorf("camelCase(%q) = %q, want %q", tt.name, got, tt.camel)
+		}
+	}
+}
+
+func TestTopicNamer(t *testing.T) {
+	tests := []struct {
+		naming   string
+		template string
+		prefix   string
+		topic    string
+		field    string
+		want     string
+	}{
+		{"", "", "invt", "EnergyTodayTotals/Battery Charge", "BAT Charge Day Energy", "invt/EnergyTodayTotals/Battery Charge/BAT Charge Day Energy"},
+		{NamingLegacy, "", "invt", "station", "pvDayEnergy", "invt/station/pvDayEnergy"},
+		{NamingLegacy, "", "", "", "inverter", "inverter"},
+		{NamingSnakeCase, "", "invt", "EnergyTodayTotals/Battery Charge", "BAT Charge Day Energy", "invt/energy_today_totals/battery_charge/bat_charge_day_energy"},
+		{NamingSnakeCase, "", "invt", "", "inverter", "invt/inverter"},
+		{NamingCamelCase, "", "invt", "GridOutput/Grid A", "Inv A Voltage", "invt/gridOutput/gridA/invAVoltage"},
+		{NamingTemplate, "{{.Prefix}}/{{snake .Group}}/{{snake .Field}}", "invt", "GridOutput/Grid A", "Inv A Voltage", "invt/grid_output/inv_a_voltage"},
+		{NamingTemplate, "{{.Prefix}}/{{slug .Topic}}/{{camel .Field}}", "invt", "GridOutput/Grid A", "Inv A Voltage", "invt/gridoutput_grid_a/invAVoltage"},
+		{NamingTemplate, "{{.Prefix}}/{{lower .Subgroup}}/{{.Field}}", "invt", "EnergyTodayTotals/PV", "PV Day Energy", "invt/pv/PV Day Energy"},
+	}
+	for _, tt := range tests {
+		namer, err := newTopicNamer(tt.naming, tt.template)
+		if err != nil {
+			t.Fatalf("%s %q: %s", tt.naming, tt.template, err)
+		}
+		got, err := namer(tt.prefix, tt.topic, tt.field)
+		if err != nil || got != tt.want {
+			t.Errorf("%s %q: %s/%s = %q, %v, want %q", tt.naming, tt.template, tt.topic, tt.field, got, err, tt.want)
+		}
+	}
+}
+
+func TestTopicNamerErrors(t *testing.T) {
+	for _, tt := range []struct {
+		naming   string
+		template string
+	}{
+		{"kebab-case", ""},
+		{NamingTemplate, ""},
+		{NamingTemplate, "{{.Prefix"},
+	} {
+		if _, err := newTopicNamer(tt.naming, tt.template); err == nil {
+			t.Errorf("%s %q accepted", tt.naming, tt.template)
+		}
+	}
+
+	// the template itself is valid, the topics it builds are not
+	for _, tmpl := range []string{"{{.Prefix}}/+/{{.Field}}", "{{.Prefix}}/#", "{{.Prefix}}//{{.Field}}", "{{.Missing}}", "{{if false}}x{{end}}"} {
+		namer, err := newTopicNamer(NamingTemplate, tmpl)
+		if err != nil {
+			t.Fatalf("%q: %s", tmpl, err)
+		}
+		if got, err := namer("invt", "station", "pvDayEnergy"); err == nil {
+			t.Errorf("%q built the topic %q", tmpl, got)
+		}
+	}
+}
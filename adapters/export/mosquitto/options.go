@@ -0,0 +1,44 @@
+package mosquitto
+
+import (
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// PublishOptions are the MQTT publishing semantics of a topic group
+type PublishOptions struct {
+	QoS    byte `yaml:"qos"`
+	Retain bool `yaml:"retain"`
+	// Payload is values (default) or json
+	Payload string `yaml:"payload"`
+}
+
+const (
+	defaultKeepAlive = 30 * time.Second
+	connectTimeout   = 10 * time.Second
+	publishTimeout   = 1 * time.Second
+)
+
+// publishOptions returns the options of a record topic: the settings of the exact topic name
+// win over the ones of its group (the first topic segment, e.g. "EnergyTodayTotals"),
+// which win over the global ones
+func (conn *Connection) publishOptions(topicName string) PublishOptions {
+	if opts, ok := conn.groups[topicName]; ok {
+		return opts
+	}
+
+	group, _, _ := strings.Cut(topicName, "/")
+	if opts, ok := conn.groups[group]; ok {
+		return opts
+	}
+
+	return conn.defaults
+}
+
+// subscription is replayed on every reconnect when resuming subscriptions is enabled
+type subscription struct {
+	qos      byte
+	callback mqtt.MessageHandler
+}
@@ -0,0 +1,64 @@
+package mosquitto
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/misterdelle/invt_logger_reader/ports"
+)
+
+func TestPublishOptions(t *testing.T) {
+	conn, _ := newTestConnection(t, MqttConfig{
+		Retain: true,
+		Groups: map[string]PublishOptions{
+			"EnergyTodayTotals":                {QoS: 1},
+			"EnergyTodayTotals/Battery Charge": {QoS: 2, Retain: true, Payload: PayloadJSON},
+		},
+	})
+
+	tests := []struct {
+		topic string
+		want  PublishOptions
+	}{
+		// the exact topic wins over its group
+		{"EnergyTodayTotals/Battery Charge", PublishOptions{QoS: 2, Retain: true, Payload: PayloadJSON}},
+		{"EnergyTodayTotals/PV", PublishOptions{QoS: 1}},
+		{"EnergyTodayTotals", PublishOptions{QoS: 1}},
+		{"GridOutput/Grid A", PublishOptions{Retain: true}},
+		{"station", PublishOptions{Retain: true}},
+	}
+	for _, tt := range tests {
+		if got := conn.publishOptions(tt.topic); got != tt.want {
+			t.Errorf("publishOptions(%q) = %+v, want %+v", tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestPublishWithOptions(t *testing.T) {
+	conn, client := newTestConnection(t, MqttConfig{
+		Prefix: "invt",
+		Retain: true,
+		Groups: map[string]PublishOptions{"EnergyTodayTotals": {QoS: 1}},
+	})
+
+	at := time.Now()
+	conn.Export(ports.NewSnapshot("", "EnergyTodayTotals/PV", map[string]interface{}{"PV Day Energy": "12.5"}, ports.RecordInfo{PollTime: at}))
+	conn.Export(ports.NewSnapshot("", "station", map[string]interface{}{"pvDayEnergy": "12.5"}, ports.RecordInfo{PollTime: at}))
+	conn.pending.Wait()
+
+	got := client.messages()
+	sort.Slice(got, func(i, j int) bool { return got[i].topic < got[j].topic })
+	want := []message{
+		{"invt/EnergyTodayTotals/PV/PV Day Energy", 1, false, "12.5"},
+		{"invt/station/pvDayEnergy", 0, true, "12.5"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("published %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("published %+v, want %+v", got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package mosquitto
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/misterdelle/invt_logger_reader/ports"
+)
+
+// payload modes, selected globally by MqttConfig.Payload and per topic group by PublishOptions.Payload
+const (
+	// PayloadValues publishes every field to its own topic as plain text
+	PayloadValues = "values"
+	// PayloadJSON publishes every record as a single JSON message on the record topic
+	PayloadJSON = "json"
+)
+
+// jsonRecord is the message published in json payload mode
+type jsonRecord struct {
+	Topic        string                 `json:"topic"`
+	PollTime     time.Time              `json:"pollTime"`
+	InverterTime *time.Time             `json:"inverterTime,omitempty"`
+	Values       map[string]interface{} `json:"values"`
+	Units        map[string]string      `json:"units,omitempty"`
+	Quality      map[string]string      `json:"quality,omitempty"`
+}
+
+func newJSONRecord(topicName string, measurement map[string]interface{}, info ports.RecordInfo) ([]byte, error) {
+	record := jsonRecord{
+		Topic:    topicName,
+		PollTime: info.PollTime,
+		Values:   make(map[string]interface{}, len(measurement)),
+		Units:    make(map[string]string),
+		Quality:  make(map[string]string),
+	}
+
+	if !info.SourceTime.IsZero() {
+		record.InverterTime = &info.SourceTime
+	}
+
+	for k, v := range measurement {
+		record.Values[k] = ports.NewValue(v).JSON()
+
+		if unit := info.Units[k]; unit != "" {
+			record.Units[k] = unit
+		}
+		if quality := info.Quality[k]; quality != "" {
+			record.Quality[k] = quality
+		}
+	}
+
+	return json.Marshal(record)
+}
+
+// groupTopic is the topic a whole record is published to in json payload mode: the last segment
+// of the topic name takes the place of the field name
+func (conn *Connection) groupTopic(topicName string) (string, error) {
+	parent, last := path.Split(topicName)
+	return conn.topicNamer(conn.prefix, strings.TrimSuffix(parent, "/"), last)
+}
+
+func validPayload(payload string) error {
+	switch payload {
+	case "", PayloadValues, PayloadJSON:
+		return nil
+	default:
+		return fmt.Errorf("unknown MQTT payload %q, use %s or %s", payload, PayloadValues, PayloadJSON)
+	}
+}
@@ -0,0 +1,68 @@
+package mosquitto
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// tlsSchemes are the broker URL schemes the MQTT client connects to over TLS
+var tlsSchemes = []string{"mqtts", "ssl", "tls", "tcps"}
+
+func isTLSUrl(brokerUrl string) bool {
+	u, err := url.Parse(brokerUrl)
+	if err != nil {
+		return false
+	}
+
+	for _, scheme := range tlsSchemes {
+		if strings.EqualFold(u.Scheme, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasTLSSettings(config *MqttConfig) bool {
+	return config.CACert != "" || config.ClientCert != "" || config.ClientKey != "" || config.ServerName != "" || config.InsecureSkipVerify
+}
+
+// newTLSConfig builds the TLS settings of the broker connection: the CA bundle replaces the
+// system roots when defined and the client certificate is used for mutual authentication
+func newTLSConfig(config *MqttConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+
+	if config.CACert != "" {
+		pem, err := os.ReadFile(config.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA bundle: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in CA bundle %s", config.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.ClientCert != "" || config.ClientKey != "" {
+		if config.ClientCert == "" || config.ClientKey == "" {
+			return nil, fmt.Errorf("client certificate and key must be both defined")
+		}
+
+		cert, err := tls.LoadX509KeyPair(config.ClientCert, config.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,238 @@
+package mosquitto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIsTLSUrl(t *testing.T) {
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"mqtts://broker:8883", true},
+		{"ssl://broker:8883", true},
+		{"tls://broker:8883", true},
+		{"tcps://broker:8883", true},
+		{"MQTTS://broker:8883", true},
+		{"tcp://broker:1883", false},
+		{"mqtt://broker:1883", false},
+		{"ws://broker:80", false},
+		{"broker:1883", false},
+		{"://broken", false},
+	}
+
+	for _, tt := range tests {
+		if got := isTLSUrl(tt.url); got != tt.want {
+			t.Errorf("isTLSUrl(%q) = %t, want %t", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestHasTLSSettings(t *testing.T) {
+	if hasTLSSettings(&MqttConfig{Url: "tcp://broker:1883"}) {
+		t.Error("no TLS setting reported as TLS")
+	}
+	if !hasTLSSettings(&MqttConfig{InsecureSkipVerify: true}) {
+		t.Error("insecureSkipVerify not reported as TLS")
+	}
+	if !hasTLSSettings(&MqttConfig{CACert: "ca.pem"}) {
+		t.Error("CA bundle not reported as TLS")
+	}
+}
+
+// writeCert writes a self-signed certificate and its key as PEM files, returning their paths
+func writeCert(t *testing.T, dir string, name string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	caCert, _ := writeCert(t, dir, "ca")
+	clientCert, clientKey := writeCert(t, dir, "client")
+
+	t.Run("defaults", func(t *testing.T) {
+		cfg, err := newTLSConfig(&MqttConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.MinVersion != tls.VersionTLS12 {
+			t.Errorf("MinVersion = %x, want TLS 1.2", cfg.MinVersion)
+		}
+		if cfg.RootCAs != nil {
+			t.Error("system roots replaced without CA bundle")
+		}
+		if cfg.InsecureSkipVerify {
+			t.Error("verification disabled by default")
+		}
+		if len(cfg.Certificates) != 0 {
+			t.Error("client certificate set without configuration")
+		}
+	})
+
+	t.Run("CA bundle and server name", func(t *testing.T) {
+		cfg, err := newTLSConfig(&MqttConfig{CACert: caCert, ServerName: "broker.local"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.RootCAs == nil {
+			t.Fatal("CA bundle not loaded")
+		}
+		if cfg.ServerName != "broker.local" {
+			t.Errorf("ServerName = %q", cfg.ServerName)
+		}
+	})
+
+	t.Run("client certificate", func(t *testing.T) {
+		cfg, err := newTLSConfig(&MqttConfig{ClientCert: clientCert, ClientKey: clientKey})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cfg.Certificates) != 1 {
+			t.Fatalf("%d client certificates, want 1", len(cfg.Certificates))
+		}
+	})
+
+	t.Run("insecure", func(t *testing.T) {
+		cfg, err := newTLSConfig(&MqttConfig{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cfg.InsecureSkipVerify {
+			t.Error("InsecureSkipVerify not set")
+		}
+	})
+
+	failures := []struct {
+		name   string
+		config MqttConfig
+	}{
+		{"missing CA bundle", MqttConfig{CACert: filepath.Join(dir, "missing.pem")}},
+		{"CA bundle without certificate", MqttConfig{CACert: clientKey}},
+		{"certificate without key", MqttConfig{ClientCert: clientCert}},
+		{"key without certificate", MqttConfig{ClientKey: clientKey}},
+		{"mismatched key", MqttConfig{ClientCert: clientCert, ClientKey: caCertKey(t, dir)}},
+	}
+	for _, tt := range failures {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newTLSConfig(&tt.config); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
+
+// caCertKey returns the key of another certificate
+func caCertKey(t *testing.T, dir string) string {
+	_, key := writeCert(t, dir, "other")
+	return key
+}
+
+// TestTLSHandshake connects with the built settings to a local listener requiring a client certificate
+func TestTLSHandshake(t *testing.T) {
+	dir := t.TempDir()
+	serverCert, serverKey := writeCert(t, dir, "broker")
+	clientCert, clientKey := writeCert(t, dir, "client")
+
+	cert, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	clients := make(chan int, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tlsConn := conn.(*tls.Conn)
+		if err := tlsConn.Handshake(); err != nil {
+			clients <- 0
+			return
+		}
+		clients <- len(tlsConn.ConnectionState().PeerCertificates)
+	}()
+
+	cfg, err := newTLSConfig(&MqttConfig{CACert: serverCert, ServerName: "broker", ClientCert: clientCert, ClientKey: clientKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.Dial("tcp", listener.Addr().String(), cfg)
+	if err != nil {
+		t.Fatalf("handshake failed: %s", err)
+	}
+	defer conn.Close()
+
+	if n := <-clients; n != 1 {
+		t.Errorf("server got %d client certificates, want 1", n)
+	}
+
+	// the server certificate is not trusted without the CA bundle
+	cfg, err = newTLSConfig(&MqttConfig{ServerName: "broker"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	if conn, err := tls.Dial("tcp", listener.Addr().String(), cfg); err == nil {
+		conn.Close()
+		t.Error("untrusted server certificate accepted")
+	}
+}
@@ -0,0 +1,44 @@
+// Package naming splits the field and topic names into words, the exporters build their
+// topic and metric names from them
+package naming
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Words splits a name into lowercase words on spaces, punctuation and case changes,
+// e.g. "BAT Charge Day Energy" -> bat charge day energy, "batterySOC" -> battery soc
+func Words(name string) []string {
+	result := make([]string, 0)
+	runes := []rune(name)
+
+	var current []rune
+	flush := func() {
+		if len(current) > 0 {
+			result = append(result, strings.ToLower(string(current)))
+			current = nil
+		}
+	}
+
+	for i, r := range runes {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			flush()
+			continue
+		}
+
+		if unicode.IsUpper(r) && len(current) > 0 {
+			prev := runes[i-1]
+			nextIsLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			// "batterySOC": lower to upper; "SOCValue": end of an acronym
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextIsLower) {
+				flush()
+			}
+		}
+
+		current = append(current, r)
+	}
+	flush()
+
+	return result
+}
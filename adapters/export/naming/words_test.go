@@ -0,0 +1,25 @@
+package naming
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWords(t *testing.T) {
+	tests := map[string]string{
+		"BAT Charge Day Energy": "bat charge day energy",
+		"batterySOC":            "battery soc",
+		"SOCValue":              "soc value",
+		"PV1 Voltage":           "pv1 voltage",
+		"Inv A Power":           "inv a power",
+		"EnergyTodayTotals":     "energy today totals",
+		"Grid-Export (total)":   "grid export total",
+		"Température °C":        "température c",
+		"":                      "",
+	}
+	for name, want := range tests {
+		if got := strings.Join(Words(name), " "); got != want {
+			t.Errorf("Words(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
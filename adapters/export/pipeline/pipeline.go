@@ -0,0 +1,336 @@
+// Package pipeline fans the published snapshots out to the exporters, each one fed by its own queue
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/misterdelle/invt_logger_reader/ports"
+)
+
+const defaultQueueSize = 1000
+
+// Changes selects the fields worth publishing, e.g. the ones that changed since last published. Every sink
+// configured with Changes has its own, told about the fields once the sink accepted them
+type Changes interface {
+	// Changed returns the fields of data worth publishing now, without recording them
+	Changed(topic string, data map[string]interface{}, now time.Time) map[string]interface{}
+	// Published records the fields of data as published
+	Published(topic string, data map[string]interface{}, now time.Time)
+	// Forget drops what has been recorded of fields, e.g. dropped before being exported
+	Forget(topic string, fields []string)
+}
+
+type SinkConfig struct {
+	// Include are the groups, topics or topic/field sent to the sink, all when empty
+	Include []string `yaml:"include"`
+	// Exclude are the groups, topics or topic/field never sent to the sink, they win over Include
+	Exclude []string `yaml:"exclude"`
+	// MinInterval is the minimum time between two snapshots of the same topic, snapshots in between are skipped
+	MinInterval time.Duration `yaml:"minInterval"`
+	// QueueSize is the number of snapshots waiting for a slow sink, the oldest are dropped past it; the ends of
+	// the poll cycles are never dropped
+	QueueSize int `yaml:"queueSize"`
+	// Changes sends only the fields selected by the sink Changes, instead of every poll
+	Changes bool `yaml:"changes"`
+}
+
+// WholeRecords is implemented by the exporters publishing some groups as a single message, e.g. MQTT in json
+// payload mode, whose consumers expect every field in it. With Changes the snapshots of those groups are sent
+// whole as soon as one of their fields changed
+type WholeRecords interface {
+	WholeRecord(group string) bool
+}
+
+// job is a snapshot, or the end of a poll cycle
+type job struct {
+	snapshot ports.Snapshot
+	cycle    bool
+	complete bool
+}
+
+type sink struct {
+	name     string
+	exporter ports.Exporter
+	config   SinkConfig
+	// changes is nil unless the sink is configured with Changes
+	changes Changes
+
+	mu      sync.Mutex
+	last    map[string]time.Time
+	queue   []job
+	closed  bool
+	dropped int
+
+	// wake tells run that a job has been queued or the sink closed
+	wake chan struct{}
+	done chan struct{}
+}
+
+// Pipeline hands every snapshot over to the sinks without waiting for them, a slow or failing sink
+// delays neither the others nor the caller
+type Pipeline struct {
+	newChanges func() Changes
+	sinks      []*sink
+}
+
+// New returns an empty pipeline, newChanges is called for every sink configured with Changes
+func New(newChanges func() Changes) *Pipeline {
+	return &Pipeline{newChanges: newChanges}
+}
+
+// Add starts feeding exporter, name identifies the sink in the logs
+func (p *Pipeline) Add(name string, exporter ports.Exporter, config SinkConfig) {
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaultQueueSize
+	}
+
+	s := &sink{
+		name:     name,
+		exporter: exporter,
+		config:   config,
+		last:     make(map[string]time.Time),
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	if config.Changes {
+		s.changes = p.newChanges()
+	}
+	p.sinks = append(p.sinks, s)
+
+	go s.run()
+}
+
+// Len returns the number of sinks
+func (p *Pipeline) Len() int {
+	return len(p.sinks)
+}
+
+// Publish queues the snapshot for every sink, each one getting the measurements it is configured for
+func (p *Pipeline) Publish(snapshot ports.Snapshot) {
+	now := time.Now()
+	for _, s := range p.sinks {
+		s.publish(snapshot, now)
+	}
+}
+
+// CycleComplete queues the end of the poll cycle for the sinks implementing ports.CycleListener
+func (p *Pipeline) CycleComplete(complete bool) {
+	for _, s := range p.sinks {
+		if _, ok := s.exporter.(ports.CycleListener); ok {
+			s.mu.Lock()
+			s.enqueue(job{cycle: true, complete: complete})
+			s.mu.Unlock()
+		}
+	}
+}
+
+// Close waits at most timeout for the sinks to take their queued snapshots, then closes them
+func (p *Pipeline) Close(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	errs := make([]error, len(p.sinks))
+	var wg sync.WaitGroup
+	for i, s := range p.sinks {
+		wg.Add(1)
+		go func(i int, s *sink) {
+			defer wg.Done()
+			errs[i] = s.close(deadline)
+		}(i, s)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// wants tells whether the sink is configured for key, topic/field
+func (s *sink) wants(key string) bool {
+	if len(s.config.Include) > 0 && !matchAny(s.config.Include, key) {
+		return false
+	}
+	return !matchAny(s.config.Exclude, key)
+}
+
+// matchAny tells whether key (topic/field) is one of the patterns or under one of them,
+// e.g. GridOutput and GridOutput/Grid A both match GridOutput/Grid A/Inv A Power
+func matchAny(patterns []string, key string) bool {
+	for _, p := range patterns {
+		if key == p || strings.HasPrefix(key, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// publish queues the measurements of snapshot the sink wants, with Changes the fields are recorded
+// as published only once queued
+func (s *sink) publish(snapshot ports.Snapshot, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	group := snapshot.Group()
+	if s.closed {
+		log.Printf("%s sink closed, %s measurements dropped", s.name, group)
+		return
+	}
+
+	if s.config.MinInterval > 0 {
+		if last, ok := s.last[group]; ok && now.Sub(last) < s.config.MinInterval {
+			return
+		}
+	}
+
+	selected := snapshot.Select(func(m ports.Measurement) bool {
+		return s.wants(m.Group + "/" + m.Field)
+	})
+	if selected.Len() == 0 {
+		return
+	}
+
+	if s.changes != nil {
+		data, _ := selected.Record()
+		changed := s.changes.Changed(group, data, now)
+		if len(changed) == 0 {
+			return
+		}
+
+		if w, ok := s.exporter.(WholeRecords); !ok || !w.WholeRecord(group) {
+			selected = selected.Select(func(m ports.Measurement) bool {
+				_, ok := changed[m.Field]
+				return ok
+			})
+		}
+	}
+
+	if s.config.MinInterval > 0 {
+		s.last[group] = now
+	}
+	if s.changes != nil {
+		data, _ := selected.Record()
+		s.changes.Published(group, data, now)
+	}
+	s.enqueue(job{snapshot: selected})
+}
+
+// enqueue queues a job, dropping the oldest snapshot when the queue is full, s.mu must be held
+func (s *sink) enqueue(j job) {
+	if s.closed || s.collapse(j) {
+		return
+	}
+
+	if len(s.queue) >= s.config.QueueSize {
+		for i, old := range s.queue {
+			if old.cycle {
+				continue
+			}
+
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			if s.dropped%100 == 0 {
+				log.Printf("%s sink is not keeping up, %d snapshots dropped so far", s.name, s.dropped+1)
+			}
+			s.dropped++
+
+			// the fields never reached the sink, they are published again at the next poll
+			if s.changes != nil {
+				fields := make([]string, 0, old.snapshot.Len())
+				for _, m := range old.snapshot.Measurements() {
+					fields = append(fields, m.Field)
+				}
+				s.changes.Forget(old.snapshot.Group(), fields)
+			}
+			break
+		}
+	}
+
+	if s.collapse(j) {
+		return
+	}
+	s.queue = append(s.queue, j)
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// collapse merges a cycle end into the one ending the queue, the latest poll tells whether it
+// was complete. A queue of cycle ends alone would grow without limit, s.mu must be held
+func (s *sink) collapse(j job) bool {
+	if !j.cycle || len(s.queue) == 0 || !s.queue[len(s.queue)-1].cycle {
+		return false
+	}
+	s.queue[len(s.queue)-1].complete = j.complete
+	return true
+}
+
+func (s *sink) run() {
+	defer close(s.done)
+
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return
+			}
+			<-s.wake
+			continue
+		}
+		j := s.queue[0]
+		s.queue[0] = job{}
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		s.handle(j)
+	}
+}
+
+// handle delivers a job, a panicking sink loses the job but keeps running
+func (s *sink) handle(j job) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("%s sink failed on %s: %v", s.name, j.snapshot.Group(), r)
+		}
+	}()
+
+	if j.cycle {
+		s.exporter.(ports.CycleListener).CycleComplete(j.complete)
+		return
+	}
+
+	if err := s.exporter.Export(j.snapshot); err != nil {
+		log.Printf("failed to export %s to %s: %s", j.snapshot.Group(), s.name, err)
+	}
+}
+
+func (s *sink) close(deadline time.Time) error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+	s.mu.Unlock()
+
+	var errs []error
+	select {
+	case <-s.done:
+	case <-time.After(time.Until(deadline)):
+		s.mu.Lock()
+		errs = append(errs, fmt.Errorf("%s: %d queued snapshots not exported", s.name, len(s.queue)))
+		s.mu.Unlock()
+	}
+
+	// the exporter is closed even when late, with what is left of the budget
+	if err := s.exporter.Close(time.Until(deadline)); err != nil {
+		errs = append(errs, fmt.Errorf("%s: %w", s.name, err))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,256 @@
+package pipeline
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/misterdelle/invt_logger_reader/ports"
+)
+
+// changes publishes a field when its value differs from the last published one
+type changes struct {
+	mu   sync.Mutex
+	last map[string]interface{}
+}
+
+func newChanges() Changes {
+	return &changes{last: make(map[string]interface{})}
+}
+
+func (c *changes) Changed(topic string, data map[string]interface{}, now time.Time) map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	result := make(map[string]interface{})
+	for field, v := range data {
+		if last, ok := c.last[topic+"/"+field]; !ok || last != v {
+			result[field] = v
+		}
+	}
+	return result
+}
+
+func (c *changes) Published(topic string, data map[string]interface{}, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for field, v := range data {
+		c.last[topic+"/"+field] = v
+	}
+}
+
+func (c *changes) Forget(topic string, fields []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, field := range fields {
+		delete(c.last, topic+"/"+field)
+	}
+}
+
+// exporter records what it receives as "group field=value ...", or "cycle"; with a gate every export
+// waits for it to be closed
+type exporter struct {
+	mu       sync.Mutex
+	received []string
+	whole    bool
+	closed   bool
+	gate     chan struct{}
+	entered  chan struct{}
+}
+
+func (e *exporter) Export(snapshot ports.Snapshot) error {
+	if e.gate != nil {
+		e.entered <- struct{}{}
+		<-e.gate
+	}
+
+	fields := []string{snapshot.Group()}
+	for _, m := range snapshot.Measurements() {
+		fields = append(fields, fmt.Sprintf("%s=%v", m.Field, m.Value))
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.received = append(e.received, strings.Join(fields, " "))
+	return nil
+}
+
+func (e *exporter) Close(timeout time.Duration) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed = true
+	return nil
+}
+
+func (e *exporter) CycleComplete(complete bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.received = append(e.received, "cycle")
+}
+
+func (e *exporter) WholeRecord(group string) bool {
+	return e.whole
+}
+
+func (e *exporter) got() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string(nil), e.received...)
+}
+
+func snapshot(group string, data map[string]interface{}) ports.Snapshot {
+	return ports.NewSnapshot("", group, data, ports.RecordInfo{PollTime: time.Now()})
+}
+
+func check(t *testing.T, name string, got []string, want ...string) {
+	t.Helper()
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("%s got\n%s\nwant\n%s", name, strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestSelection(t *testing.T) {
+	p := New(newChanges)
+	all, included, excluded := &exporter{}, &exporter{}, &exporter{}
+	p.Add("all", all, SinkConfig{})
+	p.Add("included", included, SinkConfig{Include: []string{"GridOutput/Grid A", "station/pvDayEnergy"}})
+	p.Add("excluded", excluded, SinkConfig{Exclude: []string{"GridOutput", "station/pvDayEnergy"}})
+
+	p.Publish(snapshot("GridOutput/Grid A", map[string]interface{}{"Inv A Power": 1}))
+	p.Publish(snapshot("GridOutput/Grid AB", map[string]interface{}{"Inv A Power": 2}))
+	p.Publish(snapshot("station", map[string]interface{}{"pvDayEnergy": 3, "loadDayEnergy": 4}))
+	p.CycleComplete(true)
+	p.Close(time.Second)
+
+	check(t, "all", all.got(), "GridOutput/Grid A Inv A Power=1", "GridOutput/Grid AB Inv A Power=2", "station loadDayEnergy=4 pvDayEnergy=3", "cycle")
+	check(t, "included", included.got(), "GridOutput/Grid A Inv A Power=1", "station pvDayEnergy=3", "cycle")
+	check(t, "excluded", excluded.got(), "station loadDayEnergy=4", "cycle")
+}
+
+func TestChanges(t *testing.T) {
+	p := New(newChanges)
+	every, changed, whole := &exporter{}, &exporter{}, &exporter{whole: true}
+	p.Add("every", every, SinkConfig{})
+	p.Add("changed", changed, SinkConfig{Changes: true})
+	p.Add("whole", whole, SinkConfig{Changes: true})
+
+	p.Publish(snapshot("station", map[string]interface{}{"a": 1, "b": 2}))
+	p.Publish(snapshot("station", map[string]interface{}{"a": 1, "b": 3}))
+	p.Publish(snapshot("station", map[string]interface{}{"a": 1, "b": 3}))
+	p.Close(time.Second)
+
+	check(t, "every", every.got(), "station a=1 b=2", "station a=1 b=3", "station a=1 b=3")
+	check(t, "changed", changed.got(), "station a=1 b=2", "station b=3")
+	check(t, "whole", whole.got(), "station a=1 b=2", "station a=1 b=3")
+}
+
+func TestChangesPerSink(t *testing.T) {
+	p := New(newChanges)
+	fast, slow, excluding := &exporter{}, &exporter{}, &exporter{}
+	p.Add("fast", fast, SinkConfig{Changes: true})
+	p.Add("slow", slow, SinkConfig{Changes: true, MinInterval: 100 * time.Millisecond})
+	p.Add("excluding", excluding, SinkConfig{Changes: true, Exclude: []string{"station/b"}})
+
+	p.Publish(snapshot("station", map[string]interface{}{"a": 1, "b": 1}))
+	// skipped by slow, which must still publish it once its interval elapsed
+	p.Publish(snapshot("station", map[string]interface{}{"a": 2, "b": 2}))
+	time.Sleep(150 * time.Millisecond)
+	p.Publish(snapshot("station", map[string]interface{}{"a": 2, "b": 2}))
+	p.Close(time.Second)
+
+	check(t, "fast", fast.got(), "station a=1 b=1", "station a=2 b=2")
+	check(t, "slow", slow.got(), "station a=1 b=1", "station a=2 b=2")
+	check(t, "excluding", excluding.got(), "station a=1", "station a=2")
+}
+
+func TestFullQueue(t *testing.T) {
+	p := New(newChanges)
+	e := &exporter{gate: make(chan struct{}), entered: make(chan struct{}, 10)}
+	p.Add("blocked", e, SinkConfig{QueueSize: 2, Changes: true})
+
+	p.Publish(snapshot("station", map[string]interface{}{"a": 1}))
+	<-e.entered
+	// the exporter is busy with the first snapshot, the queue holds two jobs
+	p.CycleComplete(true)
+	p.Publish(snapshot("station", map[string]interface{}{"a": 2}))
+	p.Publish(snapshot("battery", map[string]interface{}{"soc": 50}))
+	p.CycleComplete(false)
+	p.Publish(snapshot("battery", map[string]interface{}{"soc": 51}))
+	close(e.gate)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(e.got()) < 4 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// the dropped value of a is published again at the next poll, even if it did not change
+	p.Publish(snapshot("station", map[string]interface{}{"a": 2}))
+	p.Close(time.Second)
+
+	// the two cycle ends left once the snapshot between them was dropped are merged
+	check(t, "blocked", e.got(), "station a=1", "cycle", "battery soc=51", "station a=2")
+}
+
+func TestCycleEnds(t *testing.T) {
+	p := New(newChanges)
+	e := &exporter{gate: make(chan struct{}), entered: make(chan struct{}, 10)}
+	p.Add("blocked", e, SinkConfig{QueueSize: 2})
+
+	p.Publish(snapshot("station", map[string]interface{}{"a": 1}))
+	<-e.entered
+	// the polls fail while the exporter is busy
+	for i := 0; i < 10; i++ {
+		p.CycleComplete(false)
+	}
+	p.CycleComplete(true)
+
+	s := p.sinks[0]
+	s.mu.Lock()
+	queued := append([]job(nil), s.queue...)
+	s.mu.Unlock()
+	if len(queued) != 1 || !queued[0].cycle || !queued[0].complete {
+		t.Errorf("queue %+v, want the last cycle end", queued)
+	}
+
+	close(e.gate)
+	p.Close(time.Second)
+	check(t, "blocked", e.got(), "station a=1", "cycle")
+}
+
+func TestClosed(t *testing.T) {
+	p := New(newChanges)
+	e := &exporter{}
+	p.Add("closed", e, SinkConfig{})
+	if err := p.Close(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Publish(snapshot("station", map[string]interface{}{"a": 1}))
+	p.CycleComplete(true)
+	check(t, "closed", e.got())
+}
+
+func TestCloseTimeout(t *testing.T) {
+	p := New(newChanges)
+	e := &exporter{gate: make(chan struct{}), entered: make(chan struct{}, 10)}
+	p.Add("stuck", e, SinkConfig{})
+	defer close(e.gate)
+
+	p.Publish(snapshot("station", map[string]interface{}{"a": 1}))
+	p.Publish(snapshot("station", map[string]interface{}{"a": 2}))
+	<-e.entered
+
+	if err := p.Close(50 * time.Millisecond); err == nil || !strings.Contains(err.Error(), "stuck: 1 queued") {
+		t.Errorf("Close = %v", err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.closed {
+		t.Error("exporter not closed after the timeout")
+	}
+}
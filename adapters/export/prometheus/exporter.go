@@ -0,0 +1,144 @@
+package prometheus
+
+import (
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/misterdelle/invt_logger_reader/adapters/export/naming"
+	"github.com/misterdelle/invt_logger_reader/ports"
+)
+
+// namespace prefixes every metric name
+const namespace = "invt"
+
+// unitSuffix maps a unit of measure to the metric name suffix and the factor converting
+// the value to the Prometheus base unit, e.g. energies are exposed in joules
+var unitSuffix = map[string]struct {
+	suffix string
+	factor float64
+}{
+	"V":   {"volts", 1},
+	"mV":  {"volts", 0.001},
+	"A":   {"amperes", 1},
+	"mA":  {"amperes", 0.001},
+	"W":   {"watts", 1},
+	"kW":  {"watts", 1000},
+	"Wh":  {"joules", 3600},
+	"kWh": {"joules", 3600 * 1000},
+	"Hz":  {"hertz", 1},
+	"°C":  {"celsius", 1},
+	"%":   {"percent", 1},
+}
+
+// Exporter turns the snapshots into metrics, it implements ports.Exporter. Metric names are built from
+// the field names, e.g. "Inv A Voltage" in "GridOutput/Grid A" becomes invt_inv_voltage_volts{group="GridOutput",phase="A"}
+type Exporter struct {
+	registry *Registry
+	labels   Labels
+}
+
+// NewExporter returns an exporter adding labels (e.g. the inverter serial number) to every sample
+func NewExporter(registry *Registry, labels Labels) *Exporter {
+	return &Exporter{registry: registry, labels: labels}
+}
+
+// Export updates the metrics of the numeric fields, the others are ignored
+func (e *Exporter) Export(snapshot ports.Snapshot) error {
+	group, _, _ := strings.Cut(snapshot.Group(), "/")
+
+	for _, m := range snapshot.Measurements() {
+		value, ok := m.Number()
+		if !ok || m.Quality == ports.QualityInvalid {
+			continue
+		}
+
+		field, unit := m.Field, m.Unit
+		name, phase := metricName(field)
+
+		typ := Gauge
+		if isCounter(field, unit) {
+			typ = Counter
+		}
+
+		if u, ok := unitSuffix[unit]; ok {
+			name += "_" + u.suffix
+			value *= u.factor
+		}
+		if typ == Counter {
+			name += "_total"
+		}
+
+		labels := make(Labels, len(e.labels)+2)
+		for k, v := range e.labels {
+			labels[k] = v
+		}
+		labels["group"] = group
+		if phase != "" {
+			labels["phase"] = phase
+		}
+
+		help := phaseless(field, phase)
+		if unit != "" {
+			help += " (" + unit + ")"
+		}
+
+		e.registry.Set(name, typ, help, labels, value)
+	}
+
+	return nil
+}
+
+func (e *Exporter) Close(timeout time.Duration) error {
+	return nil
+}
+
+// isCounter reports whether the field is a lifetime energy counter, day, month and year
+// totals reset and are exposed as gauges
+func isCounter(field string, unit string) bool {
+	if unit != "Wh" && unit != "kWh" {
+		return false
+	}
+	return strings.Contains(strings.ToLower(field), "total")
+}
+
+// metricName converts a field name into a metric name, a single A, B or C word is the phase
+func metricName(field string) (name string, phase string) {
+	parts := []string{namespace}
+
+	for _, w := range fieldWords(field) {
+		if len(w) == 1 && strings.Contains("abc", w) && phase == "" {
+			phase = strings.ToUpper(w)
+			continue
+		}
+		parts = append(parts, w)
+	}
+
+	return strings.Join(parts, "_"), phase
+}
+
+// fieldWords splits a field name into words, metric names are ASCII: other characters separate words too
+func fieldWords(field string) []string {
+	return naming.Words(strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII {
+			return ' '
+		}
+		return r
+	}, field))
+}
+
+// phaseless removes the phase from the field name, the help is shared by all the phases
+func phaseless(field string, phase string) string {
+	if phase == "" {
+		return field
+	}
+
+	words := strings.Fields(field)
+	result := make([]string, 0, len(words))
+	for _, w := range words {
+		if w != phase {
+			result = append(result, w)
+		}
+	}
+	return strings.Join(result, " ")
+}
@@ -0,0 +1,75 @@
+package prometheus
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/misterdelle/invt_logger_reader/ports"
+)
+
+func TestExporter(t *testing.T) {
+	registry := NewRegistry()
+	e := NewExporter(registry, Labels{"inverter": "2333571751"})
+
+	e.Export(ports.NewSnapshot("", "GridOutput/Grid A", map[string]interface{}{
+		"Inv A Voltage": "230.1",
+		"Inv A Power":   "1.5",
+	}, ports.RecordInfo{Units: map[string]string{"Inv A Voltage": "V", "Inv A Power": "kW"}}))
+	e.Export(ports.NewSnapshot("", "EnergyTodayTotals/PV", map[string]interface{}{
+		"PV Total Energy": "1234.5",
+		"PV Day Energy":   "2.5",
+		"Work Mode":       "Self use",
+		"Bad Value":       "12",
+	}, ports.RecordInfo{
+		Units:   map[string]string{"PV Total Energy": "kWh", "PV Day Energy": "kWh", "Bad Value": "W"},
+		Quality: map[string]string{"Bad Value": ports.QualityInvalid},
+	}))
+
+	var b strings.Builder
+	registry.WriteTo(&b)
+	out := b.String()
+
+	for _, want := range []string{
+		`invt_inv_voltage_volts{group="GridOutput",inverter="2333571751",phase="A"} 230.1`,
+		`invt_inv_power_watts{group="GridOutput",inverter="2333571751",phase="A"} 1500`,
+		"# TYPE invt_pv_total_energy_joules_total counter",
+		`invt_pv_total_energy_joules_total{group="EnergyTodayTotals",inverter="2333571751"} 4.4442e+09`,
+		"# TYPE invt_pv_day_energy_joules gauge",
+		`invt_pv_day_energy_joules{group="EnergyTodayTotals",inverter="2333571751"} 9e+06`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %s in\n%s", want, out)
+		}
+	}
+
+	for _, unwanted := range []string{"work_mode", "bad_value"} {
+		if strings.Contains(out, unwanted) {
+			t.Errorf("%s exported:\n%s", unwanted, out)
+		}
+	}
+}
+
+func TestFieldWords(t *testing.T) {
+	tests := map[string]string{
+		"BAT Charge Day Energy": "bat charge day energy",
+		"batterySOC":            "battery soc",
+		"PV1 Voltage":           "pv1 voltage",
+		"Inv A Power":           "inv a power",
+		"Température °C":        "temp rature c",
+	}
+	for field, want := range tests {
+		if got := strings.Join(fieldWords(field), " "); got != want {
+			t.Errorf("fieldWords(%q) = %q, want %q", field, got, want)
+		}
+	}
+}
+
+func TestMetricName(t *testing.T) {
+	name, phase := metricName("Inv B Current")
+	if name != "invt_inv_current" || phase != "B" {
+		t.Errorf("metricName = %q, %q", name, phase)
+	}
+	if help := phaseless("Inv B Current", phase); help != "Inv Current" {
+		t.Errorf("phaseless = %q", help)
+	}
+}
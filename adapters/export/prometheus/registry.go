@@ -0,0 +1,165 @@
+// Package prometheus exposes the measurements in the Prometheus text exposition format
+package prometheus
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metric types
+const (
+	Gauge   = "gauge"
+	Counter = "counter"
+)
+
+// Labels of a sample, e.g. {"inverter": "2333571751", "phase": "A"}
+type Labels map[string]string
+
+type sample struct {
+	labels Labels
+	value  float64
+}
+
+type family struct {
+	name    string
+	help    string
+	typ     string
+	samples map[string]*sample
+}
+
+// Registry holds the current value of every metric
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// Set sets the value of a gauge, or of a counter read from the device
+func (r *Registry) Set(name string, typ string, help string, labels Labels, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sample(name, typ, help, labels).value = value
+}
+
+// Add increases a counter
+func (r *Registry) Add(name string, help string, labels Labels, delta float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sample(name, Counter, help, labels).value += delta
+}
+
+func (r *Registry) sample(name string, typ string, help string, labels Labels) *sample {
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{name: name, help: help, typ: typ, samples: make(map[string]*sample)}
+		r.families[name] = f
+	}
+
+	key := labels.String()
+	s, ok := f.samples[key]
+	if !ok {
+		s = &sample{labels: labels}
+		f.samples[key] = s
+	}
+	return s
+}
+
+// WriteTo writes all the metrics in the text exposition format, sorted by name and labels
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		f := r.families[name]
+		fmt.Fprintf(&b, "# HELP %s %s\n", f.name, helpEscaper.Replace(f.help))
+		fmt.Fprintf(&b, "# TYPE %s %s\n", f.name, f.typ)
+
+		keys := make([]string, 0, len(f.samples))
+		for key := range f.samples {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			b.WriteString(f.name)
+			b.WriteString(key)
+			b.WriteByte(' ')
+			b.WriteString(formatValue(f.samples[key].value))
+			b.WriteByte('\n')
+		}
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// Handler serves the metrics, e.g. on /metrics
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+// String formats the labels as {name="value",...}, sorted by name, "" when there are none
+func (l Labels) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(l[name]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
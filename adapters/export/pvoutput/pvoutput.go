@@ -0,0 +1,358 @@
+// Package pvoutput uploads the generation and consumption of the system to PVOutput.org
+package pvoutput
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/misterdelle/invt_logger_reader/ports"
+)
+
+const (
+	DefaultUrl      = "https://pvoutput.org"
+	defaultInterval = 5 * time.Minute
+	requestTimeout  = 30 * time.Second
+	// batchSize is the number of statuses PVOutput accepts in a single addbatchstatus request
+	batchSize = 30
+	// maxAge is how old a status PVOutput still accepts
+	maxAge = 14 * 24 * time.Hour
+)
+
+// Field is a published field, e.g. {"station", "pvDayEnergy"}
+type Field struct {
+	Topic string
+	Field string
+}
+
+// ParseField reads topic/field, the field name being after the last slash
+func ParseField(s string) (Field, error) {
+	i := strings.LastIndex(s, "/")
+	if i <= 0 || i == len(s)-1 {
+		return Field{}, fmt.Errorf("invalid field %q, expected topic/field", s)
+	}
+	return Field{Topic: s[:i], Field: s[i+1:]}, nil
+}
+
+type PVOutputConfig struct {
+	Url      string `yaml:"url"`
+	ApiKey   string `yaml:"apiKey"`
+	SystemId string `yaml:"systemId"`
+	// Interval is the status interval of the system on PVOutput, 5 or 15 minutes
+	Interval time.Duration `yaml:"interval"`
+
+	// fields the statuses are made of, the defaults are used when empty
+	EnergyGeneration  Field `yaml:"energyGeneration"`
+	PowerGeneration   Field `yaml:"powerGeneration"`
+	EnergyConsumption Field `yaml:"energyConsumption"`
+	PowerConsumption  Field `yaml:"powerConsumption"`
+	Voltage           Field `yaml:"voltage"`
+}
+
+var defaultFields = PVOutputConfig{
+	EnergyGeneration:  Field{"station", "pvDayEnergy"},
+	PowerGeneration:   Field{"station", "totalPowerFromPV"},
+	EnergyConsumption: Field{"station", "loadDayEnergy"},
+	PowerConsumption:  Field{"station", "currentConsumptionPower"},
+	Voltage:           Field{"GridOutput/Grid A", "Inv A Voltage"},
+}
+
+// status is a PVOutput status, missing values are nil
+type status struct {
+	time              time.Time
+	energyGeneration  *float64 // Wh
+	powerGeneration   *float64 // W
+	energyConsumption *float64 // Wh
+	powerConsumption  *float64 // W
+	voltage           *float64 // V
+}
+
+// reading is the latest value of a field converted to the PVOutput unit
+type reading struct {
+	value float64
+	time  time.Time
+}
+
+// Uploader keeps the latest value of the status fields and uploads a status every interval,
+// statuses that could not be uploaded are sent in batches later on. It implements ports.Exporter
+type Uploader struct {
+	config PVOutputConfig
+	client *http.Client
+
+	mu       sync.Mutex
+	readings map[Field]reading
+	pending  []status
+	last     time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func New(config *PVOutputConfig) (*Uploader, error) {
+	cfg := *config
+	if cfg.Url == "" {
+		cfg.Url = DefaultUrl
+	}
+	cfg.Url = strings.TrimSuffix(cfg.Url, "/")
+	if cfg.ApiKey == "" || cfg.SystemId == "" {
+		return nil, errors.New("PVOutput API key and system id are required")
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultInterval
+	}
+
+	for _, f := range []struct {
+		field *Field
+		def   Field
+	}{
+		{&cfg.EnergyGeneration, defaultFields.EnergyGeneration},
+		{&cfg.PowerGeneration, defaultFields.PowerGeneration},
+		{&cfg.EnergyConsumption, defaultFields.EnergyConsumption},
+		{&cfg.PowerConsumption, defaultFields.PowerConsumption},
+		{&cfg.Voltage, defaultFields.Voltage},
+	} {
+		if f.field.Field == "" {
+			*f.field = f.def
+		}
+	}
+
+	u := &Uploader{
+		config:   cfg,
+		client:   &http.Client{Timeout: requestTimeout},
+		readings: make(map[Field]reading),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go u.run()
+
+	return u, nil
+}
+
+// Export keeps the status fields of the snapshot
+func (u *Uploader) Export(snapshot ports.Snapshot) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for _, m := range snapshot.Measurements() {
+		f := Field{m.Group, m.Field}
+		if !u.isStatusField(f) || m.Quality == ports.QualityInvalid {
+			continue
+		}
+
+		value, ok := m.Number()
+		if !ok {
+			continue
+		}
+
+		// PVOutput wants Wh and W
+		switch m.Unit {
+		case "kWh", "kW":
+			value *= 1000
+		}
+
+		u.readings[f] = reading{value: value, time: m.PollTime}
+	}
+
+	return nil
+}
+
+func (u *Uploader) isStatusField(f Field) bool {
+	c := u.config
+	return f == c.EnergyGeneration || f == c.PowerGeneration || f == c.EnergyConsumption || f == c.PowerConsumption || f == c.Voltage
+}
+
+// Close uploads the pending statuses within timeout
+func (u *Uploader) Close(timeout time.Duration) error {
+	close(u.stop)
+
+	select {
+	case <-u.done:
+	case <-time.After(timeout):
+		return errors.New("timeout waiting for PVOutput upload")
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.pending) > 0 {
+		return fmt.Errorf("%d PVOutput statuses not uploaded", len(u.pending))
+	}
+	return nil
+}
+
+func (u *Uploader) run() {
+	defer close(u.done)
+
+	for {
+		// statuses are aligned to the system interval, e.g. 10:00, 10:05, 10:10
+		next := time.Now().Truncate(u.config.Interval).Add(u.config.Interval)
+
+		select {
+		case t := <-time.After(time.Until(next)):
+			u.addStatus(t.Truncate(u.config.Interval))
+			u.upload()
+		case <-u.stop:
+			u.upload()
+			return
+		}
+	}
+}
+
+// addStatus queues a status with the readings received since the previous one
+func (u *Uploader) addStatus(t time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	s := status{time: t}
+	fresh := false
+	value := func(f Field) *float64 {
+		r, ok := u.readings[f]
+		if !ok || !r.time.After(u.last) {
+			return nil
+		}
+		fresh = true
+		v := r.value
+		return &v
+	}
+
+	s.energyGeneration = value(u.config.EnergyGeneration)
+	s.powerGeneration = value(u.config.PowerGeneration)
+	s.energyConsumption = value(u.config.EnergyConsumption)
+	s.powerConsumption = value(u.config.PowerConsumption)
+
+	// PVOutput refuses a status with neither generation nor consumption
+	if !fresh {
+		log.Printf("no readings for the PVOutput status of %s", t.Format(time.TimeOnly))
+		return
+	}
+
+	s.voltage = value(u.config.Voltage)
+	u.last = t
+	u.pending = append(u.pending, s)
+}
+
+// upload sends the pending statuses, a single one through addstatus, more in batches through addbatchstatus.
+// Statuses refused by PVOutput are dropped, the others are retried at the next interval
+func (u *Uploader) upload() {
+	u.mu.Lock()
+	cutoff := time.Now().Add(-maxAge)
+	pending := make([]status, 0, len(u.pending))
+	for _, s := range u.pending {
+		if s.time.After(cutoff) {
+			pending = append(pending, s)
+		}
+	}
+	if dropped := len(u.pending) - len(pending); dropped > 0 {
+		log.Printf("%d PVOutput statuses older than %s dropped", dropped, maxAge)
+	}
+	u.mu.Unlock()
+
+	sent := 0
+	for sent < len(pending) {
+		n := len(pending) - sent
+		if n > batchSize {
+			n = batchSize
+		}
+		batch := pending[sent : sent+n]
+
+		var err error
+		if len(batch) == 1 {
+			err = u.post("/service/r2/addstatus.jsp", statusValues(batch[0]))
+		} else {
+			err = u.post("/service/r2/addbatchstatus.jsp", url.Values{"data": {batchData(batch)}})
+		}
+
+		var refused *refusedError
+		if errors.As(err, &refused) {
+			log.Printf("%d PVOutput statuses refused: %s", len(batch), err)
+		} else if err != nil {
+			log.Printf("PVOutput upload failed, %d statuses kept for later: %s", len(pending)-sent, err)
+			break
+		} else {
+			log.Printf("%d statuses uploaded to PVOutput", len(batch))
+		}
+		sent += n
+	}
+
+	// statuses are only added by run, which is the caller
+	u.mu.Lock()
+	u.pending = pending[sent:]
+	u.mu.Unlock()
+}
+
+// refusedError is a request PVOutput answered with a client error, retrying would not help
+type refusedError struct {
+	status int
+	body   string
+}
+
+func (e *refusedError) Error() string {
+	return fmt.Sprintf("%d %s", e.status, e.body)
+}
+
+func (u *Uploader) post(path string, values url.Values) error {
+	req, err := http.NewRequest(http.MethodPost, u.config.Url+path, strings.NewReader(values.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Pvoutput-Apikey", u.config.ApiKey)
+	req.Header.Set("X-Pvoutput-SystemId", u.config.SystemId)
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	// 403 is also the answer to an exceeded rate limit
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests:
+		return &refusedError{resp.StatusCode, strings.TrimSpace(string(body))}
+	default:
+		return fmt.Errorf("%d %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+}
+
+func statusValues(s status) url.Values {
+	values := url.Values{}
+	values.Set("d", s.time.Format("20060102"))
+	values.Set("t", s.time.Format("15:04"))
+	for _, p := range []struct {
+		name  string
+		value *float64
+	}{{"v1", s.energyGeneration}, {"v2", s.powerGeneration}, {"v3", s.energyConsumption}, {"v4", s.powerConsumption}, {"v6", s.voltage}} {
+		if p.value != nil {
+			values.Set(p.name, formatValue(p.name, *p.value))
+		}
+	}
+	return values
+}
+
+// batchData encodes statuses as date,time,v1,v2,v3,v4,v5,v6 separated by semicolons, missing values are left empty
+func batchData(statuses []status) string {
+	lines := make([]string, 0, len(statuses))
+	for _, s := range statuses {
+		v := statusValues(s)
+		lines = append(lines, strings.Join([]string{v.Get("d"), v.Get("t"), v.Get("v1"), v.Get("v2"), v.Get("v3"), v.Get("v4"), v.Get("v5"), v.Get("v6")}, ","))
+	}
+	return strings.Join(lines, ";")
+}
+
+// formatValue writes energy and power as integers, the voltage with one decimal
+func formatValue(name string, v float64) string {
+	if name == "v6" {
+		return strconv.FormatFloat(v, 'f', 1, 64)
+	}
+	return strconv.FormatFloat(v, 'f', 0, 64)
+}
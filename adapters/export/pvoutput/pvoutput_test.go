@@ -0,0 +1,226 @@
+package pvoutput
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/misterdelle/invt_logger_reader/ports"
+)
+
+type request struct {
+	path   string
+	form   url.Values
+	header http.Header
+}
+
+// standIn is a local PVOutput answering with the queued status codes, then 200
+type standIn struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []request
+}
+
+func newUploader(t *testing.T, statuses ...int) (*Uploader, *standIn) {
+	s := &standIn{statuses: statuses}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+
+		s.mu.Lock()
+		s.requests = append(s.requests, request{path: r.URL.Path, form: r.PostForm, header: r.Header.Clone()})
+		status := http.StatusOK
+		if len(s.statuses) > 0 {
+			status, s.statuses = s.statuses[0], s.statuses[1:]
+		}
+		s.mu.Unlock()
+
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+
+	u, err := New(&PVOutputConfig{Url: server.URL + "/", ApiKey: "key", SystemId: "42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { u.Close(time.Second) })
+	return u, s
+}
+
+func (s *standIn) sent() []request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]request(nil), s.requests...)
+}
+
+// read inserts the status fields as published in the station topic
+func read(u *Uploader, at time.Time, pvEnergy string, pvPower string) {
+	u.Export(ports.NewSnapshot("", "station", map[string]interface{}{
+		"pvDayEnergy":             pvEnergy,
+		"totalPowerFromPV":        pvPower,
+		"loadDayEnergy":           "7.25",
+		"currentConsumptionPower": "650",
+	}, ports.RecordInfo{
+		PollTime: at,
+		Units:    map[string]string{"pvDayEnergy": "kWh", "totalPowerFromPV": "kW", "loadDayEnergy": "kWh", "currentConsumptionPower": "W"},
+	}))
+	u.Export(ports.NewSnapshot("", "GridOutput/Grid A", map[string]interface{}{"Inv A Voltage": "230.14"}, ports.RecordInfo{PollTime: at}))
+}
+
+func TestAddStatus(t *testing.T) {
+	u, s := newUploader(t)
+	at := time.Now().Truncate(5 * time.Minute)
+
+	read(u, at.Add(-time.Minute), "2.5", "1.5")
+	u.addStatus(at)
+	u.upload()
+
+	sent := s.sent()
+	if len(sent) != 1 {
+		t.Fatalf("%d requests, want 1", len(sent))
+	}
+	r := sent[0]
+	if r.path != "/service/r2/addstatus.jsp" {
+		t.Errorf("posted to %s", r.path)
+	}
+	if r.header.Get("X-Pvoutput-Apikey") != "key" || r.header.Get("X-Pvoutput-SystemId") != "42" {
+		t.Errorf("headers %v", r.header)
+	}
+
+	want := url.Values{
+		"d":  {at.Format("20060102")},
+		"t":  {at.Format("15:04")},
+		"v1": {"2500"},
+		"v2": {"1500"},
+		"v3": {"7250"},
+		"v4": {"650"},
+		"v6": {"230.1"},
+	}
+	if r.form.Encode() != want.Encode() {
+		t.Errorf("status %s, want %s", r.form.Encode(), want.Encode())
+	}
+}
+
+func TestInvalidValues(t *testing.T) {
+	u, s := newUploader(t)
+	at := time.Now().Truncate(5 * time.Minute)
+
+	read(u, at.Add(-time.Minute), "NaN", "1.5")
+	u.Export(ports.NewSnapshot("", "station", map[string]interface{}{"totalPowerFromPV": "99"}, ports.RecordInfo{
+		PollTime: at.Add(-time.Minute),
+		Quality:  map[string]string{"totalPowerFromPV": ports.QualityInvalid},
+	}))
+	u.addStatus(at)
+	u.upload()
+
+	sent := s.sent()
+	if len(sent) != 1 {
+		t.Fatalf("%d requests, want 1", len(sent))
+	}
+	if sent[0].form.Has("v1") || sent[0].form.Get("v2") != "1500" {
+		t.Errorf("status %s", sent[0].form.Encode())
+	}
+}
+
+func TestNoReadings(t *testing.T) {
+	u, s := newUploader(t)
+	at := time.Now().Truncate(5 * time.Minute)
+
+	read(u, at.Add(-6*time.Minute), "2.5", "1.5")
+	u.addStatus(at.Add(-5 * time.Minute))
+	// nothing read since the previous status
+	u.addStatus(at)
+	u.upload()
+
+	if sent := s.sent(); len(sent) != 1 || sent[0].form.Get("t") != at.Add(-5*time.Minute).Format("15:04") {
+		t.Errorf("sent %v, want only the first status", sent)
+	}
+}
+
+func TestMissedIntervals(t *testing.T) {
+	// the first upload fails, the second is rate limited
+	u, s := newUploader(t, http.StatusServiceUnavailable, http.StatusForbidden)
+	at := time.Now().Truncate(5 * time.Minute).Add(-15 * time.Minute)
+
+	for i := 0; i < 3; i++ {
+		t0 := at.Add(time.Duration(i) * 5 * time.Minute)
+		read(u, t0.Add(-time.Minute), strings.Repeat("1", i+1), "2")
+		u.addStatus(t0)
+		u.upload()
+	}
+
+	sent := s.sent()
+	if len(sent) != 3 {
+		t.Fatalf("%d requests, want 3", len(sent))
+	}
+	if sent[0].path != "/service/r2/addstatus.jsp" || sent[1].path != "/service/r2/addbatchstatus.jsp" || sent[2].path != "/service/r2/addbatchstatus.jsp" {
+		t.Errorf("posted to %s, %s and %s", sent[0].path, sent[1].path, sent[2].path)
+	}
+
+	var lines []string
+	for i := 0; i < 3; i++ {
+		t0 := at.Add(time.Duration(i) * 5 * time.Minute)
+		lines = append(lines, strings.Join([]string{t0.Format("20060102"), t0.Format("15:04"), strings.Repeat("1", i+1) + "000", "2000", "7250", "650", "", "230.1"}, ","))
+	}
+	if got, want := sent[2].form.Get("data"), strings.Join(lines, ";"); got != want {
+		t.Errorf("batch %s, want %s", got, want)
+	}
+	if len(u.pending) != 0 {
+		t.Errorf("%d statuses still pending", len(u.pending))
+	}
+}
+
+func TestBatchSize(t *testing.T) {
+	u, s := newUploader(t)
+	at := time.Now().Truncate(5 * time.Minute).Add(-time.Duration(batchSize+5) * 5 * time.Minute)
+
+	for i := 0; i < batchSize+5; i++ {
+		t0 := at.Add(time.Duration(i) * 5 * time.Minute)
+		read(u, t0.Add(-time.Minute), "1", "1")
+		u.addStatus(t0)
+	}
+	u.upload()
+
+	sent := s.sent()
+	if len(sent) != 2 {
+		t.Fatalf("%d requests, want 2", len(sent))
+	}
+	if n := strings.Count(sent[0].form.Get("data"), ";") + 1; n != batchSize {
+		t.Errorf("first batch of %d statuses, want %d", n, batchSize)
+	}
+	if n := strings.Count(sent[1].form.Get("data"), ";") + 1; n != 5 {
+		t.Errorf("second batch of %d statuses, want 5", n)
+	}
+}
+
+func TestRefused(t *testing.T) {
+	u, s := newUploader(t, http.StatusBadRequest)
+	at := time.Now().Truncate(5 * time.Minute)
+
+	read(u, at.Add(-time.Minute), "2.5", "1.5")
+	u.addStatus(at)
+	u.upload()
+	u.upload()
+
+	if sent := s.sent(); len(sent) != 1 {
+		t.Errorf("%d requests, a refused status must not be retried", len(sent))
+	}
+	if len(u.pending) != 0 {
+		t.Errorf("%d statuses still pending", len(u.pending))
+	}
+}
+
+func TestParseField(t *testing.T) {
+	f, err := ParseField("GridOutput/Grid A/Inv A Voltage")
+	if err != nil || f != (Field{"GridOutput/Grid A", "Inv A Voltage"}) {
+		t.Errorf("ParseField = %v, %v", f, err)
+	}
+	for _, s := range []string{"pvDayEnergy", "/pvDayEnergy", "station/"} {
+		if _, err := ParseField(s); err == nil {
+			t.Errorf("no error for %q", s)
+		}
+	}
+}
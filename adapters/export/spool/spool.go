@@ -0,0 +1,382 @@
+// Package spool is a bounded on-disk FIFO queue of messages that could not be exported,
+// kept as JSON lines so that it survives restarts
+package spool
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// drop policies, applied when the queue is full
+const (
+	// DropOldest discards the oldest messages to make room for the new one
+	DropOldest = "drop-oldest"
+	// DropNewest discards the message being queued
+	DropNewest = "drop-newest"
+)
+
+// defaults used when the limits are not configured
+const (
+	DefaultMaxMessages = 10000
+	DefaultMaxBytes    = 10 * 1024 * 1024
+)
+
+// compactMinBytes is the size of the sent messages at the head of the file before it is compacted,
+// the file is compacted once they also outweigh the queued ones
+const compactMinBytes = 1024 * 1024
+
+type Config struct {
+	// Path of the queue file, the queue is disabled when empty
+	Path        string `yaml:"path"`
+	MaxMessages int    `yaml:"maxMessages"`
+	MaxBytes    int64  `yaml:"maxBytes"`
+	DropPolicy  string `yaml:"dropPolicy"`
+}
+
+// Message is a queued message, Time is when it was first produced
+type Message struct {
+	Time    time.Time `json:"time"`
+	Topic   string    `json:"topic"`
+	QoS     byte      `json:"qos"`
+	Retain  bool      `json:"retain"`
+	Payload []byte    `json:"payload"`
+	// TimeTopic receives Time when the message is replayed, for payloads that do not carry it
+	TimeTopic string `json:"timeTopic,omitempty"`
+}
+
+// Queue appends the messages to the queue file and keeps the offset of the oldest queued one in a
+// second file (path.head), so that neither Push nor Pop rewrite the queue. The sent messages are
+// removed from the file when it is compacted, once they outweigh the queued ones
+type Queue struct {
+	config Config
+
+	mu       sync.Mutex
+	messages []Message
+	sizes    []int64
+	// size is the size of the queued messages, offset the size of the sent ones at the head of the file
+	size    int64
+	offset  int64
+	file    *os.File
+	head    *os.File
+	closed  bool
+	dropped int
+}
+
+var (
+	ErrFull   = errors.New("spool is full")
+	ErrClosed = errors.New("spool is closed")
+)
+
+// New opens the queue file, loading the messages left by a previous run
+func New(config Config) (*Queue, error) {
+	if config.MaxMessages <= 0 {
+		config.MaxMessages = DefaultMaxMessages
+	}
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = DefaultMaxBytes
+	}
+	switch config.DropPolicy {
+	case "":
+		config.DropPolicy = DropOldest
+	case DropOldest, DropNewest:
+	default:
+		return nil, fmt.Errorf("unknown spool drop policy %q, use %s or %s", config.DropPolicy, DropOldest, DropNewest)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(config.Path), 0o755); err != nil {
+		return nil, err
+	}
+
+	q := &Queue{config: config}
+
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+
+	// drop what does not fit the current limits and compact the file, this also gets rid of a
+	// line truncated by a crash before appending to it
+	for len(q.messages) > q.config.MaxMessages || q.size > q.config.MaxBytes {
+		q.removeFirst()
+		q.dropped++
+	}
+
+	var err error
+	q.head, err = os.OpenFile(q.headPath(), os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := q.compact(); err != nil {
+		q.head.Close()
+		return nil, err
+	}
+
+	if len(q.messages) > 0 {
+		log.Printf("spool %s: %d messages waiting to be sent", config.Path, len(q.messages))
+	}
+
+	return q, nil
+}
+
+func (q *Queue) headPath() string {
+	return q.config.Path + ".head"
+}
+
+// load reads the queued messages, from the offset saved in the head file
+func (q *Queue) load() error {
+	f, err := os.Open(q.config.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	offset, err := q.readHead()
+	if err != nil {
+		return err
+	}
+	if info, err := f.Stat(); err == nil && offset > info.Size() {
+		log.Printf("spool %s: head offset %d past the end of the file, reading it all", q.config.Path, offset)
+		offset = 0
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var m Message
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			// a line truncated by a crash, skip it
+			log.Printf("spool %s: skipping invalid message: %s", q.config.Path, err)
+			continue
+		}
+		q.append(m, int64(len(scanner.Bytes())+1))
+	}
+
+	return scanner.Err()
+}
+
+func (q *Queue) readHead() (int64, error) {
+	b, err := os.ReadFile(q.headPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	offset, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil || offset < 0 {
+		log.Printf("spool %s: invalid head offset %q, reading the whole file", q.config.Path, strings.TrimSpace(string(b)))
+		return 0, nil
+	}
+	return offset, nil
+}
+
+// Push appends a message, when the queue is full the drop policy decides which message is lost
+func (q *Queue) Push(m Message) error {
+	line, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	size := int64(len(line))
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+
+	if size > q.config.MaxBytes {
+		q.dropped++
+		return ErrFull
+	}
+
+	full := func() bool {
+		return len(q.messages) >= q.config.MaxMessages || q.size+size > q.config.MaxBytes
+	}
+
+	if full() {
+		if q.config.DropPolicy == DropNewest {
+			q.dropped++
+			return ErrFull
+		}
+
+		for full() {
+			q.removeFirst()
+			q.dropped++
+		}
+		if err := q.writeHead(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := q.file.Write(line); err != nil {
+		return err
+	}
+	q.append(m, size)
+
+	return q.maybeCompact()
+}
+
+// Peek returns the oldest message without removing it
+func (q *Queue) Peek() (Message, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.messages) == 0 {
+		return Message{}, false
+	}
+	return q.messages[0], true
+}
+
+// Pop removes the oldest message, usually after it has been sent. The head offset is written
+// without syncing, after a crash the last popped messages may be sent again (at least once delivery)
+func (q *Queue) Pop() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+	if len(q.messages) == 0 {
+		return nil
+	}
+	q.removeFirst()
+
+	if err := q.writeHead(); err != nil {
+		return err
+	}
+	return q.maybeCompact()
+}
+
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.messages)
+}
+
+// Dropped returns the number of messages lost because the queue was full
+func (q *Queue) Dropped() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.dropped
+}
+
+// Close syncs the queue file, Push and Pop fail afterwards
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+
+	err := errors.Join(q.file.Sync(), q.head.Sync())
+	return errors.Join(err, q.file.Close(), q.head.Close())
+}
+
+func (q *Queue) append(m Message, size int64) {
+	q.messages = append(q.messages, m)
+	q.sizes = append(q.sizes, size)
+	q.size += size
+}
+
+func (q *Queue) removeFirst() {
+	q.size -= q.sizes[0]
+	q.offset += q.sizes[0]
+	q.messages = q.messages[1:]
+	q.sizes = q.sizes[1:]
+}
+
+// writeHead saves the offset of the oldest queued message, the number is padded so that it
+// always overwrites the previous one
+func (q *Queue) writeHead() error {
+	_, err := q.head.WriteAt([]byte(fmt.Sprintf("%020d\n", q.offset)), 0)
+	return err
+}
+
+// maybeCompact empties the file once every message has been sent and compacts it when the
+// sent messages outweigh the queued ones, so that each message is copied once on average
+func (q *Queue) maybeCompact() error {
+	if len(q.messages) == 0 && q.offset > 0 {
+		return q.compact()
+	}
+	if q.offset >= compactMinBytes && q.offset >= q.size {
+		return q.compact()
+	}
+	return nil
+}
+
+// compact replaces the queue file with the messages still queued. The head offset is reset before
+// the new file takes the place of the old one: a crash in between sends the old messages again
+// rather than skipping new ones
+func (q *Queue) compact() error {
+	tmp := q.config.Path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	// the sizes are those of the new file, loaded messages may have been encoded differently
+	sizes := make([]int64, len(q.messages))
+	var size int64
+	w := bufio.NewWriter(f)
+	for i, m := range q.messages {
+		line, err := json.Marshal(m)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(line)
+		w.WriteByte('\n')
+		sizes[i] = int64(len(line) + 1)
+		size += sizes[i]
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+
+	q.sizes, q.size, q.offset = sizes, size, 0
+	if err := q.writeHead(); err != nil {
+		return err
+	}
+	if err := q.head.Sync(); err != nil {
+		return err
+	}
+
+	if q.file != nil {
+		q.file.Close()
+	}
+	if err := os.Rename(tmp, q.config.Path); err != nil {
+		return err
+	}
+
+	q.file, err = os.OpenFile(q.config.Path, os.O_APPEND|os.O_WRONLY, 0o600)
+	return err
+}
@@ -0,0 +1,269 @@
+package spool
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func message(i int) Message {
+	return Message{
+		Time:    time.Date(2024, 5, 1, 10, 0, i, 0, time.UTC),
+		Topic:   fmt.Sprintf("invt/topic/%d", i),
+		QoS:     1,
+		Retain:  true,
+		Payload: []byte(fmt.Sprintf("%d", i)),
+	}
+}
+
+func open(t *testing.T, config Config) *Queue {
+	t.Helper()
+
+	q, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+// drain pops every message, returning their topics
+func drain(t *testing.T, q *Queue) []string {
+	t.Helper()
+
+	var topics []string
+	for {
+		m, ok := q.Peek()
+		if !ok {
+			return topics
+		}
+		topics = append(topics, m.Topic)
+		if err := q.Pop(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func topics(from int, to int) []string {
+	var t []string
+	for i := from; i <= to; i++ {
+		t = append(t, message(i).Topic)
+	}
+	return t
+}
+
+func equal(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestOrder(t *testing.T) {
+	q := open(t, Config{Path: filepath.Join(t.TempDir(), "spool.jsonl")})
+	defer q.Close()
+
+	for i := 1; i <= 5; i++ {
+		if err := q.Push(message(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if q.Len() != 5 {
+		t.Fatalf("Len = %d, want 5", q.Len())
+	}
+
+	m, _ := q.Peek()
+	if m.Topic != message(1).Topic || string(m.Payload) != "1" || !m.Retain || m.QoS != 1 || !m.Time.Equal(message(1).Time) {
+		t.Errorf("Peek = %+v, want %+v", m, message(1))
+	}
+
+	if got := drain(t, q); !equal(got, topics(1, 5)) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool.jsonl")
+
+	q := open(t, Config{Path: path})
+	for i := 1; i <= 10; i++ {
+		q.Push(message(i))
+	}
+	for i := 0; i < 4; i++ {
+		q.Pop()
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the popped messages are not sent again
+	q = open(t, Config{Path: path})
+	if got := drain(t, q); !equal(got, topics(5, 10)) {
+		t.Errorf("got %v", got)
+	}
+	q.Close()
+}
+
+func TestReopenWithoutClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool.jsonl")
+
+	q := open(t, Config{Path: path})
+	for i := 1; i <= 3; i++ {
+		q.Push(message(i))
+	}
+	q.Pop()
+
+	// a crash leaves a truncated line at the end of the file
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"time":"2024-05-01T10:00:00Z","topic":"inv`)
+	f.Close()
+
+	reopened := open(t, Config{Path: path})
+	defer reopened.Close()
+	if got := drain(t, reopened); !equal(got, topics(2, 3)) {
+		t.Errorf("got %v", got)
+	}
+
+	// appending after the truncated line works once the file is compacted
+	reopened.Push(message(4))
+	if got := drain(t, reopened); !equal(got, topics(4, 4)) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestDropOldest(t *testing.T) {
+	q := open(t, Config{Path: filepath.Join(t.TempDir(), "spool.jsonl"), MaxMessages: 3})
+	defer q.Close()
+
+	for i := 1; i <= 5; i++ {
+		if err := q.Push(message(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if q.Dropped() != 2 {
+		t.Errorf("Dropped = %d, want 2", q.Dropped())
+	}
+	if got := drain(t, q); !equal(got, topics(3, 5)) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestDropNewest(t *testing.T) {
+	q := open(t, Config{Path: filepath.Join(t.TempDir(), "spool.jsonl"), MaxMessages: 3, DropPolicy: DropNewest})
+	defer q.Close()
+
+	for i := 1; i <= 5; i++ {
+		err := q.Push(message(i))
+		if i > 3 && !errors.Is(err, ErrFull) {
+			t.Errorf("Push %d: %v, want ErrFull", i, err)
+		}
+	}
+	if q.Dropped() != 2 {
+		t.Errorf("Dropped = %d, want 2", q.Dropped())
+	}
+	if got := drain(t, q); !equal(got, topics(1, 3)) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	q := open(t, Config{Path: filepath.Join(t.TempDir(), "spool.jsonl"), MaxBytes: 300})
+	defer q.Close()
+
+	if err := q.Push(Message{Topic: "big", Payload: make([]byte, 400)}); !errors.Is(err, ErrFull) {
+		t.Errorf("message larger than the spool: %v, want ErrFull", err)
+	}
+
+	for i := 1; i <= 10; i++ {
+		q.Push(message(i))
+	}
+	if q.size > 300 {
+		t.Errorf("size %d over the limit", q.size)
+	}
+	got := drain(t, q)
+	if len(got) == 0 || got[len(got)-1] != message(10).Topic {
+		t.Errorf("got %v, want the newest messages", got)
+	}
+}
+
+func TestInvalidDropPolicy(t *testing.T) {
+	if _, err := New(Config{Path: filepath.Join(t.TempDir(), "spool.jsonl"), DropPolicy: "drop-random"}); err == nil {
+		t.Error("no error")
+	}
+}
+
+func TestClosed(t *testing.T) {
+	q := open(t, Config{Path: filepath.Join(t.TempDir(), "spool.jsonl")})
+	q.Push(message(1))
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.Push(message(2)); !errors.Is(err, ErrClosed) {
+		t.Errorf("Push after Close: %v, want ErrClosed", err)
+	}
+	if err := q.Pop(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Pop after Close: %v, want ErrClosed", err)
+	}
+	if err := q.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
+
+// TestFileBounded checks that a full queue does not rewrite the file for every message and that
+// the sent messages are eventually removed from it
+func TestFileBounded(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool.jsonl")
+	q := open(t, Config{Path: path, MaxMessages: 100})
+	defer q.Close()
+
+	before, _ := os.Stat(path)
+	for i := 1; i <= 200; i++ {
+		q.Push(message(i))
+	}
+	after, _ := os.Stat(path)
+
+	// the file has been appended to, not replaced
+	if !os.SameFile(before, after) {
+		t.Error("queue file replaced while pushing")
+	}
+	if q.offset == 0 {
+		t.Error("dropped messages not skipped through the head offset")
+	}
+
+	// draining the queue empties the file
+	drain(t, q)
+	info, _ := os.Stat(path)
+	if info.Size() != 0 {
+		t.Errorf("file size %d after draining, want 0", info.Size())
+	}
+
+	// past compactMinBytes the sent messages are removed once they outweigh the queued ones
+	payload := make([]byte, 20*1024)
+	for i := 0; i < 90; i++ {
+		q.Push(Message{Topic: "big", Payload: payload})
+	}
+	for i := 0; i < 60; i++ {
+		q.Pop()
+	}
+	info, _ = os.Stat(path)
+	if info.Size() > 2*q.size+compactMinBytes {
+		t.Errorf("file size %d with %d bytes queued", info.Size(), q.size)
+	}
+	if q.offset >= compactMinBytes {
+		t.Errorf("%d bytes of sent messages left in the file", q.offset)
+	}
+	if q.Len() != 30 {
+		t.Errorf("Len = %d, want 30", q.Len())
+	}
+}
@@ -0,0 +1,372 @@
+// Package webhook posts the records of every poll cycle as JSON to an HTTP endpoint
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/misterdelle/invt_logger_reader/ports"
+)
+
+const (
+	defaultBatchSize  = 100
+	defaultMaxRetries = 3
+	requestTimeout    = 30 * time.Second
+	// queueSize is the number of requests waiting for a slow endpoint, the oldest are dropped past it
+	queueSize = 100
+
+	// SignatureHeader carries sha256=<hex HMAC-SHA256 of timestamp.body> when a secret is configured
+	SignatureHeader = "X-Webhook-Signature-256"
+	// TimestampHeader carries the unix time of the request, part of the signed content
+	TimestampHeader = "X-Webhook-Timestamp"
+)
+
+// retryDelay is the wait before the first retry, it grows with every attempt
+var retryDelay = 2 * time.Second
+
+var errClosed = errors.New("webhook closed")
+
+type WebhookConfig struct {
+	// Url is a template receiving URLData, e.g. https://example.com/hooks/{{.Serial}}/{{path .Group}};
+	// records are sent in a request per distinct URL
+	Url    string `yaml:"url"`
+	Method string `yaml:"method"`
+	// Headers are added to every request, e.g. Authorization
+	Headers map[string]string `yaml:"headers"`
+	// Secret signs the requests with HMAC-SHA256, unsigned when empty
+	Secret string `yaml:"secret"`
+	// Serial is the logger serial, available to the URL template
+	Serial string `yaml:"serial"`
+	// BatchSize is the maximum number of records of a request
+	BatchSize int `yaml:"batchSize"`
+	// MaxRetries is the number of further attempts for a request failed with a temporary error, 0 disables
+	// the retries and a negative value takes the default
+	MaxRetries int `yaml:"maxRetries"`
+}
+
+// URLData is the data given to the URL template
+type URLData struct {
+	Serial   string
+	Topic    string
+	Group    string
+	Subgroup string
+}
+
+var urlTemplateFuncs = template.FuncMap{
+	"lower": strings.ToLower,
+	"path":  url.PathEscape,
+	"query": url.QueryEscape,
+}
+
+// Record is a record as sent to the endpoint, laid out like the MQTT json payload
+type Record struct {
+	DeviceID     string                 `json:"deviceId,omitempty"`
+	Topic        string                 `json:"topic"`
+	PollTime     time.Time              `json:"pollTime"`
+	InverterTime *time.Time             `json:"inverterTime,omitempty"`
+	Values       map[string]interface{} `json:"values"`
+	Units        map[string]string      `json:"units,omitempty"`
+	Quality      map[string]string      `json:"quality,omitempty"`
+}
+
+// Payload is the body of a request
+type Payload struct {
+	Time    time.Time `json:"time"`
+	Records []Record  `json:"records"`
+}
+
+type request struct {
+	url     string
+	records []Record
+}
+
+// Webhook collects the records of a poll cycle and posts them when the cycle completes, or as soon as
+// a batch is full. Requests are sent in the background, failures are retried. It implements ports.Exporter
+type Webhook struct {
+	config WebhookConfig
+	url    *template.Template
+	client *http.Client
+
+	mu      sync.Mutex
+	pending map[string][]Record
+	// urls keeps the order the URLs have been first used in the cycle
+	urls   []string
+	closed bool
+
+	queue chan request
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func New(config *WebhookConfig) (*Webhook, error) {
+	cfg := *config
+	if cfg.Url == "" {
+		return nil, errors.New("webhook URL is required")
+	}
+	if cfg.Method == "" {
+		cfg.Method = http.MethodPost
+	}
+	cfg.Method = strings.ToUpper(cfg.Method)
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultBatchSize
+	}
+	if cfg.MaxRetries < 0 {
+		cfg.MaxRetries = defaultMaxRetries
+	}
+
+	tmpl, err := template.New("url").Funcs(urlTemplateFuncs).Option("missingkey=error").Parse(cfg.Url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook URL template: %w", err)
+	}
+
+	// the template is checked once, a bad URL would otherwise only be reported at the first cycle
+	sample, err := render(tmpl, URLData{Serial: cfg.Serial, Topic: "station", Group: "station"})
+	if err != nil {
+		return nil, err
+	}
+	if u, err := url.Parse(sample); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook URL %q", sample)
+	}
+
+	h := &Webhook{
+		config:  cfg,
+		url:     tmpl,
+		client:  &http.Client{Timeout: requestTimeout},
+		pending: make(map[string][]Record),
+		queue:   make(chan request, queueSize),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	go h.run()
+
+	return h, nil
+}
+
+func render(tmpl *template.Template, data URLData) (string, error) {
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("webhook URL template: %w", err)
+	}
+	return b.String(), nil
+}
+
+// Export queues a snapshot for the current cycle
+func (h *Webhook) Export(snapshot ports.Snapshot) error {
+	group, subgroup, _ := strings.Cut(snapshot.Group(), "/")
+	target, err := render(h.url, URLData{Serial: h.config.Serial, Topic: snapshot.Group(), Group: group, Subgroup: subgroup})
+	if err != nil {
+		return err
+	}
+
+	record := Record{
+		DeviceID: snapshot.DeviceID(),
+		Topic:    snapshot.Group(),
+		PollTime: snapshot.PollTime(),
+		Values:   make(map[string]interface{}, snapshot.Len()),
+		Units:    make(map[string]string),
+		Quality:  make(map[string]string),
+	}
+	if t := snapshot.SourceTime(); !t.IsZero() {
+		record.InverterTime = &t
+	}
+	for _, m := range snapshot.Measurements() {
+		record.Values[m.Field] = m.JSONValue()
+		if m.Unit != "" {
+			record.Units[m.Field] = m.Unit
+		}
+		if m.Quality != "" {
+			record.Quality[m.Field] = m.Quality
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return errClosed
+	}
+
+	if _, ok := h.pending[target]; !ok {
+		h.urls = append(h.urls, target)
+	}
+	h.pending[target] = append(h.pending[target], record)
+	if len(h.pending[target]) >= h.config.BatchSize {
+		h.enqueue(request{url: target, records: h.pending[target]})
+		h.pending[target] = nil
+	}
+
+	return nil
+}
+
+// CycleComplete sends the records collected since the previous cycle, also when it stopped at a failing query
+func (h *Webhook) CycleComplete(complete bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.flush()
+}
+
+// flush queues a request per URL, h.mu must be held
+func (h *Webhook) flush() {
+	for _, target := range h.urls {
+		if records := h.pending[target]; len(records) > 0 {
+			h.enqueue(request{url: target, records: records})
+		}
+	}
+	h.pending = make(map[string][]Record)
+	h.urls = nil
+}
+
+// enqueue hands a request over to the sender, dropping the oldest one when the endpoint does not keep up
+func (h *Webhook) enqueue(r request) {
+	for {
+		select {
+		case h.queue <- r:
+			return
+		default:
+		}
+
+		select {
+		case old := <-h.queue:
+			log.Printf("webhook queue full, %d records for %s dropped", len(old.records), old.url)
+		default:
+		}
+	}
+}
+
+// Close sends the collected records, waiting at most timeout
+func (h *Webhook) Close(timeout time.Duration) error {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return nil
+	}
+	h.closed = true
+	h.flush()
+	h.mu.Unlock()
+
+	close(h.stop)
+
+	select {
+	case <-h.done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("pending webhook requests not completed within %s", timeout)
+	}
+}
+
+func (h *Webhook) run() {
+	defer close(h.done)
+
+	for {
+		select {
+		case r := <-h.queue:
+			h.deliver(r, true)
+		case <-h.stop:
+			// the requests queued before closing are sent once
+			for {
+				select {
+				case r := <-h.queue:
+					h.deliver(r, false)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliver sends a request, retrying temporary failures; a request still failing after the retries is dropped
+func (h *Webhook) deliver(r request, retry bool) {
+	body, err := json.Marshal(Payload{Time: time.Now(), Records: r.records})
+	if err != nil {
+		log.Printf("error encoding webhook payload: %s", err)
+		return
+	}
+
+	attempts := 1
+	if retry {
+		attempts += h.config.MaxRetries
+	}
+
+	for attempt := 1; attempt <= attempts; attempt++ {
+		var temporary bool
+		temporary, err = h.send(r.url, body)
+		if err == nil || !temporary {
+			break
+		}
+
+		if attempt < attempts {
+			log.Printf("webhook request to %s failed (attempt %d of %d): %s", r.url, attempt, attempts, err)
+			select {
+			case <-time.After(retryDelay * time.Duration(attempt)):
+			case <-h.stop:
+				// shutting down, one last attempt
+				attempts = attempt + 1
+			}
+		}
+	}
+
+	if err != nil {
+		log.Printf("error sending %d records to %s, dropped: %s", len(r.records), r.url, err)
+	}
+}
+
+// send posts a payload, temporary reports whether the request may succeed if retried
+func (h *Webhook) send(target string, body []byte) (temporary bool, err error) {
+	req, err := http.NewRequest(h.config.Method, target, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range h.config.Headers {
+		req.Header.Set(k, v)
+	}
+
+	if h.config.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(TimestampHeader, timestamp)
+		req.Header.Set(SignatureHeader, "sha256="+Sign(h.config.Secret, timestamp, body))
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return false, nil
+	}
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// Sign returns the hex HMAC-SHA256 of timestamp.body, receivers compute it the same way to
+// check the SignatureHeader
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
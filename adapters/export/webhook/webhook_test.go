@@ -0,0 +1,193 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/misterdelle/invt_logger_reader/ports"
+)
+
+func init() {
+	retryDelay = 10 * time.Millisecond
+}
+
+type received struct {
+	path    string
+	header  http.Header
+	body    []byte
+	payload Payload
+}
+
+// standIn is a local endpoint answering with the queued status codes, then 204
+type standIn struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []received
+	server   *httptest.Server
+}
+
+func newStandIn(t *testing.T, statuses ...int) *standIn {
+	s := &standIn{statuses: statuses}
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var p Payload
+		json.Unmarshal(body, &p)
+
+		s.mu.Lock()
+		s.requests = append(s.requests, received{path: r.URL.Path, header: r.Header.Clone(), body: body, payload: p})
+		status := http.StatusNoContent
+		if len(s.statuses) > 0 {
+			status, s.statuses = s.statuses[0], s.statuses[1:]
+		}
+		s.mu.Unlock()
+
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+func (s *standIn) received() []received {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]received(nil), s.requests...)
+}
+
+// wait waits for n requests, then a little more for a wrong extra one
+func (s *standIn) wait(n int) []received {
+	deadline := time.Now().Add(2 * time.Second)
+	for len(s.received()) < n && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	return s.received()
+}
+
+func TestCycle(t *testing.T) {
+	s := newStandIn(t)
+	h, err := New(&WebhookConfig{Url: s.server.URL + "/hooks/{{.Serial}}/{{lower .Group}}", Serial: "2333571751", Secret: "secret", Headers: map[string]string{"Authorization": "Bearer token"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close(time.Second)
+
+	at := time.Date(2024, 5, 1, 10, 15, 0, 0, time.UTC)
+	h.Export(ports.NewSnapshot("", "GridOutput/Grid A", map[string]interface{}{"Inv A Power": "276", "Inv A Voltage": math.NaN()}, ports.RecordInfo{PollTime: at, Units: map[string]string{"Inv A Power": "W"}}))
+	h.Export(ports.NewSnapshot("", "GridOutput/Grid B", map[string]interface{}{"Inv B Power": 300}, ports.RecordInfo{PollTime: at}))
+	h.Export(ports.NewSnapshot("", "station", map[string]interface{}{"Work Mode": "Self use"}, ports.RecordInfo{PollTime: at}))
+
+	if got := s.wait(0); len(got) != 0 {
+		t.Fatalf("%d requests before the end of the cycle", len(got))
+	}
+	h.CycleComplete(true)
+
+	got := s.wait(2)
+	if len(got) != 2 {
+		t.Fatalf("%d requests, want one per URL", len(got))
+	}
+	if got[0].path != "/hooks/2333571751/gridoutput" || got[1].path != "/hooks/2333571751/station" {
+		t.Errorf("posted to %s and %s", got[0].path, got[1].path)
+	}
+
+	r := got[0]
+	if len(r.payload.Records) != 2 {
+		t.Fatalf("%d records, want 2", len(r.payload.Records))
+	}
+	record := r.payload.Records[0]
+	if record.Topic != "GridOutput/Grid A" || !record.PollTime.Equal(at) || record.Values["Inv A Power"] != 276.0 || record.Values["Inv A Voltage"] != "NaN" || record.Units["Inv A Power"] != "W" {
+		t.Errorf("record %+v", record)
+	}
+
+	if r.header.Get("Authorization") != "Bearer token" {
+		t.Errorf("headers %v", r.header)
+	}
+	if want := "sha256=" + Sign("secret", r.header.Get(TimestampHeader), r.body); r.header.Get(SignatureHeader) != want {
+		t.Errorf("signature %s, want %s", r.header.Get(SignatureHeader), want)
+	}
+}
+
+func TestBatchSize(t *testing.T) {
+	s := newStandIn(t)
+	h, err := New(&WebhookConfig{Url: s.server.URL, BatchSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		h.Export(ports.NewSnapshot("", "station", map[string]interface{}{"n": i}, ports.RecordInfo{PollTime: time.Now()}))
+	}
+	if got := s.wait(2); len(got) != 2 {
+		t.Errorf("%d requests before the end of the cycle, want the 2 full batches", len(got))
+	}
+
+	// the rest is sent when closing
+	if err := h.Close(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	got := s.received()
+	if len(got) != 3 || len(got[2].payload.Records) != 1 {
+		t.Errorf("%d requests, want 3", len(got))
+	}
+
+	if err := h.Export(ports.NewSnapshot("", "station", map[string]interface{}{"n": 6}, ports.RecordInfo{})); err == nil {
+		t.Error("export after Close accepted")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name       string
+		statuses   []int
+		maxRetries int
+		requests   int
+	}{
+		{"server error retried", []int{http.StatusServiceUnavailable, http.StatusInternalServerError}, 3, 3},
+		{"rate limit retried", []int{http.StatusTooManyRequests}, 3, 2},
+		{"bad request dropped", []int{http.StatusBadRequest}, 3, 1},
+		{"retries exhausted", []int{500, 500, 500, 500, 500}, 2, 3},
+		{"retries disabled", []int{http.StatusServiceUnavailable}, 0, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStandIn(t, tt.statuses...)
+			h, err := New(&WebhookConfig{Url: s.server.URL, MaxRetries: tt.maxRetries})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h.Export(ports.NewSnapshot("", "inverter", map[string]interface{}{"n": 1}, ports.RecordInfo{PollTime: time.Now()}))
+			h.CycleComplete(true)
+
+			got := s.wait(tt.requests)
+			h.Close(time.Second)
+
+			if len(got) != tt.requests {
+				t.Errorf("%d requests, want %d", len(got), tt.requests)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	h, err := New(&WebhookConfig{Url: "https://example.com/{{.Group}}", MaxRetries: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close(time.Second)
+	if h.config.MaxRetries != defaultMaxRetries || h.config.Method != http.MethodPost || h.config.BatchSize != defaultBatchSize {
+		t.Errorf("defaults %+v", h.config)
+	}
+
+	for _, u := range []string{"", "example.com/hook", "ftp://example.com", "https://example.com/{{.Missing}}", "https://example.com/{{"} {
+		if _, err := New(&WebhookConfig{Url: u}); err == nil {
+			t.Errorf("no error for %q", u)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+// Package modbus serves registers to Modbus TCP clients
+package modbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// function codes
+const (
+	readHoldingRegisters   = 0x03
+	readInputRegisters     = 0x04
+	writeSingleRegister    = 0x06
+	writeMultipleRegisters = 0x10
+)
+
+// exception codes
+const (
+	illegalFunction    = 0x01
+	illegalDataAddress = 0x02
+	illegalDataValue   = 0x03
+	// gatewayTargetFailed answers reads of registers older than MaxAge, the inverter is not answering
+	gatewayTargetFailed = 0x0B
+)
+
+const (
+	// maxReadCount is the maximum number of registers of a read request
+	maxReadCount = 125
+	// maxFrame is the largest MBAP length accepted, unit id and PDU
+	maxFrame    = 254
+	idleTimeout = 5 * time.Minute
+)
+
+// Registers is the source of the served registers
+type Registers interface {
+	// Read returns count registers from address and the time the oldest of them has been read,
+	// ok is false when any of them is unknown
+	Read(address uint16, count uint16) (values []uint16, oldest time.Time, ok bool)
+}
+
+type ServerConfig struct {
+	// Listen is the address of the server, e.g. :502
+	Listen string `yaml:"listen"`
+	// MaxAge is the age past which registers are no longer served, never when 0
+	MaxAge time.Duration `yaml:"maxAge"`
+}
+
+// Server answers read requests from the registers, for any unit id. Holding and input
+// registers are the same, writes are refused
+type Server struct {
+	config    ServerConfig
+	registers Registers
+	listener  net.Listener
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// New starts a server on config.Listen
+func New(config *ServerConfig, registers Registers) (*Server, error) {
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		config:    *config,
+		registers: registers,
+		listener:  listener,
+		conns:     make(map[net.Conn]struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.accept()
+
+	return s, nil
+}
+
+// Addr returns the address the server is listening on
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Close stops accepting clients and disconnects the connected ones
+func (s *Server) Close(timeout time.Duration) error {
+	s.mu.Lock()
+	s.closed = true
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+
+	err := s.listener.Close()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		return errors.New("timeout waiting for Modbus clients")
+	}
+	return err
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Modbus TCP accept failed: %s", err)
+			}
+			return
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go s.serve(conn)
+	}
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	header := make([]byte, 7)
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+
+		// MBAP header: transaction id, protocol id, length, unit id
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+
+		protocol := binary.BigEndian.Uint16(header[2:4])
+		length := binary.BigEndian.Uint16(header[4:6])
+		if protocol != 0 || length < 2 || length > maxFrame {
+			log.Printf("invalid Modbus TCP frame from %s, closing connection", conn.RemoteAddr())
+			return
+		}
+
+		pdu := make([]byte, length-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			return
+		}
+
+		reply := s.handle(pdu)
+
+		frame := make([]byte, 7+len(reply))
+		copy(frame, header[0:4])
+		binary.BigEndian.PutUint16(frame[4:6], uint16(len(reply)+1))
+		frame[6] = header[6]
+		copy(frame[7:], reply)
+
+		if _, err := conn.Write(frame); err != nil {
+			return
+		}
+	}
+}
+
+// handle returns the reply PDU of a request PDU
+func (s *Server) handle(pdu []byte) []byte {
+	function := pdu[0]
+
+	switch function {
+	case readHoldingRegisters, readInputRegisters:
+		if len(pdu) != 5 {
+			return exception(function, illegalDataValue)
+		}
+
+		address := binary.BigEndian.Uint16(pdu[1:3])
+		count := binary.BigEndian.Uint16(pdu[3:5])
+		if count < 1 || count > maxReadCount {
+			return exception(function, illegalDataValue)
+		}
+		if uint32(address)+uint32(count) > 0x10000 {
+			return exception(function, illegalDataAddress)
+		}
+
+		values, oldest, ok := s.registers.Read(address, count)
+		if !ok {
+			return exception(function, illegalDataAddress)
+		}
+		if s.config.MaxAge > 0 && time.Since(oldest) > s.config.MaxAge {
+			return exception(function, gatewayTargetFailed)
+		}
+
+		reply := make([]byte, 2+2*len(values))
+		reply[0] = function
+		reply[1] = byte(2 * len(values))
+		for i, v := range values {
+			binary.BigEndian.PutUint16(reply[2+2*i:], v)
+		}
+		return reply
+	case writeSingleRegister, writeMultipleRegisters:
+		// the inverter settings are written through the commands, never by third parties
+		return exception(function, illegalFunction)
+	default:
+		return exception(function, illegalFunction)
+	}
+}
+
+func exception(function byte, code byte) []byte {
+	return []byte{function | 0x80, code}
+}
+
+// Chain serves the registers from the first source having all of them
+type Chain []Registers
+
+func (c Chain) Read(address uint16, count uint16) ([]uint16, time.Time, bool) {
+	for _, r := range c {
+		if values, oldest, ok := r.Read(address, count); ok {
+			return values, oldest, true
+		}
+	}
+	return nil, time.Time{}, false
+}
@@ -0,0 +1,160 @@
+package modbus
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// registers serves the registers from 100 to 109, address + 1 each
+type registers struct {
+	oldest time.Time
+}
+
+func (r registers) Read(address uint16, count uint16) ([]uint16, time.Time, bool) {
+	if address < 100 || address+count > 110 {
+		return nil, time.Time{}, false
+	}
+	values := make([]uint16, count)
+	for i := range values {
+		values[i] = address + uint16(i) + 1
+	}
+	return values, r.oldest, true
+}
+
+// pipe serves s on one end of a net.Pipe and returns the other end
+func pipe(t *testing.T, s *Server) net.Conn {
+	t.Helper()
+
+	server, client := net.Pipe()
+	s.conns[server] = struct{}{}
+	s.wg.Add(1)
+	go s.serve(server)
+
+	t.Cleanup(func() {
+		client.Close()
+		s.wg.Wait()
+	})
+	return client
+}
+
+func newTestServer(maxAge time.Duration, oldest time.Time) *Server {
+	return &Server{
+		config:    ServerConfig{MaxAge: maxAge},
+		registers: registers{oldest: oldest},
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// request sends the PDU in a frame of transaction id 0x1234 for unit 1 and returns the reply PDU
+func request(t *testing.T, conn net.Conn, pdu []byte) []byte {
+	t.Helper()
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	frame := append([]byte{0x12, 0x34, 0, 0, 0, byte(len(pdu) + 1), 1}, pdu...)
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := make([]byte, 260)
+	n, err := conn.Read(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply = reply[:n]
+	if n < 8 || !bytes.Equal(reply[0:4], frame[0:4]) || int(reply[5]) != n-6 || reply[6] != 1 {
+		t.Fatalf("invalid reply frame % x", reply)
+	}
+	return reply[7:]
+}
+
+func TestServe(t *testing.T) {
+	conn := pipe(t, newTestServer(time.Minute, time.Now()))
+
+	tests := []struct {
+		name  string
+		pdu   []byte
+		reply []byte
+	}{
+		{"holding registers", []byte{readHoldingRegisters, 0, 100, 0, 2}, []byte{readHoldingRegisters, 4, 0, 101, 0, 102}},
+		{"input registers", []byte{readInputRegisters, 0, 109, 0, 1}, []byte{readInputRegisters, 2, 0, 110}},
+		{"unknown register", []byte{readHoldingRegisters, 0, 109, 0, 2}, []byte{readHoldingRegisters | 0x80, illegalDataAddress}},
+		{"past the address space", []byte{readHoldingRegisters, 0xFF, 0xFF, 0, 2}, []byte{readHoldingRegisters | 0x80, illegalDataAddress}},
+		{"no register", []byte{readHoldingRegisters, 0, 100, 0, 0}, []byte{readHoldingRegisters | 0x80, illegalDataValue}},
+		{"too many registers", []byte{readInputRegisters, 0, 100, 0, maxReadCount + 1}, []byte{readInputRegisters | 0x80, illegalDataValue}},
+		{"short request", []byte{readHoldingRegisters, 0, 100}, []byte{readHoldingRegisters | 0x80, illegalDataValue}},
+		{"write", []byte{writeSingleRegister, 0, 100, 0, 1}, []byte{writeSingleRegister | 0x80, illegalFunction}},
+		{"write multiple", []byte{writeMultipleRegisters, 0, 100, 0, 1, 2, 0, 1}, []byte{writeMultipleRegisters | 0x80, illegalFunction}},
+		{"unknown function", []byte{0x2B, 0x0E, 1, 0}, []byte{0x2B | 0x80, illegalFunction}},
+	}
+	// all requests go through the same connection
+	for _, tt := range tests {
+		if got := request(t, conn, tt.pdu); !bytes.Equal(got, tt.reply) {
+			t.Errorf("%s: reply % x, want % x", tt.name, got, tt.reply)
+		}
+	}
+}
+
+func TestServeMaxAge(t *testing.T) {
+	read := []byte{readHoldingRegisters, 0, 100, 0, 1}
+
+	conn := pipe(t, newTestServer(time.Minute, time.Now().Add(-2*time.Minute)))
+	if got := request(t, conn, read); !bytes.Equal(got, []byte{readHoldingRegisters | 0x80, gatewayTargetFailed}) {
+		t.Errorf("stale registers: reply % x", got)
+	}
+
+	// no maximum age
+	conn = pipe(t, newTestServer(0, time.Now().Add(-24*time.Hour)))
+	if got := request(t, conn, read); !bytes.Equal(got, []byte{readHoldingRegisters, 2, 0, 101}) {
+		t.Errorf("reply % x", got)
+	}
+}
+
+func TestServeInvalidFrame(t *testing.T) {
+	for name, frame := range map[string][]byte{
+		"protocol":   {0, 1, 0, 1, 0, 6, 1, readHoldingRegisters, 0, 100, 0, 1},
+		"no PDU":     {0, 1, 0, 0, 0, 1, 1},
+		"too long":   {0, 1, 0, 0, 0x01, 0x00, 1},
+		"no unit id": {0, 1, 0, 0, 0, 0, 1},
+	} {
+		conn := pipe(t, newTestServer(0, time.Now()))
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		// the server may close the pipe before the whole frame is written
+		conn.Write(frame)
+		// the server closes the connection without replying
+		if n, err := conn.Read(make([]byte, 260)); err == nil {
+			t.Errorf("%s: read %d bytes", name, n)
+		}
+	}
+}
+
+func TestChain(t *testing.T) {
+	now := time.Now()
+	chain := Chain{registers{oldest: now}, Chain{}, fixed{address: 200, value: 7, oldest: now.Add(-time.Hour)}}
+
+	if values, oldest, ok := chain.Read(100, 2); !ok || len(values) != 2 || !oldest.Equal(now) {
+		t.Errorf("Read(100, 2) = %v, %s, %t", values, oldest, ok)
+	}
+	// from the first source having all the registers
+	if values, oldest, ok := chain.Read(200, 1); !ok || values[0] != 7 || !oldest.Equal(now.Add(-time.Hour)) {
+		t.Errorf("Read(200, 1) = %v, %s, %t", values, oldest, ok)
+	}
+	if _, _, ok := chain.Read(109, 2); ok {
+		t.Error("Read(109, 2) found registers no source has")
+	}
+}
+
+// fixed serves a single register
+type fixed struct {
+	address uint16
+	value   uint16
+	oldest  time.Time
+}
+
+func (f fixed) Read(address uint16, count uint16) ([]uint16, time.Time, bool) {
+	if address != f.address || count != 1 {
+		return nil, time.Time{}, false
+	}
+	return []uint16{f.value}, f.oldest, true
+}
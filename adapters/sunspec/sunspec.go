@@ -0,0 +1,547 @@
+// Package sunspec translates the INVT measurements into SunSpec models, so that the inverter
+// can be read over Modbus TCP like any SunSpec device
+package sunspec
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/misterdelle/invt_logger_reader/ports"
+)
+
+// DefaultBase is the usual SunSpec base address, some clients also probe 0 and 50000
+const DefaultBase = 40000
+
+// model ids and lengths, the length excludes the id and length registers
+const (
+	modelCommon   = 1
+	lenCommon     = 66
+	modelInverter = 103
+	lenInverter   = 50
+	modelStorage  = 124
+	lenStorage    = 24
+	modelBattery  = 802
+	lenBattery    = 62
+	modelEnd      = 0xFFFF
+)
+
+// values of the registers that are not implemented
+const (
+	notImplementedU16 = 0xFFFF
+	notImplementedS16 = 0x8000
+	notImplementedSF  = 0x8000
+	notImplementedU32 = 0xFFFFFFFF
+	notImplementedAcc = 0
+)
+
+// operating states of model 103 St
+const (
+	stateSleeping = 2
+	stateMPPT     = 4
+)
+
+// charge states of model 124 ChaSt and model 802 ChaSt
+const (
+	chargeEmpty       = 2
+	chargeDischarging = 3
+	chargeCharging    = 4
+	chargeFull        = 5
+	chargeHolding     = 6
+)
+
+// battery values of model 802
+const (
+	batteryLiIon     = 4
+	batteryConnected = 3
+)
+
+// idlePower is the battery power (W) below which the battery is holding
+const idlePower = 10
+
+type SunSpecConfig struct {
+	Base uint16 `yaml:"base"`
+	// identity published in the common model
+	Manufacturer string `yaml:"manufacturer"`
+	Model        string `yaml:"model"`
+	Version      string `yaml:"version"`
+	Serial       string `yaml:"serial"`
+	// BatteryCapacity (Wh) and BatteryMaxPower (W) are published in the battery model, not implemented when 0
+	BatteryCapacity float64 `yaml:"batteryCapacity"`
+	BatteryMaxPower float64 `yaml:"batteryMaxPower"`
+}
+
+type field struct {
+	topic string
+	field string
+}
+
+// reading is a field value in SunSpec units and the time it has been polled
+type reading struct {
+	value float64
+	time  time.Time
+}
+
+// fields read by the models
+var (
+	gridCurrent   = []field{{"GridOutput/Grid A", "Inv A Current"}, {"GridOutput/Grid B", "Inv B Current"}, {"GridOutput/Grid C", "Inv C Current"}}
+	gridVoltage   = []field{{"GridOutput/Grid A", "Inv A Voltage"}, {"GridOutput/Grid B", "Inv B Voltage"}, {"GridOutput/Grid C", "Inv C Voltage"}}
+	gridPower     = []field{{"GridOutput/Grid A", "Inv A Power"}, {"GridOutput/Grid B", "Inv B Power"}, {"GridOutput/Grid C", "Inv C Power"}}
+	gridFrequency = field{"GridOutput", "Grid Freq"}
+	pvTotalEnergy = field{"station", "pvTotalEnergy"}
+	pvCurrent     = []field{{"PVOutput/PV1", "Current PV 1"}, {"PVOutput/PV2", "Current PV 2"}}
+	pvVoltage     = []field{{"PVOutput/PV1", "Voltage PV 1"}, {"PVOutput/PV2", "Voltage PV 2"}}
+	pvPower       = field{"station", "totalPowerFromPV"}
+	cabinetTemp   = field{"GridOutput", "Inv 1 Temperature"}
+	sinkTemp      = field{"GridOutput", "Inv 2 Temperature"}
+	otherTemp     = field{"EnergyTodayTotals", "DC DC Temperature"}
+	batterySOC    = field{"BatteryOutput/BAT", "BAT SOC"}
+	batteryV      = field{"BatteryOutput/BAT", "BAT Voltage"}
+	batteryA      = field{"BatteryOutput/BAT", "BAT Current"}
+	batteryW      = field{"BatteryOutput/BAT", "BAT Power"}
+	cellMaxV      = field{"BatteryOutput/BMS BAT", "BMS BAT Cell Max Voltage"}
+	cellMinV      = field{"BatteryOutput/BMS BAT", "BMS BAT Cell Min Voltage"}
+)
+
+// baseUnits converts the units of the measurements into the SunSpec ones
+var baseUnits = map[string]float64{
+	"kW":  1000,
+	"kWh": 1000,
+	"mV":  0.001,
+	"mA":  0.001,
+}
+
+// Map keeps the latest measurements and serves them as SunSpec models 1, 103, 124 and 802 from
+// Base, it implements ports.Exporter and modbus.Registers
+type Map struct {
+	config SunSpecConfig
+
+	mu        sync.RWMutex
+	values    map[field]reading
+	heartbeat uint16
+}
+
+func New(config *SunSpecConfig) *Map {
+	cfg := *config
+	if cfg.Base == 0 {
+		cfg.Base = DefaultBase
+	}
+
+	return &Map{config: cfg, values: make(map[field]reading)}
+}
+
+// Export keeps the numeric fields in SunSpec units, a field missing or invalid in the poll is
+// forgotten so that its registers are served as not implemented
+func (m *Map) Export(snapshot ports.Snapshot) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, r := range snapshot.Measurements() {
+		f := field{r.Group, r.Field}
+		value, ok := r.Number()
+		if !ok || r.Quality == ports.QualityInvalid || r.Quality == ports.QualityMissing {
+			delete(m.values, f)
+			continue
+		}
+		if factor, ok := baseUnits[r.Unit]; ok {
+			value *= factor
+		}
+		m.values[f] = reading{value: value, time: r.PollTime}
+	}
+	return nil
+}
+
+// CycleComplete advances the battery heartbeat once per poll, it stops while the inverter is not answering
+func (m *Map) CycleComplete(complete bool) {
+	if !complete {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.heartbeat++
+}
+
+func (m *Map) Close(timeout time.Duration) error {
+	return nil
+}
+
+// Read returns the registers of the models and the poll time of the oldest field they are made
+// of, now when they depend on no field. ok is false outside of the models
+func (m *Map) Read(address uint16, count uint16) ([]uint16, time.Time, bool) {
+	if address < m.config.Base {
+		return nil, time.Time{}, false
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	w := m.render()
+	start := int(address - m.config.Base)
+	end := start + int(count)
+	if end > len(w.regs) {
+		return nil, time.Time{}, false
+	}
+
+	var oldest time.Time
+	for _, t := range w.times[start:end] {
+		if !t.IsZero() && (oldest.IsZero() || t.Before(oldest)) {
+			oldest = t
+		}
+	}
+	if oldest.IsZero() {
+		oldest = time.Now()
+	}
+	return w.regs[start:end], oldest, true
+}
+
+// render builds the whole register block, must be called with mu held
+func (m *Map) render() *writer {
+	w := &writer{}
+
+	// "SunS"
+	w.u16(0x5375)
+	w.u16(0x6e53)
+
+	w.header(modelCommon, lenCommon)
+	w.str(m.config.Manufacturer, 16)
+	w.str(m.config.Model, 16)
+	w.str("", 8)
+	w.str(m.config.Version, 8)
+	w.str(m.config.Serial, 16)
+	w.u16(1) // DA, device address
+	w.u16(0) // pad
+
+	m.inverter(w)
+	m.storage(w)
+	m.battery(w)
+
+	w.header(modelEnd, 0)
+	return w
+}
+
+// value returns the reading of f, its poll time goes to the next register written
+func (m *Map) value(w *writer, f field) (float64, bool) {
+	r, ok := m.values[f]
+	if ok {
+		w.uses(r.time)
+	}
+	return r.value, ok
+}
+
+// inverter renders model 103, three phase inverter
+func (m *Map) inverter(w *writer) {
+	w.header(modelInverter, lenInverter)
+
+	// A, AphA, AphB, AphC, A_SF
+	total, ok := m.sum(w, gridCurrent)
+	w.scaledU16(total, ok, -2)
+	for _, f := range gridCurrent {
+		v, ok := m.value(w, f)
+		w.scaledU16(v, ok, -2)
+	}
+	w.sf(-2)
+
+	// PPVphAB, PPVphBC, PPVphCA
+	w.repeat(notImplementedU16, 3)
+	// PhVphA, PhVphB, PhVphC, V_SF
+	for _, f := range gridVoltage {
+		v, ok := m.value(w, f)
+		w.scaledU16(v, ok, -1)
+	}
+	w.sf(-1)
+
+	// W, W_SF
+	power, ok := m.sum(w, gridPower)
+	w.scaledS16(power, ok, 0)
+	w.sf(0)
+
+	// Hz, Hz_SF
+	v, ok := m.value(w, gridFrequency)
+	w.scaledU16(v, ok, -2)
+	w.sf(-2)
+
+	// VA, VA_SF, VAr, VAr_SF, PF, PF_SF
+	w.repeat(notImplementedS16, 1)
+	w.u16(notImplementedSF)
+	w.repeat(notImplementedS16, 1)
+	w.u16(notImplementedSF)
+	w.repeat(notImplementedS16, 1)
+	w.u16(notImplementedSF)
+
+	// WH, WH_SF
+	v, ok = m.value(w, pvTotalEnergy)
+	w.acc32(v, ok)
+	w.sf(0)
+
+	// DCA, DCA_SF, DCV, DCV_SF, DCW, DCW_SF
+	current, ok := m.sum(w, pvCurrent)
+	w.scaledU16(current, ok, -2)
+	w.sf(-2)
+	voltage, ok := m.max(w, pvVoltage)
+	w.scaledU16(voltage, ok, -1)
+	w.sf(-1)
+	dcPower, dcOk := m.value(w, pvPower)
+	w.scaledS16(dcPower, dcOk, 0)
+	w.sf(0)
+
+	// TmpCab, TmpSnk, TmpTrns, TmpOt, Tmp_SF
+	v, ok = m.value(w, cabinetTemp)
+	w.scaledS16(v, ok, 0)
+	v, ok = m.value(w, sinkTemp)
+	w.scaledS16(v, ok, 0)
+	w.u16(notImplementedS16)
+	v, ok = m.value(w, otherTemp)
+	w.scaledS16(v, ok, 0)
+	w.sf(0)
+
+	// St, StVnd
+	switch {
+	case !dcOk:
+		w.u16(notImplementedU16)
+	case dcPower > 0:
+		w.u16(stateMPPT)
+	default:
+		w.u16(stateSleeping)
+	}
+	w.u16(notImplementedU16)
+
+	// Evt1, Evt2, EvtVnd1-4: no events
+	w.repeat(0, 12)
+}
+
+// storage renders model 124, basic storage controls
+func (m *Map) storage(w *writer) {
+	w.header(modelStorage, lenStorage)
+
+	// WChaMax, WChaGra, WDisChaGra, StorCtl_Mod, VAChaMax, MinRsvPct
+	w.scaledU16(m.config.BatteryMaxPower, m.config.BatteryMaxPower > 0, 0)
+	w.repeat(notImplementedU16, 5)
+
+	// ChaState, StorAval, InBatV, ChaSt
+	soc, ok := m.value(w, batterySOC)
+	w.scaledU16(soc, ok, -1)
+	w.u16(notImplementedU16)
+	v, vok := m.value(w, batteryV)
+	w.scaledU16(v, vok, -1)
+	w.u16(m.chargeState(w))
+
+	// OutWRte, InWRte, InOutWRte_WinTms, InOutWRte_RvrtTms, InOutWRte_RmpTms, ChaGriSet
+	w.repeat(notImplementedS16, 2)
+	w.repeat(notImplementedU16, 4)
+
+	// WChaMax_SF, WChaDisChaGra_SF, VAChaMax_SF, MinRsvPct_SF, ChaState_SF, StorAval_SF, InBatV_SF, InOutWRte_SF
+	w.sf(0)
+	w.u16(notImplementedSF)
+	w.u16(notImplementedSF)
+	w.u16(notImplementedSF)
+	w.sf(-1)
+	w.u16(notImplementedSF)
+	w.sf(-1)
+	w.u16(notImplementedSF)
+}
+
+// battery renders model 802, battery base
+func (m *Map) battery(w *writer) {
+	w.header(modelBattery, lenBattery)
+
+	// AHRtg, WHRtg, WChaRteMax, WDisChaRteMax, DisChaRte
+	w.u16(notImplementedU16)
+	w.scaledU16(m.config.BatteryCapacity, m.config.BatteryCapacity > 0, 1)
+	w.scaledU16(m.config.BatteryMaxPower, m.config.BatteryMaxPower > 0, 0)
+	w.scaledU16(m.config.BatteryMaxPower, m.config.BatteryMaxPower > 0, 0)
+	w.u16(notImplementedU16)
+
+	// SoCMax, SoCMin, SocRsvMax, SoCRsvMin, SoC, DoD, SoH
+	w.repeat(notImplementedU16, 4)
+	soc, ok := m.value(w, batterySOC)
+	w.scaledU16(soc, ok, -1)
+	w.repeat(notImplementedU16, 2)
+
+	// NCyc, ChaSt, LocRemCtl, Hb, CtrlHb, AlmRst, Typ, State, StateVnd, WarrDt
+	w.acc32(0, false)
+	w.u16(m.chargeState(w))
+	w.u16(notImplementedU16)
+	w.u16(m.heartbeat)
+	w.u16(notImplementedU16)
+	w.u16(0)
+	w.u16(batteryLiIon)
+	if _, ok := m.value(w, batteryV); ok {
+		w.u16(batteryConnected)
+	} else {
+		w.u16(notImplementedU16)
+	}
+	w.u16(notImplementedU16)
+	w.u32(notImplementedU32)
+
+	// Evt1, Evt2, EvtVnd1, EvtVnd2: no events
+	w.repeat(0, 8)
+
+	// V, VMax, VMin, CellVMax, CellVMaxStr, CellVMaxMod, CellVMin, CellVMinStr, CellVMinMod, CellVAvg
+	v, ok := m.value(w, batteryV)
+	w.scaledU16(v, ok, -1)
+	w.repeat(notImplementedU16, 2)
+	v, ok = m.value(w, cellMaxV)
+	w.scaledU16(v, ok, -3)
+	w.repeat(notImplementedU16, 2)
+	v, ok = m.value(w, cellMinV)
+	w.scaledU16(v, ok, -3)
+	w.repeat(notImplementedU16, 2)
+	w.u16(notImplementedU16)
+
+	// A, AChaMax, ADisChaMax, W
+	v, ok = m.value(w, batteryA)
+	w.scaledS16(v, ok, -1)
+	w.repeat(notImplementedU16, 2)
+	v, ok = m.value(w, batteryW)
+	w.scaledS16(v, ok, 0)
+
+	// ReqInvState, ReqW, SetOp, SetInvState
+	w.u16(notImplementedU16)
+	w.u16(notImplementedS16)
+	w.u16(notImplementedU16)
+	w.u16(notImplementedU16)
+
+	// AHRtg_SF, WHRtg_SF, WChaDisChaMax_SF, DisChaRte_SF, SoC_SF, DoD_SF, SoH_SF, V_SF, CellV_SF, A_SF, AMax_SF, W_SF
+	w.u16(notImplementedSF)
+	w.sf(1)
+	w.sf(0)
+	w.u16(notImplementedSF)
+	w.sf(-1)
+	w.u16(notImplementedSF)
+	w.u16(notImplementedSF)
+	w.sf(-1)
+	w.sf(-3)
+	w.sf(-1)
+	w.u16(notImplementedSF)
+	w.sf(0)
+}
+
+// chargeState derives the charge state from the battery power, positive when discharging
+func (m *Map) chargeState(w *writer) uint16 {
+	power, ok := m.value(w, batteryW)
+	if !ok {
+		return notImplementedU16
+	}
+	soc, socOk := m.value(w, batterySOC)
+
+	switch {
+	case power > idlePower:
+		return chargeDischarging
+	case power < -idlePower:
+		return chargeCharging
+	case socOk && soc >= 100:
+		return chargeFull
+	case socOk && soc <= 0:
+		return chargeEmpty
+	default:
+		return chargeHolding
+	}
+}
+
+func (m *Map) sum(w *writer, fields []field) (float64, bool) {
+	total := 0.0
+	for _, f := range fields {
+		v, ok := m.value(w, f)
+		if !ok {
+			return 0, false
+		}
+		total += v
+	}
+	return total, true
+}
+
+func (m *Map) max(w *writer, fields []field) (float64, bool) {
+	result, found := 0.0, false
+	for _, f := range fields {
+		if v, ok := m.value(w, f); ok && (!found || v > result) {
+			result, found = v, true
+		}
+	}
+	return result, found
+}
+
+// writer appends SunSpec registers and the poll time of the oldest field each of them is made of,
+// zero when none
+type writer struct {
+	regs  []uint16
+	times []time.Time
+	// oldest is the time of the fields read for the next register
+	oldest time.Time
+}
+
+// uses records the poll time of a field read for the next register
+func (w *writer) uses(t time.Time) {
+	if w.oldest.IsZero() || t.Before(w.oldest) {
+		w.oldest = t
+	}
+}
+
+func (w *writer) put(regs ...uint16) {
+	for _, v := range regs {
+		w.regs = append(w.regs, v)
+		w.times = append(w.times, w.oldest)
+	}
+	w.oldest = time.Time{}
+}
+
+func (w *writer) u16(v uint16) {
+	w.put(v)
+}
+
+func (w *writer) u32(v uint32) {
+	w.put(uint16(v>>16), uint16(v))
+}
+
+func (w *writer) repeat(v uint16, n int) {
+	for i := 0; i < n; i++ {
+		w.u16(v)
+	}
+}
+
+func (w *writer) header(id uint16, length uint16) {
+	w.u16(id)
+	w.u16(length)
+}
+
+func (w *writer) sf(sf int16) {
+	w.u16(uint16(sf))
+}
+
+// str writes s in regs registers, two characters each, padded with NULs
+func (w *writer) str(s string, regs int) {
+	b := make([]byte, 2*regs)
+	copy(b, strings.ToValidUTF8(s, ""))
+	for i := 0; i < regs; i++ {
+		w.u16(uint16(b[2*i])<<8 | uint16(b[2*i+1]))
+	}
+}
+
+// scaledU16 writes v / 10^sf, not implemented when unknown or out of range
+func (w *writer) scaledU16(v float64, ok bool, sf int) {
+	s := math.Round(v / math.Pow10(sf))
+	if !ok || s < 0 || s >= notImplementedU16 {
+		w.u16(notImplementedU16)
+		return
+	}
+	w.u16(uint16(s))
+}
+
+func (w *writer) scaledS16(v float64, ok bool, sf int) {
+	s := math.Round(v / math.Pow10(sf))
+	if !ok || s <= math.MinInt16 || s > math.MaxInt16 {
+		w.u16(notImplementedS16)
+		return
+	}
+	w.u16(uint16(int16(s)))
+}
+
+// acc32 writes an accumulator, 0 is not implemented
+func (w *writer) acc32(v float64, ok bool) {
+	if !ok || v < 0 || v > math.MaxUint32 {
+		w.u32(notImplementedAcc)
+		return
+	}
+	w.u32(uint32(math.Round(v)))
+}
@@ -0,0 +1,177 @@
+package sunspec
+
+import (
+	"testing"
+	"time"
+
+	"github.com/misterdelle/invt_logger_reader/ports"
+)
+
+// register offsets from the base
+const (
+	offCommon     = 2
+	offInverter   = offCommon + 2 + lenCommon
+	offStorage    = offInverter + 2 + lenInverter
+	offBattery    = offStorage + 2 + lenStorage
+	offEnd        = offBattery + 2 + lenBattery
+	blockLength   = offEnd + 2
+	offInverterW  = offInverter + 2 + 12
+	offInverterSt = offInverter + 2 + 36
+)
+
+func read(t *testing.T, m *Map, offset int, count int) []uint16 {
+	t.Helper()
+	regs, _, ok := m.Read(DefaultBase+uint16(offset), uint16(count))
+	if !ok {
+		t.Fatalf("registers %d-%d not served", offset, offset+count-1)
+	}
+	return regs
+}
+
+func TestModels(t *testing.T) {
+	m := New(&SunSpecConfig{Manufacturer: "INVT", Serial: "2333571751"})
+	at := time.Now()
+
+	for _, phase := range []string{"A", "B", "C"} {
+		m.Export(ports.NewSnapshot("", "GridOutput/Grid "+phase, map[string]interface{}{
+			"Inv " + phase + " Current": "2.5",
+			"Inv " + phase + " Voltage": "230.1",
+			"Inv " + phase + " Power":   "0.5",
+		}, ports.RecordInfo{PollTime: at, Units: map[string]string{"Inv " + phase + " Power": "kW"}}))
+	}
+	m.Export(ports.NewSnapshot("", "station", map[string]interface{}{"totalPowerFromPV": "1800", "pvTotalEnergy": "NaN"}, ports.RecordInfo{PollTime: at}))
+
+	if got := read(t, m, 0, 2); got[0] != 0x5375 || got[1] != 0x6e53 {
+		t.Errorf("marker %04X", got)
+	}
+	for _, h := range []struct {
+		offset int
+		id     uint16
+		length uint16
+	}{
+		{offCommon, modelCommon, lenCommon},
+		{offInverter, modelInverter, lenInverter},
+		{offStorage, modelStorage, lenStorage},
+		{offBattery, modelBattery, lenBattery},
+		{offEnd, modelEnd, 0},
+	} {
+		if got := read(t, m, h.offset, 2); got[0] != h.id || got[1] != h.length {
+			t.Errorf("model header at %d = %v, want %d %d", h.offset, got, h.id, h.length)
+		}
+	}
+
+	if got := read(t, m, offCommon+2, 1); got[0] != 'I'<<8|'N' {
+		t.Errorf("manufacturer %04X", got)
+	}
+
+	inverter := read(t, m, offInverter+2, lenInverter)
+	// A, AphA: sum of the phases in centiamperes
+	if inverter[0] != 750 || inverter[1] != 250 {
+		t.Errorf("current %v", inverter[:4])
+	}
+	// PhVphA in decivolts
+	if inverter[8] != 2301 {
+		t.Errorf("voltage %d", inverter[8])
+	}
+	// W from kW
+	if got := read(t, m, offInverterW, 1); got[0] != 1500 {
+		t.Errorf("power %d", got[0])
+	}
+	// WH not a number, not implemented
+	if inverter[22] != 0 || inverter[23] != 0 {
+		t.Errorf("energy %v", inverter[22:24])
+	}
+	if got := read(t, m, offInverterSt, 1); got[0] != stateMPPT {
+		t.Errorf("state %d", got[0])
+	}
+
+	// the storage and battery models have no readings
+	if got := read(t, m, offStorage+2+6, 1); got[0] != notImplementedU16 {
+		t.Errorf("state of charge %04X", got[0])
+	}
+}
+
+func TestRead(t *testing.T) {
+	m := New(&SunSpecConfig{})
+
+	if _, _, ok := m.Read(DefaultBase-1, 2); ok {
+		t.Error("register below the base served")
+	}
+	if _, _, ok := m.Read(DefaultBase+blockLength-1, 2); ok {
+		t.Error("register past the end served")
+	}
+	if regs, _, ok := m.Read(DefaultBase, blockLength); !ok || len(regs) != blockLength {
+		t.Errorf("whole block of %d registers, %t", len(regs), ok)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	m := New(&SunSpecConfig{})
+	before := read(t, m, 0, blockLength)
+
+	// the records of a poll do not advance it, the end of the poll does
+	m.Export(ports.NewSnapshot("", "Reader", map[string]interface{}{"status": "ok"}, ports.RecordInfo{PollTime: time.Now()}))
+	m.Export(ports.NewSnapshot("", "Reader", map[string]interface{}{"status": "ok"}, ports.RecordInfo{PollTime: time.Now()}))
+	m.CycleComplete(true)
+	m.CycleComplete(false)
+	after := read(t, m, 0, blockLength)
+
+	changed := 0
+	for i := range before {
+		if before[i] != after[i] {
+			changed++
+			if i < offBattery || after[i] != before[i]+1 {
+				t.Errorf("register %d went from %d to %d", i, before[i], after[i])
+			}
+		}
+	}
+	if changed != 1 {
+		t.Errorf("%d registers changed, want the heartbeat only", changed)
+	}
+}
+
+func TestFieldTimes(t *testing.T) {
+	m := New(&SunSpecConfig{})
+	now := time.Now()
+	grid, battery := now.Add(-time.Minute), now.Add(-time.Hour)
+
+	for _, phase := range []string{"A", "B", "C"} {
+		m.Export(ports.NewSnapshot("", "GridOutput/Grid "+phase, map[string]interface{}{"Inv " + phase + " Power": "500"}, ports.RecordInfo{PollTime: grid}))
+	}
+	m.Export(ports.NewSnapshot("", "BatteryOutput/BAT", map[string]interface{}{"BAT Voltage": "51.2", "BAT Power": "-800"}, ports.RecordInfo{PollTime: battery}))
+
+	offBatteryV := offBattery + 2 + 32
+	tests := []struct {
+		name   string
+		offset int
+		count  int
+		want   time.Time
+	}{
+		{"inverter power", offInverterW, 1, grid},
+		{"battery voltage", offBatteryV, 1, battery},
+		// the charge state is derived from the battery power
+		{"inverter and storage models", offInverter, offBattery - offInverter, battery},
+	}
+	for _, tt := range tests {
+		if _, oldest, _ := m.Read(DefaultBase+uint16(tt.offset), uint16(tt.count)); !oldest.Equal(tt.want) {
+			t.Errorf("%s read at %s, want %s", tt.name, oldest, tt.want)
+		}
+	}
+
+	// the common model does not depend on the measurements
+	if _, oldest, _ := m.Read(DefaultBase, offInverter); oldest.Before(now) {
+		t.Errorf("common model read at %s", oldest)
+	}
+
+	// invalid and missing values are not served any longer
+	m.Export(ports.NewSnapshot("", "BatteryOutput/BAT", map[string]interface{}{"BAT Voltage": "---", "BAT Power": "0"}, ports.RecordInfo{
+		PollTime: now,
+		Quality:  map[string]string{"BAT Voltage": ports.QualityInvalid, "BAT Power": ports.QualityMissing},
+	}))
+	if got := read(t, m, offBatteryV, 1); got[0] != notImplementedU16 {
+		t.Errorf("battery voltage %d", got[0])
+	}
+	if got := read(t, m, offStorage+2+9, 1); got[0] != notImplementedU16 {
+		t.Errorf("charge state %d", got[0])
+	}
+}
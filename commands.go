@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// minimumReadInterval is the shortest polling interval accepted by the set/interval command
+const minimumReadInterval = 5
+
+// commandRequest is the payload of a command topic, e.g. {"id": "42", "value": 30}.
+// Id is copied into the result so that callers can match requests and results
+type commandRequest struct {
+	ID    string          `json:"id"`
+	Value json.RawMessage `json:"value"`
+}
+
+// commandResult is published to {prefix}/result/{command}
+type commandResult struct {
+	ID      string      `json:"id,omitempty"`
+	Command string      `json:"command"`
+	OK      bool        `json:"ok"`
+	Error   string      `json:"error,omitempty"`
+	Value   interface{} `json:"value,omitempty"`
+	Time    time.Time   `json:"time"`
+}
+
+// subscribeCommands listens to the command topics:
+//
+//	{prefix}/set/poll              performs a measurement cycle now
+//	{prefix}/set/interval          changes the polling interval, value in seconds
+//	{prefix}/set/setting/{name}    writes an inverter setting, requires inverter.allowWrite
+//
+// Retained commands are refused: the broker would replay them at every reconnect
+func subscribeCommands() {
+	topic := commandTopic("set", "#")
+	mqtt.Subscribe(topic, func(client paho.Client, msg paho.Message) {
+		// handlers must not block the MQTT client, a setting write waits for the running measurement cycle
+		go handleCommand(msg.Topic(), msg.Payload(), msg.Retained())
+	})
+
+	log.Printf("listening for commands on %s", topic)
+}
+
+func handleCommand(topic string, payload []byte, retained bool) {
+	command, ok := commandName(topic)
+	if !ok {
+		log.Printf("command topic %s ignored, commands are published to %s/{command}", topic, commandTopic("set"))
+		return
+	}
+
+	if retained {
+		publishCommandResult(command, "", nil, errors.New("retained commands are not executed, publish the command without the retain flag"))
+		return
+	}
+
+	var req commandRequest
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &req); err != nil {
+			publishCommandResult(command, req.ID, nil, fmt.Errorf("invalid request: %w", err))
+			return
+		}
+	}
+
+	log.Printf("command %s received, id %q", command, req.ID)
+
+	value, err := runCommand(command, req.Value)
+	publishCommandResult(command, req.ID, value, err)
+}
+
+// commandName returns the command of a topic below {prefix}/set/, e.g. "setting/workMode"
+func commandName(topic string) (string, bool) {
+	command, found := strings.CutPrefix(topic, commandTopic("set")+"/")
+	if !found || command == "" {
+		return "", false
+	}
+	return command, true
+}
+
+func runCommand(command string, value json.RawMessage) (interface{}, error) {
+	switch {
+	case command == "poll":
+		select {
+		case pollNow <- struct{}{}:
+		default:
+			// a poll is already pending
+		}
+		return "scheduled", nil
+
+	case command == "interval":
+		var seconds int
+		if err := json.Unmarshal(value, &seconds); err != nil {
+			return nil, fmt.Errorf("interval must be a number of seconds")
+		}
+		if seconds < minimumReadInterval {
+			return nil, fmt.Errorf("interval must be at least %d seconds", minimumReadInterval)
+		}
+
+		readInterval.Store(int64(seconds))
+		log.Printf("polling interval set to %d seconds", seconds)
+		return seconds, nil
+
+	case strings.HasPrefix(command, "setting/"):
+		if !config.Inverter.AllowWrite {
+			return nil, errors.New("inverter settings are read only, set inverter.allowWrite=true to enable writes")
+		}
+
+		name := strings.TrimPrefix(command, "setting/")
+		var v string
+		if err := json.Unmarshal(value, &v); err != nil {
+			return nil, fmt.Errorf("setting value must be a string")
+		}
+
+		if err := device.WriteSetting(name, v); err != nil {
+			return nil, err
+		}
+		log.Printf("inverter setting %s set to %s", name, v)
+		return v, nil
+
+	default:
+		return nil, fmt.Errorf("unknown command %q", command)
+	}
+}
+
+func publishCommandResult(command string, id string, value interface{}, err error) {
+	result := commandResult{
+		ID:      id,
+		Command: command,
+		OK:      err == nil,
+		Value:   value,
+		Time:    time.Now(),
+	}
+	if err != nil {
+		result.Error = err.Error()
+		log.Printf("command %s failed: %s", command, err)
+	}
+
+	payload, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("error encoding %s command result: %s", command, err)
+		return
+	}
+
+	if err := mqtt.Publish(commandTopic("result", command), payload, false); err != nil {
+		log.Printf("error publishing %s command result: %s", command, err)
+	}
+}
+
+// commandTopic builds a topic below the MQTT prefix
+func commandTopic(segments ...string) string {
+	return path.Join(append([]string{config.Mqtt.Prefix}, segments...)...)
+}
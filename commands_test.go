@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/misterdelle/invt_logger_reader/ports"
+)
+
+// settingsDevice records the settings written
+type settingsDevice struct {
+	ports.Device
+	written map[string]string
+}
+
+func (d *settingsDevice) WriteSetting(name string, value string) error {
+	if name == "unknown" {
+		return errors.New("unknown setting unknown")
+	}
+	d.written[name] = value
+	return nil
+}
+
+func TestCommandName(t *testing.T) {
+	config = &Config{}
+	config.Mqtt.Prefix = "invt"
+
+	tests := []struct {
+		topic   string
+		command string
+		ok      bool
+	}{
+		{"invt/set/poll", "poll", true},
+		{"invt/set/setting/workMode", "setting/workMode", true},
+		{"invt/set", "", false},
+		{"invt/set/", "", false},
+		{"invt/setting/workMode", "", false},
+		{"other/set/poll", "", false},
+	}
+	for _, tt := range tests {
+		command, ok := commandName(tt.topic)
+		if command != tt.command || ok != tt.ok {
+			t.Errorf("commandName(%q) = %q, %t, want %q, %t", tt.topic, command, ok, tt.command, tt.ok)
+		}
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	d := &settingsDevice{written: make(map[string]string)}
+	device = d
+	config = &Config{}
+	readInterval.Store(60)
+
+	tests := []struct {
+		name       string
+		command    string
+		value      string
+		allowWrite bool
+		want       interface{}
+		err        string
+	}{
+		{"poll", "poll", "", false, "scheduled", ""},
+		{"interval", "interval", "30", false, 30, ""},
+		{"shortest interval", "interval", "5", false, 5, ""},
+		{"interval too short", "interval", "4", false, nil, "at least 5 seconds"},
+		{"interval not a number", "interval", `"30"`, false, nil, "number of seconds"},
+		{"interval missing", "interval", "", false, nil, "number of seconds"},
+		{"writes not allowed", "setting/workMode", `"1"`, false, nil, "read only"},
+		{"setting", "setting/workMode", `"1"`, true, "1", ""},
+		{"setting not a string", "setting/workMode", "1", true, nil, "must be a string"},
+		{"setting refused", "setting/unknown", `"1"`, true, nil, "unknown setting"},
+		{"unknown command", "reboot", "", true, nil, "unknown command"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Inverter.AllowWrite = tt.allowWrite
+			d.written = make(map[string]string)
+			before := readInterval.Load()
+
+			got, err := runCommand(tt.command, json.RawMessage(tt.value))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+				if len(d.written) != 0 || readInterval.Load() != before {
+					t.Errorf("failed command changed the state: %v, interval %d", d.written, readInterval.Load())
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("runCommand = %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+
+	if readInterval.Load() != 5 {
+		t.Errorf("interval %d, want 5", readInterval.Load())
+	}
+	select {
+	case <-pollNow:
+	default:
+		t.Error("poll not scheduled")
+	}
+}
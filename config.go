@@ -1,7 +1,20 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/misterdelle/invt_logger_reader/adapters/export/history"
+	"github.com/misterdelle/invt_logger_reader/adapters/export/influxdb"
 	"github.com/misterdelle/invt_logger_reader/adapters/export/mosquitto"
+	"github.com/misterdelle/invt_logger_reader/adapters/export/pipeline"
+	"github.com/misterdelle/invt_logger_reader/adapters/export/pvoutput"
+	"github.com/misterdelle/invt_logger_reader/adapters/export/webhook"
+	"github.com/misterdelle/invt_logger_reader/adapters/modbus"
+	"github.com/misterdelle/invt_logger_reader/adapters/sunspec"
 )
 
 type Config struct {
@@ -9,21 +22,306 @@ type Config struct {
 		Port         string
 		LoggerSerial uint
 		ReadInterval int
+		// AllowWrite enables the set/setting command topics
+		AllowWrite bool
+	}
+	Retry struct {
+		InitialDelay int
+		MaxDelay     int
+		Multiplier   float64
+		Jitter       float64
+	}
+	Breaker struct {
+		Threshold     int
+		ProbeInterval int
+	}
+	Http struct {
+		// Listen is the address of the HTTP server, e.g. :9100, disabled when empty
+		Listen string
+		// Dashboard serves the web dashboard on /
+		Dashboard bool
 	}
-	Mqtt mosquitto.MqttConfig
+	Publish struct {
+		Policy     string
+		Rules      string
+		MaxSilence int
+	}
+	Mqtt     mosquitto.MqttConfig
+	Influx   influxdb.InfluxConfig
+	History  history.HistoryConfig
+	PVOutput pvoutput.PVOutputConfig
+	Webhook  webhook.WebhookConfig
+	// Sinks are the pipeline settings of the exporters, by sink name
+	Sinks   map[string]pipeline.SinkConfig
+	Modbus  modbus.ServerConfig
+	SunSpec sunspec.SunSpecConfig
+	// Derived publishes the metrics computed from the energy counters, e.g. autarky
+	Derived         bool
+	Commands        bool
+	ShutdownTimeout int
 }
 
 func NewConfig(app Application) (*Config, error) {
 	config := &Config{}
 
+	if app.MQTTQoS > 2 {
+		return nil, fmt.Errorf("invalid mqtt.qos %d, must be 0, 1 or 2", app.MQTTQoS)
+	}
+
 	config.Inverter.Port = app.InverterPort
 	config.Inverter.LoggerSerial = app.InverterLoggerSerial
 	config.Inverter.ReadInterval = app.InverterReadInterval
+	config.Inverter.AllowWrite = app.InverterAllowWrite
+	config.Commands = app.MQTTCommands
+	config.Influx.Url = app.InfluxURL
+	config.Influx.Version = app.InfluxVersion
+	config.Influx.Token = app.InfluxToken
+	config.Influx.Org = app.InfluxOrg
+	config.Influx.Bucket = app.InfluxBucket
+	config.Influx.Database = app.InfluxDatabase
+	config.Influx.User = app.InfluxUser
+	config.Influx.Password = app.InfluxPassword
+	config.Influx.BatchSize = app.InfluxBatchSize
+	config.Influx.FlushInterval = time.Duration(app.InfluxFlushInterval) * time.Second
+	config.Influx.MaxRetries = app.InfluxMaxRetries
+	config.History.Path = app.HistoryPath
+	config.History.Retention = time.Duration(app.HistoryRetention) * 24 * time.Hour
+	config.History.HourlyRetention = time.Duration(app.HistoryHourly) * 24 * time.Hour
+	config.PVOutput.Url = app.PVOutputURL
+	config.PVOutput.ApiKey = app.PVOutputApiKey
+	config.PVOutput.SystemId = app.PVOutputSystemId
+	config.PVOutput.Interval = time.Duration(app.PVOutputInterval) * time.Minute
+	if config.PVOutput.Interval != 5*time.Minute && config.PVOutput.Interval != 15*time.Minute {
+		return nil, fmt.Errorf("invalid pvoutput.interval %d, must be 5 or 15", app.PVOutputInterval)
+	}
+	for name, target := range map[string]*pvoutput.Field{
+		"energyGeneration":  &config.PVOutput.EnergyGeneration,
+		"powerGeneration":   &config.PVOutput.PowerGeneration,
+		"energyConsumption": &config.PVOutput.EnergyConsumption,
+		"powerConsumption":  &config.PVOutput.PowerConsumption,
+		"voltage":           &config.PVOutput.Voltage,
+	} {
+		if v, ok := app.PVOutputFields[name]; ok {
+			f, err := pvoutput.ParseField(v)
+			if err != nil {
+				return nil, fmt.Errorf("pvoutput.%s: %w", name, err)
+			}
+			*target = f
+		}
+	}
+	config.Webhook.Url = app.WebhookURL
+	config.Webhook.Method = app.WebhookMethod
+	config.Webhook.Secret = app.WebhookSecret
+	config.Webhook.BatchSize = app.WebhookBatchSize
+	config.Webhook.MaxRetries = app.WebhookMaxRetries
+	headers, err := parseHeaders(app.WebhookHeaders)
+	if err != nil {
+		return nil, fmt.Errorf("webhook.headers: %w", err)
+	}
+	config.Webhook.Headers = headers
+	for name := range app.Sinks {
+		if !knownSink(name) {
+			return nil, fmt.Errorf("unknown sink %q in sink.%s settings, must be one of %s", name, name, strings.Join(sinkNames, ", "))
+		}
+	}
+	config.Sinks = app.Sinks
+	config.Modbus.Listen = app.ModbusListen
+	config.Modbus.MaxAge = time.Duration(app.ModbusMaxAge) * time.Second
+	if app.ModbusSunSpec {
+		if app.ModbusSunSpecBase <= 0 || app.ModbusSunSpecBase > 0xFFFF-300 {
+			return nil, fmt.Errorf("invalid modbus.sunspecBase %d", app.ModbusSunSpecBase)
+		}
+		config.SunSpec.Base = uint16(app.ModbusSunSpecBase)
+		config.SunSpec.BatteryCapacity = float64(app.SunSpecBatteryWh)
+		config.SunSpec.BatteryMaxPower = float64(app.SunSpecBatteryW)
+	}
+	config.Derived = app.Derived
+	config.Http.Listen = app.HttpListen
+	config.Http.Dashboard = app.HttpDashboard
+	config.Publish.Policy = app.PublishPolicy
+	config.Publish.Rules = app.PublishRules
+	config.Publish.MaxSilence = app.PublishMaxSilence
+	config.Mqtt.Spool.Path = app.MQTTSpoolPath
+	config.Mqtt.Spool.MaxMessages = app.MQTTSpoolMaxMessages
+	config.Mqtt.Spool.MaxBytes = int64(app.MQTTSpoolMaxBytes)
+	config.Mqtt.Spool.DropPolicy = app.MQTTSpoolDropPolicy
+
+	config.Retry.InitialDelay = app.RetryInitialDelay
+	config.Retry.MaxDelay = app.RetryMaxDelay
+	config.Retry.Multiplier = app.RetryMultiplier
+	config.Retry.Jitter = app.RetryJitter
+
+	config.Breaker.Threshold = app.BreakerThreshold
+	config.Breaker.ProbeInterval = app.BreakerProbeInterval
 
 	config.Mqtt.Url = app.MQTTURL
 	config.Mqtt.User = app.MQTTUser
 	config.Mqtt.Password = app.MQTTPassword
 	config.Mqtt.Prefix = app.MQTTTopicName
+	config.Mqtt.ClientID = app.MQTTClientID
+	config.Mqtt.TopicNaming = app.MQTTTopicNaming
+	config.Mqtt.TopicTemplate = app.MQTTTopicTemplate
+	config.Mqtt.KeepAlive = app.MQTTKeepAlive
+	config.Mqtt.AutoReconnect = app.MQTTAutoReconnect
+	config.Mqtt.ResumeSubs = app.MQTTResumeSubs
+	config.Mqtt.CleanSession = app.MQTTCleanSession
+	config.Mqtt.QoS = byte(app.MQTTQoS)
+	config.Mqtt.Retain = app.MQTTRetain
+	config.Mqtt.Payload = app.MQTTPayload
+	config.Mqtt.Groups = app.MQTTGroups
+	config.Mqtt.DiscoveryPrefix = app.MQTTDiscoveryPrefix
+	config.Mqtt.CACert = app.MQTTCACert
+	config.Mqtt.ClientCert = app.MQTTClientCert
+	config.Mqtt.ClientKey = app.MQTTClientKey
+	config.Mqtt.ServerName = app.MQTTServerName
+	config.Mqtt.InsecureSkipVerify = app.MQTTInsecure
+
+	config.ShutdownTimeout = app.ShutdownTimeout
 
 	return config, nil
 }
+
+// parseHeaders reads HTTP headers separated by semicolons, e.g. "Authorization: Bearer abc; X-Source: invt"
+func parseHeaders(s string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, item := range strings.Split(s, ";") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+
+		name, value, ok := strings.Cut(item, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid header %q, expected Name: value", strings.TrimSpace(item))
+		}
+		headers[name] = strings.TrimSpace(value)
+	}
+	return headers, nil
+}
+
+// getEnvInt reads an integer setting, def is returned when the setting is missing or not valid
+func getEnvInt(key string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || v <= 0 {
+		return def
+	}
+	return v
+}
+
+// getEnvCount reads a setting that may be 0, e.g. a number of retries, def is returned when the setting
+// is missing or not valid
+func getEnvCount(key string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || v < 0 {
+		return def
+	}
+	return v
+}
+
+// getEnvFloat reads a decimal setting, def is returned when the setting is missing or not valid
+func getEnvFloat(key string, def float64) float64 {
+	v, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil || v < 0 {
+		return def
+	}
+	return v
+}
+
+// getEnvBool reads a true/false setting, def is returned when the setting is missing or not valid
+func getEnvBool(key string, def bool) bool {
+	v, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// getEnvSinks reads the pipeline settings of the exporters, e.g. sink.influx.include=station,GridOutput
+// sink.influx.exclude=GridOutput/Grid C, sink.influx.minInterval=60 (seconds) and sink.influx.queueSize=1000
+func getEnvSinks(prefix string) map[string]pipeline.SinkConfig {
+	sinks := make(map[string]pipeline.SinkConfig)
+
+	for _, env := range os.Environ() {
+		key, _, _ := strings.Cut(env, "=")
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		name, setting, ok := strings.Cut(strings.TrimPrefix(key, prefix), ".")
+		if !ok || name == "" {
+			continue
+		}
+
+		cfg := sinks[name]
+
+		switch setting {
+		case "include":
+			cfg.Include = splitList(os.Getenv(key))
+		case "exclude":
+			cfg.Exclude = splitList(os.Getenv(key))
+		case "minInterval":
+			cfg.MinInterval = time.Duration(getEnvInt(key, 0)) * time.Second
+		case "queueSize":
+			cfg.QueueSize = getEnvInt(key, 0)
+		default:
+			continue
+		}
+
+		sinks[name] = cfg
+	}
+
+	return sinks
+}
+
+// splitList reads a comma separated list, leaving out the empty items
+func splitList(s string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// getEnvPublishGroups reads the per topic group publishing settings, e.g. mqtt.group.EnergyTodayTotals.qos=1
+// mqtt.group.EnergyTodayTotals.retain=false and mqtt.group.EnergyTodayTotals.payload=json; settings not defined for a group are taken from defaults
+func getEnvPublishGroups(prefix string, defaults mosquitto.PublishOptions) (map[string]mosquitto.PublishOptions, error) {
+	groups := make(map[string]mosquitto.PublishOptions)
+
+	for _, env := range os.Environ() {
+		key, _, _ := strings.Cut(env, "=")
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		group, setting, ok := strings.Cut(strings.TrimPrefix(key, prefix), ".")
+		if !ok || group == "" {
+			continue
+		}
+
+		opts, found := groups[group]
+		if !found {
+			opts = defaults
+		}
+
+		switch setting {
+		case "qos":
+			qos, err := strconv.Atoi(os.Getenv(key))
+			if err != nil || qos < 0 || qos > 2 {
+				return nil, fmt.Errorf("invalid qos %q for MQTT group %s, must be 0, 1 or 2", os.Getenv(key), group)
+			}
+			opts.QoS = byte(qos)
+		case "retain":
+			opts.Retain = getEnvBool(key, defaults.Retain)
+		case "payload":
+			opts.Payload = os.Getenv(key)
+		default:
+			continue
+		}
+
+		groups[group] = opts
+	}
+
+	return groups, nil
+}
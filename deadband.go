@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/misterdelle/invt_logger_reader/adapters/export/pipeline"
+	"github.com/misterdelle/invt_logger_reader/ports"
+)
+
+// publishing modes of a field
+const (
+	// PublishAlways publishes the field at every poll
+	PublishAlways = "always"
+	// PublishOnChange publishes the field when its value changes
+	PublishOnChange = "change"
+	// PublishAbsolute publishes the field when it moves by at least the threshold
+	PublishAbsolute = "absolute"
+	// PublishPercent publishes the field when it moves by at least threshold percent of the last published value
+	PublishPercent = "percent"
+)
+
+// publishPolicy decides when a field is published again
+type publishPolicy struct {
+	mode      string
+	threshold float64
+}
+
+// publishRule applies a policy to the fields matching pattern, a glob matched against
+// the field name (e.g. "PV* Power") or the topic and field name (e.g. "EnergyTodayTotals/*")
+type publishRule struct {
+	pattern string
+	policy  publishPolicy
+}
+
+type publishedValue struct {
+	value interface{}
+	at    time.Time
+}
+
+// publishFilter keeps the last published value of every field between polls and drops
+// the fields that did not change enough, maxSilence forces a republish of unchanged fields
+type publishFilter struct {
+	defaults   publishPolicy
+	rules      []publishRule
+	maxSilence time.Duration
+
+	mu   sync.Mutex
+	last map[string]publishedValue
+}
+
+func newPublishFilter(policy string, rules string, maxSilence time.Duration) (*publishFilter, error) {
+	defaults, err := parsePublishPolicy(policy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid publish.policy: %w", err)
+	}
+
+	f := &publishFilter{
+		defaults:   defaults,
+		maxSilence: maxSilence,
+		last:       make(map[string]publishedValue),
+	}
+
+	for _, r := range strings.Split(rules, ";") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+
+		pattern, p, ok := strings.Cut(r, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid publish rule %q, use pattern:mode[:threshold]", r)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid publish rule pattern %q: %w", pattern, err)
+		}
+
+		policy, err := parsePublishPolicy(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid publish rule %q: %w", r, err)
+		}
+
+		f.rules = append(f.rules, publishRule{pattern: pattern, policy: policy})
+	}
+
+	return f, nil
+}
+
+// parsePublishPolicy reads mode[:threshold], e.g. change, absolute:0.5 or percent:2
+func parsePublishPolicy(s string) (publishPolicy, error) {
+	mode, threshold, hasThreshold := strings.Cut(strings.TrimSpace(s), ":")
+
+	policy := publishPolicy{mode: mode}
+	switch mode {
+	case "":
+		policy.mode = PublishAlways
+	case PublishAlways, PublishOnChange:
+	case PublishAbsolute, PublishPercent:
+		if !hasThreshold {
+			return policy, fmt.Errorf("mode %s requires a threshold, e.g. %s:1", mode, mode)
+		}
+	default:
+		return policy, fmt.Errorf("unknown mode %q, use %s, %s, %s or %s", mode, PublishAlways, PublishOnChange, PublishAbsolute, PublishPercent)
+	}
+
+	if hasThreshold {
+		v, err := strconv.ParseFloat(threshold, 64)
+		if err != nil || v < 0 {
+			return policy, fmt.Errorf("invalid threshold %q", threshold)
+		}
+		policy.threshold = v
+	}
+
+	return policy, nil
+}
+
+// policy returns the policy of the first rule matching the field, the default policy otherwise
+func (f *publishFilter) policy(topic string, field string) publishPolicy {
+	for _, r := range f.rules {
+		if ok, _ := path.Match(r.pattern, field); ok {
+			return r.policy
+		}
+		if ok, _ := path.Match(r.pattern, topic+"/"+field); ok {
+			return r.policy
+		}
+	}
+	return f.defaults
+}
+
+// forSink returns a filter with the same policies and nothing published yet, every sink keeps its own
+func (f *publishFilter) forSink() pipeline.Changes {
+	return &publishFilter{
+		defaults:   f.defaults,
+		rules:      f.rules,
+		maxSilence: f.maxSilence,
+		last:       make(map[string]publishedValue),
+	}
+}
+
+// Changed returns the fields of data that have to be published now
+func (f *publishFilter) Changed(topic string, data map[string]interface{}, now time.Time) map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	result := make(map[string]interface{}, len(data))
+	for field, v := range data {
+		last, found := f.last[topic+"/"+field]
+		if found && !f.maxSilenceElapsed(last, now) && !changed(f.policy(topic, field), last.value, v) {
+			continue
+		}
+		result[field] = v
+	}
+
+	return result
+}
+
+// Published records the fields of data as published
+func (f *publishFilter) Published(topic string, data map[string]interface{}, now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for field, v := range data {
+		f.last[topic+"/"+field] = publishedValue{value: v, at: now}
+	}
+}
+
+// Forget drops the published values of fields, they are published again at the next poll
+func (f *publishFilter) Forget(topic string, fields []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, field := range fields {
+		delete(f.last, topic+"/"+field)
+	}
+}
+
+func (f *publishFilter) maxSilenceElapsed(last publishedValue, now time.Time) bool {
+	return f.maxSilence > 0 && now.Sub(last.at) >= f.maxSilence
+}
+
+// changed reports whether v differs enough from the last published value, non numeric
+// values are compared as they are
+func changed(policy publishPolicy, last interface{}, v interface{}) bool {
+	if policy.mode == PublishAlways {
+		return true
+	}
+
+	lastNum, lastOk := ports.NewValue(last).Number()
+	num, ok := ports.NewValue(v).Number()
+	if !lastOk || !ok {
+		return fmt.Sprintf("%v", last) != fmt.Sprintf("%v", v)
+	}
+
+	delta := math.Abs(num - lastNum)
+	switch policy.mode {
+	case PublishAbsolute:
+		return delta >= policy.threshold && delta > 0
+	case PublishPercent:
+		if lastNum == 0 {
+			return delta > 0
+		}
+		return delta > 0 && delta*100 >= math.Abs(lastNum)*policy.threshold
+	default:
+		return delta > 0
+	}
+}
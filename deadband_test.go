@@ -0,0 +1,194 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePublishPolicy(t *testing.T) {
+	tests := []struct {
+		in   string
+		want publishPolicy
+		err  string
+	}{
+		{"", publishPolicy{mode: PublishAlways}, ""},
+		{"always", publishPolicy{mode: PublishAlways}, ""},
+		{" change ", publishPolicy{mode: PublishOnChange}, ""},
+		{"absolute:0.5", publishPolicy{mode: PublishAbsolute, threshold: 0.5}, ""},
+		{"percent:2", publishPolicy{mode: PublishPercent, threshold: 2}, ""},
+		{"absolute", publishPolicy{}, "requires a threshold"},
+		{"percent:-1", publishPolicy{}, "invalid threshold"},
+		{"percent:abc", publishPolicy{}, "invalid threshold"},
+		{"sometimes", publishPolicy{}, "unknown mode"},
+	}
+	for _, tt := range tests {
+		got, err := parsePublishPolicy(tt.in)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parsePublishPolicy(%q) error %v, want %q", tt.in, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parsePublishPolicy(%q) = %+v, %v, want %+v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestNewPublishFilterErrors(t *testing.T) {
+	for _, tt := range []struct {
+		policy string
+		rules  string
+	}{
+		{"never", ""},
+		{"change", "PV* Power"},
+		{"change", "[PV:absolute:1"},
+		{"change", "PV* Power:percent"},
+	} {
+		if _, err := newPublishFilter(tt.policy, tt.rules, 0); err == nil {
+			t.Errorf("policy %q rules %q accepted", tt.policy, tt.rules)
+		}
+	}
+}
+
+func TestChanged(t *testing.T) {
+	absolute := publishPolicy{mode: PublishAbsolute, threshold: 0.5}
+	percent := publishPolicy{mode: PublishPercent, threshold: 10}
+	change := publishPolicy{mode: PublishOnChange}
+
+	tests := []struct {
+		name   string
+		policy publishPolicy
+		last   interface{}
+		v      interface{}
+		want   bool
+	}{
+		{"always", publishPolicy{mode: PublishAlways}, "1", "1", true},
+		{"change same", change, "230.1", "230.1", false},
+		{"change same number as text", change, "230.10", 230.1, false},
+		{"change", change, "230.1", "230.2", true},
+		{"change text", change, "Self use", "Backup", true},
+		{"change same text", change, "Self use", "Self use", false},
+		{"absolute below", absolute, "230.1", "230.5", false},
+		{"absolute at threshold", absolute, "230.0", "230.5", true},
+		{"absolute down", absolute, 230.0, 229.0, true},
+		{"absolute no move", publishPolicy{mode: PublishAbsolute}, "5", "5", false},
+		{"absolute zero threshold", publishPolicy{mode: PublishAbsolute}, "5", "5.01", true},
+		{"percent below", percent, "1000", "1090", false},
+		{"percent at threshold", percent, "1000", "1100", true},
+		{"percent of a negative value", percent, "-1000", "-1100", true},
+		{"percent from 0", percent, "0", "0.001", true},
+		{"percent from 0 unchanged", percent, "0", "0", false},
+		{"number to text", absolute, "230.1", "NaN", true},
+		{"text to number", absolute, "NaN", "230.1", true},
+		{"missing", absolute, nil, nil, false},
+		{"missing to number", absolute, nil, "230.1", true},
+	}
+	for _, tt := range tests {
+		if got := changed(tt.policy, tt.last, tt.v); got != tt.want {
+			t.Errorf("%s: changed(%v, %v) = %t, want %t", tt.name, tt.last, tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestPublishFilterRules(t *testing.T) {
+	f, err := newPublishFilter("change", "PV* Power:absolute:50; EnergyTodayTotals/*:always; *:percent:5", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		topic string
+		field string
+		want  publishPolicy
+	}{
+		// matched on the field name
+		{"PV", "PV1 Power", publishPolicy{mode: PublishAbsolute, threshold: 50}},
+		// matched on topic/field
+		{"EnergyTodayTotals", "PV Day Energy", publishPolicy{mode: PublishAlways}},
+		// the first matching rule wins
+		{"EnergyTodayTotals", "PV2 Power", publishPolicy{mode: PublishAbsolute, threshold: 50}},
+		{"GridOutput/Grid A", "Inv A Voltage", publishPolicy{mode: PublishPercent, threshold: 5}},
+	}
+	for _, tt := range tests {
+		if got := f.policy(tt.topic, tt.field); got != tt.want {
+			t.Errorf("policy(%s, %s) = %+v, want %+v", tt.topic, tt.field, got, tt.want)
+		}
+	}
+
+	f, _ = newPublishFilter("change", "EnergyTodayTotals/*:always", 0)
+	if got := f.policy("GridOutput/Grid A", "Inv A Voltage"); got != (publishPolicy{mode: PublishOnChange}) {
+		t.Errorf("no rule matching, policy %+v", got)
+	}
+}
+
+func TestPublishFilter(t *testing.T) {
+	f, err := newPublishFilter("absolute:1", "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	publish := func(data map[string]interface{}, at time.Duration) map[string]interface{} {
+		result := f.Changed("station", data, now.Add(at))
+		f.Published("station", result, now.Add(at))
+		return result
+	}
+
+	if got := publish(map[string]interface{}{"a": "10", "b": "20"}, 0); len(got) != 2 {
+		t.Errorf("first poll published %v, want everything", got)
+	}
+	if got := publish(map[string]interface{}{"a": "10.5", "b": "21"}, 10*time.Second); len(got) != 1 || got["b"] != "21" {
+		t.Errorf("published %v, want b", got)
+	}
+	// a moved by 1 since its last published value, not since the previous poll
+	if got := publish(map[string]interface{}{"a": "11", "b": "21"}, 20*time.Second); len(got) != 1 || got["a"] != "11" {
+		t.Errorf("published %v, want a", got)
+	}
+
+	// maxSilence elapsed for b only
+	if got := publish(map[string]interface{}{"a": "11", "b": "21"}, 70*time.Second); len(got) != 1 || got["b"] != "21" {
+		t.Errorf("published %v, want b republished", got)
+	}
+
+	// Changed alone does not record anything
+	f.Changed("station", map[string]interface{}{"a": "20"}, now.Add(71*time.Second))
+	if got := publish(map[string]interface{}{"a": "20"}, 72*time.Second); len(got) != 1 {
+		t.Errorf("published %v, want a", got)
+	}
+
+	// forgotten fields are published again
+	f.Forget("station", []string{"a"})
+	if got := publish(map[string]interface{}{"a": "20", "b": "21"}, 73*time.Second); len(got) != 1 || got["a"] != "20" {
+		t.Errorf("published %v, want a", got)
+	}
+}
+
+func TestPublishFilterForSink(t *testing.T) {
+	f, err := newPublishFilter("change", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	mqtt, webhook := f.forSink(), f.forSink()
+	data := map[string]interface{}{"a": "1"}
+
+	mqtt.Published("station", mqtt.Changed("station", data, now), now)
+	if got := mqtt.Changed("station", data, now); len(got) != 0 {
+		t.Errorf("mqtt publishes %v again", got)
+	}
+	// the other sink and the filter the sinks come from have published nothing yet
+	if got := webhook.Changed("station", data, now); len(got) != 1 {
+		t.Errorf("webhook publishes %v, want a", got)
+	}
+	if got := f.Changed("station", data, now); len(got) != 1 {
+		t.Errorf("filter publishes %v, want a", got)
+	}
+
+	// the policies are shared
+	if got := webhook.(*publishFilter).policy("station", "a"); got != f.defaults {
+		t.Errorf("sink policy %+v", got)
+	}
+}
@@ -0,0 +1,241 @@
+// Package derived computes energy metrics the inverter does not report, e.g. self-consumption and autarky,
+// from the EnergyTodayTotals counters
+package derived
+
+import (
+	"math"
+
+	"github.com/misterdelle/invt_logger_reader/ports"
+)
+
+// Group is the first segment of the derived topics
+const Group = "Derived"
+
+// periods of the EnergyTodayTotals counters
+var periods = []string{"Day", "Month", "Year", "Total"}
+
+// Field is a derived field
+type Field struct {
+	Name string
+	Unit string
+}
+
+// Topic is a derived topic with its fields, one per period
+type Topic struct {
+	Name   string
+	Fields []Field
+}
+
+// Record is the values of a derived topic. A field whose counters are missing or invalid is published without
+// value and with the quality of the counters, the fields that cannot be computed (e.g. nothing produced yet) are left out
+type Record struct {
+	Topic  string
+	Values map[string]interface{}
+	Info   ports.RecordInfo
+}
+
+// EnergyTodayTotals counters, "<counter> <period> Energy" in kWh
+const (
+	pv        = "PV"
+	export    = "Grid"
+	purchase  = "Purchasing"
+	charge    = "BAT Charge"
+	discharge = "BAT Discharge"
+	load      = "Load"
+)
+
+// counters of a period, by counter
+type counters map[string]float64
+
+// metric is a derived topic computed from inputs, value returns false when it cannot be computed
+type metric struct {
+	topic string
+	// field is the field name of a period
+	field  func(period string) string
+	unit   string
+	inputs []string
+	// periods the metric is published for, all when nil
+	periods []string
+	value   func(c counters) (float64, bool)
+}
+
+var metrics = []metric{
+	{
+		topic:  "Self Consumption",
+		field:  func(p string) string { return "Self Consumption " + p },
+		unit:   "%",
+		inputs: []string{pv, export},
+		// share of the PV energy used on site, directly or through the battery
+		value: func(c counters) (float64, bool) {
+			if c[pv] <= 0 {
+				return 0, false
+			}
+			return ratio(c[pv]-c[export], c[pv]), true
+		},
+	},
+	{
+		topic:  "Autarky",
+		field:  func(p string) string { return "Autarky " + p },
+		unit:   "%",
+		inputs: []string{load, purchase},
+		// share of the house load not purchased from the grid
+		value: func(c counters) (float64, bool) {
+			if c[load] <= 0 {
+				return 0, false
+			}
+			return ratio(c[load]-c[purchase], c[load]), true
+		},
+	},
+	{
+		topic:  "Self Consumed PV",
+		field:  func(p string) string { return "Self Consumed PV " + p + " Energy" },
+		unit:   "kWh",
+		inputs: []string{pv, export},
+		value: func(c counters) (float64, bool) {
+			return energy(math.Max(c[pv]-c[export], 0)), true
+		},
+	},
+	{
+		topic:  "House Load",
+		field:  func(p string) string { return "House Load " + p + " Energy" },
+		unit:   "kWh",
+		inputs: []string{load},
+		value: func(c counters) (float64, bool) {
+			return energy(c[load]), true
+		},
+	},
+	{
+		topic:  "Grid Export",
+		field:  func(p string) string { return "Grid Export " + p + " Energy" },
+		unit:   "kWh",
+		inputs: []string{export},
+		value: func(c counters) (float64, bool) {
+			return energy(c[export]), true
+		},
+	},
+	{
+		topic:  "Grid Purchase",
+		field:  func(p string) string { return "Grid Purchase " + p + " Energy" },
+		unit:   "kWh",
+		inputs: []string{purchase},
+		value: func(c counters) (float64, bool) {
+			return energy(c[purchase]), true
+		},
+	},
+	{
+		topic:  "Battery Efficiency",
+		field:  func(p string) string { return "Battery Efficiency " + p },
+		unit:   "%",
+		inputs: []string{charge, discharge},
+		// energy taken out of the battery per energy put in, only meaningful over periods where the
+		// state of charge ends where it started: a day swings with the state of charge
+		periods: []string{"Month", "Year", "Total"},
+		value: func(c counters) (float64, bool) {
+			if c[charge] <= 0 {
+				return 0, false
+			}
+			return math.Round(c[discharge]/c[charge]*1000) / 10, true
+		},
+	},
+}
+
+func (m metric) periodList() []string {
+	if m.periods == nil {
+		return periods
+	}
+	return m.periods
+}
+
+// ratio returns part/total as a percentage with one decimal, within 0 and 100
+func ratio(part float64, total float64) float64 {
+	r := math.Min(math.Max(part/total, 0), 1)
+	return math.Round(r*1000) / 10
+}
+
+// energy rounds an energy to Wh, differences of counters carry float noise
+func energy(kWh float64) float64 {
+	return math.Round(kWh*1000) / 1000
+}
+
+// Topics lists the derived topics and their fields
+func Topics() []Topic {
+	topics := make([]Topic, 0, len(metrics))
+	for _, m := range metrics {
+		t := Topic{Name: Group + "/" + m.topic}
+		for _, p := range m.periodList() {
+			t.Fields = append(t.Fields, Field{Name: m.field(p), Unit: m.unit})
+		}
+		topics = append(topics, t)
+	}
+	return topics
+}
+
+// Compute returns the derived records from the EnergyTodayTotals measurements, as returned by the
+// device query; info carries the poll time of the counters and, when known, their quality
+func Compute(measurements map[string]interface{}, info ports.RecordInfo) []Record {
+	records := make([]Record, 0, len(metrics))
+	for _, m := range metrics {
+		r := Record{
+			Topic:  Group + "/" + m.topic,
+			Values: make(map[string]interface{}, len(periods)),
+			Info: ports.RecordInfo{
+				PollTime:   info.PollTime,
+				SourceTime: info.SourceTime,
+				Units:      make(map[string]string, len(periods)),
+				Quality:    make(map[string]string, len(periods)),
+			},
+		}
+
+		for _, p := range m.periodList() {
+			name := m.field(p)
+
+			c := make(counters, len(m.inputs))
+			quality := ports.QualityGood
+			for _, in := range m.inputs {
+				v, q := counter(measurements, info, in+" "+p+" Energy")
+				c[in] = v
+				if q == ports.QualityInvalid || (q == ports.QualityMissing && quality == ports.QualityGood) {
+					quality = q
+				}
+			}
+
+			if quality != ports.QualityGood {
+				r.Values[name] = nil
+				r.Info.Units[name] = m.unit
+				r.Info.Quality[name] = quality
+				continue
+			}
+
+			v, ok := m.value(c)
+			if !ok {
+				continue
+			}
+			r.Values[name] = v
+			r.Info.Units[name] = m.unit
+			r.Info.Quality[name] = ports.QualityGood
+		}
+
+		if len(r.Values) > 0 {
+			records = append(records, r)
+		}
+	}
+
+	return records
+}
+
+// counter returns a counter and its quality: missing when not read, invalid when flagged so or not a number
+func counter(measurements map[string]interface{}, info ports.RecordInfo, name string) (float64, string) {
+	v, found := measurements[name]
+	if !found || v == nil {
+		return 0, ports.QualityMissing
+	}
+	if q := info.Quality[name]; q != "" && q != ports.QualityGood {
+		return 0, q
+	}
+
+	n, ok := ports.NewValue(v).Number()
+	if !ok {
+		return 0, ports.QualityInvalid
+	}
+	return n, ports.QualityGood
+}
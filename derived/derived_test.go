@@ -0,0 +1,134 @@
+package derived
+
+import (
+	"testing"
+	"time"
+
+	"github.com/misterdelle/invt_logger_reader/ports"
+)
+
+// totals are the EnergyTodayTotals counters of a day where the battery has been charged from PV
+func totals() map[string]interface{} {
+	m := map[string]interface{}{}
+	for _, p := range periods {
+		m["PV "+p+" Energy"] = "20"
+		m["Grid "+p+" Energy"] = "5"
+		m["Purchasing "+p+" Energy"] = "2"
+		m["Load "+p+" Energy"] = "12.5"
+		m["BAT Charge "+p+" Energy"] = "8"
+		m["BAT Discharge "+p+" Energy"] = "7.2"
+	}
+	return m
+}
+
+func byTopic(records []Record) map[string]Record {
+	result := make(map[string]Record, len(records))
+	for _, r := range records {
+		result[r.Topic] = r
+	}
+	return result
+}
+
+func TestCompute(t *testing.T) {
+	at := time.Date(2024, 5, 1, 10, 15, 0, 0, time.UTC)
+	records := byTopic(Compute(totals(), ports.RecordInfo{PollTime: at}))
+
+	tests := []struct {
+		topic string
+		field string
+		want  float64
+	}{
+		{"Derived/Self Consumption", "Self Consumption Day", 75},
+		{"Derived/Autarky", "Autarky Month", 84},
+		{"Derived/Self Consumed PV", "Self Consumed PV Year Energy", 15},
+		{"Derived/House Load", "House Load Total Energy", 12.5},
+		{"Derived/Grid Export", "Grid Export Day Energy", 5},
+		{"Derived/Grid Purchase", "Grid Purchase Day Energy", 2},
+		{"Derived/Battery Efficiency", "Battery Efficiency Year", 90},
+	}
+	for _, tt := range tests {
+		r, ok := records[tt.topic]
+		if !ok {
+			t.Errorf("no %s record", tt.topic)
+			continue
+		}
+		if r.Values[tt.field] != tt.want {
+			t.Errorf("%s = %v, want %v", tt.field, r.Values[tt.field], tt.want)
+		}
+		if r.Info.Quality[tt.field] != ports.QualityGood || r.Info.Units[tt.field] == "" || !r.Info.PollTime.Equal(at) {
+			t.Errorf("%s info %+v", tt.field, r.Info)
+		}
+	}
+
+	// a day swings with the state of charge
+	if v, ok := records["Derived/Battery Efficiency"].Values["Battery Efficiency Day"]; ok {
+		t.Errorf("daily battery efficiency published: %v", v)
+	}
+}
+
+func TestComputeQuality(t *testing.T) {
+	m := totals()
+	delete(m, "Load Day Energy")
+	m["PV Month Energy"] = "NaN"
+	m["Grid Month Energy"] = nil
+	m["PV Year Energy"] = "0"
+
+	records := byTopic(Compute(m, ports.RecordInfo{Quality: map[string]string{"Purchasing Total Energy": ports.QualityInvalid}}))
+
+	tests := []struct {
+		topic   string
+		field   string
+		quality string
+	}{
+		{"Derived/House Load", "House Load Day Energy", ports.QualityMissing},
+		{"Derived/Autarky", "Autarky Day", ports.QualityMissing},
+		// invalid wins over missing
+		{"Derived/Self Consumption", "Self Consumption Month", ports.QualityInvalid},
+		{"Derived/Grid Export", "Grid Export Month Energy", ports.QualityMissing},
+		{"Derived/Grid Purchase", "Grid Purchase Total Energy", ports.QualityInvalid},
+		{"Derived/Autarky", "Autarky Total", ports.QualityInvalid},
+	}
+	for _, tt := range tests {
+		r := records[tt.topic]
+		v, ok := r.Values[tt.field]
+		if !ok || v != nil || r.Info.Quality[tt.field] != tt.quality {
+			t.Errorf("%s = %v (%t), quality %q, want no value and %q", tt.field, v, ok, r.Info.Quality[tt.field], tt.quality)
+		}
+	}
+
+	// the other fields of the topics are still computed
+	if v := records["Derived/House Load"].Values["House Load Month Energy"]; v != 12.5 {
+		t.Errorf("House Load Month Energy = %v", v)
+	}
+
+	// nothing produced, cannot be computed
+	if v, ok := records["Derived/Self Consumption"].Values["Self Consumption Year"]; ok {
+		t.Errorf("Self Consumption Year = %v", v)
+	}
+}
+
+func TestComputeNothing(t *testing.T) {
+	records := Compute(map[string]interface{}{}, ports.RecordInfo{})
+	for _, r := range records {
+		for field, v := range r.Values {
+			if v != nil || r.Info.Quality[field] != ports.QualityMissing {
+				t.Errorf("%s = %v, %s", field, v, r.Info.Quality[field])
+			}
+		}
+	}
+}
+
+func TestTopics(t *testing.T) {
+	topics := Topics()
+	if len(topics) != len(metrics) {
+		t.Fatalf("%d topics, want %d", len(topics), len(metrics))
+	}
+
+	fields := make(map[string]int)
+	for _, topic := range topics {
+		fields[topic.Name] = len(topic.Fields)
+	}
+	if fields["Derived/House Load"] != 4 || fields["Derived/Battery Efficiency"] != 3 {
+		t.Errorf("fields per topic %v", fields)
+	}
+}
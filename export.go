@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/misterdelle/invt_logger_reader/adapters/comms/tcpip"
+	"github.com/misterdelle/invt_logger_reader/adapters/devices/invt"
+	"github.com/misterdelle/invt_logger_reader/adapters/export/history"
+	"github.com/misterdelle/invt_logger_reader/ports"
+)
+
+// export formats
+const (
+	exportCSV   = "csv"
+	exportJSONL = "jsonl"
+)
+
+// defaultExportRange is the exported range when -from is not given
+const defaultExportRange = 24 * time.Hour
+
+var (
+	exportFormat   = flag.String("export", "", "export the recorded history, or a capture with -capture, as csv or jsonl instead of running the reader")
+	exportFields   = flag.String("fields", "", "comma separated fields to export, topic/field when the name is used in several topics, all when empty")
+	exportFrom     = flag.String("from", "", "start of the exported range, RFC 3339 time or 2006-01-02 date, 24 hours before -to by default")
+	exportTo       = flag.String("to", "", "end of the exported range, RFC 3339 time or 2006-01-02 date, now by default")
+	exportInterval = flag.Duration("interval", 0, "resampling interval, e.g. 15m, every sample when 0; polling interval of a capture")
+	exportOut      = flag.String("out", "", "file the export is written to")
+	exportCapture  = flag.Duration("capture", 0, "poll the inverter for this long, e.g. 2h, and export the readings instead of the history")
+)
+
+// exportColumn is an exported field
+type exportColumn struct {
+	topic string
+	field string
+	unit  string
+	// name is the field, or topic/field when the field name is exported from several topics
+	name string
+}
+
+// exportWriter writes the rows of an export, values are nil when missing
+type exportWriter interface {
+	Header(columns []exportColumn) error
+	Row(t time.Time, values []interface{}) error
+	Close() error
+}
+
+// runExport writes the history, or the readings of a capture run, to -out
+func runExport(ctx context.Context) error {
+	if *exportOut == "" {
+		return errors.New("missing -out file")
+	}
+
+	// check the format before creating, and truncating, the file
+	switch *exportFormat {
+	case exportCSV, exportJSONL:
+	default:
+		return fmt.Errorf("unknown export format %q, must be %s or %s", *exportFormat, exportCSV, exportJSONL)
+	}
+
+	f, err := os.Create(*exportOut)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var w exportWriter
+	if *exportFormat == exportCSV {
+		w = &csvExport{w: csv.NewWriter(f)}
+	} else {
+		w = &jsonlExport{enc: json.NewEncoder(f)}
+	}
+
+	if *exportCapture > 0 {
+		err = exportReadings(ctx, w)
+	} else {
+		err = exportHistory(w)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// exportHistory writes the history between -from and -to, resampled every -interval
+func exportHistory(w exportWriter) error {
+	if config.History.Path == "" {
+		return errors.New("history.path is not defined, use -capture to export live readings")
+	}
+
+	to := time.Now()
+	from := time.Time{}
+	var err error
+	if *exportTo != "" {
+		if to, err = parseExportTime(*exportTo); err != nil {
+			return err
+		}
+	}
+	if *exportFrom != "" {
+		if from, err = parseExportTime(*exportFrom); err != nil {
+			return err
+		}
+	} else {
+		from = to.Add(-defaultExportRange)
+	}
+	if !from.Before(to) {
+		return errors.New("-from must be before -to")
+	}
+
+	store, err := history.OpenReadOnly(config.History.Path)
+	if err != nil {
+		return err
+	}
+	defer store.Close(time.Second)
+
+	fields, err := store.Fields()
+	if err != nil {
+		return err
+	}
+
+	columns, err := exportColumns(fields, *exportFields)
+	if err != nil {
+		return err
+	}
+
+	rows := make(map[int64][]interface{})
+	for i, c := range columns {
+		points, err := store.Series(c.topic, c.field, from, to, *exportInterval)
+		if err != nil {
+			return err
+		}
+
+		for _, p := range points {
+			ts := p.Time.UnixMilli()
+			if rows[ts] == nil {
+				rows[ts] = make([]interface{}, len(columns))
+			}
+			rows[ts][i] = p.Value
+		}
+	}
+
+	times := make([]int64, 0, len(rows))
+	for ts := range rows {
+		times = append(times, ts)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+
+	if err := w.Header(columns); err != nil {
+		return err
+	}
+	for _, ts := range times {
+		if err := w.Row(time.UnixMilli(ts), rows[ts]); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("exported %d rows of %d fields from %s to %s", len(times), len(columns), from.Format(time.RFC3339), to.Format(time.RFC3339))
+	return nil
+}
+
+// exportReadings polls the inverter every -interval, or inverter.readInterval, for -capture and writes
+// a row per poll as soon as it has been read
+func exportReadings(ctx context.Context, w exportWriter) error {
+	fields := make([]ports.HistoryField, 0)
+	for _, group := range layout {
+		for _, topic := range group.topics {
+			for _, f := range topic.fields {
+				fields = append(fields, ports.HistoryField{Topic: topic.name, Field: f.name, Unit: invt.Unit(f.source)})
+			}
+		}
+	}
+
+	columns, err := exportColumns(fields, *exportFields)
+	if err != nil {
+		return err
+	}
+
+	interval := *exportInterval
+	if interval <= 0 {
+		interval = time.Duration(config.Inverter.ReadInterval) * time.Second
+	}
+
+	port = tcpip.New(config.Inverter.Port)
+	defer port.Close()
+	device = invt.NewInvtLogger(config.Inverter.LoggerSerial, port)
+
+	if err := w.Header(columns); err != nil {
+		return err
+	}
+
+	end := time.Now().Add(*exportCapture)
+	count := 0
+	for {
+		pollTime := time.Now()
+
+		values, err := captureRow(columns)
+		if err != nil {
+			log.Printf("capture poll failed: %s", err)
+		} else {
+			if err := w.Row(pollTime, values); err != nil {
+				return err
+			}
+			count++
+		}
+
+		next := pollTime.Add(interval)
+		if next.After(end) {
+			break
+		}
+
+		select {
+		case <-time.After(time.Until(next)):
+			continue
+		case <-ctx.Done():
+			log.Printf("capture interrupted")
+		}
+		break
+	}
+
+	log.Printf("captured %d rows of %d fields", count, len(columns))
+	return nil
+}
+
+// captureRow queries the groups holding the columns
+func captureRow(columns []exportColumn) ([]interface{}, error) {
+	index := make(map[string]int, len(columns))
+	for i, c := range columns {
+		index[c.topic+"\x00"+c.field] = i
+	}
+
+	values := make([]interface{}, len(columns))
+	for _, group := range layout {
+		needed := false
+		for _, topic := range group.topics {
+			for _, f := range topic.fields {
+				if _, ok := index[topic.name+"\x00"+f.name]; ok {
+					needed = true
+				}
+			}
+		}
+		if !needed {
+			continue
+		}
+
+		measurements, err := group.query(device)
+		if err != nil {
+			return nil, fmt.Errorf("%s measurements: %w", group.name, err)
+		}
+
+		for _, topic := range group.topics {
+			for _, f := range topic.fields {
+				if i, ok := index[topic.name+"\x00"+f.name]; ok {
+					values[i] = measurements[f.source]
+				}
+			}
+		}
+	}
+
+	return values, nil
+}
+
+// exportColumns picks the fields listed in spec, all when empty
+func exportColumns(fields []ports.HistoryField, spec string) ([]exportColumn, error) {
+	selected := make([]ports.HistoryField, 0)
+
+	if strings.TrimSpace(spec) == "" {
+		selected = fields
+	} else {
+		for _, item := range strings.Split(spec, ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+
+			// field names never contain a slash, topic names do
+			topic, field := "", item
+			if i := strings.LastIndex(item, "/"); i >= 0 {
+				topic, field = item[:i], item[i+1:]
+			}
+
+			matches := make([]ports.HistoryField, 0)
+			topics := make([]string, 0)
+			for _, f := range fields {
+				if f.Field == field && (topic == "" || f.Topic == topic) {
+					matches = append(matches, f)
+					topics = append(topics, f.Topic)
+				}
+			}
+
+			switch len(matches) {
+			case 0:
+				return nil, fmt.Errorf("unknown field %q", item)
+			case 1:
+				selected = append(selected, matches[0])
+			default:
+				return nil, fmt.Errorf("field %q is in several topics (%s), use topic/field", item, strings.Join(topics, ", "))
+			}
+		}
+	}
+
+	if len(selected) == 0 {
+		return nil, errors.New("no fields to export")
+	}
+
+	used := make(map[string]int)
+	for _, f := range selected {
+		used[f.Field]++
+	}
+
+	columns := make([]exportColumn, 0, len(selected))
+	for _, f := range selected {
+		name := f.Field
+		if used[f.Field] > 1 {
+			name = f.Topic + "/" + f.Field
+		}
+		columns = append(columns, exportColumn{topic: f.Topic, field: f.Field, unit: f.Unit, name: name})
+	}
+	return columns, nil
+}
+
+// parseExportTime reads an RFC 3339 time or a local date
+func parseExportTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected an RFC 3339 time or a 2006-01-02 date", s)
+}
+
+// csvExport writes a time column and a column per field, headed by the field name and its unit
+type csvExport struct {
+	w *csv.Writer
+}
+
+func (e *csvExport) Header(columns []exportColumn) error {
+	header := make([]string, 0, len(columns)+1)
+	header = append(header, "time")
+	for _, c := range columns {
+		if c.unit != "" {
+			header = append(header, fmt.Sprintf("%s (%s)", c.name, c.unit))
+		} else {
+			header = append(header, c.name)
+		}
+	}
+	return e.write(header)
+}
+
+func (e *csvExport) Row(t time.Time, values []interface{}) error {
+	record := make([]string, 0, len(values)+1)
+	record = append(record, t.Format(time.RFC3339))
+	for _, v := range values {
+		switch n := v.(type) {
+		case nil:
+			record = append(record, "")
+		case float64:
+			record = append(record, strconv.FormatFloat(n, 'f', -1, 64))
+		default:
+			record = append(record, fmt.Sprintf("%v", v))
+		}
+	}
+	return e.write(record)
+}
+
+// write flushes every line, an interrupted capture keeps what has been read
+func (e *csvExport) write(record []string) error {
+	if err := e.w.Write(record); err != nil {
+		return err
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e *csvExport) Close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// jsonlExport writes a line per row with the same values and units layout as the MQTT json payload
+type jsonlExport struct {
+	enc     *json.Encoder
+	columns []exportColumn
+	units   map[string]string
+}
+
+type jsonlRow struct {
+	Time   time.Time              `json:"time"`
+	Values map[string]interface{} `json:"values"`
+	Units  map[string]string      `json:"units,omitempty"`
+}
+
+func (e *jsonlExport) Header(columns []exportColumn) error {
+	e.columns = columns
+	e.units = make(map[string]string)
+	for _, c := range columns {
+		if c.unit != "" {
+			e.units[c.name] = c.unit
+		}
+	}
+	return nil
+}
+
+func (e *jsonlExport) Row(t time.Time, values []interface{}) error {
+	row := jsonlRow{Time: t, Values: make(map[string]interface{}, len(values)), Units: e.units}
+	for i, v := range values {
+		if v != nil {
+			row.Values[e.columns[i].name] = ports.NewValue(v).JSON()
+		}
+	}
+	return e.enc.Encode(row)
+}
+
+func (e *jsonlExport) Close() error {
+	return nil
+}
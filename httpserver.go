@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/misterdelle/invt_logger_reader/adapters/api"
+)
+
+var httpServer *http.Server
+
+// startHTTPServer serves the HTTP endpoints (/metrics and the API) on config.Http.Listen
+func startHTTPServer(mux *http.ServeMux) {
+	httpServer = &http.Server{
+		Addr:              config.Http.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		log.Printf("HTTP server listening on %s", config.Http.Listen)
+		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("HTTP server failed: %s", err)
+		}
+	}()
+}
+
+// stopHTTPServer waits for the running requests until deadline
+func stopHTTPServer(deadline time.Time) {
+	if httpServer == nil {
+		return
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Printf("failed to stop HTTP server: %s", err)
+	}
+}
+
+// apiDevice describes the inverter to the API clients, as it is announced to Home Assistant
+func apiDevice() api.DeviceInfo {
+	d := discoveryDevice()
+
+	return api.DeviceInfo{
+		Serial:       d.Serial,
+		Name:         d.Name,
+		Manufacturer: d.Manufacturer,
+		Model:        d.Model,
+	}
+}
+
+func apiStatus() api.ReaderStatus {
+	status := breaker.Status()
+
+	result := api.ReaderStatus{
+		State:               status.State.String(),
+		LoggerAvailable:     status.State != BreakerOpen,
+		ConsecutiveFailures: status.Failures,
+		LastError:           status.LastError,
+		ReadInterval:        int(readInterval.Load()),
+	}
+
+	if !status.NextProbe.IsZero() {
+		result.NextProbe = &status.NextProbe
+	}
+	if lastPoll := snapshot.LastPoll(); !lastPoll.IsZero() {
+		result.LastPoll = &lastPoll
+	}
+
+	return result
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/misterdelle/invt_logger_reader/adapters/devices/invt"
+	"github.com/misterdelle/invt_logger_reader/adapters/export/mosquitto"
+	"github.com/misterdelle/invt_logger_reader/derived"
+	"github.com/misterdelle/invt_logger_reader/ports"
+)
+
+// measurementGroup describes how the result of a device query is split into topics
+type measurementGroup struct {
+	name   string
+	query  func(ports.Device) (map[string]interface{}, error)
+	topics []measurementTopic
+	// derived tells that the derived metrics are computed from the measurements of the group
+	derived bool
+}
+
+// measurementTopic is a set of measurements published together
+type measurementTopic struct {
+	name   string
+	fields []topicField
+}
+
+// topicField maps a published field to the measurement returned by the device query
+type topicField struct {
+	name   string
+	source string
+}
+
+// asIs publishes measurements with the name returned by the device query
+func asIs(names ...string) []topicField {
+	fields := make([]topicField, 0, len(names))
+	for _, name := range names {
+		fields = append(fields, topicField{name, name})
+	}
+	return fields
+}
+
+// layout lists, in query order, every measurement published by the reader
+var layout = []measurementGroup{
+	{
+		name:  "Station",
+		query: ports.Device.QueryStation,
+		topics: []measurementTopic{
+			{
+				name: "station",
+				fields: asIs(
+					"lastUpdateTime",
+					"lastUpdateTimeUnix",
+					"batterySOC",
+					"batteryPower",
+					"currentConsumptionPower",
+					"batteryChargeDayEnergy",
+					"batteryDischargeDayEnergy",
+					"batteryChargeTotalEnergy",
+					"batteryDischargeTotalEnergy",
+					"pvDayEnergy",
+					"gridDayEnergy",
+					"loadDayEnergy",
+					"pvTotalEnergy",
+					"gridTotalEnergy",
+					"loadTotalEnergy",
+					"purchasingDayEnergy",
+					"purchasingTotalEnergy",
+					"powerFromPV1",
+					"powerFromPV2",
+					"totalPowerFromPV",
+				),
+			},
+		},
+	},
+	{
+		name:    "EnergyTodayTotals",
+		query:   ports.Device.QueryEnergyTodayTotals,
+		derived: true,
+		topics: []measurementTopic{
+			{
+				name: "EnergyTodayTotals",
+				fields: asIs(
+					"S BUS Voltage",
+					"N BUS Voltage",
+					"DC DC Temperature",
+				),
+			},
+			{
+				name: "EnergyTodayTotals/PV",
+				fields: asIs(
+					"PV Day Energy",
+					"PV Month Energy",
+					"PV Year Energy",
+					"PV Total Energy",
+				),
+			},
+			{
+				name: "EnergyTodayTotals/Grid",
+				fields: asIs(
+					"Grid Day Energy",
+					"Grid Month Energy",
+					"Grid Year Energy",
+					"Grid Total Energy",
+				),
+			},
+			{
+				name: "EnergyTodayTotals/Load",
+				fields: asIs(
+					"Load Day Energy",
+					"Load Month Energy",
+					"Load Year Energy",
+					"Load Total Energy",
+				),
+			},
+			{
+				name: "EnergyTodayTotals/Purchase",
+				fields: asIs(
+					"Purchasing Day Energy",
+					"Purchasing Month Energy",
+					"Purchasing Year Energy",
+					"Purchasing Total Energy",
+				),
+			},
+			{
+				name: "EnergyTodayTotals/Battery Charge",
+				fields: asIs(
+					"BAT Charge Day Energy",
+					"BAT Charge Month Energy",
+					"BAT Charge Year Energy",
+					"BAT Charge Total Energy",
+				),
+			},
+			{
+				name: "EnergyTodayTotals/Battery Discharge",
+				fields: asIs(
+					"BAT Discharge Day Energy",
+					"BAT Discharge Month Energy",
+					"BAT Discharge Year Energy",
+					"BAT Discharge Total Energy",
+				),
+			},
+		},
+	},
+	{
+		name:  "GridOutput",
+		query: ports.Device.QueryGridOutput,
+		topics: []measurementTopic{
+			{
+				name: "GridOutput",
+				fields: asIs(
+					"Grid Freq",
+					"Inv 1 Temperature",
+					"Inv 2 Temperature",
+				),
+			},
+			{
+				name: "GridOutput/Grid A",
+				fields: []topicField{
+					{"Inv A Voltage", "Grid A Voltage"},
+					{"Inv A Current", "Grid A Current"},
+					{"Inv A Power", "Grid A Power"},
+				},
+			},
+			{
+				name: "GridOutput/Grid B",
+				fields: []topicField{
+					{"Inv B Voltage", "Grid B Voltage"},
+					{"Inv B Current", "Grid B Current"},
+					{"Inv B Power", "Grid B Power"},
+				},
+			},
+			{
+				name: "GridOutput/Grid C",
+				fields: []topicField{
+					{"Inv C Voltage", "Grid C Voltage"},
+					{"Inv C Current", "Grid C Current"},
+					{"Inv C Power", "Grid C Power"},
+				},
+			},
+		},
+	},
+	{
+		name:  "InverterInfo",
+		query: ports.Device.QueryInverterInfo,
+		topics: []measurementTopic{
+			{
+				name: "InverterInfo",
+				fields: asIs(
+					"Leak Current",
+				),
+			},
+			{
+				name: "InverterInfo/INV A",
+				fields: asIs(
+					"Inv A Voltage",
+					"Inv A Current",
+					"Inv A Power",
+					"Inv A Freq",
+				),
+			},
+			{
+				name: "InverterInfo/INV B",
+				fields: asIs(
+					"Inv B Voltage",
+					"Inv B Current",
+					"Inv B Power",
+					"Inv B Freq",
+				),
+			},
+			{
+				name: "InverterInfo/INV C",
+				fields: asIs(
+					"Inv C Voltage",
+					"Inv C Current",
+					"Inv C Power",
+					"Inv C Freq",
+				),
+			},
+		},
+	},
+	{
+		name:  "LoadInfo",
+		query: ports.Device.QueryLoadInfo,
+		topics: []measurementTopic{
+			{
+				name: "LoadInfo",
+				fields: asIs(
+					"Generator Port Voltage A",
+					"Generator Port Voltage B",
+					"Generator Port Voltage C",
+				),
+			},
+			{
+				name: "LoadInfo/Load A",
+				fields: asIs(
+					"Load A Voltage",
+					"Load A Current",
+					"Load A Power",
+					"Load A Rate",
+				),
+			},
+			{
+				name: "LoadInfo/Load B",
+				fields: asIs(
+					"Load B Voltage",
+					"Load B Current",
+					"Load B Power",
+					"Load B Rate",
+				),
+			},
+			{
+				name: "LoadInfo/Load C",
+				fields: asIs(
+					"Load C Voltage",
+					"Load C Current",
+					"Load C Power",
+					"Load C Rate",
+				),
+			},
+		},
+	},
+	{
+		name:  "BatteryOutput",
+		query: ports.Device.QueryBatteryOutput,
+		topics: []measurementTopic{
+			{
+				name: "BatteryOutput/BAT",
+				fields: asIs(
+					"BAT Voltage",
+					"BAT Current",
+					"BAT 1 Current",
+					"BAT 2 Current",
+					"BAT 3 Current",
+					"BAT SOC",
+					"BAT Temperature",
+					"BAT Charge Voltage",
+					"BAT Charge Current Limit",
+					"BAT Discharge Current Limit",
+					"BAT Power",
+				),
+			},
+			{
+				name: "BatteryOutput/BMS BAT",
+				fields: asIs(
+					"BMS BAT Voltage",
+					"BMS BAT Current",
+					"BMS BAT Cell Max Voltage",
+					"BMS BAT Cell Min Voltage",
+					"BMS BAT Cell Max Temperature",
+					"BMS BAT Cell Min Temperature",
+				),
+			},
+		},
+	},
+	{
+		name:  "PVOutput",
+		query: ports.Device.QueryPVOutput,
+		topics: []measurementTopic{
+			{
+				name: "PVOutput/PV1",
+				fields: asIs(
+					"Voltage PV 1",
+					"Current PV 1",
+					"Power PV 1",
+				),
+			},
+			{
+				name: "PVOutput/PV2",
+				fields: asIs(
+					"Voltage PV 2",
+					"Current PV 2",
+					"Power PV 2",
+				),
+			},
+		},
+	},
+}
+
+// discoveryDevice identifies the inverter in Home Assistant by its logger serial number
+func discoveryDevice() mosquitto.DiscoveryDevice {
+	serial := fmt.Sprintf("%d", config.Inverter.LoggerSerial)
+
+	return mosquitto.DiscoveryDevice{
+		Serial:       serial,
+		Name:         "INVT " + serial,
+		Manufacturer: "INVT",
+		Model:        "LSW-3 logger",
+	}
+}
+
+// discoverySensors announces every field of the layout, with the unit defined by its register
+func discoverySensors() []mosquitto.DiscoverySensor {
+	sensors := make([]mosquitto.DiscoverySensor, 0)
+	for _, group := range layout {
+		for _, topic := range group.topics {
+			for _, f := range topic.fields {
+				sensors = append(sensors, mosquitto.DiscoverySensor{
+					Topic: topic.name,
+					Field: f.name,
+					Unit:  invt.Unit(f.source),
+				})
+			}
+		}
+	}
+
+	if config.Derived {
+		for _, topic := range derived.Topics() {
+			for _, f := range topic.Fields {
+				sensors = append(sensors, mosquitto.DiscoverySensor{Topic: topic.Name, Field: f.Name, Unit: f.Unit})
+			}
+		}
+	}
+	return sensors
+}
+
+// inverterTime returns the inverter clock reported by the station query
+func inverterTime(measurements map[string]interface{}) (time.Time, bool) {
+	v, ok := measurements["lastUpdateTime"].(string)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", v, time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// quality flags a field as missing when the device did not return it and as invalid
+// when a field with a unit of measure is not a number; NaN and infinities are invalid too,
+// the JSON payloads keep them as text
+func quality(v interface{}, found bool, unit string) string {
+	if !found || v == nil {
+		return ports.QualityMissing
+	}
+
+	if unit != "" {
+		if _, ok := ports.NewValue(v).Number(); !ok {
+			return ports.QualityInvalid
+		}
+	}
+
+	return ports.QualityGood
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/misterdelle/invt_logger_reader/ports"
+)
+
+func TestQuality(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		found bool
+		unit  string
+		want  string
+	}{
+		{"230.1", true, "V", ports.QualityGood},
+		{12.5, true, "kWh", ports.QualityGood},
+		{7, true, "W", ports.QualityGood},
+		{"Self use", true, "", ports.QualityGood},
+		{math.NaN(), true, "", ports.QualityGood},
+		{"---", true, "V", ports.QualityInvalid},
+		{"NaN", true, "V", ports.QualityInvalid},
+		{math.NaN(), true, "V", ports.QualityInvalid},
+		{math.Inf(1), true, "kW", ports.QualityInvalid},
+		{float32(math.Inf(-1)), true, "kW", ports.QualityInvalid},
+		{true, true, "%", ports.QualityInvalid},
+		{nil, true, "V", ports.QualityMissing},
+		{nil, false, "V", ports.QualityMissing},
+	}
+	for _, tt := range tests {
+		if got := quality(tt.value, tt.found, tt.unit); got != tt.want {
+			t.Errorf("quality(%#v, %t, %q) = %s, want %s", tt.value, tt.found, tt.unit, got, tt.want)
+		}
+	}
+}
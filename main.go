@@ -1,49 +1,175 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
 	"strconv"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/misterdelle/invt_logger_reader/adapters/api"
 	"github.com/misterdelle/invt_logger_reader/adapters/comms/tcpip"
+	"github.com/misterdelle/invt_logger_reader/adapters/dashboard"
 	"github.com/misterdelle/invt_logger_reader/adapters/devices/invt"
+	"github.com/misterdelle/invt_logger_reader/adapters/export/history"
+	"github.com/misterdelle/invt_logger_reader/adapters/export/influxdb"
 	"github.com/misterdelle/invt_logger_reader/adapters/export/mosquitto"
+	"github.com/misterdelle/invt_logger_reader/adapters/export/pipeline"
+	"github.com/misterdelle/invt_logger_reader/adapters/export/prometheus"
+	"github.com/misterdelle/invt_logger_reader/adapters/export/pvoutput"
+	"github.com/misterdelle/invt_logger_reader/adapters/export/spool"
+	"github.com/misterdelle/invt_logger_reader/adapters/export/webhook"
+	"github.com/misterdelle/invt_logger_reader/adapters/modbus"
+	"github.com/misterdelle/invt_logger_reader/adapters/sunspec"
+	"github.com/misterdelle/invt_logger_reader/derived"
 	"github.com/misterdelle/invt_logger_reader/ports"
 )
 
-// maximumFailedConnections maximum number failed logger connection, after this number will be exceeded reconnect
-// interval will be extended from 5s to readInterval defined in config file
+// maximumFailedConnections maximum number of consecutive failed measurement cycles, after this number
+// will be reached the circuit breaker opens and the logger is only probed every breaker.probeInterval
 const maximumFailedConnections = 3
 
+// defaults used when the retry, breaker and shutdown settings are not defined in config file
+const (
+	defaultRetryInitialDelay    = 5
+	defaultRetryMultiplier      = 2
+	defaultRetryJitter          = 0.2
+	defaultBreakerProbeInterval = 300
+	defaultMQTTKeepAlive        = 30
+	defaultShutdownTimeout      = 10
+	defaultInfluxBatchSize      = 500
+	defaultInfluxFlushInterval  = 10
+	defaultInfluxMaxRetries     = 3
+	defaultHistoryRetention     = 7
+	defaultPVOutputInterval     = 5
+	defaultWebhookBatchSize     = 100
+	defaultWebhookMaxRetries    = 3
+	// defaultModbusMaxAgeIntervals is modbus.maxAge in read intervals, the registers are served for a few missed polls
+	defaultModbusMaxAgeIntervals = 3
+)
+
 type Application struct {
 	Env                  string
 	InverterPort         string
 	InverterLoggerSerial uint
 	InverterReadInterval int
+	InverterAllowWrite   bool
 	MQTTURL              string
 	MQTTUser             string
 	MQTTPassword         string
 	MQTTTopicName        string
+	MQTTClientID         string
+	MQTTTopicNaming      string
+	MQTTTopicTemplate    string
+	MQTTKeepAlive        int
+	MQTTAutoReconnect    bool
+	MQTTResumeSubs       bool
+	MQTTCleanSession     bool
+	MQTTQoS              int
+	MQTTRetain           bool
+	MQTTPayload          string
+	MQTTGroups           map[string]mosquitto.PublishOptions
+	MQTTDiscoveryPrefix  string
+	MQTTCACert           string
+	MQTTClientCert       string
+	MQTTClientKey        string
+	MQTTServerName       string
+	MQTTInsecure         bool
+	MQTTCommands         bool
+	MQTTSpoolPath        string
+	MQTTSpoolMaxMessages int
+	MQTTSpoolMaxBytes    int
+	MQTTSpoolDropPolicy  string
+	RetryInitialDelay    int
+	RetryMaxDelay        int
+	RetryMultiplier      float64
+	RetryJitter          float64
+	BreakerThreshold     int
+	BreakerProbeInterval int
+	ShutdownTimeout      int
+	InfluxURL            string
+	InfluxVersion        string
+	InfluxToken          string
+	InfluxOrg            string
+	InfluxBucket         string
+	InfluxDatabase       string
+	InfluxUser           string
+	InfluxPassword       string
+	InfluxBatchSize      int
+	InfluxFlushInterval  int
+	InfluxMaxRetries     int
+	HistoryPath          string
+	HistoryRetention     int
+	HistoryHourly        int
+	PVOutputURL          string
+	PVOutputApiKey       string
+	PVOutputSystemId     string
+	PVOutputInterval     int
+	PVOutputFields       map[string]string
+	WebhookURL           string
+	WebhookMethod        string
+	WebhookHeaders       string
+	WebhookSecret        string
+	WebhookBatchSize     int
+	WebhookMaxRetries    int
+	Sinks                map[string]pipeline.SinkConfig
+	ModbusListen         string
+	ModbusMaxAge         int
+	ModbusSunSpec        bool
+	ModbusSunSpecBase    int
+	SunSpecBatteryWh     int
+	SunSpecBatteryW      int
+	Derived              bool
+	HttpListen           string
+	HttpDashboard        bool
+	PublishPolicy        string
+	PublishRules         string
+	PublishMaxSilence    int
 }
 
 var (
 	config *Config
 	port   ports.CommunicationPort
 	mqtt   ports.DatabaseWithListener
-	device ports.Device
 
-	hasMQTT bool
+	health   *readerMetrics
+	snapshot *api.Store
+	archive  *history.Store
+	slave    *modbus.Server
+	device   ports.Device
+
+	retryPolicy RetryPolicy
+	breaker     *CircuitBreaker
+	changes     *publishFilter
+	exports     *pipeline.Pipeline
+	// deviceID identifies the inverter in the exported snapshots, the logger serial
+	deviceID string
+
+	hasMQTT     bool
+	hasMetrics  bool
+	hasSnapshot bool
+	hasHistory  bool
+	hasModbus   bool
+
+	// readInterval is the polling interval in seconds, it may be changed by the set/interval command
+	readInterval atomic.Int64
+	// pollNow wakes up the main loop for an immediate measurement cycle
+	pollNow = make(chan struct{}, 1)
 )
 
 // Set up an app config
 var app = Application{}
 
-func init() {
+// loadConfig reads the command line and the settings of the .env files
+func loadConfig() {
 	flag.Parse()
 
 	if app.Env != "" {
@@ -61,25 +187,185 @@ func init() {
 	inverterLoggerSerial, _ := strconv.Atoi(os.Getenv("inverter.loggerSerial"))
 	app.InverterLoggerSerial = uint(inverterLoggerSerial)
 	app.InverterReadInterval, _ = strconv.Atoi(os.Getenv("inverter.readInterval"))
+	app.InverterAllowWrite = getEnvBool("inverter.allowWrite", false)
 
 	app.MQTTURL = os.Getenv("mqtt.url")
 	app.MQTTUser = os.Getenv("mqtt.user")
 	app.MQTTPassword = os.Getenv("mqtt.password")
 	app.MQTTTopicName = os.Getenv("mqtt.prefix")
+	app.MQTTClientID = os.Getenv("mqtt.clientId")
+	if app.MQTTClientID == "" {
+		// unique per logger, two readers with the same client id would kick each other off the broker
+		app.MQTTClientID = fmt.Sprintf("invt-%d", app.InverterLoggerSerial)
+	}
+	app.MQTTTopicNaming = os.Getenv("mqtt.topicNaming")
+	app.MQTTTopicTemplate = os.Getenv("mqtt.topicTemplate")
+	app.MQTTKeepAlive = getEnvInt("mqtt.keepAlive", defaultMQTTKeepAlive)
+	app.MQTTAutoReconnect = getEnvBool("mqtt.autoReconnect", true)
+	app.MQTTResumeSubs = getEnvBool("mqtt.resumeSubs", true)
+	app.MQTTCleanSession = getEnvBool("mqtt.cleanSession", true)
+	app.MQTTQoS = getEnvInt("mqtt.qos", 0)
+	app.MQTTRetain = getEnvBool("mqtt.retain", true)
+	app.MQTTPayload = os.Getenv("mqtt.payload")
+	groups, err := getEnvPublishGroups("mqtt.group.", mosquitto.PublishOptions{QoS: byte(app.MQTTQoS), Retain: app.MQTTRetain, Payload: app.MQTTPayload})
+	if err != nil {
+		log.Fatalln(err)
+	}
+	app.MQTTGroups = groups
+	app.MQTTDiscoveryPrefix = os.Getenv("mqtt.discoveryPrefix")
+	app.MQTTCACert = os.Getenv("mqtt.caCert")
+	app.MQTTClientCert = os.Getenv("mqtt.clientCert")
+	app.MQTTClientKey = os.Getenv("mqtt.clientKey")
+	app.MQTTServerName = os.Getenv("mqtt.serverName")
+	app.MQTTInsecure = getEnvBool("mqtt.insecureSkipVerify", false)
+	app.MQTTCommands = getEnvBool("mqtt.commands", false)
+	app.MQTTSpoolPath = os.Getenv("mqtt.spool.path")
+	app.MQTTSpoolMaxMessages = getEnvInt("mqtt.spool.maxMessages", spool.DefaultMaxMessages)
+	app.MQTTSpoolMaxBytes = getEnvInt("mqtt.spool.maxBytes", spool.DefaultMaxBytes)
+	app.MQTTSpoolDropPolicy = os.Getenv("mqtt.spool.dropPolicy")
+
+	app.RetryInitialDelay = getEnvInt("retry.initialDelay", defaultRetryInitialDelay)
+	app.RetryMaxDelay = getEnvInt("retry.maxDelay", app.InverterReadInterval)
+	app.RetryMultiplier = getEnvFloat("retry.multiplier", defaultRetryMultiplier)
+	app.RetryJitter = getEnvFloat("retry.jitter", defaultRetryJitter)
+	app.BreakerThreshold = getEnvInt("breaker.threshold", maximumFailedConnections)
+	app.BreakerProbeInterval = getEnvInt("breaker.probeInterval", defaultBreakerProbeInterval)
+
+	app.ShutdownTimeout = getEnvInt("shutdown.timeout", defaultShutdownTimeout)
+
+	app.InfluxURL = os.Getenv("influx.url")
+	app.InfluxVersion = os.Getenv("influx.version")
+	app.InfluxToken = os.Getenv("influx.token")
+	app.InfluxOrg = os.Getenv("influx.org")
+	app.InfluxBucket = os.Getenv("influx.bucket")
+	app.InfluxDatabase = os.Getenv("influx.database")
+	app.InfluxUser = os.Getenv("influx.user")
+	app.InfluxPassword = os.Getenv("influx.password")
+	app.InfluxBatchSize = getEnvInt("influx.batchSize", defaultInfluxBatchSize)
+	app.InfluxFlushInterval = getEnvInt("influx.flushInterval", defaultInfluxFlushInterval)
+	app.InfluxMaxRetries = getEnvCount("influx.maxRetries", defaultInfluxMaxRetries)
+
+	app.HistoryPath = os.Getenv("history.path")
+	app.HistoryRetention = getEnvInt("history.retention", defaultHistoryRetention)
+	app.HistoryHourly = getEnvInt("history.hourlyRetention", 0)
+	app.PVOutputURL = os.Getenv("pvoutput.url")
+	app.PVOutputApiKey = os.Getenv("pvoutput.apiKey")
+	app.PVOutputSystemId = os.Getenv("pvoutput.systemId")
+	app.PVOutputInterval = getEnvInt("pvoutput.interval", defaultPVOutputInterval)
+	app.PVOutputFields = make(map[string]string)
+	for _, name := range []string{"energyGeneration", "powerGeneration", "energyConsumption", "powerConsumption", "voltage"} {
+		if v := os.Getenv("pvoutput." + name); v != "" {
+			app.PVOutputFields[name] = v
+		}
+	}
+	app.WebhookURL = os.Getenv("webhook.url")
+	app.WebhookMethod = os.Getenv("webhook.method")
+	app.WebhookHeaders = os.Getenv("webhook.headers")
+	app.WebhookSecret = os.Getenv("webhook.secret")
+	app.WebhookBatchSize = getEnvInt("webhook.batchSize", defaultWebhookBatchSize)
+	app.WebhookMaxRetries = getEnvCount("webhook.maxRetries", defaultWebhookMaxRetries)
+	app.Sinks = getEnvSinks("sink.")
+	app.ModbusListen = os.Getenv("modbus.listen")
+	app.ModbusMaxAge = getEnvCount("modbus.maxAge", defaultModbusMaxAgeIntervals*app.InverterReadInterval)
+	app.ModbusSunSpec = getEnvBool("modbus.sunspec", true)
+	app.ModbusSunSpecBase = getEnvInt("modbus.sunspecBase", sunspec.DefaultBase)
+	app.SunSpecBatteryWh = getEnvInt("modbus.sunspecBatteryCapacity", 0)
+	app.SunSpecBatteryW = getEnvInt("modbus.sunspecBatteryMaxPower", 0)
+	app.Derived = getEnvBool("derived.enabled", true)
+	app.HttpListen = os.Getenv("http.listen")
+	app.HttpDashboard = getEnvBool("http.dashboard", true)
+
+	app.PublishPolicy = os.Getenv("publish.policy")
+	app.PublishRules = os.Getenv("publish.rules")
+	app.PublishMaxSilence = getEnvInt("publish.maxSilence", 0)
 
 	fmt.Printf("app.InverterPort        : %s \n", app.InverterPort)
 	fmt.Printf("app.InverterLoggerSerial: %d \n", app.InverterLoggerSerial)
 	fmt.Printf("app.InverterReadInterval: %d \n", app.InverterReadInterval)
+	fmt.Printf("app.InverterAllowWrite  : %t \n", app.InverterAllowWrite)
 	fmt.Printf("app.MQTTURL             : %s \n", app.MQTTURL)
 	fmt.Printf("app.MQTTUser            : %s \n", app.MQTTUser)
 	fmt.Printf("app.MQTTPassword        : %s \n", app.MQTTPassword)
 	fmt.Printf("app.MQTTTopicName       : %s \n", app.MQTTTopicName)
+	fmt.Printf("app.MQTTClientID        : %s \n", app.MQTTClientID)
+	fmt.Printf("app.MQTTTopicNaming     : %s \n", app.MQTTTopicNaming)
+	fmt.Printf("app.MQTTTopicTemplate   : %s \n", app.MQTTTopicTemplate)
+	fmt.Printf("app.MQTTKeepAlive       : %d \n", app.MQTTKeepAlive)
+	fmt.Printf("app.MQTTAutoReconnect   : %t \n", app.MQTTAutoReconnect)
+	fmt.Printf("app.MQTTResumeSubs      : %t \n", app.MQTTResumeSubs)
+	fmt.Printf("app.MQTTCleanSession    : %t \n", app.MQTTCleanSession)
+	fmt.Printf("app.MQTTQoS             : %d \n", app.MQTTQoS)
+	fmt.Printf("app.MQTTRetain          : %t \n", app.MQTTRetain)
+	fmt.Printf("app.MQTTPayload         : %s \n", app.MQTTPayload)
+	fmt.Printf("app.MQTTGroups          : %v \n", app.MQTTGroups)
+	fmt.Printf("app.MQTTDiscoveryPrefix : %s \n", app.MQTTDiscoveryPrefix)
+	fmt.Printf("app.MQTTCACert          : %s \n", app.MQTTCACert)
+	fmt.Printf("app.MQTTClientCert      : %s \n", app.MQTTClientCert)
+	fmt.Printf("app.MQTTClientKey       : %s \n", app.MQTTClientKey)
+	fmt.Printf("app.MQTTServerName      : %s \n", app.MQTTServerName)
+	fmt.Printf("app.MQTTInsecure        : %t \n", app.MQTTInsecure)
+	fmt.Printf("app.MQTTCommands        : %t \n", app.MQTTCommands)
+	fmt.Printf("app.MQTTSpoolPath       : %s \n", app.MQTTSpoolPath)
+	fmt.Printf("app.MQTTSpoolMaxMessages: %d \n", app.MQTTSpoolMaxMessages)
+	fmt.Printf("app.MQTTSpoolMaxBytes   : %d \n", app.MQTTSpoolMaxBytes)
+	fmt.Printf("app.MQTTSpoolDropPolicy : %s \n", app.MQTTSpoolDropPolicy)
+	fmt.Printf("app.RetryInitialDelay   : %d \n", app.RetryInitialDelay)
+	fmt.Printf("app.RetryMaxDelay       : %d \n", app.RetryMaxDelay)
+	fmt.Printf("app.RetryMultiplier     : %v \n", app.RetryMultiplier)
+	fmt.Printf("app.RetryJitter         : %v \n", app.RetryJitter)
+	fmt.Printf("app.BreakerThreshold    : %d \n", app.BreakerThreshold)
+	fmt.Printf("app.BreakerProbeInterval: %d \n", app.BreakerProbeInterval)
+	fmt.Printf("app.ShutdownTimeout     : %d \n", app.ShutdownTimeout)
+	fmt.Printf("app.InfluxURL           : %s \n", app.InfluxURL)
+	fmt.Printf("app.InfluxVersion       : %s \n", app.InfluxVersion)
+	fmt.Printf("app.InfluxOrg           : %s \n", app.InfluxOrg)
+	fmt.Printf("app.InfluxBucket        : %s \n", app.InfluxBucket)
+	fmt.Printf("app.InfluxDatabase      : %s \n", app.InfluxDatabase)
+	fmt.Printf("app.InfluxUser          : %s \n", app.InfluxUser)
+	fmt.Printf("app.InfluxBatchSize     : %d \n", app.InfluxBatchSize)
+	fmt.Printf("app.InfluxFlushInterval : %d \n", app.InfluxFlushInterval)
+	fmt.Printf("app.InfluxMaxRetries    : %d \n", app.InfluxMaxRetries)
+	fmt.Printf("app.HistoryPath         : %s \n", app.HistoryPath)
+	fmt.Printf("app.HistoryRetention    : %d \n", app.HistoryRetention)
+	fmt.Printf("app.HistoryHourly       : %d \n", app.HistoryHourly)
+	fmt.Printf("app.PVOutputURL         : %s \n", app.PVOutputURL)
+	fmt.Printf("app.PVOutputSystemId    : %s \n", app.PVOutputSystemId)
+	fmt.Printf("app.PVOutputInterval    : %d \n", app.PVOutputInterval)
+	fmt.Printf("app.PVOutputFields      : %v \n", app.PVOutputFields)
+	fmt.Printf("app.WebhookURL          : %s \n", app.WebhookURL)
+	fmt.Printf("app.WebhookMethod       : %s \n", app.WebhookMethod)
+	fmt.Printf("app.WebhookBatchSize    : %d \n", app.WebhookBatchSize)
+	fmt.Printf("app.WebhookMaxRetries   : %d \n", app.WebhookMaxRetries)
+	fmt.Printf("app.Sinks               : %v \n", app.Sinks)
+	fmt.Printf("app.ModbusListen        : %s \n", app.ModbusListen)
+	fmt.Printf("app.ModbusMaxAge        : %d \n", app.ModbusMaxAge)
+	fmt.Printf("app.ModbusSunSpec       : %t \n", app.ModbusSunSpec)
+	fmt.Printf("app.ModbusSunSpecBase   : %d \n", app.ModbusSunSpecBase)
+	fmt.Printf("app.SunSpecBatteryWh    : %d \n", app.SunSpecBatteryWh)
+	fmt.Printf("app.SunSpecBatteryW     : %d \n", app.SunSpecBatteryW)
+	fmt.Printf("app.Derived             : %t \n", app.Derived)
+	fmt.Printf("app.HttpListen          : %s \n", app.HttpListen)
+	fmt.Printf("app.HttpDashboard       : %t \n", app.HttpDashboard)
+	fmt.Printf("app.PublishPolicy       : %s \n", app.PublishPolicy)
+	fmt.Printf("app.PublishRules        : %s \n", app.PublishRules)
+	fmt.Printf("app.PublishMaxSilence   : %d \n", app.PublishMaxSilence)
 
-	var err error
 	config, err = NewConfig(app)
 	if err != nil {
 		log.Fatalln(err)
 	}
+}
+
+// setup connects to the logger and the exporters and starts the HTTP server
+func setup() {
+	var err error
+
+	changes, err = newPublishFilter(config.Publish.Policy, config.Publish.Rules, time.Duration(config.Publish.MaxSilence)*time.Second)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	exports = pipeline.New(changes.forSink)
+	deviceID = fmt.Sprintf("%d", config.Inverter.LoggerSerial)
 
 	hasMQTT = config.Mqtt.Url != "" && config.Mqtt.Prefix != ""
 
@@ -87,623 +373,388 @@ func init() {
 	log.Printf("using TCP/IP communications port %s", config.Inverter.Port)
 
 	if hasMQTT {
-		mqtt, err = mosquitto.New(&config.Mqtt)
+		conn, err := mosquitto.New(&config.Mqtt)
 		if err != nil {
 			log.Fatalf("MQTT connection failed: %s", err)
 		}
 
 		log.Printf("using MQTT at URL %s", config.Mqtt.Url)
-	}
 
-	device = invt.NewInvtLogger(config.Inverter.LoggerSerial, port)
-}
+		conn.PublishDiscovery(discoveryDevice(), discoverySensors())
+		mqtt = conn
+		exports.Add("mqtt", conn, sinkConfig("mqtt", true))
+	}
 
-func main() {
-	for {
-		log.Printf("performing measurements")
-		timeStart := time.Now()
+	if config.Influx.Url != "" {
+		config.Influx.Tags = map[string]string{"inverter": fmt.Sprintf("%d", config.Inverter.LoggerSerial)}
 
-		err := loadStation()
+		conn, err := influxdb.New(&config.Influx)
 		if err != nil {
-			continue
+			log.Fatalf("InfluxDB setup failed: %s", err)
 		}
 
-		err = loadEnergyTodayTotals()
-		if err != nil {
-			continue
-		}
+		log.Printf("using InfluxDB at URL %s", config.Influx.Url)
+		exports.Add("influx", conn, sinkConfig("influx", false))
+	}
 
-		err = loadGridOutput()
-		if err != nil {
-			continue
-		}
+	hasHistory = config.History.Path != ""
 
-		err = loadInverterInfo()
+	if hasHistory {
+		store, err := history.New(&config.History)
 		if err != nil {
-			continue
+			log.Fatalf("history setup failed: %s", err)
 		}
 
-		err = loadLoadInfo()
-		if err != nil {
-			continue
-		}
+		log.Printf("recording history in %s", config.History.Path)
+		archive = store
+		exports.Add("history", store, sinkConfig("history", false))
+	}
 
-		err = loadBatteryOutput()
+	if config.PVOutput.ApiKey != "" {
+		uploader, err := pvoutput.New(&config.PVOutput)
 		if err != nil {
-			continue
+			log.Fatalf("PVOutput setup failed: %s", err)
 		}
 
-		err = loadPVOutput()
-		if err != nil {
-			continue
-		}
+		log.Printf("uploading to PVOutput system %s every %s", config.PVOutput.SystemId, config.PVOutput.Interval)
+		exports.Add("pvoutput", uploader, sinkConfig("pvoutput", false))
+	}
 
-		duration := time.Since(timeStart)
+	if config.Webhook.Url != "" {
+		config.Webhook.Serial = fmt.Sprintf("%d", config.Inverter.LoggerSerial)
 
-		delay := time.Duration(config.Inverter.ReadInterval)*time.Second - duration
-		if delay <= 0 {
-			delay = 1 * time.Second
+		hook, err := webhook.New(&config.Webhook)
+		if err != nil {
+			log.Fatalf("webhook setup failed: %s", err)
 		}
 
-		time.Sleep(delay)
+		log.Printf("sending the poll cycles to webhook %s", config.Webhook.Url)
+		exports.Add("webhook", hook, sinkConfig("webhook", true))
 	}
 
-}
+	logger := invt.NewInvtLogger(config.Inverter.LoggerSerial, port)
+	device = logger
 
-// func isSerialPort(portName string) bool {
-// 	return strings.HasPrefix(portName, "/")
-// }
+	hasModbus = config.Modbus.Listen != ""
 
-func loadStation() error {
-	failedConnections := 0
+	if hasModbus {
+		registers := modbus.Chain{logger.Registers()}
 
-	//
-	// Station
-	//
-	measurementsStation, err := device.QueryStation()
+		hasSunSpec := config.SunSpec.Base != 0
+		if hasSunSpec {
+			identity := discoveryDevice()
+			config.SunSpec.Manufacturer = identity.Manufacturer
+			config.SunSpec.Model = identity.Model
+			config.SunSpec.Serial = identity.Serial
 
-	if err != nil {
-		log.Printf("failed to perform measurementsStation: %s", err)
-		failedConnections++
+			sunSpec := sunspec.New(&config.SunSpec)
+			registers = append(registers, sunSpec)
+			exports.Add("sunspec", sunSpec, sinkConfig("sunspec", false))
+		}
 
-		if failedConnections > maximumFailedConnections {
-			time.Sleep(time.Duration(config.Inverter.ReadInterval) * time.Second)
+		slave, err = modbus.New(&config.Modbus, registers)
+		if err != nil {
+			log.Fatalf("Modbus TCP server failed: %s", err)
 		}
 
-		return err
+		log.Printf("serving the inverter registers over Modbus TCP on %s", slave.Addr())
+		if hasSunSpec {
+			log.Printf("serving the SunSpec models from register %d", config.SunSpec.Base)
+		}
 	}
 
-	log.Println("Station Measurement: ", measurementsStation)
-
-	failedConnections = 0
+	readInterval.Store(int64(config.Inverter.ReadInterval))
+	if hasMQTT && config.Commands {
+		subscribeCommands()
+	}
 
-	if hasMQTT {
-		go func() {
-			err = mqtt.InsertGenericRecord("station", measurementsStation)
-			if err != nil {
-				log.Printf("failed to insert record to MQTT: %s\n", err)
-			} else {
-				log.Println("measurementsStation pushed to MQTT")
-			}
-		}()
+	retryPolicy = RetryPolicy{
+		InitialDelay: time.Duration(config.Retry.InitialDelay) * time.Second,
+		MaxDelay:     time.Duration(config.Retry.MaxDelay) * time.Second,
+		Multiplier:   config.Retry.Multiplier,
+		Jitter:       config.Retry.Jitter,
 	}
+	breaker = NewCircuitBreaker(config.Breaker.Threshold, time.Duration(config.Breaker.ProbeInterval)*time.Second)
 
-	return nil
+	if config.Http.Listen != "" {
+		hasMetrics = true
+		hasSnapshot = true
 
-}
+		labels := prometheus.Labels{"inverter": fmt.Sprintf("%d", config.Inverter.LoggerSerial)}
+		registry := prometheus.NewRegistry()
+		health = newReaderMetrics(registry, labels)
 
-func loadEnergyTodayTotals() error {
-	failedConnections := 0
+		snapshot = api.NewStore()
+		stream := api.NewHub(snapshot)
 
-	//
-	// Energy Today Totals
-	//
-	measurementsEnergyTodayTotals, err := device.QueryEnergyTodayTotals()
+		// the reader status is already exposed by the invt_reader_* metrics
+		metricsSink := sinkConfig("metrics", false)
+		metricsSink.Exclude = append([]string{readerTopic}, metricsSink.Exclude...)
 
-	if err != nil {
-		log.Printf("failed to perform measurementsEnergyTodayTotals: %s", err)
-		failedConnections++
+		exports.Add("metrics", prometheus.NewExporter(registry, labels), metricsSink)
+		exports.Add("api", snapshot, sinkConfig("api", false))
+		exports.Add("stream", stream, sinkConfig("stream", false))
 
-		if failedConnections > maximumFailedConnections {
-			time.Sleep(time.Duration(config.Inverter.ReadInterval) * time.Second)
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", registry.Handler())
+		// a nil *history.Store would not be a nil ports.History
+		var records ports.History
+		if hasHistory {
+			records = archive
 		}
 
-		return err
+		mux.Handle(api.Prefix, api.NewServer(snapshot, stream, records, apiDevice(), apiStatus))
+		if config.Http.Dashboard {
+			mux.Handle("/", dashboard.Handler())
+		}
+		startHTTPServer(mux)
 	}
+}
 
-	pv := make(map[string]interface{})
-	grid := make(map[string]interface{})
-	load := make(map[string]interface{})
-	purchase := make(map[string]interface{})
-	batCharge := make(map[string]interface{})
-	batDischarge := make(map[string]interface{})
-	root := make(map[string]interface{})
-
-	pv["PV Day Energy"] = measurementsEnergyTodayTotals["PV Day Energy"]
-	pv["PV Month Energy"] = measurementsEnergyTodayTotals["PV Month Energy"]
-	pv["PV Year Energy"] = measurementsEnergyTodayTotals["PV Year Energy"]
-	pv["PV Total Energy"] = measurementsEnergyTodayTotals["PV Total Energy"]
-
-	grid["Grid Day Energy"] = measurementsEnergyTodayTotals["Grid Day Energy"]
-	grid["Grid Month Energy"] = measurementsEnergyTodayTotals["Grid Month Energy"]
-	grid["Grid Year Energy"] = measurementsEnergyTodayTotals["Grid Year Energy"]
-	grid["Grid Total Energy"] = measurementsEnergyTodayTotals["Grid Total Energy"]
-
-	load["Load Day Energy"] = measurementsEnergyTodayTotals["Load Day Energy"]
-	load["Load Month Energy"] = measurementsEnergyTodayTotals["Load Month Energy"]
-	load["Load Year Energy"] = measurementsEnergyTodayTotals["Load Year Energy"]
-	load["Load Total Energy"] = measurementsEnergyTodayTotals["Load Total Energy"]
-
-	purchase["Purchasing Day Energy"] = measurementsEnergyTodayTotals["Purchasing Day Energy"]
-	purchase["Purchasing Month Energy"] = measurementsEnergyTodayTotals["Purchasing Month Energy"]
-	purchase["Purchasing Year Energy"] = measurementsEnergyTodayTotals["Purchasing Year Energy"]
-	purchase["Purchasing Total Energy"] = measurementsEnergyTodayTotals["Purchasing Total Energy"]
-
-	batCharge["BAT Charge Day Energy"] = measurementsEnergyTodayTotals["BAT Charge Day Energy"]
-	batCharge["BAT Charge Month Energy"] = measurementsEnergyTodayTotals["BAT Charge Month Energy"]
-	batCharge["BAT Charge Year Energy"] = measurementsEnergyTodayTotals["BAT Charge Year Energy"]
-	batCharge["BAT Charge Total Energy"] = measurementsEnergyTodayTotals["BAT Charge Total Energy"]
-
-	batDischarge["BAT Discharge Day Energy"] = measurementsEnergyTodayTotals["BAT Discharge Day Energy"]
-	batDischarge["BAT Discharge Month Energy"] = measurementsEnergyTodayTotals["BAT Discharge Month Energy"]
-	batDischarge["BAT Discharge Year Energy"] = measurementsEnergyTodayTotals["BAT Discharge Year Energy"]
-	batDischarge["BAT Discharge Total Energy"] = measurementsEnergyTodayTotals["BAT Discharge Total Energy"]
-
-	root["S BUS Voltage"] = measurementsEnergyTodayTotals["S BUS Voltage"]
-	root["N BUS Voltage"] = measurementsEnergyTodayTotals["N BUS Voltage"]
-	root["DC DC Temperature"] = measurementsEnergyTodayTotals["DC DC Temperature"]
-
-	log.Println("measurementsEnergyTodayTotals: ", measurementsEnergyTodayTotals)
+func main() {
+	loadConfig()
 
-	failedConnections = 0
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	if hasMQTT {
-		err = mqtt.InsertGenericRecord("EnergyTodayTotals", root)
-		if err != nil {
-			log.Printf("failed to insert record to MQTT: %s\n", err)
-		} else {
-			log.Println("EnergyTodayTotals pushed to MQTT")
+	if *exportFormat != "" {
+		if err := runExport(ctx); err != nil {
+			log.Fatalf("export failed: %s", err)
 		}
+		return
+	}
 
-		go func(topic string, data map[string]interface{}) {
-			err = mqtt.InsertGenericRecord(topic, data)
-			if err != nil {
-				log.Printf("failed to insert record to MQTT: %s\n", err)
-			} else {
-				log.Printf("%s pushed to MQTT", topic)
-			}
-		}("EnergyTodayTotals/PV", pv)
+	setup()
 
-		go func(topic string, data map[string]interface{}) {
-			err = mqtt.InsertGenericRecord(topic, data)
-			if err != nil {
-				log.Printf("failed to insert record to MQTT: %s\n", err)
-			} else {
-				log.Printf("%s pushed to MQTT", topic)
-			}
-		}("EnergyTodayTotals/Grid", grid)
+	forced := false
 
-		go func(topic string, data map[string]interface{}) {
-			err = mqtt.InsertGenericRecord(topic, data)
-			if err != nil {
-				log.Printf("failed to insert record to MQTT: %s\n", err)
-			} else {
-				log.Printf("%s pushed to MQTT", topic)
+	for {
+		delay := time.Duration(readInterval.Load()) * time.Second
+
+		// a requested poll is performed even while the breaker is open
+		if forced || breaker.Allow() {
+			log.Printf("performing measurements")
+			timeStart := time.Now()
+
+			done := make(chan error, 1)
+			go func() {
+				done <- measure(ctx)
+			}()
+
+			var err error
+			select {
+			case err = <-done:
+			case <-ctx.Done():
+				shutdown(done)
+				return
 			}
-		}("EnergyTodayTotals/Load", load)
 
-		go func(topic string, data map[string]interface{}) {
-			err = mqtt.InsertGenericRecord(topic, data)
-			if err != nil {
-				log.Printf("failed to insert record to MQTT: %s\n", err)
-			} else {
-				log.Printf("%s pushed to MQTT", topic)
+			if hasMetrics {
+				health.ObserveCycle(time.Since(timeStart), err)
 			}
-		}("EnergyTodayTotals/Purchase", purchase)
 
-		go func(topic string, data map[string]interface{}) {
-			err = mqtt.InsertGenericRecord(topic, data)
 			if err != nil {
-				log.Printf("failed to insert record to MQTT: %s\n", err)
+				breaker.Failure(err)
+				delay = retryPolicy.Delay(breaker.Status().Failures)
+				log.Printf("measurement cycle failed, retrying in %s", delay.Round(time.Second))
 			} else {
-				log.Printf("%s pushed to MQTT", topic)
+				breaker.Success()
+				delay -= time.Since(timeStart)
 			}
-		}("EnergyTodayTotals/Battery Charge", batCharge)
 
-		go func(topic string, data map[string]interface{}) {
-			err = mqtt.InsertGenericRecord(topic, data)
-			if err != nil {
-				log.Printf("failed to insert record to MQTT: %s\n", err)
-			} else {
-				log.Printf("%s pushed to MQTT", topic)
+			publishReaderStatus()
+			exports.CycleComplete(err == nil)
+			if hasMetrics {
+				health.ObserveBreaker(breaker.Status())
 			}
-		}("EnergyTodayTotals/Battery Discharge", batDischarge)
-	}
-
-	return nil
-
-}
-
-func loadGridOutput() error {
-	failedConnections := 0
-
-	//
-	// Grid Output
-	//
-	measurementsGridOutput, err := device.QueryGridOutput()
+		}
 
-	if err != nil {
-		log.Printf("failed to perform measurementsGridOutput: %s", err)
-		failedConnections++
+		if status := breaker.Status(); status.State == BreakerOpen {
+			delay = time.Until(status.NextProbe)
+			log.Printf("logger unreachable after %d attempts, next probe at %s", status.Failures, status.NextProbe.Format(time.TimeOnly))
+		}
 
-		if failedConnections > maximumFailedConnections {
-			time.Sleep(time.Duration(config.Inverter.ReadInterval) * time.Second)
+		if delay <= 0 {
+			delay = 1 * time.Second
 		}
 
-		return err
+		select {
+		case <-time.After(delay):
+			forced = false
+		case <-pollNow:
+			log.Printf("immediate poll requested")
+			forced = true
+		case <-ctx.Done():
+			shutdown(nil)
+			return
+		}
 	}
 
-	gridA := make(map[string]interface{})
-	gridB := make(map[string]interface{})
-	gridC := make(map[string]interface{})
-	root := make(map[string]interface{})
-
-	gridA["Inv A Voltage"] = measurementsGridOutput["Grid A Voltage"]
-	gridA["Inv A Current"] = measurementsGridOutput["Grid A Current"]
-	gridA["Inv A Power"] = measurementsGridOutput["Grid A Power"]
-
-	gridB["Inv B Voltage"] = measurementsGridOutput["Grid B Voltage"]
-	gridB["Inv B Current"] = measurementsGridOutput["Grid B Current"]
-	gridB["Inv B Power"] = measurementsGridOutput["Grid B Power"]
-
-	gridC["Inv C Voltage"] = measurementsGridOutput["Grid C Voltage"]
-	gridC["Inv C Current"] = measurementsGridOutput["Grid C Current"]
-	gridC["Inv C Power"] = measurementsGridOutput["Grid C Power"]
-
-	root["Grid Freq"] = measurementsGridOutput["Grid Freq"]
-	root["Inv 1 Temperature"] = measurementsGridOutput["Inv 1 Temperature"]
-	root["Inv 2 Temperature"] = measurementsGridOutput["Inv 2 Temperature"]
-
-	log.Println("measurementsGridOutput: ", measurementsGridOutput)
+}
 
-	failedConnections = 0
+// measure performs a full measurement cycle, stopping at the first failing query or
+// as soon as a shutdown has been requested
+func measure(ctx context.Context) error {
+	info := ports.RecordInfo{PollTime: time.Now()}
 
-	if hasMQTT {
-		err = mqtt.InsertGenericRecord("GridOutput", root)
-		if err != nil {
-			log.Printf("failed to insert record to MQTT: %s\n", err)
-		} else {
-			log.Println("GridOutput pushed to MQTT")
+	for _, group := range layout {
+		if err := ctx.Err(); err != nil {
+			return err
 		}
 
-		go func(topic string, data map[string]interface{}) {
-			err = mqtt.InsertGenericRecord(topic, data)
-			if err != nil {
-				log.Printf("failed to insert record to MQTT: %s\n", err)
-			} else {
-				log.Printf("%s pushed to MQTT", topic)
-			}
-		}("GridOutput/Grid A", gridA)
-
-		go func(topic string, data map[string]interface{}) {
-			err = mqtt.InsertGenericRecord(topic, data)
-			if err != nil {
-				log.Printf("failed to insert record to MQTT: %s\n", err)
-			} else {
-				log.Printf("%s pushed to MQTT", topic)
-			}
-		}("GridOutput/Grid B", gridB)
-
-		go func(topic string, data map[string]interface{}) {
-			err = mqtt.InsertGenericRecord(topic, data)
-			if err != nil {
-				log.Printf("failed to insert record to MQTT: %s\n", err)
-			} else {
-				log.Printf("%s pushed to MQTT", topic)
-			}
-		}("GridOutput/Grid C", gridC)
+		if err := load(group, &info); err != nil {
+			return err
+		}
 	}
 
 	return nil
-
 }
 
-func loadInverterInfo() error {
-	failedConnections := 0
-
-	//
-	// Inverter Info
-	//
-	measurementsInverterInfo, err := device.QueryInverterInfo()
-
+// load queries the device for a group of measurements and publishes its topics, info carries
+// the cycle poll time and, once the station has been read, the inverter clock
+func load(group measurementGroup, info *ports.RecordInfo) error {
+	measurements, err := group.query(device)
 	if err != nil {
-		log.Printf("failed to perform measurementsInverterInfo: %s", err)
-		failedConnections++
-
-		if failedConnections > maximumFailedConnections {
-			time.Sleep(time.Duration(config.Inverter.ReadInterval) * time.Second)
-		}
-
+		log.Printf("failed to perform %s measurements: %s", group.name, err)
 		return err
 	}
 
-	invA := make(map[string]interface{})
-	invB := make(map[string]interface{})
-	invC := make(map[string]interface{})
-	root := make(map[string]interface{})
-
-	invA["Inv A Voltage"] = measurementsInverterInfo["Inv A Voltage"]
-	invA["Inv A Current"] = measurementsInverterInfo["Inv A Current"]
-	invA["Inv A Power"] = measurementsInverterInfo["Inv A Power"]
-	invA["Inv A Freq"] = measurementsInverterInfo["Inv A Freq"]
+	log.Printf("%s measurements: %v", group.name, measurements)
 
-	invB["Inv B Voltage"] = measurementsInverterInfo["Inv B Voltage"]
-	invB["Inv B Current"] = measurementsInverterInfo["Inv B Current"]
-	invB["Inv B Power"] = measurementsInverterInfo["Inv B Power"]
-	invB["Inv B Freq"] = measurementsInverterInfo["Inv B Freq"]
-
-	invC["Inv C Voltage"] = measurementsInverterInfo["Inv C Voltage"]
-	invC["Inv C Current"] = measurementsInverterInfo["Inv C Current"]
-	invC["Inv C Power"] = measurementsInverterInfo["Inv C Power"]
-	invC["Inv C Freq"] = measurementsInverterInfo["Inv C Freq"]
-
-	root["Leak Current"] = measurementsInverterInfo["Leak Current"]
+	if t, ok := inverterTime(measurements); ok {
+		info.SourceTime = t
+	}
 
-	log.Println("measurementsInverterInfo: ", measurementsInverterInfo)
+	if exports.Len() > 0 {
+		for _, topic := range group.topics {
+			data := make(map[string]interface{}, len(topic.fields))
+			topicInfo := ports.RecordInfo{
+				PollTime:   info.PollTime,
+				SourceTime: info.SourceTime,
+				Units:      make(map[string]string, len(topic.fields)),
+				Quality:    make(map[string]string, len(topic.fields)),
+			}
 
-	failedConnections = 0
+			for _, f := range topic.fields {
+				v, found := measurements[f.source]
+				data[f.name] = v
 
-	if hasMQTT {
-		err = mqtt.InsertGenericRecord("InverterInfo", root)
-		if err != nil {
-			log.Printf("failed to insert record to MQTT: %s\n", err)
-		} else {
-			log.Println("InverterInfo pushed to MQTT")
-		}
-
-		go func(topic string, data map[string]interface{}) {
-			err = mqtt.InsertGenericRecord(topic, data)
-			if err != nil {
-				log.Printf("failed to insert record to MQTT: %s\n", err)
-			} else {
-				log.Printf("%s pushed to MQTT", topic)
+				unit := invt.Unit(f.source)
+				if unit != "" {
+					topicInfo.Units[f.name] = unit
+				}
+				topicInfo.Quality[f.name] = quality(v, found, unit)
 			}
-		}("InverterInfo/INV A", invA)
 
-		go func(topic string, data map[string]interface{}) {
-			err = mqtt.InsertGenericRecord(topic, data)
-			if err != nil {
-				log.Printf("failed to insert record to MQTT: %s\n", err)
-			} else {
-				log.Printf("%s pushed to MQTT", topic)
-			}
-		}("InverterInfo/INV B", invB)
+			publish(topic.name, data, topicInfo)
+		}
 
-		go func(topic string, data map[string]interface{}) {
-			err = mqtt.InsertGenericRecord(topic, data)
-			if err != nil {
-				log.Printf("failed to insert record to MQTT: %s\n", err)
-			} else {
-				log.Printf("%s pushed to MQTT", topic)
+		if group.derived && config.Derived {
+			for _, r := range derived.Compute(measurements, *info) {
+				publish(r.Topic, r.Values, r.Info)
 			}
-		}("InverterInfo/INV C", invC)
-
+		}
 	}
 
 	return nil
-
 }
 
-func loadLoadInfo() error {
-	failedConnections := 0
-
-	//
-	// Load Info
-	//
-	measurementsLoadInfo, err := device.QueryLoadInfo()
-
-	if err != nil {
-		log.Printf("failed to perform measurementsLoadInfo: %s", err)
-		failedConnections++
-
-		if failedConnections > maximumFailedConnections {
-			time.Sleep(time.Duration(config.Inverter.ReadInterval) * time.Second)
+// shutdown stops the reader within config.ShutdownTimeout: it waits for the running
+// measurement cycle (if any), shuts the logger connection down and flushes the exporters.
+// The cycle gets half of the timeout at most, the rest is kept for flushing the exporters
+func shutdown(cycle <-chan error) {
+	timeout := time.Duration(config.ShutdownTimeout) * time.Second
+	deadline := time.Now().Add(timeout)
+
+	log.Printf("shutting down, waiting up to %s", timeout)
+
+	if cycle != nil {
+		select {
+		case <-cycle:
+			cycle = nil
+		case <-time.After(timeout / 2):
+			// shutting the port down below fails the request in flight and the next ones
+			log.Printf("measurement cycle still running, cancelling current request")
 		}
-
-		return err
 	}
 
-	loadA := make(map[string]interface{})
-	loadB := make(map[string]interface{})
-	loadC := make(map[string]interface{})
-	root := make(map[string]interface{})
-
-	loadA["Load A Voltage"] = measurementsLoadInfo["Load A Voltage"]
-	loadA["Load A Current"] = measurementsLoadInfo["Load A Current"]
-	loadA["Load A Power"] = measurementsLoadInfo["Load A Power"]
-	loadA["Load A Rate"] = measurementsLoadInfo["Load A Rate"]
-
-	loadB["Load B Voltage"] = measurementsLoadInfo["Load B Voltage"]
-	loadB["Load B Current"] = measurementsLoadInfo["Load B Current"]
-	loadB["Load B Power"] = measurementsLoadInfo["Load B Power"]
-	loadB["Load B Rate"] = measurementsLoadInfo["Load B Rate"]
-
-	loadC["Load C Voltage"] = measurementsLoadInfo["Load C Voltage"]
-	loadC["Load C Current"] = measurementsLoadInfo["Load C Current"]
-	loadC["Load C Power"] = measurementsLoadInfo["Load C Power"]
-	loadC["Load C Rate"] = measurementsLoadInfo["Load C Rate"]
-
-	root["Generator Port Voltage A"] = measurementsLoadInfo["Generator Port Voltage A"]
-	root["Generator Port Voltage B"] = measurementsLoadInfo["Generator Port Voltage B"]
-	root["Generator Port Voltage C"] = measurementsLoadInfo["Generator Port Voltage C"]
-
-	log.Println("measurementsLoadInfo: ", measurementsLoadInfo)
-
-	failedConnections = 0
+	if err := port.Shutdown(); err != nil {
+		log.Printf("error during connection close: %s", err)
+	}
 
-	if hasMQTT {
-		err = mqtt.InsertGenericRecord("LoadInfo", root)
-		if err != nil {
-			log.Printf("failed to insert record to MQTT: %s\n", err)
-		} else {
-			log.Println("LoadInfo pushed to MQTT")
+	// the cancelled cycle may still be publishing what it has read so far
+	if cycle != nil {
+		select {
+		case <-cycle:
+		case <-time.After(time.Until(deadline)):
+			log.Printf("measurement cycle not cancelled, the measurements it still publishes are dropped")
 		}
-
-		go func(topic string, data map[string]interface{}) {
-			err = mqtt.InsertGenericRecord(topic, data)
-			if err != nil {
-				log.Printf("failed to insert record to MQTT: %s\n", err)
-			} else {
-				log.Printf("%s pushed to MQTT", topic)
-			}
-		}("LoadInfo/Load A", loadA)
-
-		go func(topic string, data map[string]interface{}) {
-			err = mqtt.InsertGenericRecord(topic, data)
-			if err != nil {
-				log.Printf("failed to insert record to MQTT: %s\n", err)
-			} else {
-				log.Printf("%s pushed to MQTT", topic)
-			}
-		}("LoadInfo/Load B", loadB)
-
-		go func(topic string, data map[string]interface{}) {
-			err = mqtt.InsertGenericRecord(topic, data)
-			if err != nil {
-				log.Printf("failed to insert record to MQTT: %s\n", err)
-			} else {
-				log.Printf("%s pushed to MQTT", topic)
-			}
-		}("LoadInfo/Load C", loadC)
 	}
 
-	return nil
-
-}
-
-func loadBatteryOutput() error {
-	failedConnections := 0
-
-	//
-	// Battery Output
-	//
-	measurementsBatteryOutput, err := device.QueryBatteryOutput()
-
-	if err != nil {
-		log.Printf("failed to perform measurementsBatteryOutput: %s", err)
-		failedConnections++
-
-		if failedConnections > maximumFailedConnections {
-			time.Sleep(time.Duration(config.Inverter.ReadInterval) * time.Second)
+	if hasModbus {
+		if err := slave.Close(time.Until(deadline)); err != nil {
+			log.Printf("failed to close Modbus TCP server: %s", err)
 		}
-
-		return err
 	}
 
-	bat := make(map[string]interface{})
-	bmsBAT := make(map[string]interface{})
-
-	bat["BAT Voltage"] = measurementsBatteryOutput["BAT Voltage"]
-	bat["BAT Current"] = measurementsBatteryOutput["BAT Current"]
-	bat["BAT 1 Current"] = measurementsBatteryOutput["BAT 1 Current"]
-	bat["BAT 2 Current"] = measurementsBatteryOutput["BAT 2 Current"]
-	bat["BAT 3 Current"] = measurementsBatteryOutput["BAT 3 Current"]
-	bat["BAT SOC"] = measurementsBatteryOutput["BAT SOC"]
-	bat["BAT Temperature"] = measurementsBatteryOutput["BAT Temperature"]
-	bat["BAT Charge Voltage"] = measurementsBatteryOutput["BAT Charge Voltage"]
-	bat["BAT Charge Current Limit"] = measurementsBatteryOutput["BAT Charge Current Limit"]
-	bat["BAT Discharge Current Limit"] = measurementsBatteryOutput["BAT Discharge Current Limit"]
-	bat["BAT Power"] = measurementsBatteryOutput["BAT Power"]
+	// streaming clients never end their requests by themselves, the stream sink is closed
+	// along with the others before stopping the HTTP server
+	if err := exports.Close(time.Until(deadline)); err != nil {
+		log.Printf("failed to close the exporters: %s", err)
+	}
+	stopHTTPServer(deadline)
 
-	bmsBAT["BMS BAT Voltage"] = measurementsBatteryOutput["BMS BAT Voltage"]
-	bmsBAT["BMS BAT Current"] = measurementsBatteryOutput["BMS BAT Current"]
-	bmsBAT["BMS BAT Cell Max Voltage"] = measurementsBatteryOutput["BMS BAT Cell Max Voltage"]
-	bmsBAT["BMS BAT Cell Min Voltage"] = measurementsBatteryOutput["BMS BAT Cell Min Voltage"]
-	bmsBAT["BMS BAT Cell Max Temperature"] = measurementsBatteryOutput["BMS BAT Cell Max Temperature"]
-	bmsBAT["BMS BAT Cell Min Temperature"] = measurementsBatteryOutput["BMS BAT Cell Min Temperature"]
+	log.Printf("shutdown completed")
+}
 
-	log.Println("measurementsBatteryOutput: ", measurementsBatteryOutput)
+// readerTopic is the topic of the reader status
+const readerTopic = "Reader"
 
-	failedConnections = 0
+// publishReaderStatus exposes the circuit breaker state to the exporters, the logger
+// is reported unavailable while the breaker is open
+func publishReaderStatus() {
+	status := breaker.Status()
 
 	if hasMQTT {
-		go func(topic string, data map[string]interface{}) {
-			err = mqtt.InsertGenericRecord(topic, data)
-			if err != nil {
-				log.Printf("failed to insert record to MQTT: %s\n", err)
-			} else {
-				log.Printf("%s pushed to MQTT", topic)
-			}
-		}("BatteryOutput/BAT", bat)
-
-		go func(topic string, data map[string]interface{}) {
-			err = mqtt.InsertGenericRecord(topic, data)
-			if err != nil {
-				log.Printf("failed to insert record to MQTT: %s\n", err)
-			} else {
-				log.Printf("%s pushed to MQTT", topic)
-			}
-		}("BatteryOutput/BMS BAT", bmsBAT)
+		mqtt.SetLoggerAvailable(status.State != BreakerOpen)
 	}
 
-	return nil
+	nextProbe := ""
+	if !status.NextProbe.IsZero() {
+		nextProbe = status.NextProbe.Format(time.RFC3339)
+	}
 
+	publish(readerTopic, map[string]interface{}{
+		"Breaker State":        status.State.String(),
+		"Consecutive Failures": status.Failures,
+		"Last Error":           status.LastError,
+		"Next Probe":           nextProbe,
+	}, ports.RecordInfo{PollTime: time.Now()})
 }
 
-func loadPVOutput() error {
-	failedConnections := 0
-
-	//
-	// PV Output
-	//
-	measurementsPVOutput, err := device.QueryPVOutput()
+// publish hands a group of measurements over to the exporters, the sinks publishing changes only
+// leave out the fields that did not change enough since they were last published
+func publish(topic string, data map[string]interface{}, info ports.RecordInfo) {
+	exports.Publish(ports.NewSnapshot(deviceID, topic, data, info))
+}
 
-	if err != nil {
-		log.Printf("failed to perform measurementsPVOutput: %s", err)
-		failedConnections++
+// sinkNames are the exporters configurable through the sink.<name>. settings
+var sinkNames = []string{"mqtt", "influx", "history", "pvoutput", "webhook", "sunspec", "metrics", "api", "stream"}
 
-		if failedConnections > maximumFailedConnections {
-			time.Sleep(time.Duration(config.Inverter.ReadInterval) * time.Second)
+func knownSink(name string) bool {
+	for _, n := range sinkNames {
+		if n == name {
+			return true
 		}
-
-		return err
-	}
-
-	PV1 := make(map[string]interface{})
-	PV2 := make(map[string]interface{})
-
-	PV1["Voltage PV 1"] = measurementsPVOutput["Voltage PV 1"]
-	PV1["Current PV 1"] = measurementsPVOutput["Current PV 1"]
-	PV1["Power PV 1"] = measurementsPVOutput["Power PV 1"]
-
-	PV2["Voltage PV 2"] = measurementsPVOutput["Voltage PV 2"]
-	PV2["Current PV 2"] = measurementsPVOutput["Current PV 2"]
-	PV2["Power PV 2"] = measurementsPVOutput["Power PV 2"]
-
-	log.Println("measurementsPVOutput: ", measurementsPVOutput)
-
-	failedConnections = 0
-
-	if hasMQTT {
-		go func(topic string, data map[string]interface{}) {
-			err = mqtt.InsertGenericRecord(topic, data)
-			if err != nil {
-				log.Printf("failed to insert record to MQTT: %s\n", err)
-			} else {
-				log.Printf("%s pushed to MQTT", topic)
-			}
-		}("PVOutput/PV1", PV1)
-
-		go func(topic string, data map[string]interface{}) {
-			err = mqtt.InsertGenericRecord(topic, data)
-			if err != nil {
-				log.Printf("failed to insert record to MQTT: %s\n", err)
-			} else {
-				log.Printf("%s pushed to MQTT", topic)
-			}
-		}("PVOutput/PV2", PV2)
 	}
+	return false
+}
 
-	return nil
-
+// sinkConfig returns the pipeline settings of a sink, changes tells whether the sink gets the changed fields
+// only (MQTT and the webhook) or every poll (InfluxDB, metrics, API, history, PVOutput and SunSpec): the time
+// series keep a point per poll
+func sinkConfig(name string, changes bool) pipeline.SinkConfig {
+	cfg := config.Sinks[name]
+	cfg.Changes = changes
+	return cfg
 }
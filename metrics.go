@@ -0,0 +1,57 @@
+package main
+
+import (
+	"time"
+
+	"github.com/misterdelle/invt_logger_reader/adapters/export/prometheus"
+)
+
+// readerMetrics exposes the health of the reader next to the inverter measurements
+type readerMetrics struct {
+	registry *prometheus.Registry
+	labels   prometheus.Labels
+}
+
+func newReaderMetrics(registry *prometheus.Registry, labels prometheus.Labels) *readerMetrics {
+	m := &readerMetrics{registry: registry, labels: labels}
+
+	// expose the counters from the start, rate() needs the zero
+	m.registry.Add("invt_reader_polls_total", "Measurement cycles performed", m.with("result", "success"), 0)
+	m.registry.Add("invt_reader_polls_total", "Measurement cycles performed", m.with("result", "failure"), 0)
+
+	return m
+}
+
+// ObserveCycle records the outcome of a measurement cycle
+func (m *readerMetrics) ObserveCycle(duration time.Duration, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	} else {
+		m.registry.Set("invt_reader_last_success_timestamp_seconds", prometheus.Gauge, "Time of the last successful measurement cycle", m.labels, float64(time.Now().Unix()))
+	}
+
+	m.registry.Add("invt_reader_polls_total", "Measurement cycles performed", m.with("result", result), 1)
+	m.registry.Set("invt_reader_poll_duration_seconds", prometheus.Gauge, "Duration of the last measurement cycle", m.labels, duration.Seconds())
+}
+
+// ObserveBreaker records the circuit breaker state
+func (m *readerMetrics) ObserveBreaker(status BreakerStatus) {
+	up := 1.0
+	if status.State == BreakerOpen {
+		up = 0
+	}
+
+	m.registry.Set("invt_reader_logger_up", prometheus.Gauge, "Whether the logger is answering", m.labels, up)
+	m.registry.Set("invt_reader_breaker_state", prometheus.Gauge, "Circuit breaker state: 0 closed, 1 open, 2 half-open", m.labels, float64(status.State))
+	m.registry.Set("invt_reader_consecutive_failures", prometheus.Gauge, "Consecutive failed measurement cycles", m.labels, float64(status.Failures))
+}
+
+func (m *readerMetrics) with(name string, value string) prometheus.Labels {
+	labels := make(prometheus.Labels, len(m.labels)+1)
+	for k, v := range m.labels {
+		labels[k] = v
+	}
+	labels[name] = value
+	return labels
+}
@@ -5,4 +5,6 @@ type CommunicationPort interface {
 	Read(buffer []byte) (int, error)
 	Write(payload []byte) (int, error)
 	Close() error
+	// Shutdown closes the port for good, the pending and later Open calls fail
+	Shutdown() error
 }
@@ -1,13 +1,42 @@
 package ports
 
-import mqtt "github.com/eclipse/paho.mqtt.golang"
+import (
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// quality flags of a measurement
+const (
+	QualityGood    = "good"
+	QualityMissing = "missing"
+	QualityInvalid = "invalid"
+)
+
+// RecordInfo describes a group of measurements: when it has been read and the unit
+// and quality of each field
+type RecordInfo struct {
+	PollTime time.Time
+	// SourceTime is the inverter clock at read time, zero when unknown
+	SourceTime time.Time
+	Units      map[string]string
+	Quality    map[string]string
+}
 
 type Database interface {
 	InsertRecord(measurement map[string]interface{}) error
 	InsertGenericRecord(topicName string, measurement map[string]interface{}) error
+	// InsertRecordWithInfo inserts a group of measurements along with its RecordInfo
+	InsertRecordWithInfo(topicName string, measurement map[string]interface{}, info RecordInfo) error
+	// Close waits up to timeout for pending inserts, then releases the connection
+	Close(timeout time.Duration) error
 }
 
 type DatabaseWithListener interface {
 	Database
 	Subscribe(topic string, callback mqtt.MessageHandler)
+	// Publish sends a raw message to an absolute topic
+	Publish(topic string, payload []byte, retained bool) error
+	// SetLoggerAvailable tells the listeners whether the logger is answering
+	SetLoggerAvailable(available bool)
 }
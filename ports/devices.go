@@ -10,4 +10,6 @@ type Device interface {
 	QueryLoadInfo() (map[string]interface{}, error)
 	QueryBatteryOutput() (map[string]interface{}, error)
 	QueryPVOutput() (map[string]interface{}, error)
+	// WriteSetting writes a named inverter setting
+	WriteSetting(name string, value string) error
 }
@@ -0,0 +1,26 @@
+package ports
+
+import "time"
+
+// HistoryField is a recorded field
+type HistoryField struct {
+	Topic string `json:"topic"`
+	Field string `json:"field"`
+	Unit  string `json:"unit,omitempty"`
+}
+
+// HistoryPoint summarizes the Count samples recorded in [Time, Time+step)
+type HistoryPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+	Count int64     `json:"count"`
+}
+
+type History interface {
+	// Fields returns the recorded fields, sorted by topic and field
+	Fields() ([]HistoryField, error)
+	// Series returns the points of a field in [from, to), one per step or one per sample when step is 0
+	Series(topic string, field string, from time.Time, to time.Time, step time.Duration) ([]HistoryPoint, error)
+}
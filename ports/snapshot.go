@@ -0,0 +1,176 @@
+package ports
+
+import (
+	"sort"
+	"time"
+)
+
+// Measurement is a single field read from the device. It is a plain value, copies share nothing
+// with the snapshot it comes from
+type Measurement struct {
+	DeviceID string
+	// Group is the topic of the record, e.g. EnergyTodayTotals/Battery Charge
+	Group string
+	Field string
+	Value Value
+	Unit  string
+	// SourceTime is the inverter clock at read time, zero when unknown
+	SourceTime time.Time
+	PollTime   time.Time
+	Quality    string
+}
+
+// Number returns the value of a numeric measurement
+func (m Measurement) Number() (float64, bool) {
+	return m.Value.Number()
+}
+
+// JSONValue returns the value to encode in JSON payloads, NaN and infinities as text
+func (m Measurement) JSONValue() interface{} {
+	return m.Value.JSON()
+}
+
+// Snapshot is the measurements of a group read at a poll, sorted by field. It cannot be changed once built,
+// exporters may keep it or hand it over to other goroutines
+type Snapshot struct {
+	deviceID     string
+	group        string
+	pollTime     time.Time
+	sourceTime   time.Time
+	measurements []Measurement
+}
+
+// NewSnapshot builds a snapshot from a record, data and info are copied
+func NewSnapshot(deviceID string, group string, data map[string]interface{}, info RecordInfo) Snapshot {
+	s := Snapshot{
+		deviceID:     deviceID,
+		group:        group,
+		pollTime:     info.PollTime,
+		sourceTime:   info.SourceTime,
+		measurements: make([]Measurement, 0, len(data)),
+	}
+
+	for field, v := range data {
+		s.measurements = append(s.measurements, Measurement{
+			DeviceID:   deviceID,
+			Group:      group,
+			Field:      field,
+			Value:      NewValue(v),
+			Unit:       info.Units[field],
+			SourceTime: info.SourceTime,
+			PollTime:   info.PollTime,
+			Quality:    info.Quality[field],
+		})
+	}
+	sort.Slice(s.measurements, func(i, j int) bool { return s.measurements[i].Field < s.measurements[j].Field })
+
+	return s
+}
+
+func (s Snapshot) DeviceID() string {
+	return s.deviceID
+}
+
+// Group is the topic of the record, e.g. GridOutput/Grid A
+func (s Snapshot) Group() string {
+	return s.group
+}
+
+func (s Snapshot) PollTime() time.Time {
+	return s.pollTime
+}
+
+// SourceTime is the inverter clock at read time, zero when unknown
+func (s Snapshot) SourceTime() time.Time {
+	return s.sourceTime
+}
+
+func (s Snapshot) Len() int {
+	return len(s.measurements)
+}
+
+// Measurements returns a copy of the measurements
+func (s Snapshot) Measurements() []Measurement {
+	return append([]Measurement(nil), s.measurements...)
+}
+
+// Measurement returns the measurement of a field
+func (s Snapshot) Measurement(field string) (Measurement, bool) {
+	i := sort.Search(len(s.measurements), func(i int) bool { return s.measurements[i].Field >= field })
+	if i < len(s.measurements) && s.measurements[i].Field == field {
+		return s.measurements[i], true
+	}
+	return Measurement{}, false
+}
+
+// Select returns a snapshot of the measurements keep returns true for
+func (s Snapshot) Select(keep func(m Measurement) bool) Snapshot {
+	selected := s
+	selected.measurements = make([]Measurement, 0, len(s.measurements))
+	for _, m := range s.measurements {
+		if keep(m) {
+			selected.measurements = append(selected.measurements, m)
+		}
+	}
+	return selected
+}
+
+// Record returns the snapshot as the data and RecordInfo of a Database insert, built anew at every call.
+// The data holds the typed values
+func (s Snapshot) Record() (map[string]interface{}, RecordInfo) {
+	data := make(map[string]interface{}, len(s.measurements))
+	info := RecordInfo{
+		PollTime:   s.pollTime,
+		SourceTime: s.sourceTime,
+		Units:      make(map[string]string, len(s.measurements)),
+		Quality:    make(map[string]string, len(s.measurements)),
+	}
+
+	for _, m := range s.measurements {
+		data[m.Field] = m.Value
+		if m.Unit != "" {
+			info.Units[m.Field] = m.Unit
+		}
+		if m.Quality != "" {
+			info.Quality[m.Field] = m.Quality
+		}
+	}
+	return data, info
+}
+
+// Exporter is an output of the snapshots
+type Exporter interface {
+	Export(snapshot Snapshot) error
+	// Close waits up to timeout for pending exports, then releases the exporter
+	Close(timeout time.Duration) error
+}
+
+// CycleListener is an exporter told about the end of every poll cycle, after the snapshots of the cycle
+type CycleListener interface {
+	CycleComplete(complete bool)
+}
+
+// DatabaseExporter exports the snapshots to a Database, each insert getting its own record
+func DatabaseExporter(db Database) Exporter {
+	return databaseExporter{db: db}
+}
+
+type databaseExporter struct {
+	db Database
+}
+
+func (e databaseExporter) Export(snapshot Snapshot) error {
+	data, info := snapshot.Record()
+	return e.db.InsertRecordWithInfo(snapshot.Group(), data, info)
+}
+
+func (e databaseExporter) Close(timeout time.Duration) error {
+	return e.db.Close(timeout)
+}
+
+// CycleComplete is forwarded to the databases listening for the poll cycles
+func (e databaseExporter) CycleComplete(complete bool) {
+	if l, ok := e.db.(CycleListener); ok {
+		l.CycleComplete(complete)
+	}
+}
@@ -0,0 +1,133 @@
+package ports
+
+import (
+	"testing"
+	"time"
+)
+
+func record() (map[string]interface{}, RecordInfo) {
+	data := map[string]interface{}{"PV1 Power": "1200", "PV2 Power": "800", "Work Mode": "Self use"}
+	info := RecordInfo{
+		PollTime:   time.Date(2024, 5, 1, 10, 15, 0, 0, time.UTC),
+		SourceTime: time.Date(2024, 5, 1, 10, 14, 58, 0, time.UTC),
+		Units:      map[string]string{"PV1 Power": "W", "PV2 Power": "W"},
+		Quality:    map[string]string{"PV1 Power": QualityGood, "PV2 Power": QualityGood, "Work Mode": QualityGood},
+	}
+	return data, info
+}
+
+func TestNewSnapshot(t *testing.T) {
+	data, info := record()
+	s := NewSnapshot("2333571751", "PV", data, info)
+
+	// the caller may reuse its map
+	data["PV1 Power"] = "0"
+	delete(data, "PV2 Power")
+	info.Units["PV1 Power"] = "kW"
+
+	if s.DeviceID() != "2333571751" || s.Group() != "PV" || !s.PollTime().Equal(info.PollTime) || !s.SourceTime().Equal(info.SourceTime) {
+		t.Errorf("snapshot header %+v", s)
+	}
+	if s.Len() != 3 {
+		t.Fatalf("Len = %d, want 3", s.Len())
+	}
+
+	fields := []string{"PV1 Power", "PV2 Power", "Work Mode"}
+	for i, m := range s.Measurements() {
+		if m.Field != fields[i] {
+			t.Errorf("measurement %d is %s, want %s", i, m.Field, fields[i])
+		}
+		if m.DeviceID != "2333571751" || m.Group != "PV" || !m.PollTime.Equal(info.PollTime) {
+			t.Errorf("measurement %+v", m)
+		}
+	}
+
+	m, ok := s.Measurement("PV1 Power")
+	if !ok || m.Value.Text() != "1200" || m.Unit != "W" || m.Quality != QualityGood {
+		t.Errorf("Measurement(PV1 Power) = %+v, %t", m, ok)
+	}
+	if _, ok := s.Measurement("PV3 Power"); ok {
+		t.Error("missing field found")
+	}
+}
+
+func TestSnapshotImmutable(t *testing.T) {
+	data, info := record()
+	s := NewSnapshot("", "PV", data, info)
+
+	measurements := s.Measurements()
+	measurements[0].Value = NewValue("0")
+	if m, _ := s.Measurement("PV1 Power"); m.Value.Text() != "1200" {
+		t.Error("snapshot changed through Measurements")
+	}
+
+	got, gotInfo := s.Record()
+	got["PV1 Power"] = "0"
+	gotInfo.Units["PV1 Power"] = "kW"
+	again, againInfo := s.Record()
+	if again["PV1 Power"] != NewValue("1200") || againInfo.Units["PV1 Power"] != "W" {
+		t.Error("snapshot changed through Record")
+	}
+}
+
+func TestSelect(t *testing.T) {
+	data, info := record()
+	s := NewSnapshot("", "PV", data, info)
+
+	power := s.Select(func(m Measurement) bool { return m.Unit == "W" })
+	if power.Len() != 2 || s.Len() != 3 {
+		t.Fatalf("Select kept %d of %d", power.Len(), s.Len())
+	}
+	if power.Group() != "PV" || !power.PollTime().Equal(info.PollTime) {
+		t.Error("Select lost the snapshot header")
+	}
+
+	got, gotInfo := power.Record()
+	if len(got) != 2 || got["Work Mode"] != nil || gotInfo.Units["PV2 Power"] != "W" || !gotInfo.SourceTime.Equal(info.SourceTime) {
+		t.Errorf("Record = %v, %+v", got, gotInfo)
+	}
+}
+
+type database struct {
+	topics []string
+	cycles []bool
+	closed bool
+}
+
+func (d *database) InsertRecord(measurement map[string]interface{}) error { return nil }
+func (d *database) InsertGenericRecord(topicName string, measurement map[string]interface{}) error {
+	return nil
+}
+func (d *database) InsertRecordWithInfo(topicName string, measurement map[string]interface{}, info RecordInfo) error {
+	d.topics = append(d.topics, topicName)
+	return nil
+}
+func (d *database) Close(timeout time.Duration) error {
+	d.closed = true
+	return nil
+}
+func (d *database) CycleComplete(complete bool) {
+	d.cycles = append(d.cycles, complete)
+}
+
+func TestDatabaseExporter(t *testing.T) {
+	db := &database{}
+	e := DatabaseExporter(db)
+
+	data, info := record()
+	if err := e.Export(NewSnapshot("", "PV", data, info)); err != nil {
+		t.Fatal(err)
+	}
+	e.(CycleListener).CycleComplete(true)
+	e.Close(time.Second)
+
+	if len(db.topics) != 1 || db.topics[0] != "PV" {
+		t.Errorf("inserted %v", db.topics)
+	}
+	if len(db.cycles) != 1 || !db.cycles[0] {
+		t.Errorf("cycles %v", db.cycles)
+	}
+	if !db.closed {
+		t.Error("database not closed")
+	}
+}
@@ -0,0 +1,102 @@
+package ports
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// ValueKind tells what a measurement holds
+type ValueKind int
+
+const (
+	// NoValue is a field the device did not return or the reader could not compute
+	NoValue ValueKind = iota
+	NumberValue
+	TextValue
+)
+
+// Value is a measurement value. Numeric texts are numbers, NaN and infinities are texts: the exporters
+// cannot store them as numbers. The text as read is kept, the MQTT topics publish it unchanged
+type Value struct {
+	kind   ValueKind
+	number float64
+	text   string
+}
+
+// NewValue types a value read from the device or computed by the reader
+func NewValue(v interface{}) Value {
+	var f float64
+	switch n := v.(type) {
+	case nil:
+		return Value{}
+	case Value:
+		return n
+	case float64:
+		f = n
+	case float32:
+		f = float64(n)
+	case int:
+		f = float64(n)
+	case int32:
+		f = float64(n)
+	case int64:
+		f = float64(n)
+	case uint16:
+		f = float64(n)
+	case uint32:
+		f = float64(n)
+	case string:
+		var err error
+		if f, err = strconv.ParseFloat(n, 64); err != nil {
+			return Value{kind: TextValue, text: n}
+		}
+	default:
+		return Value{kind: TextValue, text: fmt.Sprint(v)}
+	}
+
+	text := fmt.Sprint(v)
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return Value{kind: TextValue, text: text}
+	}
+	return Value{kind: NumberValue, number: f, text: text}
+}
+
+func (v Value) Kind() ValueKind {
+	return v.kind
+}
+
+// Number returns the value of a number
+func (v Value) Number() (float64, bool) {
+	return v.number, v.kind == NumberValue
+}
+
+// Text returns the value as read, numbers included, or "" for no value
+func (v Value) Text() string {
+	return v.text
+}
+
+// String formats the value as read, so that records handed over as maps print as before
+func (v Value) String() string {
+	if v.kind == NoValue {
+		return "<nil>"
+	}
+	return v.text
+}
+
+// JSON returns the value to encode in JSON payloads: a number, a text or nil
+func (v Value) JSON() interface{} {
+	switch v.kind {
+	case NumberValue:
+		return v.number
+	case TextValue:
+		return v.text
+	default:
+		return nil
+	}
+}
+
+func (v Value) MarshalJSON() ([]byte, error) {
+	return json.Marshal(v.JSON())
+}
@@ -0,0 +1,73 @@
+package ports
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestNewValue(t *testing.T) {
+	tests := []struct {
+		value  interface{}
+		kind   ValueKind
+		number float64
+		text   string
+	}{
+		{"230.1", NumberValue, 230.1, "230.1"},
+		{"230.10", NumberValue, 230.1, "230.10"},
+		{"-5", NumberValue, -5, "-5"},
+		{12.5, NumberValue, 12.5, "12.5"},
+		{float32(0.5), NumberValue, 0.5, "0.5"},
+		{7, NumberValue, 7, "7"},
+		{int64(8), NumberValue, 8, "8"},
+		{uint16(9), NumberValue, 9, "9"},
+		{"Self use", TextValue, 0, "Self use"},
+		{"", TextValue, 0, ""},
+		{"NaN", TextValue, 0, "NaN"},
+		{"Inf", TextValue, 0, "Inf"},
+		{"-Infinity", TextValue, 0, "-Infinity"},
+		{math.NaN(), TextValue, 0, "NaN"},
+		{math.Inf(1), TextValue, 0, "+Inf"},
+		{true, TextValue, 0, "true"},
+		{nil, NoValue, 0, ""},
+		{NewValue("230.1"), NumberValue, 230.1, "230.1"},
+	}
+
+	for _, tt := range tests {
+		v := NewValue(tt.value)
+		number, ok := v.Number()
+		if v.Kind() != tt.kind || number != tt.number || ok != (tt.kind == NumberValue) || v.Text() != tt.text {
+			t.Errorf("NewValue(%#v) = %d %v %q, want %d %v %q", tt.value, v.Kind(), number, v.Text(), tt.kind, tt.number, tt.text)
+		}
+	}
+}
+
+func TestValueJSON(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{"230.1", "230.1"},
+		{"230.10", "230.1"},
+		{7, "7"},
+		{"Self use", `"Self use"`},
+		{math.NaN(), `"NaN"`},
+		{float32(math.Inf(-1)), `"-Inf"`},
+		{nil, "null"},
+	}
+
+	for _, tt := range tests {
+		got, err := json.Marshal(NewValue(tt.value))
+		if err != nil || string(got) != tt.want {
+			t.Errorf("Marshal(%#v) = %s, %v, want %s", tt.value, got, err, tt.want)
+		}
+	}
+
+	// the maps handed over to the databases print the values as read
+	if got := NewValue("230.10").String(); got != "230.10" {
+		t.Errorf("String = %q", got)
+	}
+	if got := NewValue(nil).String(); got != "<nil>" {
+		t.Errorf("String = %q", got)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RetryPolicy computes how long to wait before retrying after consecutive failures:
+// the delay grows exponentially from InitialDelay up to MaxDelay and is randomised by Jitter
+type RetryPolicy struct {
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Multiplier   float64
+	// Jitter is the fraction (0..1) of the delay randomly added or removed
+	Jitter float64
+}
+
+// Delay returns the wait time after the given number of consecutive failures
+func (p RetryPolicy) Delay(failures int) time.Duration {
+	if failures < 1 {
+		failures = 1
+	}
+
+	d := float64(p.InitialDelay) * math.Pow(p.Multiplier, float64(failures-1))
+	if p.MaxDelay > 0 && d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+
+	return time.Duration(d)
+}
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// BreakerStatus is a point in time copy of the circuit breaker state
+type BreakerStatus struct {
+	State     BreakerState
+	Failures  int
+	LastError string
+	NextProbe time.Time
+}
+
+// CircuitBreaker stops querying the logger after threshold consecutive failures,
+// once open a single probe is let through every probeInterval
+type CircuitBreaker struct {
+	threshold     int
+	probeInterval time.Duration
+
+	mu        sync.Mutex
+	state     BreakerState
+	failures  int
+	lastError string
+	openedAt  time.Time
+}
+
+func NewCircuitBreaker(threshold int, probeInterval time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold:     threshold,
+		probeInterval: probeInterval,
+	}
+}
+
+// Allow reports whether a request may be performed now, an open breaker switches
+// to half-open when the probe interval has elapsed
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.probeInterval {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		return true
+	default:
+		return true
+	}
+}
+
+// Success closes the breaker and resets the failures counter
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = BreakerClosed
+	b.failures = 0
+	b.lastError = ""
+}
+
+// Failure records a failed request, it opens the breaker when the threshold is reached
+// or when the half-open probe failed
+func (b *CircuitBreaker) Failure(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if err != nil {
+		b.lastError = err.Error()
+	}
+
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+func (b *CircuitBreaker) Status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := BreakerStatus{
+		State:     b.state,
+		Failures:  b.failures,
+		LastError: b.lastError,
+	}
+
+	if b.state == BreakerOpen {
+		status.NextProbe = b.openedAt.Add(b.probeInterval)
+	}
+
+	return status
+}
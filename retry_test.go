@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	p := RetryPolicy{InitialDelay: 10 * time.Second, MaxDelay: 5 * time.Minute, Multiplier: 2}
+
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 10 * time.Second},
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{5, 160 * time.Second},
+		{6, 5 * time.Minute},
+		{100, 5 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := p.Delay(tt.failures); got != tt.want {
+			t.Errorf("Delay(%d) = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+
+	// without MaxDelay the delay keeps growing
+	p.MaxDelay = 0
+	if got := p.Delay(10); got != 10*time.Second*512 {
+		t.Errorf("uncapped Delay(10) = %s", got)
+	}
+}
+
+func TestRetryJitter(t *testing.T) {
+	p := RetryPolicy{InitialDelay: 10 * time.Second, MaxDelay: 40 * time.Second, Multiplier: 2, Jitter: 0.25}
+
+	for _, tt := range []struct {
+		failures int
+		base     time.Duration
+	}{
+		{1, 10 * time.Second},
+		{10, 40 * time.Second},
+	} {
+		low, high := tt.base*3/4, tt.base*5/4
+		varied := false
+		for i := 0; i < 200; i++ {
+			got := p.Delay(tt.failures)
+			if got < low || got > high {
+				t.Fatalf("Delay(%d) = %s, want between %s and %s", tt.failures, got, low, high)
+			}
+			varied = varied || got != tt.base
+		}
+		if !varied {
+			t.Errorf("Delay(%d) never randomised", tt.failures)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	b := NewCircuitBreaker(3, 50*time.Millisecond)
+
+	for i := 1; i < 3; i++ {
+		b.Failure(errors.New("timeout"))
+		if !b.Allow() {
+			t.Fatalf("breaker open after %d failures", i)
+		}
+	}
+	if s := b.Status(); s.State != BreakerClosed || s.Failures != 2 || s.LastError != "timeout" || !s.NextProbe.IsZero() {
+		t.Errorf("status %+v", s)
+	}
+
+	b.Failure(errors.New("connection refused"))
+	s := b.Status()
+	if s.State != BreakerOpen || s.Failures != 3 || s.LastError != "connection refused" {
+		t.Errorf("status %+v, want open", s)
+	}
+	if until := time.Until(s.NextProbe); until <= 0 || until > 50*time.Millisecond {
+		t.Errorf("next probe in %s", until)
+	}
+	if b.Allow() {
+		t.Error("open breaker allowed a request before the probe interval")
+	}
+
+	// the probe fails, the breaker opens again
+	time.Sleep(60 * time.Millisecond)
+	if !b.Allow() || b.Status().State != BreakerHalfOpen {
+		t.Fatalf("no probe after the interval, %+v", b.Status())
+	}
+	b.Failure(errors.New("timeout"))
+	if s := b.Status(); s.State != BreakerOpen || s.Failures != 4 {
+		t.Errorf("status %+v after a failed probe, want open", s)
+	}
+	if b.Allow() {
+		t.Error("request allowed right after a failed probe")
+	}
+
+	// the probe succeeds, the breaker closes
+	time.Sleep(60 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("no probe after the interval")
+	}
+	b.Success()
+	if s := b.Status(); s.State != BreakerClosed || s.Failures != 0 || s.LastError != "" || !s.NextProbe.IsZero() {
+		t.Errorf("status %+v after a successful probe, want closed", s)
+	}
+	if !b.Allow() {
+		t.Error("closed breaker refused a request")
+	}
+}
+
+func TestBreakerState(t *testing.T) {
+	for state, want := range map[BreakerState]string{BreakerClosed: "closed", BreakerOpen: "open", BreakerHalfOpen: "half-open"} {
+		if state.String() != want {
+			t.Errorf("%d is %q, want %q", state, state.String(), want)
+		}
+	}
+}